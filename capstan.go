@@ -11,8 +11,12 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mikelangelo-project/capstan/cmd"
+	"github.com/mikelangelo-project/capstan/configdrive"
 	"github.com/mikelangelo-project/capstan/core"
 	"github.com/mikelangelo-project/capstan/hypervisor"
 	"github.com/mikelangelo-project/capstan/nat"
@@ -96,6 +100,122 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "image",
+			Usage: "portable image bundles",
+			Subcommands: []cli.Command{
+				{
+					Name:      "export",
+					Usage:     "bundle an image from the local repository into a single archive",
+					ArgsUsage: "image-name",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "output, o", Usage: "bundle file (default: <image-name>.tar or <image-name>.tar.gz)"},
+						cli.BoolFlag{Name: "compress, z", Usage: "gzip the bundle"},
+						cli.StringFlag{Name: "p", Value: hypervisor.Default(), Usage: "hypervisor: qemu|vbox|vmw|gce"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan image export [image-name]", EX_USAGE)
+						}
+						imageName := c.Args().First()
+						target := c.String("output")
+						if target == "" {
+							target = strings.Replace(filepath.Base(imageName), ":", "-", -1) + ".tar"
+							if c.Bool("compress") {
+								target += ".gz"
+							}
+						}
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := repo.ExportImage(imageName, c.String("p"), target, c.Bool("compress")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "load",
+					Usage:     "register an image from the bundle in the local repository",
+					ArgsUsage: "bundle-file",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name, n", Usage: "image name (default: name stored in the bundle)"},
+						cli.BoolFlag{Name: "force, f", Usage: "replace existing image"},
+					},
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan image load [bundle-file]", EX_USAGE)
+						}
+						repo := util.NewRepo(c.GlobalString("u"))
+						manifest, err := repo.LoadImage(c.Args().First(), c.String("name"), hypervisor.Names(), c.Bool("force"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						packages, err := repo.ImagePackages(manifest.Name)
+						if err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						if len(packages) > 0 {
+							fmt.Println("Image is composed of packages:")
+							for _, pkg := range packages {
+								fmt.Printf("   * %s\n", pkg.String())
+							}
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "system",
+			Usage: "manage disk space used by Capstan",
+			Subcommands: []cli.Command{
+				{
+					Name:  "df",
+					Usage: "show disk space used by images, packages, instances and caches",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "verbose, v", Usage: "list individual items"},
+					},
+					Action: func(c *cli.Context) error {
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.SystemDf(repo, c.Bool("verbose")); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "prune",
+					Usage: "remove stopped instances, orphaned caches and, when selected, unused images and packages",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "dry-run", Usage: "only list what would be removed"},
+						cli.IntFlag{Name: "older-than", Value: 0, Usage: "only remove stopped instances not used in the last N days"},
+						cli.BoolFlag{Name: "images", Usage: "remove unused images"},
+						cli.BoolFlag{Name: "packages", Usage: "remove unused packages"},
+						cli.BoolFlag{Name: "instances", Usage: "remove stopped instances"},
+						cli.BoolFlag{Name: "caches", Usage: "remove orphaned caches"},
+						cli.BoolFlag{Name: "force, f", Usage: "remove images and packages without confirmation"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.Int("older-than") < 0 {
+							return cli.NewExitError("--older-than must not be negative", EX_USAGE)
+						}
+						repo := util.NewRepo(c.GlobalString("u"))
+						opts := cmd.PruneOptions{
+							DryRun:    c.Bool("dry-run"),
+							OlderThan: c.Int("older-than"),
+							Images:    c.Bool("images"),
+							Packages:  c.Bool("packages"),
+							Instances: c.Bool("instances"),
+							Caches:    c.Bool("caches"),
+							Force:     c.Bool("force"),
+						}
+						if err := cmd.SystemPrune(repo, opts); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:  "pull",
 			Usage: "pull an image from a repository",
@@ -104,7 +224,7 @@ func main() {
 			},
 			Action: func(c *cli.Context) error {
 				if len(c.Args()) != 1 {
-					return cli.NewExitError("usage: capstan pull [image-name]", EX_USAGE)
+					return cli.NewExitError("usage: capstan pull [image-name[:tag]]", EX_USAGE)
 				}
 				hypervisor := c.String("p")
 				if !isValidHypervisor(hypervisor) {
@@ -119,11 +239,12 @@ func main() {
 			},
 		},
 		{
-			Name:  "rmi",
-			Usage: "delete an image from a repository",
+			Name:      "rmi",
+			Usage:     "delete an image from a repository. All versions are deleted unless a tag is given.",
+			ArgsUsage: "image-name[:tag]",
 			Action: func(c *cli.Context) error {
 				if len(c.Args()) != 1 {
-					return cli.NewExitError("usage: capstan rmi [image-name]", EX_USAGE)
+					return cli.NewExitError("usage: capstan rmi [image-name[:tag]]", EX_USAGE)
 				}
 				repo := util.NewRepo(c.GlobalString("u"))
 				err := repo.RemoveImage(c.Args().First())
@@ -133,27 +254,54 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:      "tag",
+			Usage:     "create a new tagged version of an image",
+			ArgsUsage: "source-image[:tag] target-image[:tag]",
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 2 {
+					return cli.NewExitError("usage: capstan tag [source-image[:tag]] [target-image[:tag]]", EX_USAGE)
+				}
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := repo.TagImage(c.Args()[0], c.Args()[1]); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
 		{
 			Name:      "run",
 			Usage:     "launch a VM. You may pass the image name as the first argument.",
 			ArgsUsage: "instance-name",
 			Flags: []cli.Flag{
-				cli.StringFlag{Name: "i", Value: "", Usage: "image_name"},
+				cli.StringFlag{Name: "i", Value: "", Usage: "image_name[:tag]"},
 				cli.StringFlag{Name: "p", Value: hypervisor.Default(), Usage: "hypervisor: qemu|vbox|vmw|gce"},
 				cli.StringFlag{Name: "m", Value: "1G", Usage: "memory size"},
 				cli.IntFlag{Name: "c", Value: 2, Usage: "number of CPUs"},
 				cli.StringFlag{Name: "n", Value: "nat", Usage: "networking: nat|bridge|tap|vhost"},
 				cli.BoolFlag{Name: "v", Usage: "verbose mode"},
 				cli.StringFlag{Name: "b", Value: "", Usage: "networking device (bridge or tap): e.g., virbr0, vboxnet0, tap0"},
-				cli.StringSliceFlag{Name: "f", Value: new(cli.StringSlice), Usage: "port forwarding rules"},
+				cli.StringSliceFlag{Name: "f", Value: new(cli.StringSlice), Usage: "port forwarding rule [bind_ip:]host_port[-last]:guest_port[-last][/tcp|udp] e.g. 8000:80 (repeatable, ignored for vmw)"},
 				cli.StringFlag{Name: "gce-upload-dir", Value: "", Usage: "Directory to upload local image to: e.g., gs://osvimg"},
 				cli.StringFlag{Name: "mac", Value: "", Usage: "MAC address. If not specified, the MAC address will be generated automatically."},
 				cli.StringFlag{Name: "execute,e", Usage: "set the command line to execute"},
 				cli.StringFlag{Name: "boot", Usage: "specify config_set name to boot unikernel with"},
 				cli.BoolFlag{Name: "persist", Usage: "persist instance parameters (only relevant for qemu instances)"},
 				cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable)"},
+				cli.StringSliceFlag{Name: "env-file", Value: new(cli.StringSlice), Usage: "read environment variables from file with KEY=VALUE lines (repeatable)"},
+				cli.BoolFlag{Name: "detach, d", Usage: "run instance in background, see logs, attach and wait commands (only relevant for qemu instances)"},
+				cli.BoolFlag{Name: "wait-healthy", Usage: "wait until health check of instance running in background passes"},
+				cli.BoolFlag{Name: "config-drive", Usage: "pass --boot, --env and --env-file to instance on NoCloud config drive instead of its command line (only relevant for qemu instances)"},
+				cli.StringSliceFlag{Name: "config-drive-file", Value: new(cli.StringSlice), Usage: "put file on config drive e.g. ./app.conf:/etc/app.conf (repeatable, implies --config-drive)"},
+				cli.StringSliceFlag{Name: "net", Value: new(cli.StringSlice), Usage: "network device nat|bridge[:device]|tap:device|vhost, in place of -n and -b (repeatable, only relevant for qemu instances)"},
+				cli.StringSliceFlag{Name: "volume", Value: new(cli.StringSlice), Usage: "attach volume name[:size][:mount_point] or ./disk.img[:mount_point] e.g. pgdata:10G:/var/lib/postgresql (repeatable, only relevant for qemu instances)"},
+				cli.StringSliceFlag{Name: "mount", Value: new(cli.StringSlice), Usage: "share host directory with instance e.g. ./src:/app, read-only with virtiofs (repeatable, only relevant for qemu instances)"},
 			},
 			Action: func(c *cli.Context) error {
+				if c.Bool("wait-healthy") && !c.Bool("detach") {
+					return cli.NewExitError("--wait-healthy can only be used together with --detach", EX_USAGE)
+				}
+
 				// Check for orphaned instances (those with osv.monitor and disk.qcow2, but
 				// without osv.config) and remove them.
 				if err := util.RemoveOrphanedInstances(c.Bool("v")); err != nil {
@@ -161,14 +309,45 @@ func main() {
 				}
 
 				bootOpts := cmd.BootOptions{
-					Cmd:     c.String("execute"),
-					Boot:    c.String("boot"),
-					EnvList: c.StringSlice("env"),
+					Cmd:      c.String("execute"),
+					Boot:     c.String("boot"),
+					EnvList:  c.StringSlice("env"),
+					EnvFiles: c.StringSlice("env-file"),
+				}
+
+				// Boot options are either passed on config drive or written to the command line.
+				var bootCmd string
+				var configDrive *configdrive.ConfigDrive
+				var err error
+				if c.Bool("config-drive") || len(c.StringSlice("config-drive-file")) > 0 {
+					configDrive, err = bootOpts.ConfigDrive(c.StringSlice("config-drive-file"))
+					bootCmd = bootOpts.Cmd
+				} else {
+					bootCmd, err = bootOpts.GetCmd()
 				}
-				bootCmd, err := bootOpts.GetCmd()
 				if err != nil {
 					return cli.NewExitError(err, EX_DATAERR)
 				}
+				natRules, err := nat.Parse(c.StringSlice("f"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
+				networks, err := hypervisor.ParseNetworks(c.StringSlice("net"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
+				networking, bridge := c.String("n"), c.String("b")
+				if len(networks) > 0 {
+					if c.IsSet("n") || c.IsSet("b") {
+						return cli.NewExitError("--net cannot be used together with -n and -b", EX_USAGE)
+					}
+					// The first device replaces the one given by -n and -b.
+					networking, bridge, networks = networks[0].Mode, networks[0].Bridge, networks[1:]
+				}
+				mounts, err := hypervisor.ParseMounts(c.StringSlice("mount"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
 
 				config := &runtime.RunConfig{
 					InstanceName: c.Args().First(),
@@ -177,13 +356,29 @@ func main() {
 					Verbose:      c.Bool("v"),
 					Memory:       c.String("m"),
 					Cpus:         c.Int("c"),
-					Networking:   c.String("n"),
-					Bridge:       c.String("b"),
-					NatRules:     nat.Parse(c.StringSlice("f")),
+					Networking:   networking,
+					Bridge:       bridge,
+					NatRules:     natRules,
 					GCEUploadDir: c.String("gce-upload-dir"),
 					MAC:          c.String("mac"),
 					Cmd:          bootCmd,
 					Persist:      c.Bool("persist"),
+					Detach:       c.Bool("detach"),
+					WaitHealthy:  c.Bool("wait-healthy"),
+					ConfigDrive:  configDrive,
+					Networks:     networks,
+					Volumes:      c.StringSlice("volume"),
+					Mounts:       mounts,
+				}
+
+				// Health check is declared by config set of the package in current directory.
+				if config.InstanceName == "" && config.ImageName == "" {
+					bootOpts.PackageDir, _ = os.Getwd()
+					healthCheck, err := bootOpts.HealthCheck()
+					if err != nil {
+						return cli.NewExitError(err, EX_DATAERR)
+					}
+					config.HealthCheck = healthCheck
 				}
 
 				if !isValidHypervisor(config.Hypervisor) {
@@ -235,7 +430,7 @@ func main() {
 			Name:  "compose",
 			Usage: "compose the image from a folder or a file",
 			Flags: []cli.Flag{
-				cli.StringFlag{Name: "loader_image, l", Value: "mike/osv-loader", Usage: "the base loader image"},
+				cli.StringFlag{Name: "loader_image, l", Usage: "the base loader image (default: loader_image from config.yaml or mike/osv-loader)"},
 				cli.StringFlag{Name: "size, s", Value: "10G", Usage: "size of the target user partition (use M or G suffix)"},
 			},
 			Action: func(c *cli.Context) error {
@@ -266,9 +461,15 @@ func main() {
 		{
 			Name:      "images",
 			ShortName: "i",
-			Usage:     "list images",
+			Usage:     "list images. Only versions of the given image are listed if image name is given.",
+			ArgsUsage: "[image-name]",
 			Action: func(c *cli.Context) error {
 				repo := util.NewRepo(c.GlobalString("u"))
+				if len(c.Args()) > 0 {
+					name, _ := util.ParseImageReference(c.Args().First())
+					fmt.Print(repo.ListImageVersions(name))
+					return nil
+				}
 				fmt.Print(repo.ListImages())
 
 				return nil
@@ -294,15 +495,179 @@ func main() {
 			Name:      "instances",
 			ShortName: "I",
 			Usage:     "list instances",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "table", Usage: "output format, table or json"},
+				cli.StringFlag{Name: "status", Usage: "only list instances with given status e.g. running or stopped"},
+			},
 			Action: func(c *cli.Context) error {
-				cmd.Instances()
-
+				if err := cmd.Instances(c.String("format"), c.String("status")); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "instance",
+			Usage: "instance manipulation tools",
+			Subcommands: []cli.Command{
+				{
+					Name:      "inspect",
+					Usage:     "print details of an instance as JSON",
+					ArgsUsage: "instance-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan instance inspect instance-name", EX_USAGE)
+						}
+						if err := cmd.InspectInstance(c.Args().First()); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:      "stats",
+			Usage:     "show CPU, memory, block I/O and network usage of running instances",
+			ArgsUsage: "[instance-name...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "no-stream", Usage: "print a single sample and exit"},
+				cli.StringFlag{Name: "format", Value: "table", Usage: "output format, table or json"},
+			},
+			Action: func(c *cli.Context) error {
+				if err := cmd.Stats(c.Args(), !c.Bool("no-stream"), c.String("format"), os.Stdout); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
 				return nil
 			},
 		},
+		{
+			Name:      "commit",
+			Usage:     "save disk of a stopped instance as a new image in the local repository",
+			ArgsUsage: "instance-name image-name",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "run", Usage: "the command line to be executed by the new image (default: same as the instance)"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 2 {
+					return cli.NewExitError("usage: capstan commit [--run command] instance-name image-name", EX_USAGE)
+				}
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := cmd.CommitInstance(repo, c.Args()[0], c.Args()[1], c.String("run")); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "snapshot",
+			Usage: "save state of an instance and return to it later",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create",
+					Usage:     "create snapshot of an instance (disk of stopped instance, disk and memory of running one)",
+					ArgsUsage: "instance-name [snapshot-name]",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) < 1 || len(c.Args()) > 2 {
+							return cli.NewExitError("usage: capstan snapshot create instance-name [snapshot-name]", EX_USAGE)
+						}
+						if err := cmd.CreateSnapshot(c.Args().First(), c.Args().Get(1)); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "list",
+					Usage:     "list snapshots of an instance",
+					ArgsUsage: "instance-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan snapshot list instance-name", EX_USAGE)
+						}
+						if err := cmd.ListSnapshots(c.Args().First(), os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "restore",
+					Usage:     "return an instance to the state saved in snapshot",
+					ArgsUsage: "instance-name snapshot-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan snapshot restore instance-name snapshot-name", EX_USAGE)
+						}
+						if err := cmd.RestoreSnapshot(c.Args()[0], c.Args()[1]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "delete",
+					Usage:     "delete snapshot of an instance",
+					ArgsUsage: "instance-name snapshot-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan snapshot delete instance-name snapshot-name", EX_USAGE)
+						}
+						if err := cmd.DeleteSnapshot(c.Args()[0], c.Args()[1]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "volume",
+			Usage: "manage volumes that instances keep their data on",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create",
+					Usage:     "create volume of given size, e.g. 10G, formatted with ext filesystem",
+					ArgsUsage: "volume-name size",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							return cli.NewExitError("usage: capstan volume create volume-name size", EX_USAGE)
+						}
+						if err := cmd.CreateVolume(c.Args()[0], c.Args()[1]); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "ls",
+					Usage: "list volumes and instances that they are attached to",
+					Action: func(c *cli.Context) error {
+						if err := cmd.ListVolumes(os.Stdout); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "rm",
+					Usage:     "delete volume and all data on it",
+					ArgsUsage: "volume-name",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							return cli.NewExitError("usage: capstan volume rm volume-name", EX_USAGE)
+						}
+						if err := cmd.DeleteVolume(c.Args().First()); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:  "stop",
-			Usage: "stop an instance",
+			Usage: "stop an instance (QEMU instances are asked to power down first and are terminated if they do not in 10 seconds)",
 			Action: func(c *cli.Context) error {
 				if len(c.Args()) != 1 {
 					return cli.NewExitError("usage: capstan stop [instance_name]", EX_USAGE)
@@ -328,6 +693,153 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:      "logs",
+			Usage:     "print console output of an instance running in background or of all instances of the project",
+			ArgsUsage: "[instance-name]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "follow, f", Usage: "keep printing console output until the instance stops"},
+				cli.StringFlag{Name: "since", Usage: "only print output since duration ago e.g. 10m or since timestamp e.g. 2017-06-01T10:00:00Z"},
+				cli.StringFlag{Name: "file", Value: runtime.DefaultProjectFile, Usage: "project file, used when no instance is given"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) > 1 {
+					return cli.NewExitError("usage: capstan logs [command options] [instance-name]", EX_USAGE)
+				}
+				since, err := cmd.ParseSince(c.String("since"), time.Now())
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_USAGE)
+				}
+				if len(c.Args()) == 0 {
+					project, err := runtime.ParseProjectFile(c.String("file"))
+					if err != nil {
+						return cli.NewExitError(err.Error(), EX_DATAERR)
+					}
+					err = cmd.ProjectLogs(project, c.Bool("follow"), since, os.Stdout)
+				} else {
+					err = cmd.Logs(c.Args().First(), c.Bool("follow"), since, os.Stdout)
+				}
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "attach",
+			Usage:     "attach terminal to console of an instance running in background (detach with Ctrl-])",
+			ArgsUsage: "instance-name",
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 1 {
+					return cli.NewExitError("usage: capstan attach instance-name", EX_USAGE)
+				}
+				if err := cmd.Attach(c.Args().First()); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "wait",
+			Usage:     "wait until an instance running in background stops and print its exit status",
+			ArgsUsage: "instance-name",
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 1 {
+					return cli.NewExitError("usage: capstan wait instance-name", EX_USAGE)
+				}
+				status, err := cmd.Wait(c.Args().First())
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				fmt.Println(status)
+				if status != 0 {
+					return cli.NewExitError("", status)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "up",
+			Usage: "run all instances of the project in background, in order of their dependencies",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file", Value: runtime.DefaultProjectFile, Usage: "project file"},
+				cli.StringFlag{Name: "p", Value: hypervisor.Default(), Usage: "hypervisor: qemu|vbox|vmw|gce"},
+				cli.BoolFlag{Name: "v", Usage: "verbose mode"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 0 {
+					return cli.NewExitError("usage: capstan up [command options]", EX_USAGE)
+				}
+				if !isValidHypervisor(c.String("p")) {
+					return cli.NewExitError(fmt.Sprintf("error: '%s' is not a supported hypervisor\n", c.String("p")), EX_DATAERR)
+				}
+				project, err := runtime.ParseProjectFile(c.String("file"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				repo := util.NewRepo(c.GlobalString("u"))
+				if err := cmd.ProjectUp(repo, project, c.String("p"), c.Bool("v")); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "down",
+			Usage: "stop and delete all instances of the project",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file", Value: runtime.DefaultProjectFile, Usage: "project file"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 0 {
+					return cli.NewExitError("usage: capstan down [command options]", EX_USAGE)
+				}
+				project, err := runtime.ParseProjectFile(c.String("file"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				if err := cmd.ProjectDown(project); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "ps",
+			Usage: "list instances of the project",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file", Value: runtime.DefaultProjectFile, Usage: "project file"},
+				cli.StringFlag{Name: "format", Value: "table", Usage: "output format, table or json"},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 0 {
+					return cli.NewExitError("usage: capstan ps [command options]", EX_USAGE)
+				}
+				project, err := runtime.ParseProjectFile(c.String("file"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				if err := cmd.ProjectPs(project, c.String("format"), os.Stdout); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "supervise",
+			Usage:     "supervise an instance running in background (used internally by 'capstan run -d')",
+			ArgsUsage: "platform instance-name",
+			Hidden:    true,
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) != 2 {
+					return cli.NewExitError("usage: capstan supervise platform instance-name", EX_USAGE)
+				}
+				if err := cmd.Supervise(c.Args()[0], c.Args()[1]); err != nil {
+					return cli.NewExitError(err.Error(), EX_DATAERR)
+				}
+				return nil
+			},
+		},
 		{
 			Name:  "package",
 			Usage: "package manipulation tools",
@@ -423,8 +935,22 @@ func main() {
 						cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository"},
 						cli.StringFlag{Name: "boot", Usage: "specify default config_set name to boot unikernel with"},
 						cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable)"},
+						cli.StringSliceFlag{Name: "env-file", Value: new(cli.StringSlice), Usage: "read environment variables from file with KEY=VALUE lines (repeatable)"},
+						cli.BoolFlag{Name: "print-config", Usage: "print meta/run.yaml with variables interpolated and exit"},
 					},
 					Action: func(c *cli.Context) error {
+						if c.Bool("print-config") {
+							packageDir, _ := os.Getwd()
+							bootOpts := cmd.BootOptions{
+								EnvList:  c.StringSlice("env"),
+								EnvFiles: c.StringSlice("env-file"),
+							}
+							if err := cmd.PrintPackageConfig(packageDir, &bootOpts); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+							return nil
+						}
+
 						if len(c.Args()) != 1 {
 							return cli.NewExitError("Usage: capstan package compose [image-name]", EX_USAGE)
 						}
@@ -452,6 +978,7 @@ func main() {
 							Cmd:        c.String("run"),
 							Boot:       c.String("boot"),
 							EnvList:    c.StringSlice("env"),
+							EnvFiles:   c.StringSlice("env-file"),
 							PackageDir: packageDir,
 						}
 
@@ -593,6 +1120,7 @@ func main() {
 							cli.BoolFlag{Name: "pull-missing, p", Usage: "attempt to pull packages missing from a local repository"},
 							cli.StringFlag{Name: "boot", Usage: "specify config_set name to boot unikernel with"},
 							cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable)"},
+							cli.StringSliceFlag{Name: "env-file", Value: new(cli.StringSlice), Usage: "read environment variables from file with KEY=VALUE lines (repeatable)"},
 						}, openstack.OPENSTACK_CREDENTIALS_FLAGS...),
 					ArgsUsage:   "image-name",
 					Description: "Compose package, build .qcow2 image and upload it to OpenStack under nickname <image-name>.",
@@ -615,6 +1143,11 @@ func main() {
 							cli.StringFlag{Name: "name, n", Usage: "instance name"},
 							cli.IntFlag{Name: "count, c", Value: 1, Usage: "number of instances to run"},
 							cli.BoolFlag{Name: "verbose, v", Usage: "verbose mode"},
+							cli.BoolFlag{Name: "config-drive", Usage: "pass --boot, --env and --env-file to instances as user-data on config drive"},
+							cli.StringSliceFlag{Name: "config-drive-file", Value: new(cli.StringSlice), Usage: "put file on config drive e.g. ./app.conf:/etc/app.conf (repeatable, implies --config-drive)"},
+							cli.StringFlag{Name: "boot", Usage: "specify config_set name to boot unikernel with (requires --config-drive)"},
+							cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of environment variable e.g. PORT=8000 (repeatable, requires --config-drive)"},
+							cli.StringSliceFlag{Name: "env-file", Value: new(cli.StringSlice), Usage: "read environment variables from file with KEY=VALUE lines (repeatable, requires --config-drive)"},
 						}, openstack.OPENSTACK_CREDENTIALS_FLAGS...),
 					ArgsUsage: "image-name",
 					Description: "Run image that you've previously uploaded with 'capstan stack push'.\n   " +
@@ -648,7 +1181,8 @@ func main() {
 							return cli.NewExitError("usage: capstan runtime preview -r [runtime-name]", EX_USAGE)
 						}
 
-						if err := cmd.RuntimePreview(c.String("runtime"), c.Bool("plain")); err != nil {
+						repo := util.NewRepo(c.GlobalString("u"))
+						if err := cmd.RuntimePreview(repo, c.String("runtime"), c.Bool("plain")); err != nil {
 							return cli.NewExitError(err.Error(), EX_DATAERR)
 						}
 
@@ -675,6 +1209,36 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:  "validate",
+					Usage: "validates meta/run.yaml of the package in current directory",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{Name: "env", Value: new(cli.StringSlice), Usage: "specify value of variable used in meta/run.yaml e.g. PORT=8000 (repeatable)"},
+						cli.StringSliceFlag{Name: "env-file", Value: new(cli.StringSlice), Usage: "read variables used in meta/run.yaml from file with KEY=VALUE lines (repeatable)"},
+						cli.BoolFlag{Name: "schema", Usage: "print JSON Schema of meta/run.yaml instead of validating it"},
+						cli.StringFlag{Name: "runtime, r", Usage: "runtime to print JSON Schema for (default: runtime of meta/run.yaml or all)"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.Bool("schema") {
+							if err := cmd.RuntimeJSONSchema(c.String("runtime")); err != nil {
+								return cli.NewExitError(err.Error(), EX_DATAERR)
+							}
+							return nil
+						}
+
+						repo := util.NewRepo(c.GlobalString("u"))
+						packageDir, _ := os.Getwd()
+						bootOpts := cmd.BootOptions{
+							EnvList:  c.StringSlice("env"),
+							EnvFiles: c.StringSlice("env-file"),
+						}
+						if err := cmd.RuntimeValidate(repo, packageDir, &bootOpts); err != nil {
+							return cli.NewExitError(err.Error(), EX_DATAERR)
+						}
+
+						return nil
+					},
+				},
 				{
 					Name:  "list",
 					Usage: "list available runtimes",
@@ -691,11 +1255,7 @@ func main() {
 	app.Run(os.Args)
 }
 
-func isValidHypervisor(hypervisor string) bool {
-	switch hypervisor {
-	case "qemu", "vbox", "vmw", "gce":
-		return true
-	default:
-		return false
-	}
+func isValidHypervisor(name string) bool {
+	_, err := hypervisor.Get(name)
+	return err == nil
 }
@@ -95,7 +95,7 @@ func UploadRPM(r *util.Repo, hypervisor string, image string, template *core.Tem
 		Verbose:     verbose,
 		Memory:      size,
 		Networking:  "nat",
-		NatRules:    []nat.Rule{nat.Rule{GuestPort: "10000", HostPort: "10000"}},
+		NatRules:    []nat.Rule{{HostPort: nat.Port(10000), GuestPort: nat.Port(10000), Protocol: nat.TCP}},
 		BackingFile: false,
 	}
 	vm, err := qemu.LaunchVM(vmconfig)
@@ -196,7 +196,7 @@ func UploadFiles(r *util.Repo, hypervisor string, image string, t *core.Template
 		Verbose:     verbose,
 		Memory:      size,
 		Networking:  "nat",
-		NatRules:    []nat.Rule{nat.Rule{GuestPort: "10000", HostPort: "10000"}},
+		NatRules:    []nat.Rule{{HostPort: nat.Port(10000), GuestPort: nat.Port(10000), Protocol: nat.TCP}},
 		BackingFile: false,
 		DisableKvm:  r.DisableKvm,
 	}
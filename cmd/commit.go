@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// setCmdLine sets boot command of the image. It is replaced in tests since
+// it needs qemu-nbd.
+var setCmdLine = util.SetCmdLine
+
+// CommitInstance saves disk of the stopped instance as a new image in the
+// local repository. Boot command of the image is replaced with cmdLine
+// unless it is empty.
+func CommitInstance(repo *util.Repo, instance, image, cmdLine string) (err error) {
+	if err := util.ValidateImageReference(image); err != nil {
+		return err
+	}
+	name, platform := util.SearchInstance(instance)
+	if name == "" {
+		return fmt.Errorf("instance %s not found", instance)
+	}
+	driver, err := hypervisor.Get(platform)
+	if err != nil {
+		return err
+	}
+	exporter, ok := driver.(hypervisor.DiskExporter)
+	if !ok {
+		return fmt.Errorf("%s: committing instances is not supported", platform)
+	}
+	if status := instanceStatus(name, platform); status != "Stopped" {
+		return fmt.Errorf("instance %s is running, stop it before committing", name)
+	}
+	if repo.ImageExists(platform, image) {
+		return fmt.Errorf("image %s already exists, delete it first or choose another name", image)
+	}
+	record, err := LoadInstanceRecord(platform, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Committing instance %s into image %s...\n", name, image)
+	dir := repo.ImageDir(image)
+	_, statErr := os.Stat(dir)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return fmt.Errorf("%s: mkdir failed", dir)
+	}
+	path := repo.ImagePath(platform, image)
+
+	// Leave no partial image behind. Directory is kept if it existed before,
+	// e.g. because it contains the image for another platform.
+	defer func() {
+		if err == nil {
+			return
+		}
+		if os.IsNotExist(statErr) {
+			os.RemoveAll(dir)
+		} else {
+			os.Remove(path)
+		}
+	}()
+
+	if err := exporter.ExportDisk(name, path); err != nil {
+		return err
+	}
+	if cmdLine != "" {
+		if err := setCmdLine(path, cmdLine); err != nil {
+			return fmt.Errorf("failed to set boot command of image %s: %s", image, err)
+		}
+	}
+
+	info := &util.ImageInfo{
+		FormatVersion: "1",
+		Created:       time.Now().Format(core.DATETIME_F),
+		Description:   fmt.Sprintf("Committed from instance %s", name),
+		Instance:      name,
+		BaseImage:     record.Image,
+		BaseDigest:    record.Digest,
+	}
+	if _, tag := util.ParseImageReference(image); tag != util.DefaultTag {
+		info.Version = tag
+	}
+	if err := repo.StoreImageInfo(image, info); err != nil {
+		return err
+	}
+	fmt.Printf("Created image %s\n", image)
+	return nil
+}
@@ -25,6 +25,10 @@ import (
 )
 
 func Compose(r *util.Repo, loaderImage string, imageSize int64, uploadPath string, appName string) error {
+	if err := util.ValidateImageReference(appName); err != nil {
+		return err
+	}
+
 	// Initialize an empty image based on the provided loader image. imageSize is used to
 	// determine the size of the user partition.
 	err := r.InitializeImage(loaderImage, appName, imageSize)
@@ -72,7 +76,7 @@ func UploadPackageContents(r *util.Repo, appImage string, uploadPaths map[string
 		Verbose:     false,
 		Memory:      512,
 		Networking:  "nat",
-		NatRules:    []nat.Rule{nat.Rule{GuestPort: "10000", HostPort: "10000"}},
+		NatRules:    []nat.Rule{{HostPort: nat.Port(10000), GuestPort: nat.Port(10000), Protocol: nat.TCP}},
 		BackingFile: false,
 		Cmd:         osvCmdline,
 		DisableKvm:  r.DisableKvm,
@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// detachKey is Ctrl-] that detaches terminal from console of the instance.
+const detachKey = 0x1d
+
+// backgroundInstance returns platform of the instance that was run in
+// background.
+func backgroundInstance(name string) (string, error) {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return "", fmt.Errorf("instance %s not found", name)
+	}
+	if _, err := os.Stat(instanceFile(platform, name, launchFileName)); os.IsNotExist(err) {
+		return "", fmt.Errorf("instance %s was not run in background, use 'capstan run -d'", name)
+	}
+	return platform, nil
+}
+
+// ParseSince parses --since, which is either duration before now e.g. 10m or
+// RFC 3339 timestamp e.g. 2017-06-01T10:00:00Z.
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since '%s', expected duration e.g. 10m or timestamp e.g. 2017-06-01T10:00:00Z", value)
+}
+
+// Logs prints console output of instance running in background. When since
+// is set, only lines that were written since then are printed. When follow
+// is set, output is printed as it is written until the instance stops.
+func Logs(name string, follow bool, since time.Time, out io.Writer) error {
+	platform, err := backgroundInstance(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(instanceConsoleFile(platform, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !since.IsZero() {
+		offset, err := consoleOffsetSince(platform, name, since)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	for {
+		// Whatever is written before the instance stops must be printed.
+		_, stopped, err := waitExitStatus(platform, name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, f); err != nil {
+			return err
+		}
+		if !follow || stopped {
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// consoleOffsetSince returns offset of the first line of console log that
+// was written at or after given time.
+func consoleOffsetSince(platform, name string, since time.Time) (int64, error) {
+	f, err := os.Open(instanceFile(platform, name, consoleTimesFileName))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		nanos, err1 := strconv.ParseInt(fields[0], 10, 64)
+		offset, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if !time.Unix(0, nanos).Before(since) {
+			return offset, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	// No line was written since then.
+	info, err := os.Stat(instanceConsoleFile(platform, name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Attach connects the terminal to console of instance running in background
+// until the instance stops or Ctrl-] is pressed.
+func Attach(name string) error {
+	platform, err := backgroundInstance(name)
+	if err != nil {
+		return err
+	}
+	conn, err := util.Connect("unix", instanceConsoleSocket(platform, name))
+	if err != nil {
+		return fmt.Errorf("instance %s is not running", name)
+	}
+	defer conn.Close()
+
+	fmt.Printf("Attached to instance %s, press Ctrl-] to detach\n", name)
+	util.RawTerm()
+	defer util.ResetTerm()
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(os.Stdout, conn)
+		done <- true
+	}()
+	go func() {
+		copyUntilDetach(conn, os.Stdin)
+		done <- true
+	}()
+	<-done
+
+	fmt.Printf("\r\nDetached from instance %s\r\n", name)
+	return nil
+}
+
+// copyUntilDetach copies src to dst until detach key is read from src.
+func copyUntilDetach(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf)
+		if i := bytes.IndexByte(buf[:n], detachKey); i >= 0 {
+			_, err := dst.Write(buf[:i])
+			return err
+		}
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Wait waits until instance running in background stops and returns its
+// exit status. This is exit status of the application as reported by OSv on
+// the console or exit status of the hypervisor if there is no such report.
+func Wait(name string) (int, error) {
+	platform, err := backgroundInstance(name)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		status, stopped, err := waitExitStatus(platform, name)
+		if err != nil || stopped {
+			return status, err
+		}
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/fake"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+
+	. "gopkg.in/check.v1"
+)
+
+// TestSuperviseHelper is not a real test. It runs supervisor of an instance
+// of the fake hypervisor in a separate process, see consoleSuite.
+func TestSuperviseHelper(t *testing.T) {
+	if os.Getenv("CAPSTAN_SUPERVISE_HELPER") != "1" {
+		return
+	}
+
+	d := fake.Register()
+	d.Command = []string{"sh", "-c", os.Getenv("CAPSTAN_SUPERVISE_COMMAND")}
+	if os.Getenv("CAPSTAN_SUPERVISE_FAIL") != "" {
+		d.Err = fmt.Errorf("%s", os.Getenv("CAPSTAN_SUPERVISE_FAIL"))
+	}
+	if err := Supervise(fake.Name, os.Args[len(os.Args)-1]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+type consoleSuite struct {
+	instancesSuite
+	supervisor func(platform, name string) (*exec.Cmd, error)
+	image      string
+	command    string
+	fail       string
+}
+
+var _ = Suite(&consoleSuite{})
+
+func (s *consoleSuite) SetUpSuite(c *C) {
+	s.instancesSuite.SetUpSuite(c)
+	s.supervisor = supervisorCommand
+}
+
+func (s *consoleSuite) TearDownSuite(c *C) {
+	s.instancesSuite.TearDownSuite(c)
+	supervisorCommand = s.supervisor
+}
+
+func (s *consoleSuite) SetUpTest(c *C) {
+	s.instancesSuite.SetUpTest(c)
+	s.image = filepath.Join(c.MkDir(), "demo.qcow2")
+	writeOverlay(c, s.image, "")
+	s.command = "echo hello"
+	s.fail = ""
+
+	supervisorCommand = func(platform, name string) (*exec.Cmd, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSuperviseHelper$", "--", name)
+		cmd.Env = append(os.Environ(),
+			"CAPSTAN_SUPERVISE_HELPER=1",
+			"CAPSTAN_SUPERVISE_COMMAND="+s.command,
+			"CAPSTAN_SUPERVISE_FAIL="+s.fail)
+		return cmd, nil
+	}
+}
+
+func (s *consoleSuite) runInBackground(c *C) error {
+	return RunInstance(s.repo, &runtime.RunConfig{
+		InstanceName: "demo",
+		ImageName:    s.image,
+		Hypervisor:   fake.Name,
+		Memory:       "512M",
+		Detach:       true,
+	})
+}
+
+func (s *consoleSuite) TestRunInBackground(c *C) {
+	s.command = "echo hello; echo world; exit 3"
+
+	// This is what we're testing here.
+	err := s.runInBackground(c)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	status, err := Wait("demo")
+	c.Check(err, IsNil)
+	c.Check(status, Equals, 3)
+
+	var out bytes.Buffer
+	c.Check(Logs("demo", false, time.Time{}, &out), IsNil)
+	c.Check(out.String(), Equals, "hello\nworld\n")
+
+	out.Reset()
+	c.Check(Logs("demo", true, time.Now().Add(time.Hour), &out), IsNil)
+	c.Check(out.String(), Equals, "")
+}
+
+func (s *consoleSuite) TestWaitReportsGuestStatus(c *C) {
+	s.command = "echo 'program /app.so returned 3'; printf 'Powering off.\\r\\n'; exit 0"
+	c.Assert(s.runInBackground(c), IsNil)
+
+	// This is what we're testing here.
+	status, err := Wait("demo")
+
+	// Expectations.
+	c.Check(err, IsNil)
+	c.Check(status, Equals, 3)
+}
+
+func (s *consoleSuite) TestRunInBackgroundFails(c *C) {
+	s.fail = "no hypervisor today"
+
+	// This is what we're testing here.
+	err := s.runInBackground(c)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "failed to launch instance demo in background: no hypervisor today")
+}
+
+func (s *consoleSuite) TestAttachToConsole(c *C) {
+	s.command = "echo ready; read line; echo got $line"
+	c.Assert(s.runInBackground(c), IsNil)
+
+	// This is what we're testing here.
+	conn, err := util.Connect("unix", instanceConsoleSocket(fake.Name, "demo"))
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hi\n"))
+	c.Assert(err, IsNil)
+
+	// Expectations.
+	status, err := Wait("demo")
+	c.Check(err, IsNil)
+	c.Check(status, Equals, 0)
+	var out bytes.Buffer
+	c.Check(Logs("demo", false, time.Time{}, &out), IsNil)
+	c.Check(out.String(), Equals, "ready\ngot hi\n")
+}
+
+func (s *consoleSuite) TestLogsSince(c *C) {
+	s.command = "echo first; sleep 1; echo second"
+	c.Assert(s.runInBackground(c), IsNil)
+	_, err := Wait("demo")
+	c.Assert(err, IsNil)
+
+	// Find time of the second line.
+	f, err := os.Open(instanceFile(fake.Name, "demo", consoleTimesFileName))
+	c.Assert(err, IsNil)
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	c.Assert(lines, HasLen, 2)
+	var nanos, offset int64
+	fmt.Sscanf(lines[1], "%d %d", &nanos, &offset)
+	c.Check(offset, Equals, int64(len("first\n")))
+
+	// This is what we're testing here.
+	var out bytes.Buffer
+	err = Logs("demo", false, time.Unix(0, nanos), &out)
+
+	// Expectations.
+	c.Check(err, IsNil)
+	c.Check(out.String(), Equals, "second\n")
+}
+
+func (s *consoleSuite) TestSupervisorKilled(c *C) {
+	s.command = "echo ready; sleep 2"
+	c.Assert(s.runInBackground(c), IsNil)
+	data, err := ioutil.ReadFile(instanceFile(fake.Name, "demo", supervisorPidName))
+	c.Assert(err, IsNil)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	c.Assert(err, IsNil)
+
+	supervisor, err := os.FindProcess(pid)
+	c.Assert(err, IsNil)
+	c.Assert(supervisor.Kill(), IsNil)
+
+	// This is what we're testing here.
+	_, waitErr := Wait("demo")
+	logsErr := Logs("demo", true, time.Time{}, &bytes.Buffer{})
+
+	// Expectations.
+	c.Check(waitErr, ErrorMatches, "supervisor of instance demo is no longer running, exit status of the instance is unknown")
+	c.Check(logsErr, ErrorMatches, "supervisor of instance demo is no longer running, exit status of the instance is unknown")
+}
+
+func (s *consoleSuite) TestNotInBackground(c *C) {
+	config := &runtime.RunConfig{InstanceName: "demo", ImageName: s.image, Hypervisor: fake.Name, Memory: "512M"}
+	c.Assert(RunInstance(s.repo, config), IsNil)
+
+	// This is what we're testing here.
+	_, waitErr := Wait("demo")
+	logsErr := Logs("demo", false, time.Time{}, &bytes.Buffer{})
+	attachErr := Attach("missing")
+
+	// Expectations.
+	c.Check(waitErr, ErrorMatches, "instance demo was not run in background, use 'capstan run -d'")
+	c.Check(logsErr, ErrorMatches, "instance demo was not run in background, use 'capstan run -d'")
+	c.Check(attachErr, ErrorMatches, "instance missing not found")
+}
+
+func (s *consoleSuite) TestCopyUntilDetach(c *C) {
+	var out bytes.Buffer
+
+	// This is what we're testing here.
+	err := copyUntilDetach(&out, strings.NewReader("ls\n\x1dexit\n"))
+
+	// Expectations.
+	c.Check(err, IsNil)
+	c.Check(out.String(), Equals, "ls\n")
+}
+
+func (s *consoleSuite) TestParseSince(c *C) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := []struct {
+		value       string
+		expected    time.Time
+		expectedErr string
+	}{
+		{"", time.Time{}, ""},
+		{"10m", now.Add(-10 * time.Minute), ""},
+		{"2017-06-01T10:00:00Z", time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC), ""},
+		{"yesterday", time.Time{}, "invalid --since 'yesterday', .*"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.value)
+
+		// This is what we're testing here.
+		since, err := ParseSince(args.value, now)
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Check(err, ErrorMatches, args.expectedErr)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(since.Equal(args.expected), Equals, true)
+		}
+	}
+}
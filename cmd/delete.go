@@ -10,36 +10,27 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/mikelangelo-project/capstan/hypervisor/gce"
-	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
-	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
-	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
+	"github.com/mikelangelo-project/capstan/hypervisor"
 	"github.com/mikelangelo-project/capstan/util"
 )
 
 func Delete(name string) error {
-	var err error
 	instanceName, instancePlatform := util.SearchInstance(name)
 	if instanceName == "" {
 		fmt.Printf("Instance: %s not found\n", name)
 		return nil
 	}
-
-	switch instancePlatform {
-	case "qemu":
-		qemu.StopVM(name)
-		err = qemu.DeleteVM(name)
-	case "vbox":
-		vbox.StopVM(name)
-		err = vbox.DeleteVM(name)
-	case "vmw":
-		vmw.StopVM(name)
-		err = vmw.DeleteVM(name)
-	case "gce":
-		gce.StopVM(name)
-		err = gce.DeleteVM(name)
-	}
+	driver, err := hypervisor.Get(instancePlatform)
 	if err != nil {
+		return err
+	}
+
+	// Files unknown to the hypervisor would prevent instance directory
+	// from being removed.
+	removeInstanceFiles(instancePlatform, name)
+
+	driver.Stop(name)
+	if err := driver.Delete(name); err != nil {
 		fmt.Printf("Failed to delete instance: %s\n", name)
 		return err
 	}
@@ -0,0 +1,16 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+// Drivers of supported hypervisors register themselves when imported.
+import (
+	_ "github.com/mikelangelo-project/capstan/hypervisor/gce"
+	_ "github.com/mikelangelo-project/capstan/hypervisor/qemu"
+	_ "github.com/mikelangelo-project/capstan/hypervisor/vbox"
+	_ "github.com/mikelangelo-project/capstan/hypervisor/vmw"
+)
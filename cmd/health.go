@@ -0,0 +1,236 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	healthFileName  = "healthcheck.yaml"
+	consoleFileName = "console.log"
+
+	// maxProbeTimeout limits time that a single probe may take.
+	maxProbeTimeout = 5 * time.Second
+)
+
+// InstanceHealth is a health check stored with the instance together with
+// everything needed to probe it from the host.
+type InstanceHealth struct {
+	Check runtime.HealthCheck `yaml:"check"`
+	// Address is host address that guest port of the check is reachable at.
+	Address string `yaml:"address,omitempty"`
+	// ConsoleLog is file that console output of the instance is written to.
+	ConsoleLog string `yaml:"console_log,omitempty"`
+}
+
+// NewInstanceHealth resolves where the check of the instance with given
+// networking can be probed at.
+func NewInstanceHealth(check *runtime.HealthCheck, networking string, natRules []nat.Rule, consoleLog string) (*InstanceHealth, error) {
+	res := &InstanceHealth{Check: *check, ConsoleLog: consoleLog}
+
+	port := check.GuestPort()
+	if port == 0 {
+		return res, nil
+	}
+	if networking != "nat" {
+		return nil, fmt.Errorf("%s health check requires 'nat' networking with port %d forwarded e.g. -f %d:%d",
+			check.Kind(), port, port, port)
+	}
+	for _, rule := range natRules {
+		hostPort, ok := rule.HostPortFor(port)
+		if !ok || rule.Protocol != nat.TCP {
+			continue
+		}
+		host := "localhost"
+		if rule.BindIP != "" && rule.BindIP != "0.0.0.0" {
+			host = rule.BindIP
+		}
+		res.Address = net.JoinHostPort(host, strconv.Itoa(hostPort))
+		return res, nil
+	}
+	return nil, fmt.Errorf("%s health check requires guest port %d to be forwarded e.g. -f %d:%d",
+		check.Kind(), port, port, port)
+}
+
+// Probe checks the health once.
+func (h *InstanceHealth) Probe() error {
+	timeout := h.Check.IntervalDuration()
+	if timeout > maxProbeTimeout {
+		timeout = maxProbeTimeout
+	}
+
+	switch h.Check.Kind() {
+	case runtime.HealthCheckTCP:
+		conn, err := net.DialTimeout("tcp", h.Address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case runtime.HealthCheckHTTP:
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get("http://" + h.Address + h.Check.HTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != h.Check.ExpectedStatus() {
+			return fmt.Errorf("GET %s returned status %d instead of %d", h.Check.HTTP, resp.StatusCode, h.Check.ExpectedStatus())
+		}
+		return nil
+	case runtime.HealthCheckLog:
+		data, err := ioutil.ReadFile(h.ConsoleLog)
+		if err != nil {
+			return err
+		}
+		if !regexp.MustCompile("(?m)" + h.Check.Log).Match(data) {
+			return fmt.Errorf("no console line matches '%s'", h.Check.Log)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown health check")
+}
+
+// WaitHealthy probes the health until the check passes or times out. Waiting
+// is aborted when the instance exits, i.e. when exited channel receives.
+func (h *InstanceHealth) WaitHealthy(exited <-chan error) error {
+	deadline := time.After(h.Check.TimeoutDuration())
+	for {
+		err := h.Probe()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-deadline:
+			return fmt.Errorf("instance is not healthy after %s (%s): %s", h.Check.TimeoutDuration(), h.Check.String(), err)
+		case exitErr := <-exited:
+			if exitErr != nil {
+				return fmt.Errorf("instance stopped before it became healthy: %s", exitErr)
+			}
+			return fmt.Errorf("instance stopped before it became healthy")
+		case <-time.After(h.Check.IntervalDuration()):
+		}
+	}
+}
+
+// instanceHealthFile returns path of the health check of the instance.
+func instanceHealthFile(platform, name string) string {
+	return filepath.Join(hypervisor.InstanceDir(platform, name), healthFileName)
+}
+
+// instanceConsoleFile returns path of the file that console output of
+// instance running in background is written to.
+func instanceConsoleFile(platform, name string) string {
+	return filepath.Join(hypervisor.InstanceDir(platform, name), consoleFileName)
+}
+
+// StoreInstanceHealth stores health check with the instance.
+func StoreInstanceHealth(platform, name string, h *InstanceHealth) error {
+	data, err := yaml.Marshal(h)
+	if err != nil {
+		return err
+	}
+	path := instanceHealthFile(platform, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// LoadInstanceHealth returns health check of the instance or nil if the
+// instance has none.
+func LoadInstanceHealth(platform, name string) (*InstanceHealth, error) {
+	data, err := ioutil.ReadFile(instanceHealthFile(platform, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	h := InstanceHealth{}
+	if err := yaml.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("failed to parse health check of instance %s: %s", name, err)
+	}
+	return &h, nil
+}
+
+// storeImageHealthCheck stores health check of the config set that the image
+// boots with next to the image. Stale check is removed when there is none.
+func storeImageHealthCheck(repo *util.Repo, image string, check *runtime.HealthCheck) error {
+	path := repo.ImageHealthCheckPath(image)
+	if check == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := yaml.Marshal(check)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// loadImageHealthCheck returns health check stored with the image or nil if
+// the image has none.
+func loadImageHealthCheck(repo *util.Repo, image string) (*runtime.HealthCheck, error) {
+	data, err := ioutil.ReadFile(repo.ImageHealthCheckPath(image))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	check := runtime.HealthCheck{}
+	if err := yaml.Unmarshal(data, &check); err != nil {
+		return nil, fmt.Errorf("failed to parse health check of image %s: %s", image, err)
+	}
+	return &check, nil
+}
+
+// removeInstanceFiles removes files that Capstan stores with the instance
+// in addition to the ones managed by the hypervisor.
+func removeInstanceFiles(platform, name string) {
+	os.Remove(instanceHealthFile(platform, name))
+	os.Remove(instanceConsoleFile(platform, name))
+	for _, fileName := range []string{recordFileName, launchFileName, consoleTimesFileName, consoleSocketName, exitStatusFileName, pidFileName, supervisorPidName, supervisorLogName} {
+		os.Remove(instanceFile(platform, name, fileName))
+	}
+}
+
+// instanceHealthStatus returns Healthy or Unhealthy for running instances
+// with a health check and empty string otherwise.
+func instanceHealthStatus(name, platform, status string) string {
+	if status != "Running" {
+		return ""
+	}
+	h, err := LoadInstanceHealth(platform, name)
+	if err != nil || h == nil {
+		return ""
+	}
+	if h.Probe() != nil {
+		return "Unhealthy"
+	}
+	return "Healthy"
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/runtime"
+
+	. "gopkg.in/check.v1"
+)
+
+type healthSuite struct {
+	instancesSuite
+}
+
+var _ = Suite(&healthSuite{})
+
+func (*healthSuite) TestNewInstanceHealth(c *C) {
+	m := []struct {
+		comment         string
+		check           runtime.HealthCheck
+		networking      string
+		natRules        []nat.Rule
+		expectedAddress string
+		expectedErr     string
+	}{
+		{
+			"tcp forwarded",
+			runtime.HealthCheck{TCP: 8000}, "nat", []nat.Rule{{HostPort: nat.Port(18000), GuestPort: nat.Port(8000), Protocol: nat.TCP}},
+			"localhost:18000", "",
+		},
+		{
+			"http forwarded",
+			runtime.HealthCheck{HTTP: "/health", Port: 8000}, "nat",
+			[]nat.Rule{{HostPort: nat.Port(2222), GuestPort: nat.Port(22), Protocol: nat.TCP}, {HostPort: nat.Port(8080), GuestPort: nat.Port(8000), Protocol: nat.TCP}},
+			"localhost:8080", "",
+		},
+		{
+			"range bound to address",
+			runtime.HealthCheck{TCP: 8001}, "nat",
+			[]nat.Rule{
+				{HostPort: nat.Port(9001), GuestPort: nat.Port(8001), Protocol: nat.UDP},
+				{BindIP: "127.0.0.2", HostPort: nat.PortRange{First: 9000, Last: 9002}, GuestPort: nat.PortRange{First: 8000, Last: 8002}, Protocol: nat.TCP},
+			},
+			"127.0.0.2:9001", "",
+		},
+		{
+			"log",
+			runtime.HealthCheck{Log: "started"}, "bridge", nil,
+			"", "",
+		},
+		{
+			"not forwarded",
+			runtime.HealthCheck{TCP: 8000}, "nat", []nat.Rule{{HostPort: nat.Port(2222), GuestPort: nat.Port(22), Protocol: nat.TCP}},
+			"", "tcp health check requires guest port 8000 to be forwarded e.g. -f 8000:8000",
+		},
+		{
+			"bridge",
+			runtime.HealthCheck{HTTP: "/", Port: 80}, "bridge", nil,
+			"", "http health check requires 'nat' networking with port 80 forwarded e.g. -f 80:80",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		h, err := NewInstanceHealth(&args.check, args.networking, args.natRules, "/console.log")
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Check(err, ErrorMatches, args.expectedErr)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(h.Address, Equals, args.expectedAddress)
+		c.Check(h.ConsoleLog, Equals, "/console.log")
+	}
+}
+
+func (*healthSuite) TestProbeTCP(c *C) {
+	// Prepare
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	h := InstanceHealth{Check: runtime.HealthCheck{TCP: 8000}, Address: listener.Addr().String()}
+
+	// This is what we're testing here.
+	c.Check(h.Probe(), IsNil)
+	listener.Close()
+	c.Check(h.Probe(), NotNil)
+}
+
+func (*healthSuite) TestProbeHTTP(c *C) {
+	// Prepare
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	m := []struct {
+		comment     string
+		check       runtime.HealthCheck
+		expectedErr string
+	}{
+		{"healthy", runtime.HealthCheck{HTTP: "/health", Port: 8000}, ""},
+		{"wrong path", runtime.HealthCheck{HTTP: "/", Port: 8000}, "GET / returned status 404 instead of 200"},
+		{"expected status", runtime.HealthCheck{HTTP: "/", Port: 8000, Status: 404}, ""},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		h := InstanceHealth{Check: args.check, Address: address}
+
+		// This is what we're testing here.
+		err := h.Probe()
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Check(err, ErrorMatches, args.expectedErr)
+		} else {
+			c.Check(err, IsNil)
+		}
+	}
+}
+
+func (*healthSuite) TestProbeLog(c *C) {
+	// Prepare
+	consoleLog := filepath.Join(c.MkDir(), "console.log")
+	ioutil.WriteFile(consoleLog, []byte("OSv v0.24\nServer listening on port 8000\n"), 0644)
+
+	// This is what we're testing here.
+	h := InstanceHealth{Check: runtime.HealthCheck{Log: `^Server listening on port \d+$`}, ConsoleLog: consoleLog}
+	c.Check(h.Probe(), IsNil)
+	h = InstanceHealth{Check: runtime.HealthCheck{Log: `^listening`}, ConsoleLog: consoleLog}
+	c.Check(h.Probe(), ErrorMatches, "no console line matches '\\^listening'")
+}
+
+func (*healthSuite) TestWaitHealthy(c *C) {
+	// Prepare
+	consoleLog := filepath.Join(c.MkDir(), "console.log")
+	ioutil.WriteFile(consoleLog, []byte("booting\n"), 0644)
+	h := InstanceHealth{
+		Check:      runtime.HealthCheck{Log: "started", Interval: "10ms", Timeout: "50ms"},
+		ConsoleLog: consoleLog,
+	}
+
+	// Timeout.
+	c.Check(h.WaitHealthy(nil), ErrorMatches, "instance is not healthy after 50ms \\(log line matching 'started'\\): no console line matches 'started'")
+
+	// Instance exited.
+	exited := make(chan error, 1)
+	exited <- errors.New("exit status 1")
+	c.Check(h.WaitHealthy(exited), ErrorMatches, "instance stopped before it became healthy: exit status 1")
+
+	// Healthy.
+	ioutil.WriteFile(consoleLog, []byte("booting\nstarted\n"), 0644)
+	c.Check(h.WaitHealthy(nil), IsNil)
+}
+
+func (*healthSuite) TestStoreInstanceHealth(c *C) {
+	// Prepare
+	h := &InstanceHealth{
+		Check:   runtime.HealthCheck{HTTP: "/health", Port: 8000, Timeout: "30s"},
+		Address: "localhost:8000",
+	}
+
+	// This is what we're testing here.
+	err := StoreInstanceHealth("qemu", "inst1", h)
+	c.Assert(err, IsNil)
+	loaded, err := LoadInstanceHealth("qemu", "inst1")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(loaded, DeepEquals, h)
+	c.Check(instanceHealthStatus("inst1", "qemu", "Stopped"), Equals, "")
+	c.Check(instanceHealthStatus("inst1", "qemu", "Running"), Equals, "Unhealthy")
+
+	missing, err := LoadInstanceHealth("qemu", "inst2")
+	c.Check(err, IsNil)
+	c.Check(missing, IsNil)
+	c.Check(instanceHealthStatus("inst2", "qemu", "Running"), Equals, "")
+
+	removeInstanceFiles("qemu", "inst1")
+	loaded, err = LoadInstanceHealth("qemu", "inst1")
+	c.Check(loaded, IsNil)
+}
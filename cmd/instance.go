@@ -9,21 +9,135 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/mikelangelo-project/capstan/hypervisor/gce"
-	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
-	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
-	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
-	"github.com/mikelangelo-project/capstan/util"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
 )
 
-func Instances() error {
-	header := fmt.Sprintf("%-35s %-10s %-10s %-15s", "Name", "Platform", "Status", "Image")
-	fmt.Println(header)
-	rootDir := filepath.Join(util.ConfigDir(), "instances")
+const recordFileName = "instance.yaml"
+
+// InstanceRecord describes how the instance was created. It is stored with
+// the instance regardless of its hypervisor.
+type InstanceRecord struct {
+	Name     string `yaml:"name" json:"name"`
+	Platform string `yaml:"platform" json:"platform"`
+	// Image is image reference that the instance was created from as given
+	// to 'capstan run', Digest is SHA256 digest of the image file.
+	Image      string    `yaml:"image" json:"image"`
+	Digest     string    `yaml:"digest,omitempty" json:"digest,omitempty"`
+	Created    time.Time `yaml:"created" json:"created"`
+	Cmd        string    `yaml:"cmd,omitempty" json:"cmd,omitempty"`
+	Memory     int64     `yaml:"memory" json:"memory"`
+	Cpus       int       `yaml:"cpus" json:"cpus"`
+	Networking string    `yaml:"networking,omitempty" json:"networking,omitempty"`
+	Ports      []string  `yaml:"ports,omitempty" json:"ports,omitempty"`
+	// Volumes are attached volumes as host_path:mount_point.
+	Volumes []string `yaml:"volumes,omitempty" json:"volumes,omitempty"`
+	// Mounts are shared host directories as host_dir:guest_dir.
+	Mounts []string `yaml:"mounts,omitempty" json:"mounts,omitempty"`
+	// PID is process id of the hypervisor that ran the instance last.
+	PID int `yaml:"pid,omitempty" json:"pid,omitempty"`
+}
+
+// InstanceInfo is instance record together with the current state of the
+// instance.
+type InstanceInfo struct {
+	InstanceRecord `yaml:",inline"`
+	Status         string `yaml:"status" json:"status"`
+	Health         string `yaml:"health,omitempty" json:"health,omitempty"`
+}
+
+// newInstanceRecord returns record of the instance that is about to be
+// created from image at given path.
+func newInstanceRecord(platform, imageName, path string, c *hypervisor.Config) *InstanceRecord {
+	r := &InstanceRecord{
+		Name:       c.Name,
+		Platform:   platform,
+		Image:      imageName,
+		Created:    time.Now().UTC().Truncate(time.Second),
+		Cmd:        c.Cmd,
+		Memory:     c.Memory,
+		Cpus:       c.Cpus,
+		Networking: c.Networking,
+	}
+	if checksum, err := util.CachedFileChecksum(path); err == nil {
+		r.Digest = "sha256:" + checksum
+	}
+	for _, rule := range c.NatRules {
+		r.Ports = append(r.Ports, rule.String())
+	}
+	for _, v := range c.Volumes {
+		r.Volumes = append(r.Volumes, v.Path+":"+v.MountPoint)
+	}
+	for _, m := range c.Mounts {
+		r.Mounts = append(r.Mounts, m.Source+":"+m.Target)
+	}
+	return r
+}
+
+// instanceRecordFile returns path of the record of the instance.
+func instanceRecordFile(platform, name string) string {
+	return filepath.Join(hypervisor.InstanceDir(platform, name), recordFileName)
+}
+
+// StoreInstanceRecord stores record with the instance.
+func StoreInstanceRecord(r *InstanceRecord) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	path := instanceRecordFile(r.Platform, r.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// LoadInstanceRecord returns record of the instance. Instances that were
+// created before records were introduced get a record with only name and
+// platform set.
+func LoadInstanceRecord(platform, name string) (*InstanceRecord, error) {
+	r := InstanceRecord{}
+	data, err := ioutil.ReadFile(instanceRecordFile(platform, name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse record of instance %s: %s", name, err)
+	}
+	r.Name = name
+	r.Platform = platform
+	return &r, nil
+}
+
+// recordInstancePID updates record of the instance with the process id of
+// the hypervisor that runs it.
+func recordInstancePID(platform, name string, pid int) error {
+	if _, err := os.Stat(instanceRecordFile(platform, name)); os.IsNotExist(err) {
+		return nil
+	}
+	r, err := LoadInstanceRecord(platform, name)
+	if err != nil {
+		return err
+	}
+	r.PID = pid
+	return StoreInstanceRecord(r)
+}
+
+// ListInstances returns all instances, optionally only those with given
+// status (case insensitive).
+func ListInstances(status string) ([]InstanceInfo, error) {
+	res := []InstanceInfo{}
+	rootDir := util.InstancesPath()
 	platforms, _ := ioutil.ReadDir(rootDir)
 	for _, platform := range platforms {
 		if platform.IsDir() {
@@ -38,28 +152,83 @@ func Instances() error {
 						continue
 					}
 
-					printInstance(instance.Name(), platform.Name(), instanceDir)
+					info, err := instanceInfo(instance.Name(), platform.Name())
+					if err != nil {
+						return nil, err
+					}
+					if status != "" && !strings.EqualFold(info.Status, status) {
+						continue
+					}
+					res = append(res, *info)
 				}
 			}
 		}
 	}
+	return res, nil
+}
+
+func instanceInfo(name, platform string) (*InstanceInfo, error) {
+	r, err := LoadInstanceRecord(platform, name)
+	if err != nil {
+		return nil, err
+	}
+	info := &InstanceInfo{InstanceRecord: *r, Status: instanceStatus(name, platform)}
+	info.Health = instanceHealthStatus(name, platform, info.Status)
+	if info.Status != "Running" {
+		// Process id of stopped instance is meaningless.
+		info.PID = 0
+	}
+	return info, nil
+}
+
+// Instances prints instances in given format, either table or json.
+func Instances(format, status string) error {
+	instances, err := ListInstances(status)
+	if err != nil {
+		return err
+	}
+	return printInstances(os.Stdout, instances, format)
+}
+
+func printInstances(out io.Writer, instances []InstanceInfo, format string) error {
+	switch format {
+	case "", "table":
+		fmt.Fprintf(out, "%-35s %-10s %-10s %-10s %-25s %-20s %s\n", "Name", "Platform", "Status", "Health", "Image", "Created", "Ports")
+		for _, i := range instances {
+			created := ""
+			if !i.Created.IsZero() {
+				created = i.Created.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(out, "%-35s %-10s %-10s %-10s %-25s %-20s %s\n",
+				i.Name, i.Platform, i.Status, i.Health, i.Image, created, strings.Join(i.Ports, ","))
+		}
+		return nil
+	case "json":
+		return printJSON(out, instances)
+	default:
+		return fmt.Errorf("unsupported format '%s', use table or json", format)
+	}
+}
 
-	return nil
+// InspectInstance prints everything that is known about the instance as
+// JSON.
+func InspectInstance(name string) error {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return fmt.Errorf("instance %s not found", name)
+	}
+	info, err := instanceInfo(instanceName, platform)
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, info)
 }
 
-func printInstance(name, platform, dir string) error {
-	var status string
-
-	switch platform {
-	case "qemu":
-		status, _ = qemu.GetVMStatus(name, dir)
-	case "vbox":
-		status, _ = vbox.GetVMStatus(name, dir)
-	case "vmw":
-		status, _ = vmw.GetVMStatus(name, dir)
-	case "gce":
-		status, _ = gce.GetVMStatus(name, dir)
-	}
-	fmt.Printf("%-35s %-10s %-10s %-15s\n", name, platform, status, "")
-	return nil
+func printJSON(out io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
 }
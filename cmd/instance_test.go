@@ -0,0 +1,43 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/fake"
+	"github.com/mikelangelo-project/capstan/util"
+
+	. "gopkg.in/check.v1"
+)
+
+// instancesSuite is embedded by suites whose tests create instances. Each
+// test gets its own home directory, where instances are always stored, and
+// its own repository. Suites that need more setup call these methods from
+// their own.
+type instancesSuite struct {
+	repo   *util.Repo
+	home   string
+	driver *fake.Driver
+}
+
+func (s *instancesSuite) SetUpSuite(c *C) {
+	s.home = os.Getenv("HOME")
+}
+
+func (s *instancesSuite) TearDownSuite(c *C) {
+	os.Setenv("HOME", s.home)
+}
+
+func (s *instancesSuite) SetUpTest(c *C) {
+	os.Setenv("HOME", c.MkDir())
+
+	s.repo = util.NewRepo(util.DefaultRepositoryUrl)
+	s.repo.Path = c.MkDir()
+	s.driver = fake.Register()
+}
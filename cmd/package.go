@@ -19,6 +19,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/mikelangelo-project/capstan/configdrive"
 	"github.com/mikelangelo-project/capstan/core"
 	"github.com/mikelangelo-project/capstan/runtime"
 	"github.com/mikelangelo-project/capstan/util"
@@ -161,6 +162,10 @@ func BuildPackage(packageDir string) (string, error) {
 func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pullMissing bool,
 	packageDir, appName string, bootOpts *BootOptions) error {
 
+	if err := util.ValidateImageReference(appName); err != nil {
+		return err
+	}
+
 	// Package content should be collected in a subdirectory called mpm-pkg.
 	targetPath := filepath.Join(packageDir, "mpm-pkg")
 	// Remove collected directory afterwards.
@@ -173,7 +178,8 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 	}
 
 	// First, collect the contents of the package.
-	if err := CollectPackage(repo, packageDir, pullMissing, bootOpts.Boot, verbose); err != nil {
+	packages, err := collectPackage(repo, packageDir, pullMissing, verbose, bootOpts)
+	if err != nil {
 		return err
 	}
 
@@ -218,6 +224,23 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 	// Save the new image cache
 	imageCache.WriteToFile(imageCachePath)
 
+	// Remember what packages the image consists of.
+	if err := repo.StoreImagePackages(appName, packages); err != nil {
+		return err
+	}
+
+	// Remember health check of the config set so that it is used when the
+	// image is run by its name.
+	healthOpts := *bootOpts
+	healthOpts.PackageDir = packageDir
+	healthCheck, err := healthOpts.HealthCheck()
+	if err != nil {
+		return err
+	}
+	if err := storeImageHealthCheck(repo, appName, healthCheck); err != nil {
+		return err
+	}
+
 	// Set the command line.
 	if err = util.SetCmdLine(imagePath, commandLine); err != nil {
 		return err
@@ -230,22 +253,66 @@ func ComposePackage(repo *util.Repo, imageSize int64, updatePackage, verbose, pu
 // CollectPackage will try to resolve all of the dependencies of the given package
 // and collect the content in the $CWD/mpm-pkg directory.
 func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, customBoot string, verbose bool) error {
+	_, err := collectPackage(repo, packageDir, pullMissing, verbose, &BootOptions{Boot: customBoot})
+	return err
+}
+
+// collectPackage collects the content of the package and returns metadata of the
+// package itself followed by all of the packages that it requires. Boot options
+// provide variables to interpolate meta/run.yaml of the package with and select
+// config set that templates are rendered for.
+func collectPackage(repo *util.Repo, packageDir string, pullMissing bool, verbose bool, bootOpts *BootOptions) ([]core.Package, error) {
 	// Get the manifest file of the given package.
 	pkg, err := core.ParsePackageManifest(filepath.Join(packageDir, "meta", "package.yaml"))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	manifest := pkg
 
-	genRuntime, err := runtime.PackageRunManifestGeneral(filepath.Join(packageDir, "meta", "run.yaml"))
+	vars, err := bootOpts.Variables()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Package may define its own runtimes.
+	if err := runtime.LoadRuntimeDefinitions(filepath.Join(packageDir, "meta", "runtimes")); err != nil {
+		return nil, err
+	}
+
+	runYamlPath := filepath.Join(packageDir, "meta", "run.yaml")
+	genRuntime, err := runtime.PackageRunManifestGeneral(runYamlPath)
+	if err != nil {
+		// The runtime may be defined by one of the required packages.
+		if err := loadRequiredRuntimes(repo, pkg.Require); err != nil {
+			return nil, err
+		}
+		genRuntime, err = runtime.PackageRunManifestGeneral(runYamlPath)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// If runtime is known, then we add runtime dependencies to the list.
-	if genRuntime != nil && len(genRuntime.GetDependencies()) > 0 {
-		fmt.Printf("Prepending '%s' runtime dependencies to dep list: %s\n",
-			genRuntime.GetRuntimeName(), genRuntime.GetDependencies())
-		pkg.Require = append(genRuntime.GetDependencies(), pkg.Require...)
+	// If runtime is known, then we add runtime dependencies to the list. They
+	// may depend on values of config sets, e.g. selected interpreter.
+	var cmdConf *runtime.CmdConfig
+	if genRuntime != nil {
+		data, err := readRunYaml(packageDir, vars)
+		if err != nil {
+			return nil, err
+		}
+		if cmdConf, err = runtime.ParsePackageRunManifestData(data); err != nil {
+			return nil, err
+		}
+
+		if err := validateRuntimeVersions(repo, cmdConf, pullMissing); err != nil {
+			return nil, err
+		}
+
+		if deps := cmdConf.Dependencies(); len(deps) > 0 {
+			fmt.Printf("Prepending '%s' runtime dependencies to dep list: %s\n",
+				genRuntime.GetRuntimeName(), deps)
+			pkg.Require = append(deps, pkg.Require...)
+		}
 	}
 
 	// The bootstrap package is implicitly required by every application package,
@@ -256,7 +323,7 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 	// Look for all dependencies and make sure they are all available in the repository.
 	requiredPackages, err := repo.GetPackageDependencies(pkg, pullMissing)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	targetPath := filepath.Join(packageDir, "mpm-pkg")
@@ -269,7 +336,7 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 	}
 
 	if err = os.MkdirAll(targetPath, 0775); err != nil {
-		return err
+		return nil, err
 	}
 
 	allCmdConfigs := &runtime.AllCmdConfigs{}
@@ -278,12 +345,12 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 	for _, req := range requiredPackages {
 		reader, err := repo.GetPackageTarReader(req.Name)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		cmdConf, err := extractPackageContent(reader, targetPath, req.Name)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		allCmdConfigs.Add(req.Name, cmdConf)
 	}
@@ -298,7 +365,7 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 	}
 	capstanignore, err := core.CapstanignoreInit(capstanignorePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Now we need to append the content of the current package into the target directory.
@@ -323,14 +390,6 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 		// Apply meta/run.yaml before ignoring it.
 		if relPath == "/meta/run.yaml" {
 			// Prepare files with boot commands.
-			data, err := ioutil.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			cmdConf, err := runtime.ParsePackageRunManifestData(data)
-			if err != nil {
-				return err
-			}
 			allCmdConfigs.Add(pkg.Name, cmdConf)
 			return nil
 		} else if relPath == "/meta" { // Prevent empty `/meta` dir from being uploaded.
@@ -367,15 +426,32 @@ func CollectPackage(repo *util.Repo, packageDir string, pullMissing bool, custom
 		}
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Runtime may need to add content to the package, e.g. vendored libraries.
+	if cmdConf != nil {
+		if err := cmdConf.PrepareContent(packageDir, targetPath); err != nil {
+			return nil, err
+		}
 	}
 
 	// Persist all boot commands into /run directory.
 	if err := allCmdConfigs.Persist(targetPath); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// Render configuration files from templates. Config sets are resolved
+	// by now, so templates see environment inherited from base.
+	data, err := newTemplateData(manifest, requiredPackages, cmdConf, bootOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := renderTemplates(filepath.Join(packageDir, "meta", "templates"), targetPath, data); err != nil {
+		return nil, err
+	}
+
+	return append([]core.Package{pkg}, requiredPackages...), nil
 }
 
 func collectDirectoryContents(packageDir string) (map[string]string, error) {
@@ -417,7 +493,9 @@ func ImportPackage(repo *util.Repo, packageDir string) error {
 }
 
 func extractPackageContent(tarReader *tar.Reader, target, pkgName string) (*runtime.CmdConfig, error) {
-	var cmdConf *runtime.CmdConfig
+	// Runtimes defined by the package may appear after meta/run.yaml in the
+	// archive so meta/run.yaml is parsed once the whole archive is read.
+	var runYaml []byte
 	for {
 		header, err := tarReader.Next()
 		if err != nil {
@@ -430,12 +508,16 @@ func extractPackageContent(tarReader *tar.Reader, target, pkgName string) (*runt
 
 		if absTarPathMatches(header.Name, "/meta/run.yaml") {
 			// Prepare files with boot commands for this package.
+			if runYaml, err = ioutil.ReadAll(tarReader); err != nil {
+				return nil, err
+			}
+			continue
+		} else if absTarPathMatches(header.Name, "/meta/runtimes/[^/]+\\.yaml") {
 			data, err := ioutil.ReadAll(tarReader)
 			if err != nil {
 				return nil, err
 			}
-			cmdConf, err = runtime.ParsePackageRunManifestData(data)
-			if err != nil {
+			if err := runtime.LoadRuntimeDefinitionData(data, fmt.Sprintf("%s:%s", pkgName, header.Name)); err != nil {
 				return nil, err
 			}
 			continue
@@ -485,7 +567,69 @@ func extractPackageContent(tarReader *tar.Reader, target, pkgName string) (*runt
 		}
 	}
 
-	return cmdConf, nil
+	if runYaml == nil {
+		return nil, nil
+	}
+	return runtime.ParsePackageRunManifestData(runYaml)
+}
+
+// loadRequiredRuntimes registers runtimes defined in meta/runtimes of the
+// given packages. Packages that are not available locally are skipped.
+func loadRequiredRuntimes(repo *util.Repo, pkgNames []string) error {
+	for _, pkgName := range pkgNames {
+		tarReader, err := repo.GetPackageTarReader(pkgName)
+		if err != nil {
+			continue
+		}
+
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if !absTarPathMatches(header.Name, "/meta/runtimes/[^/]+\\.yaml") {
+				continue
+			}
+			data, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return err
+			}
+			if err := runtime.LoadRuntimeDefinitionData(data, fmt.Sprintf("%s:%s", pkgName, header.Name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// packageRunManifest returns parsed meta/run.yaml of the package from the
+// local repository or nil if the package does not contain one.
+func packageRunManifest(repo *util.Repo, pkgName string) (*runtime.CmdConfig, error) {
+	tarReader, err := repo.GetPackageTarReader(pkgName)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if absTarPathMatches(header.Name, "/meta/run.yaml") {
+			data, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return nil, err
+			}
+			return runtime.ParsePackageRunManifestData(data)
+		}
+	}
 }
 
 // PullPackage looks for the package in remote repository and tries to import
@@ -623,9 +767,154 @@ type BootOptions struct {
 	Cmd        string
 	Boot       string
 	EnvList    []string
+	EnvFiles   []string
 	PackageDir string
 }
 
+// Env returns environment variables from env files and from EnvList, the
+// latter taking precedence.
+func (b *BootOptions) Env() (map[string]string, error) {
+	res := make(map[string]string)
+	for _, envFile := range b.EnvFiles {
+		env, err := util.ParseEnvFile(envFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --env-file: %s", err)
+		}
+		for k, v := range env {
+			res[k] = v
+		}
+	}
+
+	env, err := util.ParseEnvironmentList(b.EnvList)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range env {
+		res[k] = v
+	}
+	return res, nil
+}
+
+// Variables returns variables that are used to interpolate meta/run.yaml,
+// i.e. host environment overridden by Env().
+func (b *BootOptions) Variables() (map[string]string, error) {
+	env, err := b.Env()
+	if err != nil {
+		return nil, err
+	}
+
+	res := util.EnvironMap()
+	for k, v := range env {
+		res[k] = v
+	}
+	return res, nil
+}
+
+// PrintPackageConfig prints meta/run.yaml of the package with all variables
+// interpolated.
+func PrintPackageConfig(packageDir string, bootOpts *BootOptions) error {
+	vars, err := bootOpts.Variables()
+	if err != nil {
+		return err
+	}
+
+	data, err := readRunYaml(packageDir, vars)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("%s does not exist", filepath.Join(packageDir, "meta", "run.yaml"))
+	}
+
+	// Make sure that the result is valid.
+	if _, err := runtime.ParsePackageRunManifestData(data); err != nil {
+		return err
+	}
+
+	fmt.Print(string(data))
+	return nil
+}
+
+// HealthCheck returns health check of the config set that the unikernel
+// boots with, i.e. the one selected by --boot or config_set_default. Nil is
+// returned when boot command is given directly or config set has no check.
+func (b *BootOptions) HealthCheck() (*runtime.HealthCheck, error) {
+	if b.Cmd != "" || b.PackageDir == "" {
+		return nil, nil
+	}
+
+	vars, err := b.Variables()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readRunYaml(b.PackageDir, vars)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	cmdConf, err := runtime.ParsePackageRunManifestData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	name := b.configSetName(cmdConf)
+	if cmdConf.ConfigSets[name] == nil {
+		return nil, nil
+	}
+	return cmdConf.ConfigSets[name].GetHealthCheck(), nil
+}
+
+// ConfigDrive returns contextualization disk that passes environment
+// variables, files given as local_path:guest_path and config set selected
+// by --boot to the instance instead of writing them to its command line.
+func (b *BootOptions) ConfigDrive(fileSpecs []string) (*configdrive.ConfigDrive, error) {
+	env, err := b.Env()
+	if err != nil {
+		return nil, err
+	}
+	files, err := configdrive.ParseFiles(fileSpecs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &configdrive.ConfigDrive{
+		ConfigSet: b.Boot,
+		Env:       env,
+		Files:     files,
+	}, nil
+}
+
+// configSetName returns name of the config set that the unikernel boots
+// with, i.e. the one selected by --boot, config_set_default or the only one.
+func (b *BootOptions) configSetName(cmdConf *runtime.CmdConfig) string {
+	if b.Cmd != "" {
+		return ""
+	}
+
+	name := b.Boot
+	if name == "" {
+		name = cmdConf.ConfigSetDefault
+	}
+	if name == "" && len(cmdConf.ConfigSets) == 1 {
+		for confName := range cmdConf.ConfigSets {
+			name = confName
+		}
+	}
+	return name
+}
+
+// readRunYaml reads meta/run.yaml of the package and interpolates variables
+// in it. Nil is returned if the file does not exist.
+func readRunYaml(packageDir string, vars map[string]string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(packageDir, "meta", "run.yaml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return runtime.Interpolate(data, vars)
+}
+
 // GetCmd builds final bootcmd based on three parameters (in this order):
 // * --run <commandLine>
 // * --boot <customBoot>
@@ -640,7 +929,15 @@ func (b *BootOptions) GetCmd() (string, error) {
 		fmt.Println("Command line will be set based on --boot parameter")
 		command = runtime.BootCmdForScript(b.Boot)
 	} else if b.PackageDir != "" { // Default configuration in yaml has third-highest priority (config_set_default: <>).
-		if data, err := ioutil.ReadFile(filepath.Join(b.PackageDir, "meta", "run.yaml")); err == nil {
+		vars, err := b.Variables()
+		if err != nil {
+			return "", err
+		}
+		data, err := readRunYaml(b.PackageDir, vars)
+		if err != nil {
+			return "", err
+		}
+		if data != nil {
 			if cmdConf, err := runtime.ParsePackageRunManifestData(data); err == nil && cmdConf.ConfigSetDefault != "" {
 				fmt.Println("Command line will be set based on config_set_default attribute of meta/run.yaml")
 				command = runtime.BootCmdForScript(cmdConf.ConfigSetDefault)
@@ -652,7 +949,7 @@ func (b *BootOptions) GetCmd() (string, error) {
 	}
 
 	// Prepend environment variables to the command.
-	if env, err := util.ParseEnvironmentList(b.EnvList); err == nil {
+	if env, err := b.Env(); err == nil {
 		if command, err = runtime.PrependEnvsPrefix(command, env, false); err != nil {
 			return "", err
 		}
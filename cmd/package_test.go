@@ -8,6 +8,7 @@
 package cmd
 
 import (
+	"archive/zip"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -15,6 +16,7 @@ import (
 	"testing"
 
 	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
 	"github.com/mikelangelo-project/capstan/util"
 
 	. "github.com/mikelangelo-project/capstan/testing"
@@ -336,6 +338,438 @@ func (s *suite) TestRecursiveRunYamlsWithOwnRunYaml(c *C) {
 	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
 }
 
+func (s *suite) TestRuntimeDefinedByRequiredPackage(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: fake.demo\ntitle: Fake Demo\nauthor: Demo Author\n",
+		"/meta/run.yaml": FixIndent(`
+			runtime: native
+			config_set:
+			  demoBoot1:
+			    bootcmd: echo Demo1
+		`),
+		"/meta/runtimes/greet.yaml": FixIndent(`
+			name: greet
+			description: Greet someone
+			base: fake.demo:demoBoot1
+			fields:
+			  - name: who
+			    type: string
+			    required: true
+			env:
+			  WHO: who
+		`),
+	}, c)
+	s.requireFakeDemoPkg(c)
+	s.setRunYaml(`
+		runtime: greet
+		config_set:
+		  ownBoot:
+		    who: World
+	`, c)
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expectedBoots := map[string]interface{}{
+		"demoBoot1": "echo Demo1",
+		"ownBoot":   checkBootCmd("echo Demo1", []string{"--env=WHO?=World"}),
+	}
+	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
+}
+
+func (s *suite) TestCollectPython3WithRequirements(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: python-3.7\ntitle: Python 3.7\nauthor: Demo Author\n",
+		"/meta/run.yaml": FixIndent(`
+			runtime: native
+			config_set:
+			  python:
+			    bootcmd: /python.so $PYTHON_ARGS $MAIN $ARGS
+		`),
+	}, c)
+	s.setRunYaml(`
+		runtime: python3
+		config_set:
+		  default:
+		    interpreter: python-3.7
+		    main: /file.txt
+	`, c)
+	PrepareFiles(s.packageDir, map[string]string{"/requirements.txt": "six>=1.0\n"})
+	wheelhouse := c.MkDir()
+	writeWheel(filepath.Join(wheelhouse, "six-1.11.0-py2.py3-none-any.whl"), map[string]string{
+		"six.py": DefaultText,
+	}, c)
+	os.Setenv("CAPSTAN_WHEELHOUSE", wheelhouse)
+	defer os.Unsetenv("CAPSTAN_WHEELHOUSE")
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expectedBoots := map[string]interface{}{
+		"python": "/python.so $PYTHON_ARGS $MAIN $ARGS",
+		"default": checkBootCmd("/python.so $PYTHON_ARGS $MAIN $ARGS", []string{
+			"--env=PYTHON_ARGS?=-O",
+			"--env=MAIN?=/file.txt",
+			"--env=PYTHONPATH?=/usr/lib/python3/site-packages",
+		}),
+	}
+	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
+	_, err = os.Stat(filepath.Join(s.packageDir, "mpm-pkg", "usr", "lib", "python3", "site-packages", "six.py"))
+	c.Check(err, IsNil)
+}
+
+func (s *suite) TestCollectProcesses(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  app:
+		    bootcmd: /app.so
+		  all:
+		    processes:
+		      - config_set: fake.demo:demoBoot1
+		        background: true
+		      - config_set: app
+		config_set_default: all
+	`, c)
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expectedBoots := map[string]interface{}{
+		"demoBoot1": "echo Demo1",
+		"demoBoot2": "echo Demo2",
+		"app":       "/app.so",
+		"all":       "echo Demo1 & /app.so",
+	}
+	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
+}
+
+func (s *suite) TestCollectRendersTemplates(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  dev:
+		    base: fake.demo:demoBoot1
+		    env:
+		      PORT: 8000
+		      DEBUG: true
+		  prod:
+		    bootcmd: /app.so
+		    env:
+		      PORT: 80
+		config_set_default: prod
+	`, c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/templates/app.properties": FixIndent(`
+			# {{.Package.Name}} by {{.Package.Author}}, config set {{.ConfigSet}}
+			port={{.Env.PORT}}
+			debug={{index .Env "DEBUG" | default "false"}}
+			requires={{join .Dependencies ","}}
+		`),
+		"/meta/templates/etc/nginx/nginx.conf": "listen {{.Env.PORT}};\n",
+		"/etc/nginx/nginx.conf":                DefaultText,
+	})
+
+	m := []struct {
+		comment            string
+		customBoot         string
+		expectedProperties string
+		expectedNginx      string
+	}{
+		{
+			"default config set",
+			"",
+			FixIndent(`
+				# package-name by package-author, config set prod
+				port=80
+				debug=false
+				requires=fake.demo,osv.bootstrap
+			`),
+			"listen 80;\n",
+		},
+		{
+			"selected config set",
+			"dev",
+			FixIndent(`
+				# package-name by package-author, config set dev
+				port=8000
+				debug=true
+				requires=fake.demo,osv.bootstrap
+			`),
+			"listen 8000;\n",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := CollectPackage(s.repo, s.packageDir, false, args.customBoot, false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		properties, _ := ioutil.ReadFile(filepath.Join(s.packageDir, "mpm-pkg", "app.properties"))
+		c.Check(string(properties), Equals, args.expectedProperties)
+		c.Check(filepath.Join(s.packageDir, "mpm-pkg", "etc", "nginx"), DirEquals, map[string]interface{}{
+			"nginx.conf": args.expectedNginx,
+		})
+	}
+}
+
+func (s *suite) TestCollectTemplateErrors(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	PrepareFiles(s.packageDir, map[string]string{
+		"/meta/templates/a.conf":     "{{.Env.PORT",
+		"/meta/templates/b/b.conf":   "{{.Unknown}}",
+		"/meta/templates/c.conf":     "valid",
+		"/meta/templates/d/e/f.conf": "{{.Env.MISSING}}",
+	})
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "(?s)failed to render templates:\n"+
+		"  meta/templates/a.conf: a.conf:1: unclosed action\n"+
+		"  meta/templates/b/b.conf: b.conf:1:2: executing \"b.conf\" at <.Unknown>: can't evaluate field Unknown .*\n"+
+		"  meta/templates/d/e/f.conf: f.conf:1:6: executing \"f.conf\" at <.Env.MISSING>: map has no entry for key \"MISSING\"")
+}
+
+func (s *suite) TestCollectPython3MissingMain(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: python-3.6\ntitle: Python 3.6\nauthor: Demo Author\n",
+		"/meta/run.yaml":     "runtime: native\nconfig_set:\n  python:\n    bootcmd: /python.so\n",
+	}, c)
+	s.setRunYaml(`
+		runtime: python3
+		config_set:
+		  default:
+		    main: /missing.py
+	`, c)
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "Validation failed for configuration set 'default': main script '/missing.py' does not exist in the package")
+}
+
+func (s *suite) TestCollectUnknownRuntimeVersion(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.importPkg(map[string]string{
+		"/meta/package.yaml": "name: node-6.11.0\ntitle: Node.js 6.11.0\nauthor: Demo Author\n",
+		"/meta/run.yaml":     "runtime: native\nconfig_set:\n  node:\n    bootcmd: /node.so\n",
+	}, c)
+	s.setRunYaml(`
+		runtime: node
+		config_set:
+		  default:
+		    version: 7.0.0
+		    main: /file.txt
+	`, c)
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "Validation failed for configuration set 'default': "+
+		"version '7.0.0' of runtime 'node' does not exist, available versions: 6.11.0")
+}
+
+func (s *suite) TestGetCmdWithEnvFile(c *C) {
+	// Prepare.
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  dev:
+		    bootcmd: /app.so --dev
+		  prod:
+		    bootcmd: /app.so
+		config_set_default: ${PROFILE:-dev}
+	`, c)
+	envFile := filepath.Join(c.MkDir(), "prod.env")
+	ioutil.WriteFile(envFile, []byte("PROFILE=prod\nPORT=80\n"), 0600)
+
+	m := []struct {
+		comment     string
+		bootOpts    BootOptions
+		expectedCmd string
+		expectedEnv []string
+	}{
+		{
+			"default",
+			BootOptions{PackageDir: s.packageDir},
+			"runscript /run/dev", []string{},
+		},
+		{
+			"env file",
+			BootOptions{PackageDir: s.packageDir, EnvFiles: []string{envFile}},
+			"runscript /run/prod", []string{"--env=PROFILE=prod", "--env=PORT=80"},
+		},
+		{
+			"env overrides env file",
+			BootOptions{PackageDir: s.packageDir, EnvFiles: []string{envFile}, EnvList: []string{"PROFILE=dev"}},
+			"runscript /run/dev", []string{"--env=PROFILE=dev", "--env=PORT=80"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		cmd, err := args.bootOpts.GetCmd()
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(cmd, BootCmdEquals, args.expectedCmd, args.expectedEnv)
+	}
+}
+
+func (s *suite) TestCollectInterpolatesRunYaml(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  default:
+		    bootcmd: /app.so --port ${CAPSTAN_TEST_PORT:-8000}
+		    env:
+		      NAME: ${CAPSTAN_TEST_NAME}
+	`, c)
+	os.Setenv("CAPSTAN_TEST_NAME", "demo")
+	defer os.Unsetenv("CAPSTAN_TEST_NAME")
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	expectedBoots := map[string]interface{}{
+		"default": checkBootCmd("/app.so --port 8000", []string{"--env=NAME?=demo"}),
+	}
+	c.Check(filepath.Join(s.packageDir, "mpm-pkg", "run"), DirEquals, expectedBoots)
+}
+
+func (s *suite) TestCollectUndefinedVariable(c *C) {
+	// Prepare.
+	s.importFakeOSvBootstrapPkg(c)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  default:
+		    bootcmd: /app.so ${CAPSTAN_TEST_UNDEFINED}
+	`, c)
+
+	// This is what we're testing here.
+	err := CollectPackage(s.repo, s.packageDir, false, "", false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "(?s)failed to interpolate meta/run.yaml:\n  config_set.default.bootcmd: variable 'CAPSTAN_TEST_UNDEFINED' is not defined.*")
+}
+
+func (s *suite) TestBootOptionsHealthCheck(c *C) {
+	// Prepare.
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  web:
+		    bootcmd: /web.so
+		    healthcheck:
+		      http: /health
+		      port: ${PORT:-8000}
+		  worker:
+		    bootcmd: /worker.so
+		config_set_default: web
+	`, c)
+
+	m := []struct {
+		comment  string
+		bootOpts BootOptions
+		expected *runtime.HealthCheck
+	}{
+		{"default config set", BootOptions{}, &runtime.HealthCheck{HTTP: "/health", Port: 8000}},
+		{"variables", BootOptions{EnvList: []string{"PORT=9000"}}, &runtime.HealthCheck{HTTP: "/health", Port: 9000}},
+		{"selected config set", BootOptions{Boot: "worker"}, nil},
+		{"command line", BootOptions{Cmd: "/web.so"}, nil},
+		{"unknown config set", BootOptions{Boot: "unknown"}, nil},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		args.bootOpts.PackageDir = s.packageDir
+
+		// This is what we're testing here.
+		healthCheck, err := args.bootOpts.HealthCheck()
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(healthCheck, DeepEquals, args.expected)
+	}
+}
+
+func (s *suite) TestRuntimeValidate(c *C) {
+	// Prepare.
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  own:
+		    base: fake.demo:demoBoot1
+		  missing:
+		    base: fake.demo:demoBoot3
+		  unknown:
+		    bootcmd: /app.so
+		    bootcdm: /app.so
+	`, c)
+
+	// This is what we're testing here.
+	err := RuntimeValidate(s.repo, s.packageDir, &BootOptions{})
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "meta/run.yaml is not valid, 2 problem\\(s\\) found")
+}
+
+func (s *suite) TestRuntimeValidateValid(c *C) {
+	// Prepare.
+	s.importFakeDemoPkg(c)
+	s.requireFakeDemoPkg(c)
+	s.setRunYaml(`
+		runtime: native
+		config_set:
+		  own:
+		    base: fake.demo:demoBoot1
+		  port:
+		    bootcmd: /app.so --port=${PORT:-8000}
+		config_set_default: ${PROFILE}
+	`, c)
+
+	// This is what we're testing here.
+	err := RuntimeValidate(s.repo, s.packageDir, &BootOptions{EnvList: []string{"PROFILE=port"}})
+
+	// Expectations.
+	c.Check(err, IsNil)
+}
+
 func (s *suite) TestRecursiveRunYamlsWithOwnRunYamlOverwrite(c *C) {
 	// Prepare.
 	s.importFakeOSvBootstrapPkg(c)
@@ -554,6 +988,28 @@ func (s *suite) TestRuntimeInheritance(c *C) {
 				"ownBoot":   checkBootCmd("echo Demo1", []string{"--env=HOST?=localhost", "--env=PORT?=8000"}),
 			},
 		},
+		{
+			"with own bootcmd",
+			`
+				runtime: native
+				config_set:
+				  ownBoot:
+				    base: "fake.demo:demoBoot1"
+				    bootcmd: echo Own
+			`,
+			`
+				runtime: native
+				config_set:
+				  demoBoot1:
+				    bootcmd: echo Demo1
+				    env:
+				      PORT: 1111
+			`,
+			map[string]interface{}{
+				"demoBoot1": "--env=PORT?=1111 echo Demo1",
+				"ownBoot":   "--env=PORT?=1111 echo Own",
+			},
+		},
 	}
 	for i, args := range m {
 		c.Logf("CASE #%d: %s", i, args.comment)
@@ -735,6 +1191,21 @@ func (s *suite) setRunYaml(runYamlText string, c *C) {
 	ioutil.WriteFile(filepath.Join(s.packageDir, "meta", "run.yaml"), []byte(FixIndent(runYamlText)), 0700)
 }
 
+// writeWheel creates a wheel (zip archive) with given files.
+func writeWheel(path string, files map[string]string, c *C) {
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		c.Assert(err, IsNil)
+		fw.Write([]byte(content))
+	}
+	c.Assert(w.Close(), IsNil)
+}
+
 // checkBootCmd prepares lambda function that can be passed to DirEquals.
 func checkBootCmd(bootCmd string, env []string) func(string) error {
 	return func(v string) error { return CheckBootCmd(v, bootCmd, env) }
@@ -0,0 +1,283 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// ProjectUp runs all instances of the project in background. Instances are
+// started after instances they depend on, waiting for those to become
+// healthy when they have a health check. Instances that are already running
+// are left as they are.
+func ProjectUp(repo *util.Repo, p *runtime.Project, platform string, verbose bool) error {
+	order, err := p.StartOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		id := p.InstanceName(name)
+		gate := p.HasDependents(name)
+
+		if instanceName, instancePlatform := util.SearchInstance(id); instanceName != "" &&
+			instanceStatus(instanceName, instancePlatform) == "Running" {
+			fmt.Printf("Instance %s is already running\n", id)
+			if err := waitRunningHealthy(instancePlatform, id, gate); err != nil {
+				return err
+			}
+			continue
+		}
+
+		config, err := projectRunConfig(repo, p, name, platform, verbose)
+		if err != nil {
+			return fmt.Errorf("instance %s: %s", id, err)
+		}
+		config.Detach = true
+		config.WaitHealthy = gate && config.HealthCheck != nil
+		if err := RunInstance(repo, config); err != nil {
+			return fmt.Errorf("failed to run instance %s: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// waitRunningHealthy waits for health check of the running instance to pass
+// if other instances wait for it.
+func waitRunningHealthy(platform, name string, gate bool) error {
+	if !gate {
+		return nil
+	}
+	h, err := LoadInstanceHealth(platform, name)
+	if err != nil || h == nil {
+		return err
+	}
+	fmt.Printf("Waiting for instance %s to become healthy (%s)\n", name, h.Check.String())
+	if err := h.WaitHealthy(nil); err != nil {
+		return fmt.Errorf("instance %s: %s", name, err)
+	}
+	return nil
+}
+
+// projectRunConfig returns how to run the project instance. Package of the
+// instance is composed into image named after the instance first.
+func projectRunConfig(repo *util.Repo, p *runtime.Project, name, platform string, verbose bool) (*runtime.RunConfig, error) {
+	i := p.Instances[name]
+	id := p.InstanceName(name)
+
+	bootOpts := BootOptions{
+		Cmd:  i.Run,
+		Boot: i.Boot,
+	}
+	for _, envFile := range i.EnvFile {
+		bootOpts.EnvFiles = append(bootOpts.EnvFiles, p.Path(envFile))
+	}
+	for k, v := range i.Env {
+		bootOpts.EnvList = append(bootOpts.EnvList, k+"="+v)
+	}
+	sort.Strings(bootOpts.EnvList)
+
+	// Image is either in the repository or a file relative to the project.
+	imageName := i.Image
+	if f, err := os.Stat(p.Path(i.Image)); i.Image != "" && err == nil && f.Mode().IsRegular() {
+		imageName = p.Path(i.Image)
+	}
+	if i.Package != "" {
+		bootOpts.PackageDir = p.Path(i.Package)
+		imageName = id
+		sz, _ := util.ParseMemSize("10G")
+		if err := ComposePackage(repo, sz, true, verbose, true, bootOpts.PackageDir, imageName, &bootOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	bootCmd, err := bootOpts.GetCmd()
+	if err != nil {
+		return nil, err
+	}
+	natRules, err := nat.Parse(i.Ports)
+	if err != nil {
+		return nil, err
+	}
+	healthCheck := i.HealthCheck
+	if healthCheck == nil {
+		if healthCheck, err = bootOpts.HealthCheck(); err != nil {
+			return nil, err
+		}
+	}
+
+	config := &runtime.RunConfig{
+		InstanceName: id,
+		ImageName:    imageName,
+		Hypervisor:   platform,
+		Verbose:      verbose,
+		Memory:       i.Memory,
+		Cpus:         i.Cpus,
+		Networking:   i.Networking,
+		Bridge:       i.Bridge,
+		NatRules:     natRules,
+		Cmd:          bootCmd,
+		HealthCheck:  healthCheck,
+	}
+	// Same defaults as for 'capstan run'.
+	if config.Memory == "" {
+		config.Memory = "1G"
+	}
+	if config.Cpus == 0 {
+		config.Cpus = 2
+	}
+	if config.Networking == "" {
+		config.Networking = "nat"
+	}
+	return config, nil
+}
+
+// ProjectDown stops and deletes all instances of the project, in reverse
+// order of starting them.
+func ProjectDown(p *runtime.Project) error {
+	order, err := p.StartOrder()
+	if err != nil {
+		return err
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		id := p.InstanceName(order[i])
+		if instanceName, _ := util.SearchInstance(id); instanceName == "" {
+			continue
+		}
+		if err := Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// projectInstances returns instances of the project that exist.
+func projectInstances(p *runtime.Project) ([]InstanceInfo, error) {
+	res := []InstanceInfo{}
+	order, err := p.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range order {
+		instanceName, platform := util.SearchInstance(p.InstanceName(name))
+		if instanceName == "" {
+			continue
+		}
+		info, err := instanceInfo(instanceName, platform)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *info)
+	}
+	return res, nil
+}
+
+// ProjectPs prints instances of the project in given format, either table
+// or json.
+func ProjectPs(p *runtime.Project, format string, out io.Writer) error {
+	instances, err := projectInstances(p)
+	if err != nil {
+		return err
+	}
+	return printInstances(out, instances, format)
+}
+
+// ProjectLogs prints console output of all instances of the project, each
+// line prefixed with name of the instance. When follow is set, output of all
+// instances is printed as it is written until they all stop.
+func ProjectLogs(p *runtime.Project, follow bool, since time.Time, out io.Writer) error {
+	instances, err := projectInstances(p)
+	if err != nil {
+		return err
+	}
+	width := 0
+	for _, i := range instances {
+		if len(i.Name) > width {
+			width = len(i.Name)
+		}
+	}
+
+	var lock sync.Mutex
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for n, i := range instances {
+		w := &prefixWriter{prefix: fmt.Sprintf("%-*s | ", width, i.Name), out: out, lock: &lock}
+		logs := func(n int, name string) {
+			errs[n] = Logs(name, follow, since, w)
+			w.Flush()
+		}
+		if !follow {
+			// Print output of one instance after another.
+			logs(n, i.Name)
+			continue
+		}
+		wg.Add(1)
+		go func(n int, name string) {
+			defer wg.Done()
+			logs(n, name)
+		}(n, i.Name)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixWriter writes whole lines with a prefix. Writers that share the same
+// lock do not interleave their lines.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	lock   *sync.Mutex
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes the last line even though it is not complete.
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeLine(append(w.buf, '\n'))
+	w.buf = nil
+	return err
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+	return err
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/fake"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/testing"
+	"github.com/mikelangelo-project/capstan/util"
+
+	. "gopkg.in/check.v1"
+)
+
+type projectSuite struct {
+	instancesSuite
+	supervisor func(platform, name string) (*exec.Cmd, error)
+	project    *runtime.Project
+}
+
+var _ = Suite(&projectSuite{})
+
+func (s *projectSuite) SetUpSuite(c *C) {
+	s.instancesSuite.SetUpSuite(c)
+	s.supervisor = supervisorCommand
+}
+
+func (s *projectSuite) TearDownSuite(c *C) {
+	s.instancesSuite.TearDownSuite(c)
+	supervisorCommand = s.supervisor
+}
+
+func (s *projectSuite) SetUpTest(c *C) {
+	s.instancesSuite.SetUpTest(c)
+
+	// Instances print their name, see TestSuperviseHelper.
+	supervisorCommand = func(platform, name string) (*exec.Cmd, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSuperviseHelper$", "--", name)
+		cmd.Env = append(os.Environ(),
+			"CAPSTAN_SUPERVISE_HELPER=1",
+			"CAPSTAN_SUPERVISE_COMMAND=echo "+name+" ready")
+		return cmd, nil
+	}
+
+	dir := c.MkDir()
+	writeOverlay(c, filepath.Join(dir, "app.qcow2"), "")
+	c.Assert(testing.PrepareFiles(dir, map[string]string{"app.env": "MODE=test\n"}), IsNil)
+	p, err := runtime.ParseProject([]byte(`
+name: shop
+instances:
+  api:
+    image: app.qcow2
+    env_file: [app.env]
+    ports: ["8000:8000"]
+    depends_on: [cache]
+  cache:
+    image: app.qcow2
+    memory: 256M
+    healthcheck:
+      log: cache ready
+`), dir)
+	c.Assert(err, IsNil)
+	s.project = p
+}
+
+// waitProject waits until all instances of the project that were run stop.
+func (s *projectSuite) waitProject(c *C) {
+	for _, name := range s.project.InstanceNames() {
+		if instanceName, _ := util.SearchInstance(s.project.InstanceName(name)); instanceName != "" {
+			_, err := Wait(instanceName)
+			c.Assert(err, IsNil)
+		}
+	}
+}
+
+func (s *projectSuite) TestProjectRunConfig(c *C) {
+	// This is what we're testing here.
+	config, err := projectRunConfig(s.repo, s.project, "api", fake.Name, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(config, DeepEquals, &runtime.RunConfig{
+		InstanceName: "shop-api",
+		ImageName:    s.project.Path("app.qcow2"),
+		Hypervisor:   fake.Name,
+		Memory:       "1G",
+		Cpus:         2,
+		Networking:   "nat",
+		NatRules:     []nat.Rule{{HostPort: nat.Port(8000), GuestPort: nat.Port(8000), Protocol: nat.TCP}},
+		Cmd:          "--env=MODE=test ",
+	})
+}
+
+func (s *projectSuite) TestProjectUpAndDown(c *C) {
+	// This is what we're testing here.
+	err := ProjectUp(s.repo, s.project, fake.Name, false)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	s.waitProject(c)
+
+	var out bytes.Buffer
+	c.Check(ProjectPs(s.project, "json", &out), IsNil)
+	var instances []InstanceInfo
+	c.Assert(json.Unmarshal(out.Bytes(), &instances), IsNil)
+	c.Assert(instances, HasLen, 2)
+	c.Check(instances[0].Name, Equals, "shop-cache")
+	c.Check(instances[0].Memory, Equals, int64(256))
+	c.Check(instances[1].Name, Equals, "shop-api")
+	c.Check(instances[1].Ports, DeepEquals, []string{"8000:8000"})
+
+	out.Reset()
+	c.Check(ProjectLogs(s.project, false, time.Time{}, &out), IsNil)
+	c.Check(out.String(), Equals, "shop-cache | shop-cache ready\nshop-api   | shop-api ready\n")
+
+	// This is what we're testing here.
+	err = ProjectDown(s.project)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(s.driver.Deleted, DeepEquals, []string{"shop-api", "shop-cache"})
+	out.Reset()
+	c.Check(ProjectPs(s.project, "table", &out), IsNil)
+	c.Check(out.String(), Matches, "Name +Platform .*\n")
+}
+
+func (s *projectSuite) TestProjectUpUnhealthy(c *C) {
+	s.project.Instances["cache"].HealthCheck.Log = "cache started"
+	s.project.Instances["cache"].HealthCheck.Timeout = "200ms"
+
+	// This is what we're testing here.
+	err := ProjectUp(s.repo, s.project, fake.Name, false)
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "failed to run instance shop-cache: instance stopped before it became healthy|failed to run instance shop-cache: instance is not healthy .*")
+	instanceName, _ := util.SearchInstance("shop-api")
+	c.Check(instanceName, Equals, "")
+	s.waitProject(c)
+}
+
+func (s *projectSuite) TestPrefixWriter(c *C) {
+	var out bytes.Buffer
+	var lock sync.Mutex
+	w := &prefixWriter{prefix: "api | ", out: &out, lock: &lock}
+
+	// This is what we're testing here.
+	fmt.Fprint(w, "first")
+	fmt.Fprint(w, " line\nsecond line\nlast")
+	w.Flush()
+
+	// Expectations.
+	c.Check(out.String(), Equals, "api | first line\napi | second line\napi | last\n")
+}
@@ -12,15 +12,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"github.com/mikelangelo-project/capstan/configdrive"
 	"github.com/mikelangelo-project/capstan/core"
-	"github.com/mikelangelo-project/capstan/hypervisor/gce"
-	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
-	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
-	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
+	"github.com/mikelangelo-project/capstan/hypervisor"
 	"github.com/mikelangelo-project/capstan/image"
 	"github.com/mikelangelo-project/capstan/runtime"
 	"github.com/mikelangelo-project/capstan/util"
@@ -28,60 +25,62 @@ import (
 
 func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 	var path string
-	var cmd *exec.Cmd
 
 	// Start an existing instance
 	if config.ImageName == "" && config.InstanceName != "" {
 		instanceName, instancePlatform := util.SearchInstance(config.InstanceName)
 		if instanceName != "" {
+			driver, err := hypervisor.Get(instancePlatform)
+			if err != nil {
+				return err
+			}
+			if err := checkCapabilities(driver, config); err != nil {
+				return err
+			}
+			// Devices are attached when the instance is created.
+			if len(config.Volumes) > 0 || len(config.Networks) > 0 || len(config.Mounts) > 0 {
+				return fmt.Errorf("--volume, --net and --mount can not be changed for existing instance %s, use 'capstan delete %s' to remove it first", instanceName, instanceName)
+			}
+
 			defer fmt.Println("")
 
-			// Do not set RawTerm for gce
-			if instancePlatform != "gce" {
-				util.RawTerm()
-				defer util.ResetTerm()
+			opts := &hypervisor.RunOptions{Cmd: config.Cmd}
+			if opts.ConfigDrive, err = createConfigDrive(config.ConfigDrive, instancePlatform, instanceName, config.MAC); err != nil {
+				return err
 			}
 
-			var err error
-			switch instancePlatform {
-			case "qemu":
-				c, err := qemu.LoadConfig(instanceName)
-				// Also pass the command line to the instance (note that this is not stored in the config)
-				c.Cmd = config.Cmd
+			printNote := func() {
+				fmt.Println()
+				fmt.Println("Running (already existing) instance:", instanceName)
+				fmt.Println("NOTE: instance parameters will NOT reflect arguments to 'capstan run' command!")
+				fmt.Printf("      (use 'capstan delete %s' to remove existing instance first)\n", instanceName)
+				fmt.Println()
+			}
 
+			if config.Detach {
+				exited, err := startSupervisor(instanceName, &instanceLaunch{Platform: instancePlatform, Options: opts})
 				if err != nil {
 					return err
 				}
-				cmd, err = qemu.LaunchVM(c)
-			case "vbox":
-				c, err := vbox.LoadConfig(instanceName)
-				if err != nil {
-					return err
-				}
-				cmd, err = vbox.LaunchVM(c)
-			case "vmw":
-				c, err := vmw.LoadConfig(instanceName)
-				if err != nil {
-					return err
-				}
-				cmd, err = vmw.LaunchVM(c)
-			case "gce":
-				c, err := gce.LoadConfig(instanceName)
-				if err != nil {
-					return err
-				}
-				cmd, err = gce.LaunchVM(c)
+				printNote()
+				return detachInstance(exited, instancePlatform, instanceName, config.WaitHealthy)
+			}
+
+			// Do not set RawTerm for remote instances
+			if !driver.Capabilities().Remote {
+				util.RawTerm()
+				defer util.ResetTerm()
 			}
 
+			cmd, err := driver.Start(instanceName, opts)
 			if err != nil {
 				return err
 			}
 			if cmd != nil {
-				fmt.Println()
-				fmt.Println("Running (already existing) instance:", instanceName)
-				fmt.Println("NOTE: instance parameters will NOT reflect arguments to 'capstan run' command!")
-				fmt.Printf("      (use 'capstan delete %s' to remove existing instance first)\n", instanceName)
-				fmt.Println()
+				// The record is informative only, failing to update it
+				// must not stop the instance.
+				recordInstancePID(instancePlatform, instanceName, cmd.Process.Pid)
+				printNote()
 				return cmd.Wait()
 			}
 			return nil
@@ -89,7 +88,7 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 			// The InstanceName is actually a ImageName
 			// so, cmd like "capstan run cloudius/osv" will work
 			config.ImageName = config.InstanceName
-			config.InstanceName = strings.Replace(config.InstanceName, "/", "-", -1)
+			config.InstanceName = strings.NewReplacer("/", "-", ":", "-").Replace(config.InstanceName)
 			return RunInstance(repo, config)
 		}
 	} else if config.ImageName != "" && config.InstanceName != "" {
@@ -198,111 +197,101 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 	if err != nil {
 		return err
 	}
+	driver, err := hypervisor.Get(config.Hypervisor)
+	if err != nil {
+		return err
+	}
+	if !driver.Capabilities().SupportsFormat(format) {
+		return fmt.Errorf("%s: image format of %s is not supported, unable to run it.", config.Hypervisor, path)
+	}
+	if err := checkCapabilities(driver, config); err != nil {
+		return err
+	}
+	volumes, err := ResolveVolumes(config.Volumes)
+	if err != nil {
+		return err
+	}
 	defer fmt.Println("")
 
 	id := config.InstanceName
 	fmt.Printf("Created instance: %s\n", id)
-	// Do not set RawTerm for gce
-	if config.Hypervisor != "gce" {
-		util.RawTerm()
-		defer util.ResetTerm()
-	}
 
-	switch config.Hypervisor {
-	case "qemu":
-		dir := filepath.Join(util.ConfigDir(), "instances/qemu", id)
-		bridge := config.Bridge
-		if bridge == "" {
-			bridge = "virbr0"
-		}
-		config := &qemu.VMConfig{
-			Name:        id,
-			Image:       path,
-			Verbose:     true,
-			Memory:      size,
-			Cpus:        config.Cpus,
-			Networking:  config.Networking,
-			Bridge:      bridge,
-			NatRules:    config.NatRules,
-			BackingFile: true,
-			InstanceDir: dir,
-			Monitor:     filepath.Join(dir, "osv.monitor"),
-			ConfigFile:  filepath.Join(dir, "osv.config"),
-			MAC:         config.MAC,
-			Cmd:         config.Cmd,
-			DisableKvm:  repo.DisableKvm,
-			Persist:     config.Persist,
+	// Images from the repository carry health check of the config set they
+	// boot with unless the boot command or config set is overridden.
+	if config.HealthCheck == nil && config.Cmd == "" && (config.ConfigDrive == nil || config.ConfigDrive.ConfigSet == "") &&
+		path == repo.ImagePath(config.Hypervisor, config.ImageName) {
+		if config.HealthCheck, err = loadImageHealthCheck(repo, config.ImageName); err != nil {
+			return err
 		}
+	}
 
-		cmd, err = qemu.LaunchVM(config)
-	case "vbox":
-		if format != image.VDI && format != image.VMDK {
-			return fmt.Errorf("%s: image format of %s is not supported, unable to run it.", config.Hypervisor, path)
+	// Store health check with the instance.
+	if config.HealthCheck != nil {
+		h, err := NewInstanceHealth(config.HealthCheck, config.Networking, config.NatRules, instanceConsoleFile(config.Hypervisor, id))
+		if err != nil && config.WaitHealthy {
+			return err
+		} else if err != nil {
+			fmt.Printf("WARN: health of the instance will not be checked: %s\n", err)
+		} else if err := StoreInstanceHealth(config.Hypervisor, id, h); err != nil {
+			return err
 		}
-		dir := filepath.Join(util.ConfigDir(), "instances/vbox", id)
-		bridge := config.Bridge
-		if bridge == "" {
-			bridge = "vboxnet0"
-		}
-		config := &vbox.VMConfig{
-			Name:       id,
-			Dir:        filepath.Join(util.ConfigDir(), "instances/vbox"),
-			Image:      path,
-			Memory:     size,
-			Cpus:       config.Cpus,
-			Networking: config.Networking,
-			Bridge:     bridge,
-			NatRules:   config.NatRules,
-			ConfigFile: filepath.Join(dir, "osv.config"),
-			MAC:        config.MAC,
-		}
-		cmd, err = vbox.LaunchVM(config)
-	case "gce":
-		if format != image.GCE_TARBALL && format != image.GCE_GS {
-			return fmt.Errorf("%s: image format of %s is not supported, unable to run it.", config.Hypervisor, path)
-		}
-		dir := filepath.Join(util.ConfigDir(), "instances/gce", id)
-		c := &gce.VMConfig{
-			Name:        id,
-			Image:       id,
-			Network:     "default",
-			MachineType: "n1-standard-1",
-			Zone:        "us-central1-a",
-			ConfigFile:  filepath.Join(dir, "osv.config"),
-			InstanceDir: dir,
-		}
-		if format == image.GCE_TARBALL {
-			c.CloudStoragePath = strings.TrimSuffix(config.GCEUploadDir, "/") + "/" + id + ".tar.gz"
-			c.Tarball = path
-		} else {
-			c.CloudStoragePath = path
-			c.Tarball = ""
-		}
-		cmd, err = gce.LaunchVM(c)
-	case "vmw":
-		if format != image.VMDK {
-			return fmt.Errorf("%s: image format of %s is not supported, unable to run it.", config.Hypervisor, path)
+	}
+
+	c := &hypervisor.Config{
+		RunOptions:   hypervisor.RunOptions{Cmd: config.Cmd},
+		Name:         id,
+		Image:        path,
+		Memory:       size,
+		Cpus:         config.Cpus,
+		Networking:   config.Networking,
+		Bridge:       config.Bridge,
+		NatRules:     config.NatRules,
+		MAC:          config.MAC,
+		DisableKvm:   repo.DisableKvm,
+		Persist:      config.Persist,
+		GCEUploadDir: config.GCEUploadDir,
+		Networks:     config.Networks,
+		Volumes:      volumes,
+		Mounts:       config.Mounts,
+	}
+	if c.ConfigDrive, err = createConfigDrive(config.ConfigDrive, config.Hypervisor, id, config.MAC); err != nil {
+		return err
+	}
+	record := newInstanceRecord(config.Hypervisor, config.ImageName, path, c)
+
+	if config.Detach {
+		// Instances running in background must be found to be stopped later.
+		c.Persist = true
+		// Supervisor adds process id of the hypervisor to the record.
+		if err := StoreInstanceRecord(record); err != nil {
+			return err
 		}
-		dir := filepath.Join(util.ConfigDir(), "instances/vmw", id)
-		config := &vmw.VMConfig{
-			Name:         id,
-			Dir:          dir,
-			Image:        filepath.Join(dir, "osv.vmdk"),
-			Memory:       size,
-			Cpus:         config.Cpus,
-			NatRules:     config.NatRules,
-			VMXFile:      filepath.Join(dir, "osv.vmx"),
-			InstanceDir:  dir,
-			OriginalVMDK: path,
-			ConfigFile:   filepath.Join(dir, "osv.config"),
+		exited, err := startSupervisor(id, &instanceLaunch{Platform: config.Hypervisor, Config: c})
+		if err != nil {
+			os.Remove(instanceRecordFile(config.Hypervisor, id))
+			return err
 		}
-		cmd, err = vmw.LaunchVM(config)
-	default:
-		err = fmt.Errorf("%s: is not a supported hypervisor", config.Hypervisor)
+		return detachInstance(exited, config.Hypervisor, id, config.WaitHealthy)
 	}
+
+	// Do not set RawTerm for remote instances
+	if !driver.Capabilities().Remote {
+		util.RawTerm()
+		defer util.ResetTerm()
+	}
+
+	cmd, err := driver.Launch(c)
 	if err != nil {
 		return err
 	}
+	if cmd != nil {
+		record.PID = cmd.Process.Pid
+	}
+	// The record is informative only, failing to store it must not stop the
+	// instance.
+	if err := StoreInstanceRecord(record); err != nil {
+		fmt.Printf("WARN: failed to store record of instance %s: %s\n", id, err)
+	}
 	if cmd != nil {
 		err = cmd.Wait()
 		if err != nil && strings.Contains(err.Error(), "failed to initialize KVM: Device or resource busy") {
@@ -315,6 +304,71 @@ func RunInstance(repo *util.Repo, config *runtime.RunConfig) error {
 	}
 }
 
+// checkCapabilities makes sure that the driver supports what is requested.
+func checkCapabilities(driver hypervisor.Driver, config *runtime.RunConfig) error {
+	caps := driver.Capabilities()
+	if config.Detach && !caps.Detach {
+		return fmt.Errorf("%s: running instance in background is not supported", driver.Name())
+	}
+	if config.ConfigDrive != nil && !caps.ConfigDrive {
+		return fmt.Errorf("%s: config drive is not supported", driver.Name())
+	}
+	if len(config.Networks) > 0 && !caps.Networks {
+		return fmt.Errorf("%s: more than one network device is not supported", driver.Name())
+	}
+	if len(config.Volumes) > 0 && !caps.Volumes {
+		return fmt.Errorf("%s: volumes are not supported", driver.Name())
+	}
+	if len(config.Mounts) > 0 && !caps.Mounts {
+		return fmt.Errorf("%s: mounting host directories is not supported", driver.Name())
+	}
+	return nil
+}
+
+// createConfigDrive creates contextualization disk of the instance in its
+// directory and returns its path. Empty path is returned if no drive is needed.
+func createConfigDrive(drive *configdrive.ConfigDrive, platform, name, mac string) (string, error) {
+	if drive == nil {
+		return "", nil
+	}
+
+	drive.InstanceID = name
+	drive.Hostname = name
+	drive.MAC = mac
+	path := filepath.Join(hypervisor.InstanceDir(platform, name), hypervisor.ConfigDriveFile)
+	if err := drive.Create(path); err != nil {
+		return "", err
+	}
+	fmt.Printf("Created config drive: %s\n", path)
+	return path, nil
+}
+
+// detachInstance leaves the instance running in background, optionally
+// after waiting for it to become healthy. Exited channel receives when the
+// instance stops.
+func detachInstance(exited <-chan error, platform, name string, waitHealthy bool) error {
+	fmt.Printf("Instance %s is running in background, use 'capstan logs %s' to see its console output\n",
+		name, name)
+	if !waitHealthy {
+		return nil
+	}
+
+	h, err := LoadInstanceHealth(platform, name)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return fmt.Errorf("instance %s has no health check, declare 'healthcheck' in meta/run.yaml", name)
+	}
+
+	fmt.Printf("Waiting for instance %s to become healthy (%s)\n", name, h.Check.String())
+	if err := h.WaitHealthy(exited); err != nil {
+		return err
+	}
+	fmt.Printf("Instance %s is healthy\n", name)
+	return nil
+}
+
 func buildJarImage(repo *util.Repo, config *runtime.RunConfig) (*runtime.RunConfig, error) {
 	jarPath := config.ImageName
 	imageName, jarName := parseJarNames(jarPath)
@@ -360,16 +414,11 @@ func deleteInstance(name string) error {
 	if instanceName == "" {
 		return nil
 	}
-	var err error
-	switch instancePlatform {
-	case "qemu":
-		err = qemu.DeleteVM(name)
-	case "vbox":
-		err = vbox.DeleteVM(name)
-	case "vmw":
-		err = vmw.DeleteVM(name)
-	case "gce":
-		err = gce.DeleteVM(name)
-	}
-	return err
+	removeInstanceFiles(instancePlatform, name)
+
+	driver, err := hypervisor.Get(instancePlatform)
+	if err != nil {
+		return err
+	}
+	return driver.Delete(name)
 }
@@ -0,0 +1,445 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/hypervisor/fake"
+	"github.com/mikelangelo-project/capstan/image"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+type runSuite struct {
+	instancesSuite
+	image string
+}
+
+var _ = Suite(&runSuite{})
+
+func (s *runSuite) SetUpTest(c *C) {
+	s.instancesSuite.SetUpTest(c)
+	s.image = filepath.Join(c.MkDir(), "demo.qcow2")
+	writeOverlay(c, s.image, "")
+}
+
+func (s *runSuite) runConfig() *runtime.RunConfig {
+	return &runtime.RunConfig{
+		InstanceName: "demo",
+		ImageName:    s.image,
+		Hypervisor:   fake.Name,
+		Memory:       "512M",
+		Cpus:         2,
+		Networking:   "nat",
+		Cmd:          "/app.so",
+	}
+}
+
+func (s *runSuite) TestRunNewInstance(c *C) {
+	// This is what we're testing here.
+	err := RunInstance(s.repo, s.runConfig())
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Assert(s.driver.Launched, HasLen, 1)
+	launched := s.driver.Launched[0]
+	c.Check(launched.Name, Equals, "demo")
+	c.Check(launched.Image, Equals, s.image)
+	c.Check(launched.Memory, Equals, int64(512))
+	c.Check(launched.Cpus, Equals, 2)
+	c.Check(launched.Cmd, Equals, "/app.so")
+	c.Check(launched.ConfigDrive, Equals, "")
+}
+
+func (s *runSuite) TestRunExistingInstance(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+	config := s.runConfig()
+	config.ImageName = ""
+	config.Cmd = "/other.so"
+
+	// This is what we're testing here.
+	err := RunInstance(s.repo, config)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(s.driver.Launched, HasLen, 1)
+	c.Check(s.driver.Started, DeepEquals, map[string]hypervisor.RunOptions{
+		"demo": {Cmd: "/other.so"},
+	})
+}
+
+func (s *runSuite) TestRunExistingInstanceWithDevices(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+	m := []struct {
+		comment  string
+		volumes  []string
+		networks []hypervisor.Network
+		mounts   []hypervisor.Mount
+	}{
+		{"volume", []string{"pgdata:/data"}, nil, nil},
+		{"network", nil, []hypervisor.Network{{Mode: "bridge", Bridge: "br0"}}, nil},
+		{"mount", nil, nil, []hypervisor.Mount{{Source: "/src", Target: "/app"}}},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		config := s.runConfig()
+		config.ImageName = ""
+		config.Volumes = args.volumes
+		config.Networks = args.networks
+		config.Mounts = args.mounts
+
+		// This is what we're testing here.
+		err := RunInstance(s.repo, config)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, "--volume, --net and --mount can not be changed for existing instance demo, .*")
+		c.Check(s.driver.Started, HasLen, 0)
+	}
+}
+
+func (s *runSuite) TestRunReplacesInstance(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+
+	// This is what we're testing here.
+	err := RunInstance(s.repo, s.runConfig())
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(s.driver.Launched, HasLen, 2)
+	c.Check(s.driver.Deleted, DeepEquals, []string{"demo"})
+}
+
+func (s *runSuite) TestRunUnsupported(c *C) {
+	m := []struct {
+		comment     string
+		caps        hypervisor.Capabilities
+		prepare     func(config *runtime.RunConfig)
+		expectedErr string
+	}{
+		{
+			"detach",
+			hypervisor.Capabilities{},
+			func(config *runtime.RunConfig) {},
+			"fake: running instance in background is not supported",
+		},
+		{
+			"image format",
+			hypervisor.Capabilities{Detach: true, Formats: []image.ImageFormat{image.VDI}},
+			func(config *runtime.RunConfig) {},
+			"fake: image format of .*demo.qcow2 is not supported, unable to run it.",
+		},
+		{
+			"networks",
+			hypervisor.Capabilities{Detach: true},
+			func(config *runtime.RunConfig) { config.Networks = []hypervisor.Network{{Mode: "nat"}} },
+			"fake: more than one network device is not supported",
+		},
+		{
+			"volumes",
+			hypervisor.Capabilities{Detach: true},
+			func(config *runtime.RunConfig) { config.Volumes = []string{"data:1G"} },
+			"fake: volumes are not supported",
+		},
+		{
+			"mounts",
+			hypervisor.Capabilities{Detach: true},
+			func(config *runtime.RunConfig) { config.Mounts = []hypervisor.Mount{{Source: "/src", Target: "/app"}} },
+			"fake: mounting host directories is not supported",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		s.driver.Caps = args.caps
+		config := s.runConfig()
+		config.Detach = true
+		args.prepare(config)
+
+		// This is what we're testing here.
+		err := RunInstance(s.repo, config)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+		c.Check(s.driver.Launched, HasLen, 0)
+	}
+}
+
+func (s *runSuite) TestStopAndDelete(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+	c.Check(instanceStatus("demo", fake.Name), Equals, "Running")
+
+	// This is what we're testing here.
+	c.Check(Stop("demo"), IsNil)
+	c.Check(instanceStatus("demo", fake.Name), Equals, "Stopped")
+	c.Check(Delete("demo"), IsNil)
+
+	// Expectations.
+	c.Check(s.driver.Stopped, DeepEquals, []string{"demo", "demo"})
+	c.Check(s.driver.Deleted, DeepEquals, []string{"demo"})
+	name, _ := util.SearchInstance("demo")
+	c.Check(name, Equals, "")
+}
+
+func (s *runSuite) TestRunRecordsInstance(c *C) {
+	config := s.runConfig()
+	config.NatRules = []nat.Rule{{HostPort: nat.Port(8000), GuestPort: nat.Port(80), Protocol: nat.TCP}}
+	config.Mounts = []hypervisor.Mount{{Source: "/src", Target: "/app"}}
+
+	// This is what we're testing here.
+	err := RunInstance(s.repo, config)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	r, err := LoadInstanceRecord(fake.Name, "demo")
+	c.Assert(err, IsNil)
+	c.Check(r.Name, Equals, "demo")
+	c.Check(r.Platform, Equals, fake.Name)
+	c.Check(r.Image, Equals, s.image)
+	c.Check(r.Digest, Matches, "sha256:[0-9a-f]{64}")
+	c.Check(r.Created.IsZero(), Equals, false)
+	c.Check(r.Cmd, Equals, "/app.so")
+	c.Check(r.Memory, Equals, int64(512))
+	c.Check(r.Cpus, Equals, 2)
+	c.Check(r.Networking, Equals, "nat")
+	c.Check(r.Ports, DeepEquals, []string{"8000:80"})
+	c.Check(r.Mounts, DeepEquals, []string{"/src:/app"})
+}
+
+func (s *runSuite) TestRunFailedLaunchIsNotRecorded(c *C) {
+	// Prepare
+	s.driver.Err = fmt.Errorf("no hypervisor")
+
+	// This is what we're testing here.
+	err := RunInstance(s.repo, s.runConfig())
+
+	// Expectations.
+	c.Assert(err, ErrorMatches, "no hypervisor")
+	_, err = os.Stat(instanceRecordFile(fake.Name, "demo"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *runSuite) TestRunImageHealthCheck(c *C) {
+	// Prepare
+	path := s.repo.ImagePath(fake.Name, "demo/app")
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0775), IsNil)
+	writeOverlay(c, path, "")
+	check := &runtime.HealthCheck{TCP: 8000}
+	c.Assert(storeImageHealthCheck(s.repo, "demo/app", check), IsNil)
+
+	config := s.runConfig()
+	config.ImageName = "demo/app"
+	config.Cmd = ""
+	config.NatRules = []nat.Rule{{HostPort: nat.Port(18000), GuestPort: nat.Port(8000), Protocol: nat.TCP}}
+
+	// This is what we're testing here.
+	err := RunInstance(s.repo, config)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	h, err := LoadInstanceHealth(fake.Name, "demo")
+	c.Assert(err, IsNil)
+	c.Assert(h, NotNil)
+	c.Check(h.Check, DeepEquals, *check)
+	c.Check(h.Address, Equals, "localhost:18000")
+}
+
+func (s *runSuite) TestRunImageHealthCheckOverridden(c *C) {
+	// Prepare
+	path := s.repo.ImagePath(fake.Name, "demo/app")
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0775), IsNil)
+	writeOverlay(c, path, "")
+	c.Assert(storeImageHealthCheck(s.repo, "demo/app", &runtime.HealthCheck{TCP: 8000}), IsNil)
+
+	config := s.runConfig()
+	config.ImageName = "demo/app"
+
+	// This is what we're testing here.
+	err := RunInstance(s.repo, config)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	h, err := LoadInstanceHealth(fake.Name, "demo")
+	c.Assert(err, IsNil)
+	c.Check(h, IsNil)
+}
+
+func (s *runSuite) TestListInstances(c *C) {
+	for _, name := range []string{"first", "second"} {
+		config := s.runConfig()
+		config.InstanceName = name
+		c.Assert(RunInstance(s.repo, config), IsNil)
+	}
+	c.Assert(Stop("second"), IsNil)
+
+	m := []struct {
+		status   string
+		expected []string
+	}{
+		{"", []string{"first", "second"}},
+		{"running", []string{"first"}},
+		{"Stopped", []string{"second"}},
+		{"paused", []string{}},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.status)
+
+		// This is what we're testing here.
+		instances, err := ListInstances(args.status)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		names := []string{}
+		for _, i := range instances {
+			names = append(names, i.Name)
+		}
+		c.Check(names, DeepEquals, args.expected)
+	}
+}
+
+func (s *runSuite) TestPrintInstances(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+	instances, err := ListInstances("")
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	var table, js bytes.Buffer
+	tableErr := printInstances(&table, instances, "table")
+	jsonErr := printInstances(&js, instances, "json")
+	yamlErr := printInstances(&bytes.Buffer{}, instances, "yaml")
+
+	// Expectations.
+	c.Check(tableErr, IsNil)
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Check(lines[1], Matches, "demo +fake +Running +"+s.image+" .*")
+
+	c.Check(jsonErr, IsNil)
+	var parsed []map[string]interface{}
+	c.Assert(json.Unmarshal(js.Bytes(), &parsed), IsNil)
+	c.Assert(parsed, HasLen, 1)
+	c.Check(parsed[0]["name"], Equals, "demo")
+	c.Check(parsed[0]["image"], Equals, s.image)
+	c.Check(parsed[0]["status"], Equals, "Running")
+	c.Check(parsed[0]["memory"], Equals, float64(512))
+
+	c.Check(yamlErr, ErrorMatches, "unsupported format 'yaml', use table or json")
+}
+
+func (s *runSuite) TestSnapshots(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+
+	// This is what we're testing here.
+	c.Check(CreateSnapshot("demo", "running"), IsNil)
+	c.Check(Stop("demo"), IsNil)
+	c.Check(CreateSnapshot("demo", "stopped"), IsNil)
+	c.Check(RestoreSnapshot("demo", "running"), IsNil)
+	c.Check(DeleteSnapshot("demo", "stopped"), IsNil)
+	var out bytes.Buffer
+	c.Check(ListSnapshots("demo", &out), IsNil)
+
+	// Expectations.
+	c.Check(s.driver.Restored, DeepEquals, map[string]string{"demo": "running"})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Check(lines[1], Matches, "running +disk\\+memory +1\\.0KB +[0-9-]+ [0-9:]+")
+}
+
+func (s *runSuite) TestSnapshotFails(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+
+	c.Check(CreateSnapshot("demo", "before upgrade"), ErrorMatches, "invalid snapshot name 'before upgrade', .*")
+	c.Check(RestoreSnapshot("demo", "x; quit"), ErrorMatches, "invalid snapshot name 'x; quit', .*")
+	c.Check(DeleteSnapshot("demo", "-all"), ErrorMatches, "invalid snapshot name '-all', .*")
+	c.Check(CreateSnapshot("missing", "first"), ErrorMatches, "instance missing not found")
+	c.Check(RestoreSnapshot("demo", "missing"), ErrorMatches, "snapshot missing does not exist")
+}
+
+func (s *runSuite) TestCommit(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+	c.Assert(Stop("demo"), IsNil)
+	var cmdLines []string
+	setCmdLine = func(path, cmdLine string) error {
+		cmdLines = append(cmdLines, cmdLine)
+		return nil
+	}
+	defer func() { setCmdLine = util.SetCmdLine }()
+
+	// This is what we're testing here.
+	err := CommitInstance(s.repo, "demo", "warm/demo:v2", "/app.so --warm")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	path := s.repo.ImagePath(fake.Name, "warm/demo:v2")
+	c.Check(s.driver.Exported, DeepEquals, map[string]string{"demo": path})
+	c.Check(cmdLines, DeepEquals, []string{"/app.so --warm"})
+
+	data, err := ioutil.ReadFile(filepath.Join(s.repo.ImageDir("warm/demo:v2"), "index.yaml"))
+	c.Assert(err, IsNil)
+	var info util.ImageInfo
+	c.Assert(yaml.Unmarshal(data, &info), IsNil)
+	c.Check(info.Version, Equals, "v2")
+	c.Check(info.Instance, Equals, "demo")
+	c.Check(info.BaseImage, Equals, s.image)
+	c.Check(info.BaseDigest, Matches, "sha256:[0-9a-f]{64}")
+}
+
+func (s *runSuite) TestCommitFails(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+
+	m := []struct {
+		comment     string
+		instance    string
+		image       string
+		expectedErr string
+	}{
+		{"running", "demo", "demo", "instance demo is running, stop it before committing"},
+		{"missing", "missing", "demo", "instance missing not found"},
+		{"invalid", "demo", "../demo", "../demo: invalid image name"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := CommitInstance(s.repo, args.instance, args.image, "")
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+	}
+
+	c.Assert(Stop("demo"), IsNil)
+	c.Assert(CommitInstance(s.repo, "demo", "demo", ""), IsNil)
+	c.Check(CommitInstance(s.repo, "demo", "demo", ""), ErrorMatches, "image demo already exists, .*")
+}
+
+func (s *runSuite) TestCommitRemovesPartialImage(c *C) {
+	c.Assert(RunInstance(s.repo, s.runConfig()), IsNil)
+	c.Assert(Stop("demo"), IsNil)
+	setCmdLine = func(path, cmdLine string) error {
+		return fmt.Errorf("qemu-nbd not found")
+	}
+	defer func() { setCmdLine = util.SetCmdLine }()
+
+	// This is what we're testing here.
+	err := CommitInstance(s.repo, "demo", "warm/demo", "/app.so --warm")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "failed to set boot command of image warm/demo: qemu-nbd not found")
+	_, err = os.Stat(s.repo.ImageDir("warm/demo"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -9,17 +9,23 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/mikelangelo-project/capstan/runtime"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
 )
 
-func RuntimePreview(runtimeName string, plain bool) error {
+func RuntimePreview(repo *util.Repo, runtimeName string, plain bool) error {
 	// Resolve runtime
-	rt, err := runtime.PickRuntime(runtime.RuntimeType(runtimeName))
+	rt, err := pickRuntime(runtimeName)
 	if err != nil {
 		return err
 	}
@@ -35,6 +41,17 @@ func RuntimePreview(runtimeName string, plain bool) error {
 	// Actually print.
 	fmt.Print(res)
 
+	// List versions that can be set with 'version' field.
+	if _, ok := rt.(runtime.VersionedRuntime); ok {
+		local, remote, err := runtimeVersions(repo, rt)
+		fmt.Printf("Versions available locally: %s\n", formatVersions(local))
+		if err != nil {
+			fmt.Printf("Versions available remotely: unknown (%s)\n", err)
+		} else {
+			fmt.Printf("Versions available remotely: %s\n", formatVersions(remote))
+		}
+	}
+
 	fmt.Println("Use 'capstan runtime init' to persist this template into $CWD/meta/run.yaml")
 
 	return nil
@@ -42,7 +59,7 @@ func RuntimePreview(runtimeName string, plain bool) error {
 
 func RuntimeInit(runtimeName string, plain bool, force bool) error {
 	// Resolve runtime
-	rt, err := runtime.PickRuntime(runtime.RuntimeType(runtimeName))
+	rt, err := pickRuntime(runtimeName)
 	if err != nil {
 		return err
 	}
@@ -75,14 +92,191 @@ func RuntimeInit(runtimeName string, plain bool, force bool) error {
 }
 
 func RuntimeList() error {
+	if err := loadPackageRuntimes(); err != nil {
+		return err
+	}
+
 	fmt.Printf("%-20s%-50s%-20s\n", "RUNTIME", "DESCRIPTION", "DEPENDENCIES")
-	for _, runtimeType := range runtime.SupportedRuntimes {
+	runtimeTypes := append(append([]runtime.RuntimeType{}, runtime.SupportedRuntimes...), runtime.DeclaredRuntimes()...)
+	for _, runtimeType := range runtimeTypes {
 		rt, _ := runtime.PickRuntime(runtimeType)
 		fmt.Printf("%-20s%-50s%-20s\n", string(runtimeType), rt.GetRuntimeDescription(), rt.GetDependencies())
 	}
 	return nil
 }
 
+// pickRuntime resolves runtime by name, taking into account runtimes
+// defined by the package in current directory.
+func pickRuntime(runtimeName string) (runtime.Runtime, error) {
+	if err := loadPackageRuntimes(); err != nil {
+		return nil, err
+	}
+	return runtime.PickRuntime(runtime.RuntimeType(runtimeName))
+}
+
+// RuntimeValidate checks meta/run.yaml of the package against schema of its
+// runtime and prints all problems with their positions.
+func RuntimeValidate(repo *util.Repo, packageDir string, bootOpts *BootOptions) error {
+	runYamlPath := filepath.Join(packageDir, "meta", "run.yaml")
+
+	// Runtimes may be defined by the package itself or by required packages.
+	if err := runtime.LoadRuntimeDefinitions(filepath.Join(packageDir, "meta", "runtimes")); err != nil {
+		return err
+	}
+	pkg, pkgErr := core.ParsePackageManifest(filepath.Join(packageDir, "meta", "package.yaml"))
+	if pkgErr == nil {
+		if err := loadRequiredRuntimes(repo, pkg.Require); err != nil {
+			return err
+		}
+	}
+
+	vars, err := bootOpts.Variables()
+	if err != nil {
+		return err
+	}
+	data, err := readRunYaml(packageDir, vars)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("%s does not exist", runYamlPath)
+	}
+	// Problems are reported at their positions in the file as it is written.
+	source, err := ioutil.ReadFile(runYamlPath)
+	if err != nil {
+		return err
+	}
+
+	lookup := func(pkgName string) (*runtime.CmdConfig, error) {
+		if pkgErr == nil && pkgName == pkg.Name {
+			return runtime.ParsePackageRunManifestData(data)
+		}
+		if !repo.PackageExists(pkgName) {
+			return nil, fmt.Errorf("package '%s' is not in the local repository", pkgName)
+		}
+		return packageRunManifest(repo, pkgName)
+	}
+
+	problems := runtime.ValidateInterpolatedRunManifest(source, data, lookup)
+	for _, problem := range problems {
+		if problem.Line > 0 {
+			fmt.Printf("meta/run.yaml:%d:%d: %s\n", problem.Line, problem.Column, problem.Message)
+		} else {
+			fmt.Printf("meta/run.yaml: %s\n", problem.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("meta/run.yaml is not valid, %d problem(s) found", len(problems))
+	}
+
+	fmt.Println("meta/run.yaml is valid")
+	return nil
+}
+
+// RuntimeJSONSchema prints JSON Schema of meta/run.yaml. Schema is limited
+// to the given runtime or to the runtime used in meta/run.yaml of current
+// package. If neither is known, schema covers all runtimes.
+func RuntimeJSONSchema(runtimeName string) error {
+	if err := loadPackageRuntimes(); err != nil {
+		return err
+	}
+
+	if runtimeName == "" {
+		if data, err := ioutil.ReadFile(filepath.Join("meta", "run.yaml")); err == nil {
+			if cmdConf, err := runtime.ParsePackageRunManifestData(data); err == nil {
+				runtimeName = string(cmdConf.RuntimeType)
+			}
+		}
+	}
+
+	var runtimes []runtime.Runtime
+	if runtimeName != "" {
+		rt, err := runtime.PickRuntime(runtime.RuntimeType(runtimeName))
+		if err != nil {
+			return err
+		}
+		runtimes = append(runtimes, rt)
+	} else {
+		runtimeTypes := append(append([]runtime.RuntimeType{}, runtime.SupportedRuntimes...), runtime.Python)
+		for _, runtimeType := range append(runtimeTypes, runtime.DeclaredRuntimes()...) {
+			rt, _ := runtime.PickRuntime(runtimeType)
+			runtimes = append(runtimes, rt)
+		}
+	}
+
+	data, err := json.MarshalIndent(runtime.RunManifestJSONSchema(runtimes), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// runtimeVersions returns versions of the runtime that are provided by
+// packages in the local and remote repository.
+func runtimeVersions(repo *util.Repo, rt runtime.Runtime) ([]string, []string, error) {
+	local := runtime.RuntimeVersions(rt, repo.ListPackageNames())
+
+	remotePackages, err := util.ListPackageNamesRemote(repo.URL)
+	if err != nil {
+		return local, nil, err
+	}
+	return local, runtime.RuntimeVersions(rt, remotePackages), nil
+}
+
+// validateRuntimeVersions makes sure that packages providing versions
+// selected in config sets exist. Remote repository is only consulted when
+// missing packages are about to be pulled.
+func validateRuntimeVersions(repo *util.Repo, cmdConf *runtime.CmdConfig, pullMissing bool) error {
+	var confNames []string
+	for confName := range cmdConf.ConfigSets {
+		confNames = append(confNames, confName)
+	}
+	sort.Strings(confNames)
+
+	for _, confName := range confNames {
+		rt := cmdConf.ConfigSets[confName]
+		versioned, ok := rt.(runtime.VersionedRuntime)
+		if !ok {
+			continue
+		}
+
+		version := versioned.GetVersion()
+		pkgName := versioned.VersionPackage(version)
+		if repo.PackageExists(pkgName) {
+			continue
+		}
+		if pullMissing {
+			if exists, err := util.IsRemotePackage(repo.URL, pkgName); err == nil && exists {
+				continue
+			}
+		}
+
+		available := runtime.RuntimeVersions(rt, repo.ListPackageNames())
+		if pullMissing {
+			if remotePackages, err := util.ListPackageNamesRemote(repo.URL); err == nil {
+				available = runtime.RuntimeVersions(rt, append(repo.ListPackageNames(), remotePackages...))
+			}
+		}
+		return fmt.Errorf("Validation failed for configuration set '%s': version '%s' of runtime '%s' does not exist, available versions: %s",
+			confName, version, rt.GetRuntimeName(), formatVersions(available))
+	}
+	return nil
+}
+
+func formatVersions(versions []string) string {
+	if len(versions) == 0 {
+		return "none"
+	}
+	return strings.Join(versions, ", ")
+}
+
+// loadPackageRuntimes loads runtime definitions from meta/runtimes of the
+// package in current directory.
+func loadPackageRuntimes() error {
+	return runtime.LoadRuntimeDefinitions(filepath.Join("meta", "runtimes"))
+}
+
 func removeComments(s string) string {
 	// Remove all comments.
 	re := regexp.MustCompile("(?m)^ *" + "#" + ".*$[\r\n]+")
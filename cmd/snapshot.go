@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// snapshotNamePattern restricts snapshot names to what can be passed to
+// QEMU monitor commands as is.
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateSnapshotName returns error if snapshot name can not be passed to
+// the hypervisor.
+func validateSnapshotName(snapshot string) error {
+	if !snapshotNamePattern.MatchString(snapshot) {
+		return fmt.Errorf("invalid snapshot name '%s', use letters, digits, '.', '_' and '-'", snapshot)
+	}
+	return nil
+}
+
+// instanceSnapshotter returns name of the instance and driver that can
+// snapshot it.
+func instanceSnapshotter(name string) (string, hypervisor.Snapshotter, error) {
+	instanceName, platform := util.SearchInstance(name)
+	if instanceName == "" {
+		return "", nil, fmt.Errorf("instance %s not found", name)
+	}
+	driver, err := hypervisor.Get(platform)
+	if err != nil {
+		return "", nil, err
+	}
+	snapshotter, ok := driver.(hypervisor.Snapshotter)
+	if !ok {
+		return "", nil, fmt.Errorf("%s: snapshots of instances are not supported", platform)
+	}
+	return instanceName, snapshotter, nil
+}
+
+// CreateSnapshot saves state of the instance under given name. Snapshot of
+// a stopped instance contains its disk, snapshot of a running one contains
+// its memory as well. When name is empty, one is generated from current time.
+func CreateSnapshot(instance, snapshot string) error {
+	if snapshot == "" {
+		snapshot = time.Now().Format("20060102-150405")
+	}
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	name, snapshotter, err := instanceSnapshotter(instance)
+	if err != nil {
+		return err
+	}
+	if err := snapshotter.CreateSnapshot(name, snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("Created snapshot %s of instance %s\n", snapshot, name)
+	return nil
+}
+
+// ListSnapshots prints snapshots of the instance.
+func ListSnapshots(instance string, out io.Writer) error {
+	name, snapshotter, err := instanceSnapshotter(instance)
+	if err != nil {
+		return err
+	}
+	snapshots, err := snapshotter.Snapshots(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%-30s %-15s %-10s %s\n", "Name", "Contents", "Memory", "Created")
+	for _, s := range snapshots {
+		contents, memory := "disk", "-"
+		if s.MemorySize > 0 {
+			contents, memory = "disk+memory", util.FormatSize(s.MemorySize)
+		}
+		fmt.Fprintf(out, "%-30s %-15s %-10s %s\n", s.Name, contents, memory, s.Created.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// RestoreSnapshot returns the instance to the state saved in the snapshot.
+func RestoreSnapshot(instance, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	name, snapshotter, err := instanceSnapshotter(instance)
+	if err != nil {
+		return err
+	}
+	if err := snapshotter.RestoreSnapshot(name, snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("Restored instance %s to snapshot %s\n", name, snapshot)
+	return nil
+}
+
+// DeleteSnapshot deletes the snapshot of the instance.
+func DeleteSnapshot(instance, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	name, snapshotter, err := instanceSnapshotter(instance)
+	if err != nil {
+		return err
+	}
+	if err := snapshotter.DeleteSnapshot(name, snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted snapshot %s of instance %s\n", snapshot, name)
+	return nil
+}
@@ -67,6 +67,7 @@ func OpenStackPush(c *cli.Context) error {
 		Cmd:        c.String("run"),
 		Boot:       c.String("boot"),
 		EnvList:    c.StringSlice("env"),
+		EnvFiles:   c.StringSlice("env-file"),
 		PackageDir: packageDir,
 	}
 
@@ -111,6 +112,25 @@ func OpenStackRun(c *cli.Context) error {
 		name = fmt.Sprintf("instance-of-%s", imageName)
 	}
 
+	// User-data is passed to instances on config drive that OpenStack creates.
+	var userData []byte
+	if c.Bool("config-drive") || len(c.StringSlice("config-drive-file")) > 0 {
+		bootOpts := BootOptions{
+			Boot:     c.String("boot"),
+			EnvList:  c.StringSlice("env"),
+			EnvFiles: c.StringSlice("env-file"),
+		}
+		drive, err := bootOpts.ConfigDrive(c.StringSlice("config-drive-file"))
+		if err != nil {
+			return err
+		}
+		if userData, err = drive.UserData(); err != nil {
+			return err
+		}
+	} else if c.String("boot") != "" || len(c.StringSlice("env")) > 0 || len(c.StringSlice("env-file")) > 0 {
+		return fmt.Errorf("--boot, --env and --env-file require --config-drive")
+	}
+
 	// Authenticate against OpenStack Identity
 	credentials, err := openstack.ObtainCredentials(c, verbose)
 	if err != nil {
@@ -145,7 +165,7 @@ func OpenStackRun(c *cli.Context) error {
 
 	// Launch instances.
 	fmt.Printf("Launching %d instances from image '%s'...\n", count, imageName)
-	err = openstack.LaunchInstances(clientNova, name, imageName, flavor.Name, count, verbose)
+	err = openstack.LaunchInstances(clientNova, name, imageName, flavor.Name, count, userData, verbose)
 	if err != nil {
 		return err
 	}
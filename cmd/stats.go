@@ -0,0 +1,335 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// clockTicks is number of clock ticks per second that CPU times in /proc
+// are measured in (USER_HZ).
+const clockTicks = 100
+
+var (
+	// procRoot and sysRoot are where proc and sys filesystems are mounted.
+	procRoot = "/proc"
+	sysRoot  = "/sys"
+
+	// statsInterval is time between two samples of resource usage.
+	statsInterval = time.Second
+)
+
+// InstanceStats is resource usage of a running instance. CPU usage is
+// measured over the last sampling interval, the other values are totals.
+type InstanceStats struct {
+	Name       string  `json:"name"`
+	Platform   string  `json:"platform"`
+	PID        int     `json:"pid"`
+	CPUPercent float64 `json:"cpu_percent"`
+	// MemoryUsage is resident memory of the hypervisor process read from
+	// /proc, MemoryLimit is memory that the instance was created with.
+	MemoryUsage     int64         `json:"memory_usage"`
+	MemoryLimit     int64         `json:"memory_limit"`
+	BlockReadBytes  int64         `json:"block_read_bytes"`
+	BlockWriteBytes int64         `json:"block_write_bytes"`
+	Network         *NetworkStats `json:"network,omitempty"`
+}
+
+// NetworkStats are network counters of the instance from the guest point of
+// view. They are only known for instances with tap based networking.
+type NetworkStats struct {
+	RxBytes int64 `json:"rx_bytes"`
+	TxBytes int64 `json:"tx_bytes"`
+}
+
+// processSample is resource usage of a process at a point in time.
+type processSample struct {
+	time     time.Time
+	cpuTicks int64
+	rss      int64
+	network  *NetworkStats
+}
+
+// statsTarget is a running instance that resource usage is sampled for.
+type statsTarget struct {
+	record   *InstanceRecord
+	reporter hypervisor.StatsReporter
+	last     *processSample
+	lastHV   *hypervisor.Stats
+}
+
+// Stats prints resource usage of given running instances or all running
+// instances when none is given. Unless stream is set it prints a single
+// sample. Format is either table or json.
+func Stats(names []string, stream bool, format string, out io.Writer) error {
+	if format != "" && format != "table" && format != "json" {
+		return fmt.Errorf("unsupported format '%s', use table or json", format)
+	}
+	targets, err := statsTargets(names)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range targets {
+		if t.last, err = sampleProcess(t.record.PID); err != nil {
+			return fmt.Errorf("failed to read resource usage of instance %s: %s", t.record.Name, err)
+		}
+	}
+
+	for {
+		time.Sleep(statsInterval)
+
+		stats := []InstanceStats{}
+		running := targets[:0]
+		for _, t := range targets {
+			s, err := t.sample()
+			if err != nil && !stream {
+				return fmt.Errorf("failed to read resource usage of instance %s: %s", t.record.Name, err)
+			} else if err != nil {
+				// The instance has stopped.
+				continue
+			}
+			stats = append(stats, *s)
+			running = append(running, t)
+		}
+		targets = running
+
+		if stream && format != "json" {
+			// Clear the terminal.
+			fmt.Fprint(out, "\033[H\033[2J")
+		}
+		if err := printStats(out, stats, format); err != nil {
+			return err
+		}
+		if !stream || len(targets) == 0 {
+			return nil
+		}
+	}
+}
+
+// statsTargets returns running instances with given names or all running
+// instances that resource usage can be reported for.
+func statsTargets(names []string) ([]*statsTarget, error) {
+	targets := []*statsTarget{}
+	if len(names) == 0 {
+		instances, err := ListInstances("running")
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range instances {
+			if t, err := newStatsTarget(i.Name, i.Platform); err == nil {
+				targets = append(targets, t)
+			}
+		}
+		return targets, nil
+	}
+
+	for _, name := range names {
+		instanceName, platform := util.SearchInstance(name)
+		if instanceName == "" {
+			return nil, fmt.Errorf("instance %s not found", name)
+		}
+		t, err := newStatsTarget(instanceName, platform)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func newStatsTarget(name, platform string) (*statsTarget, error) {
+	driver, err := hypervisor.Get(platform)
+	if err != nil {
+		return nil, err
+	}
+	reporter, ok := driver.(hypervisor.StatsReporter)
+	if !ok {
+		return nil, fmt.Errorf("%s: resource usage of instances is not supported", platform)
+	}
+	if status := instanceStatus(name, platform); status != "Running" {
+		return nil, fmt.Errorf("instance %s is not running", name)
+	}
+	r, err := LoadInstanceRecord(platform, name)
+	if err != nil {
+		return nil, err
+	}
+	if r.PID == 0 {
+		return nil, fmt.Errorf("process of instance %s is not known, run it again to record it", name)
+	}
+	return &statsTarget{record: r, reporter: reporter}, nil
+}
+
+// sample returns resource usage of the instance since the last sample.
+func (t *statsTarget) sample() (*InstanceStats, error) {
+	current, err := sampleProcess(t.record.PID)
+	if err != nil {
+		return nil, err
+	}
+	hvStats, err := t.reporter.Stats(t.record.Name)
+	if err != nil && t.lastHV != nil {
+		// Monitor of the instance may be busy with another client, the
+		// process is still running though.
+		hvStats = t.lastHV
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &InstanceStats{
+		Name:            t.record.Name,
+		Platform:        t.record.Platform,
+		PID:             t.record.PID,
+		CPUPercent:      cpuPercent(t.last, current),
+		MemoryUsage:     current.rss,
+		MemoryLimit:     t.record.Memory * 1024 * 1024,
+		BlockReadBytes:  hvStats.BlockReadBytes,
+		BlockWriteBytes: hvStats.BlockWriteBytes,
+		Network:         current.network,
+	}
+	t.last = current
+	t.lastHV = hvStats
+	return s, nil
+}
+
+// cpuPercent returns CPU usage between two samples, 100% being one CPU.
+func cpuPercent(prev, current *processSample) float64 {
+	elapsed := current.time.Sub(prev.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	used := float64(current.cpuTicks-prev.cpuTicks) / clockTicks
+	return used / elapsed * 100
+}
+
+// sampleProcess reads resource usage of the process from /proc.
+func sampleProcess(pid int) (*processSample, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	s := &processSample{time: time.Now()}
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// Command name in parentheses may contain spaces, fields after it are
+	// state, ppid, ..., utime (14th) and stime (15th).
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	if len(fields) < 13 {
+		return nil, fmt.Errorf("unexpected format of %s", filepath.Join(dir, "stat"))
+	}
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("unexpected format of %s", filepath.Join(dir, "stat"))
+	}
+	s.cpuTicks = utime + stime
+
+	if s.rss, err = processRSS(filepath.Join(dir, "status")); err != nil {
+		return nil, err
+	}
+	s.network = processNetwork(dir)
+	return s, nil
+}
+
+// processRSS returns resident set size in bytes from /proc/<pid>/status.
+func processRSS(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// processNetwork returns counters of tap devices that the process has open
+// or nil if it has none. Tap devices are found by iff in fdinfo.
+func processNetwork(dir string) *NetworkStats {
+	infos, _ := filepath.Glob(filepath.Join(dir, "fdinfo", "*"))
+	var res *NetworkStats
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(info)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != "iff:" {
+				continue
+			}
+			statsDir := filepath.Join(sysRoot, "class", "net", fields[1], "statistics")
+			rx, err1 := readCounter(filepath.Join(statsDir, "rx_bytes"))
+			tx, err2 := readCounter(filepath.Join(statsDir, "tx_bytes"))
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			if res == nil {
+				res = &NetworkStats{}
+			}
+			// What the host receives on tap device the guest transmits.
+			res.RxBytes += tx
+			res.TxBytes += rx
+		}
+	}
+	return res
+}
+
+func readCounter(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func printStats(out io.Writer, stats []InstanceStats, format string) error {
+	if format == "json" {
+		return printJSON(out, stats)
+	}
+
+	fmt.Fprintf(out, "%-35s %-8s %-21s %-7s %-21s %s\n", "Name", "CPU %", "Mem usage / limit", "Mem %", "Block I/O", "Net I/O")
+	for _, s := range stats {
+		memPercent := 0.0
+		if s.MemoryLimit > 0 {
+			memPercent = float64(s.MemoryUsage) / float64(s.MemoryLimit) * 100
+		}
+		network := "-"
+		if s.Network != nil {
+			network = util.FormatSize(s.Network.RxBytes) + " / " + util.FormatSize(s.Network.TxBytes)
+		}
+		fmt.Fprintf(out, "%-35s %-8s %-21s %-7s %-21s %s\n",
+			s.Name,
+			fmt.Sprintf("%.2f%%", s.CPUPercent),
+			util.FormatSize(s.MemoryUsage)+" / "+util.FormatSize(s.MemoryLimit),
+			fmt.Sprintf("%.2f%%", memPercent),
+			util.FormatSize(s.BlockReadBytes)+" / "+util.FormatSize(s.BlockWriteBytes),
+			network)
+	}
+	return nil
+}
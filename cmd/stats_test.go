@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/hypervisor/fake"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type statsSuite struct {
+	instancesSuite
+	proc string
+	sys  string
+}
+
+var _ = Suite(&statsSuite{})
+
+func (s *statsSuite) TearDownSuite(c *C) {
+	s.instancesSuite.TearDownSuite(c)
+	procRoot = "/proc"
+	sysRoot = "/sys"
+	statsInterval = time.Second
+}
+
+func (s *statsSuite) SetUpTest(c *C) {
+	s.instancesSuite.SetUpTest(c)
+	s.proc = c.MkDir()
+	s.sys = c.MkDir()
+	procRoot = s.proc
+	sysRoot = s.sys
+	statsInterval = 10 * time.Millisecond
+
+	image := filepath.Join(c.MkDir(), "demo.qcow2")
+	writeOverlay(c, image, "")
+	config := &runtime.RunConfig{InstanceName: "demo", ImageName: image, Hypervisor: fake.Name, Memory: "512M"}
+	c.Assert(RunInstance(s.repo, config), IsNil)
+	c.Assert(recordInstancePID(fake.Name, "demo", 4242), IsNil)
+}
+
+// writeProcess creates /proc and /sys files of the process that has given
+// tap device open.
+func (s *statsSuite) writeProcess(c *C, pid int, utime, stime, rssKB int, tap string) {
+	dir := fmt.Sprint(pid)
+	files := map[string]string{
+		filepath.Join(dir, "stat"):        fmt.Sprintf("%d (qemu system) S 1 %d 0 0 -1 4194560 1 0 0 0 %d %d 0 0 20 0 4 0 1 1 1", pid, pid, utime, stime),
+		filepath.Join(dir, "status"):      fmt.Sprintf("Name:\tqemu-system-x86\nVmPeak:\t  999999 kB\nVmRSS:\t  %d kB\nThreads:\t4\n", rssKB),
+		filepath.Join(dir, "fdinfo", "3"): "pos:\t0\nflags:\t02\n",
+	}
+	if tap != "" {
+		files[filepath.Join(dir, "fdinfo", "12")] = fmt.Sprintf("pos:\t0\nflags:\t04002\nmnt_id:\t19\niff:\t%s\n", tap)
+	}
+	c.Assert(testing.PrepareFiles(s.proc, files), IsNil)
+
+	if tap != "" {
+		c.Assert(testing.PrepareFiles(s.sys, map[string]string{
+			filepath.Join("class", "net", tap, "statistics", "rx_bytes"): "100\n",
+			filepath.Join("class", "net", tap, "statistics", "tx_bytes"): "300\n",
+		}), IsNil)
+	}
+}
+
+func (s *statsSuite) TestSampleProcess(c *C) {
+	s.writeProcess(c, 4242, 150, 50, 2048, "tap0")
+
+	// This is what we're testing here.
+	sample, err := sampleProcess(4242)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(sample.cpuTicks, Equals, int64(200))
+	c.Check(sample.rss, Equals, int64(2048*1024))
+	c.Check(sample.network, DeepEquals, &NetworkStats{RxBytes: 300, TxBytes: 100})
+}
+
+func (s *statsSuite) TestCPUPercent(c *C) {
+	now := time.Now()
+	prev := &processSample{time: now, cpuTicks: 100}
+	current := &processSample{time: now.Add(2 * time.Second), cpuTicks: 250}
+
+	// This is what we're testing here.
+	percent := cpuPercent(prev, current)
+
+	// Expectations.
+	c.Check(percent, Equals, 75.0)
+}
+
+func (s *statsSuite) TestStatsJSON(c *C) {
+	s.writeProcess(c, 4242, 10, 10, 1024, "")
+	s.driver.InstanceStats["demo"] = hypervisor.Stats{BlockReadBytes: 4096, BlockWriteBytes: 512}
+
+	// This is what we're testing here.
+	var out bytes.Buffer
+	err := Stats(nil, false, "json", &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	var stats []InstanceStats
+	c.Assert(json.Unmarshal(out.Bytes(), &stats), IsNil)
+	c.Check(stats, DeepEquals, []InstanceStats{
+		{
+			Name:            "demo",
+			Platform:        fake.Name,
+			PID:             4242,
+			MemoryUsage:     1024 * 1024,
+			MemoryLimit:     512 * 1024 * 1024,
+			BlockReadBytes:  4096,
+			BlockWriteBytes: 512,
+		},
+	})
+}
+
+func (s *statsSuite) TestStatsTable(c *C) {
+	s.writeProcess(c, 4242, 10, 10, 1024, "tap0")
+	s.driver.InstanceStats["demo"] = hypervisor.Stats{BlockReadBytes: 4096}
+
+	// This is what we're testing here.
+	var out bytes.Buffer
+	err := Stats([]string{"demo"}, false, "table", &out)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Check(lines[1], Matches, `demo +0\.00% +1\.0MB / 512\.0MB +0\.20% +4\.0KB / 0B +300B / 100B`)
+}
+
+func (s *statsSuite) TestStatsFails(c *C) {
+	s.writeProcess(c, 4242, 10, 10, 1024, "")
+	c.Assert(Stop("demo"), IsNil)
+
+	m := []struct {
+		comment     string
+		names       []string
+		format      string
+		expectedErr string
+	}{
+		{"not running", []string{"demo"}, "table", "instance demo is not running"},
+		{"missing", []string{"missing"}, "table", "instance missing not found"},
+		{"format", []string{"demo"}, "yaml", "unsupported format 'yaml', use table or json"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := Stats(args.names, false, args.format, &bytes.Buffer{})
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+	}
+}
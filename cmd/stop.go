@@ -10,10 +10,7 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/mikelangelo-project/capstan/hypervisor/gce"
-	"github.com/mikelangelo-project/capstan/hypervisor/qemu"
-	"github.com/mikelangelo-project/capstan/hypervisor/vbox"
-	"github.com/mikelangelo-project/capstan/hypervisor/vmw"
+	"github.com/mikelangelo-project/capstan/hypervisor"
 	"github.com/mikelangelo-project/capstan/util"
 )
 
@@ -23,20 +20,12 @@ func Stop(name string) error {
 		fmt.Printf("Instance: %s not found\n", name)
 		return nil
 	}
-
-	var err error
-	switch instancePlatform {
-	case "qemu":
-		err = qemu.StopVM(name)
-	case "vbox":
-		err = vbox.StopVM(name)
-	case "vmw":
-		err = vmw.StopVM(name)
-	case "gce":
-		err = gce.StopVM(name)
+	driver, err := hypervisor.Get(instancePlatform)
+	if err != nil {
+		return err
 	}
 
-	if err != nil {
+	if err := driver.Stop(name); err != nil {
 		fmt.Printf("Failed to stop instance: %s\n", name)
 	}
 
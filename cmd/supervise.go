@@ -0,0 +1,407 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	launchFileName       = "launch.yaml"
+	consoleTimesFileName = "console.times"
+	consoleSocketName    = "console.sock"
+	exitStatusFileName   = "exit.status"
+	pidFileName          = "vm.pid"
+	supervisorPidName    = "supervisor.pid"
+	supervisorLogName    = "supervisor.log"
+
+	// pollInterval is time between two checks of files of the instance
+	// that is running in background.
+	pollInterval = 100 * time.Millisecond
+)
+
+// guestStatusRegexp matches line that OSv prints on console when the
+// application returns non-zero status, e.g. "program /app.so returned 3".
+var guestStatusRegexp = regexp.MustCompile(`^program .* returned (-?\d+)\s*$`)
+
+// instanceLaunch tells supervisor of instance running in background how to
+// launch the instance.
+type instanceLaunch struct {
+	Platform string `yaml:"platform"`
+	// Config is set for new instances, existing ones are started with Options.
+	Config  *hypervisor.Config     `yaml:"config,omitempty"`
+	Options *hypervisor.RunOptions `yaml:"options,omitempty"`
+}
+
+// supervisorCommand returns command that supervises the instance in a
+// separate process, see Supervise.
+var supervisorCommand = func(platform, name string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(exe, "supervise", platform, name), nil
+}
+
+// instanceFile returns path of a file that Capstan stores with the instance.
+func instanceFile(platform, name, fileName string) string {
+	return filepath.Join(hypervisor.InstanceDir(platform, name), fileName)
+}
+
+// instanceConsoleSocket returns address that console of the instance running
+// in background can be attached to.
+func instanceConsoleSocket(platform, name string) string {
+	if runtime.GOOS == "windows" {
+		return fmt.Sprintf(`\\.\pipe\capstan-%s-%s`, platform, name)
+	}
+	return instanceFile(platform, name, consoleSocketName)
+}
+
+// startSupervisor starts supervisor of the instance in background and waits
+// until it launches the instance. Returned channel receives when supervisor
+// exits, i.e. after the instance stops.
+func startSupervisor(name string, launch *instanceLaunch) (<-chan error, error) {
+	dir := hypervisor.InstanceDir(launch.Platform, name)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	for _, fileName := range []string{exitStatusFileName, pidFileName, supervisorPidName, consoleTimesFileName} {
+		os.Remove(filepath.Join(dir, fileName))
+	}
+
+	data, err := yaml.Marshal(launch)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, launchFileName), data, 0644); err != nil {
+		return nil, err
+	}
+
+	cmd, err := supervisorCommand(launch.Platform, name)
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.Create(filepath.Join(dir, supervisorLogName))
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+	cmd.Stdout = log
+	cmd.Stderr = log
+	util.DetachProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if err := writeInstanceFile(launch.Platform, name, supervisorPidName, fmt.Sprintf("%d\n", cmd.Process.Pid)); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		if _, err := os.Stat(filepath.Join(dir, pidFileName)); err == nil {
+			return exited, nil
+		}
+
+		select {
+		case err := <-exited:
+			// Instance may have stopped right after it was launched.
+			if _, statErr := os.Stat(filepath.Join(dir, pidFileName)); statErr == nil {
+				exited := make(chan error, 1)
+				exited <- err
+				return exited, nil
+			}
+			out, _ := ioutil.ReadFile(filepath.Join(dir, supervisorLogName))
+			return nil, fmt.Errorf("failed to launch instance %s in background: %s", name, strings.TrimSpace(string(out)))
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Supervise launches the instance as described by its launch file and stays
+// with it until it stops. Console output of the instance is written to its
+// console log and to clients attached to its console socket. Exit status of
+// the instance is recorded once it stops.
+func Supervise(platform, name string) error {
+	data, err := ioutil.ReadFile(instanceFile(platform, name, launchFileName))
+	if err != nil {
+		return err
+	}
+	launch := instanceLaunch{}
+	if err := yaml.Unmarshal(data, &launch); err != nil {
+		return err
+	}
+	driver, err := hypervisor.Get(platform)
+	if err != nil {
+		return err
+	}
+
+	console, err := newConsoleLog(platform, name)
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+
+	socket := instanceConsoleSocket(platform, name)
+	os.Remove(socket)
+	listener, err := util.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// Input of attached clients is passed to the instance through a pipe.
+	stdin, input, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	go console.serve(listener, input)
+
+	var cmd *exec.Cmd
+	if launch.Config != nil {
+		launch.Config.Stdin = stdin
+		launch.Config.Stdout = console
+		cmd, err = driver.Launch(launch.Config)
+	} else {
+		opts := hypervisor.RunOptions{}
+		if launch.Options != nil {
+			opts = *launch.Options
+		}
+		opts.Stdin = stdin
+		opts.Stdout = console
+		cmd, err = driver.Start(name, &opts)
+	}
+	stdin.Close()
+	if err != nil {
+		return err
+	}
+
+	pid := 0
+	if cmd != nil {
+		pid = cmd.Process.Pid
+	}
+	if err := ioutil.WriteFile(instanceFile(platform, name, pidFileName), []byte(fmt.Sprintf("%d\n", pid)), 0644); err != nil {
+		return err
+	}
+	if err := recordInstancePID(platform, name, pid); err != nil {
+		return err
+	}
+
+	status := 0
+	if cmd != nil {
+		status = exitStatus(cmd.Wait())
+	}
+	// The hypervisor exits with 0 whenever OSv powers off, exit status of
+	// the application is only known from its console.
+	if guestStatus, ok := consoleExitStatus(instanceConsoleFile(platform, name)); ok {
+		status = guestStatus
+	}
+	return writeInstanceFile(platform, name, exitStatusFileName, fmt.Sprintf("%d\n", status))
+}
+
+// writeInstanceFile replaces file of the instance at once, so that others
+// never read it half-written.
+func writeInstanceFile(platform, name, fileName, content string) error {
+	path := instanceFile(platform, name, fileName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// consoleExitStatus returns exit status of the application that OSv reported
+// last in the console log, if any.
+func consoleExitStatus(path string) (int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	status, found := 0, false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if m := guestStatusRegexp.FindStringSubmatch(scanner.Text()); m != nil {
+			status, _ = strconv.Atoi(m[1])
+			found = true
+		}
+	}
+	return status, found
+}
+
+// exitStatus returns exit status of the process that returned given error
+// from Wait.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// readExitStatus returns exit status of instance that ran in background and
+// whether it has stopped.
+func readExitStatus(platform, name string) (int, bool, error) {
+	data, err := ioutil.ReadFile(instanceFile(platform, name, exitStatusFileName))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	status, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid exit status of instance %s: %s", name, err)
+	}
+	return status, true, nil
+}
+
+// waitExitStatus returns exit status of instance that ran in background and
+// whether it has stopped. Error is returned when its supervisor is gone
+// without recording the exit status, e.g. because it was killed.
+func waitExitStatus(platform, name string) (int, bool, error) {
+	status, stopped, err := readExitStatus(platform, name)
+	if err != nil || stopped {
+		return status, stopped, err
+	}
+
+	data, err := ioutil.ReadFile(instanceFile(platform, name, supervisorPidName))
+	if os.IsNotExist(err) {
+		// Supervisor is just being started.
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid supervisor pid of instance %s: %s", name, err)
+	}
+	if util.ProcessAlive(pid) {
+		return 0, false, nil
+	}
+
+	// Supervisor may have recorded the exit status right before it exited.
+	status, stopped, err = readExitStatus(platform, name)
+	if err != nil || stopped {
+		return status, stopped, err
+	}
+	return 0, false, fmt.Errorf("supervisor of instance %s is no longer running, exit status of the instance is unknown", name)
+}
+
+// consoleLog receives console output of the instance. The output is written
+// to console log, forwarded to attached clients and the time of each line is
+// recorded so that output since a point in time can be shown.
+type consoleLog struct {
+	mu       sync.Mutex
+	log      *os.File
+	times    *os.File
+	offset   int64
+	lineDone bool
+	clients  map[net.Conn]bool
+}
+
+func newConsoleLog(platform, name string) (*consoleLog, error) {
+	log, err := os.Create(instanceConsoleFile(platform, name))
+	if err != nil {
+		return nil, err
+	}
+	times, err := os.Create(instanceFile(platform, name, consoleTimesFileName))
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	return &consoleLog{log: log, times: times, lineDone: true, clients: make(map[net.Conn]bool)}, nil
+}
+
+func (l *consoleLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for i, b := range p {
+		if l.lineDone {
+			fmt.Fprintf(l.times, "%d %d\n", now, l.offset+int64(i))
+		}
+		l.lineDone = b == '\n'
+	}
+
+	n, err := l.log.Write(p)
+	l.offset += int64(n)
+
+	for conn := range l.clients {
+		if _, err := conn.Write(p); err != nil {
+			conn.Close()
+			delete(l.clients, conn)
+		}
+	}
+	return n, err
+}
+
+// serve attaches clients that connect to the console socket. Their input is
+// written to given input of the instance.
+func (l *consoleLog) serve(listener net.Listener, input io.Writer) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		l.mu.Lock()
+		l.clients[conn] = true
+		l.mu.Unlock()
+
+		go func() {
+			io.Copy(input, conn)
+
+			l.mu.Lock()
+			delete(l.clients, conn)
+			l.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (l *consoleLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for conn := range l.clients {
+		conn.Close()
+	}
+	l.times.Close()
+	return l.log.Close()
+}
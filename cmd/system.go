@@ -0,0 +1,423 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/image/qcow2"
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// PruneOptions control which resources are removed by SystemPrune.
+type PruneOptions struct {
+	DryRun bool
+	// OlderThan is the number of days a stopped instance has to be left
+	// untouched before it is pruned.
+	OlderThan int
+	// Categories to prune. Stopped instances and orphaned caches are pruned
+	// when none is set, images and packages only when they are selected.
+	Images    bool
+	Packages  bool
+	Instances bool
+	Caches    bool
+	// Force removes images and packages without asking for confirmation.
+	Force bool
+}
+
+func (o *PruneOptions) none() bool {
+	return !o.Images && !o.Packages && !o.Instances && !o.Caches
+}
+
+// confirmPrune asks the user whether to proceed with the removal of images
+// and packages. Anything but yes is taken as no.
+var confirmPrune = func(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// systemItem is a single resource that occupies space on the local disk.
+type systemItem struct {
+	Name string
+	// Paths to remove when the item is pruned. Directories are removed
+	// recursively.
+	Paths []string
+	Size  int64
+	// Reclaimable is set for items that are not referenced by anything else.
+	Reclaimable bool
+	// Platform is only set for instances and is used to delete them.
+	Platform string
+}
+
+// systemCategory groups items of the same kind.
+type systemCategory struct {
+	Name  string
+	Items []systemItem
+}
+
+func (c *systemCategory) sizes() (total, reclaimable int64, count int) {
+	for _, item := range c.Items {
+		total += item.Size
+		if item.Reclaimable {
+			reclaimable += item.Size
+			count++
+		}
+	}
+	return
+}
+
+var imageHypervisors = []string{"qemu", "vbox", "vmw", "gce"}
+
+// SystemDf prints disk space used by images, packages, instances and caches
+// that are managed by Capstan.
+func SystemDf(repo *util.Repo, verbose bool) error {
+	categories, err := collectSystemItems(repo, 0)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-20s %-8s %-10s %-10s\n", "Type", "Total", "Size", "Reclaimable")
+	for _, c := range categories {
+		total, reclaimable, _ := c.sizes()
+		fmt.Printf("%-20s %-8d %-10s %-10s\n", c.Name, len(c.Items), util.FormatSize(total), util.FormatSize(reclaimable))
+	}
+
+	if verbose {
+		for _, c := range categories {
+			fmt.Printf("\n%s:\n", c.Name)
+			for _, item := range c.Items {
+				unused := ""
+				if item.Reclaimable {
+					unused = "unused"
+				}
+				fmt.Printf("  %-50s %-10s %s\n", item.Name, util.FormatSize(item.Size), unused)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SystemPrune removes stopped instances and orphaned caches and, when
+// selected, images and packages that are not referenced by any instance,
+// image or lock file. The loader image and the packages it requires are
+// always kept.
+func SystemPrune(repo *util.Repo, opts PruneOptions) error {
+	categories, err := collectSystemItems(repo, opts.OlderThan)
+	if err != nil {
+		return err
+	}
+
+	selected := map[string]bool{
+		"Images":          opts.Images,
+		"Packages":        opts.Packages,
+		"Instances":       opts.none() || opts.Instances,
+		"Orphaned caches": opts.none() || opts.Caches,
+	}
+
+	if (opts.Images || opts.Packages) && !opts.DryRun && !opts.Force &&
+		!confirmPrune("This will remove all unused images and packages from the local repository. Continue?") {
+		return fmt.Errorf("images and packages were not removed, use --force to remove them without confirmation")
+	}
+
+	var reclaimed int64
+	for _, c := range categories {
+		if !selected[c.Name] {
+			continue
+		}
+		for _, item := range c.Items {
+			if !item.Reclaimable {
+				continue
+			}
+
+			if opts.DryRun {
+				fmt.Printf("Would remove %s: %s (%s)\n", strings.ToLower(c.Name), item.Name, util.FormatSize(item.Size))
+				reclaimed += item.Size
+				continue
+			}
+
+			if err := pruneItem(item); err != nil {
+				fmt.Printf("Failed to remove %s: %s\n", item.Name, err)
+				continue
+			}
+			fmt.Printf("Removed %s: %s (%s)\n", strings.ToLower(c.Name), item.Name, util.FormatSize(item.Size))
+			reclaimed += item.Size
+		}
+	}
+
+	if opts.DryRun {
+		fmt.Printf("Total space that would be reclaimed: %s\n", util.FormatSize(reclaimed))
+	} else {
+		fmt.Printf("Total reclaimed space: %s\n", util.FormatSize(reclaimed))
+	}
+
+	return nil
+}
+
+func pruneItem(item systemItem) error {
+	// Instances on remote hypervisors are not considered.
+	if driver, err := hypervisor.Get(item.Platform); err == nil && !driver.Capabilities().Remote {
+		return driver.Delete(item.Name)
+	}
+
+	for _, path := range item.Paths {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectSystemItems gathers all resources together with their sizes and
+// determines which of them can be removed. Stopped instances are only
+// considered reclaimable if they were not modified in the last olderThan days.
+func collectSystemItems(repo *util.Repo, olderThan int) ([]systemCategory, error) {
+	instances, usedImages := collectInstances(repo, olderThan)
+
+	lock, err := repo.Locks()
+	if err != nil {
+		return nil, err
+	}
+
+	// The loader image and everything it boots with are needed to compose
+	// any new image.
+	keptImages := map[string]bool{imageKey(repo.LoaderImage): true}
+	for _, ref := range lock.Images {
+		keptImages[imageKey(ref)] = true
+	}
+	usedPackages := make(map[string]bool)
+	keepPackage(repo, "osv.bootstrap", usedPackages)
+	for _, name := range lock.Packages {
+		keepPackage(repo, name, usedPackages)
+	}
+
+	images := systemCategory{Name: "Images"}
+	caches := systemCategory{Name: "Orphaned caches"}
+
+	for _, name := range repo.ListImageNames() {
+		item := systemItem{Name: name}
+		found := false
+		for _, hypervisor := range imageHypervisors {
+			imagePath := repo.ImagePath(hypervisor, name)
+			cachePath := repo.ImageCachePath(hypervisor, name)
+
+			if info, err := os.Stat(imagePath); err == nil {
+				found = true
+				item.Paths = append(item.Paths, imagePath)
+				item.Size += info.Size()
+				if info, err := os.Stat(cachePath); err == nil {
+					item.Paths = append(item.Paths, cachePath)
+					item.Size += info.Size()
+				}
+			} else if info, err := os.Stat(cachePath); err == nil {
+				// Hash cache without the image it belongs to.
+				caches.Items = append(caches.Items, systemItem{
+					Name:        cachePath,
+					Paths:       []string{cachePath},
+					Size:        info.Size(),
+					Reclaimable: true,
+				})
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		for _, file := range []string{"index.yaml", "packages.yaml", "healthcheck.yaml"} {
+			metaPath := filepath.Join(repo.ImageDir(name), file)
+			if info, err := os.Stat(metaPath); err == nil {
+				item.Paths = append(item.Paths, metaPath)
+				item.Size += info.Size()
+			}
+		}
+
+		item.Reclaimable = !keptImages[imageKey(name)]
+		for _, path := range item.Paths {
+			if usedImages[filepath.Clean(path)] {
+				item.Reclaimable = false
+			}
+		}
+
+		// Packages of images that are kept must be kept as well.
+		if !item.Reclaimable {
+			packages, err := repo.ImagePackages(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, pkg := range packages {
+				keepPackage(repo, pkg.Name, usedPackages)
+			}
+		}
+
+		images.Items = append(images.Items, item)
+	}
+
+	packages := systemCategory{Name: "Packages"}
+	files, _ := ioutil.ReadDir(repo.PackagesPath())
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".mpm" {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), ".mpm")
+		item := systemItem{
+			Name:        name,
+			Paths:       []string{repo.PackagePath(name)},
+			Size:        f.Size(),
+			Reclaimable: !usedPackages[name],
+		}
+		if info, err := os.Stat(repo.PackageManifest(name)); err == nil {
+			item.Paths = append(item.Paths, repo.PackageManifest(name))
+			item.Size += info.Size()
+		}
+		packages.Items = append(packages.Items, item)
+	}
+
+	caches.Items = append(caches.Items, collectOrphanedCaches()...)
+
+	return []systemCategory{images, packages, instances, caches}, nil
+}
+
+// imageKey returns the reference under which ListImageNames lists the image.
+func imageKey(ref string) string {
+	return util.ImageReference(util.ParseImageReference(ref))
+}
+
+// keepPackage marks the package and all packages it requires as used.
+func keepPackage(repo *util.Repo, name string, used map[string]bool) {
+	if used[name] {
+		return
+	}
+	used[name] = true
+
+	// Manifest is not validated, incomplete manifests still list requirements.
+	data, err := ioutil.ReadFile(repo.PackageManifest(name))
+	if err != nil {
+		return
+	}
+	pkg := core.Package{}
+	if err := yaml.Unmarshal(data, &pkg); err == nil {
+		for _, required := range pkg.Require {
+			keepPackage(repo, required, used)
+		}
+	}
+}
+
+// collectInstances returns all instances together with the set of image
+// files that any instance was created from or uses as a backing file.
+func collectInstances(repo *util.Repo, olderThan int) (systemCategory, map[string]bool) {
+	instances := systemCategory{Name: "Instances"}
+	usedImages := make(map[string]bool)
+	threshold := time.Now().AddDate(0, 0, -olderThan)
+
+	platforms, _ := ioutil.ReadDir(util.InstancesPath())
+	for _, platform := range platforms {
+		if !platform.IsDir() {
+			continue
+		}
+		platformDir := filepath.Join(util.InstancesPath(), platform.Name())
+		dirs, _ := ioutil.ReadDir(platformDir)
+		for _, dir := range dirs {
+			instanceDir := filepath.Join(platformDir, dir.Name())
+			config, err := os.Stat(filepath.Join(instanceDir, "osv.config"))
+			if !dir.IsDir() || err != nil {
+				// Directories without osv.config are reported as orphaned caches.
+				continue
+			}
+
+			if platform.Name() == "qemu" {
+				if backing := qemuBackingFile(filepath.Join(instanceDir, "disk.qcow2")); backing != "" {
+					usedImages[filepath.Clean(backing)] = true
+				}
+			}
+			// Other hypervisors copy the image, so only the record of the
+			// instance tells which image it was created from.
+			if r, err := LoadInstanceRecord(platform.Name(), dir.Name()); err == nil && r.Image != "" {
+				usedImages[filepath.Clean(r.Image)] = true
+				for _, hypervisor := range imageHypervisors {
+					usedImages[filepath.Clean(repo.ImagePath(hypervisor, r.Image))] = true
+				}
+			}
+
+			size, _ := util.DirSize(instanceDir)
+			status := instanceStatus(dir.Name(), platform.Name())
+			instances.Items = append(instances.Items, systemItem{
+				Name:     dir.Name(),
+				Paths:    []string{instanceDir},
+				Size:     size,
+				Platform: platform.Name(),
+				// Instances on GCE are cloud resources and are never pruned.
+				Reclaimable: platform.Name() != "gce" && status == "Stopped" && config.ModTime().Before(threshold),
+			})
+		}
+	}
+
+	return instances, usedImages
+}
+
+// collectOrphanedCaches returns instance directories that were left behind
+// by non-persistent instances. Nothing outside of Capstan's own directories is
+// ever considered.
+func collectOrphanedCaches() []systemItem {
+	var items []systemItem
+
+	platforms, _ := ioutil.ReadDir(util.InstancesPath())
+	for _, platform := range platforms {
+		if !platform.IsDir() {
+			continue
+		}
+		platformDir := filepath.Join(util.InstancesPath(), platform.Name())
+		dirs, _ := ioutil.ReadDir(platformDir)
+		for _, dir := range dirs {
+			instanceDir := filepath.Join(platformDir, dir.Name())
+			if _, err := os.Stat(filepath.Join(instanceDir, "osv.config")); !dir.IsDir() || err == nil {
+				continue
+			}
+			size, _ := util.DirSize(instanceDir)
+			items = append(items, systemItem{
+				Name:        instanceDir,
+				Paths:       []string{instanceDir},
+				Size:        size,
+				Reclaimable: true,
+			})
+		}
+	}
+
+	return items
+}
+
+func qemuBackingFile(diskPath string) string {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	backing, _ := qcow2.BackingFile(f)
+	return backing
+}
+
+func instanceStatus(name, platform string) string {
+	driver, err := hypervisor.Get(platform)
+	if err != nil {
+		return ""
+	}
+	status, _ := driver.Status(name)
+	return status
+}
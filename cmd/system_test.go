@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/image/qcow2"
+	"github.com/mikelangelo-project/capstan/util"
+
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+type systemSuite struct {
+	instancesSuite
+	confirm func(string) bool
+}
+
+var _ = Suite(&systemSuite{})
+
+func (s *systemSuite) SetUpSuite(c *C) {
+	s.instancesSuite.SetUpSuite(c)
+	s.confirm = confirmPrune
+}
+
+func (s *systemSuite) TearDownSuite(c *C) {
+	s.instancesSuite.TearDownSuite(c)
+	confirmPrune = s.confirm
+}
+
+func (s *systemSuite) SetUpTest(c *C) {
+	s.instancesSuite.SetUpTest(c)
+
+	PrepareFiles(s.repo.Path, map[string]string{
+		"/repository/demo/used/used.qemu":             DefaultText,
+		"/repository/demo/used/packages.yaml":         "- name: pkg-a\n",
+		"/repository/demo/unused/unused.qemu":         DefaultText,
+		"/repository/demo/gone/gone.qemu.cache":       DefaultText,
+		"/repository/demo/vbox/vbox.vbox":             DefaultText,
+		"/repository/demo/locked/locked.qemu":         DefaultText,
+		"/repository/mike/osv-loader/osv-loader.qemu": DefaultText,
+		"/packages/pkg-a.mpm":                         DefaultText,
+		"/packages/pkg-a.yaml":                        "name: pkg-a\n",
+		"/packages/pkg-b.mpm":                         DefaultText,
+		"/packages/pkg-b.yaml":                        "name: pkg-b\n",
+		"/packages/osv.bootstrap.mpm":                 DefaultText,
+		"/packages/osv.bootstrap.yaml":                "name: osv.bootstrap\nrequire:\n  - pkg-c\n",
+		"/packages/pkg-c.mpm":                         DefaultText,
+		"/packages/pkg-c.yaml":                        "name: pkg-c\n",
+		"/packages/pkg-d.mpm":                         DefaultText,
+		"/packages/pkg-d.yaml":                        "name: pkg-d\n",
+		"/locks/ci.yaml":                              "images:\n  - demo/locked\npackages:\n  - pkg-d\n",
+	})
+
+	PrepareFiles(util.InstancesPath(), map[string]string{
+		"/qemu/inst1/osv.config":    "image: disk.qcow2\n",
+		"/qemu/orphan/disk.qcow2":   DefaultText,
+		"/vbox/inst2/osv.config":    "image: disk.vdi\n",
+		"/vbox/inst2/instance.yaml": "image: demo/vbox\n",
+	})
+	writeOverlay(c, filepath.Join(util.InstancesPath(), "qemu", "inst1", "disk.qcow2"),
+		s.repo.ImagePath("qemu", "demo/used"))
+}
+
+// writeOverlay writes a minimal QCOW2 header that refers to the given backing file.
+func writeOverlay(c *C, path, backing string) {
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	header := qcow2.Header{
+		Magic:             qcow2.QCOW2_MAGIC,
+		Version:           2,
+		BackingFileOffset: uint64(binary.Size(qcow2.Header{})),
+		BackingFileSize:   uint32(len(backing)),
+	}
+	c.Assert(binary.Write(f, binary.BigEndian, &header), IsNil)
+	_, err = f.WriteString(backing)
+	c.Assert(err, IsNil)
+}
+
+func reclaimableNames(categories []systemCategory, name string) []string {
+	var names []string
+	for _, cat := range categories {
+		if cat.Name != name {
+			continue
+		}
+		for _, item := range cat.Items {
+			if item.Reclaimable {
+				names = append(names, filepath.Base(item.Name))
+			}
+		}
+	}
+	return names
+}
+
+func (s *systemSuite) TestCollectSystemItems(c *C) {
+	// This is what we're testing here.
+	categories, err := collectSystemItems(s.repo, 0)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(reclaimableNames(categories, "Images"), DeepEquals, []string{"unused"})
+	c.Check(reclaimableNames(categories, "Packages"), DeepEquals, []string{"pkg-b"})
+	c.Check(reclaimableNames(categories, "Instances"), DeepEquals, []string{"inst1", "inst2"})
+	c.Check(reclaimableNames(categories, "Orphaned caches"), DeepEquals, []string{"gone.qemu.cache", "orphan"})
+}
+
+func (s *systemSuite) TestCollectSystemItemsOlderThan(c *C) {
+	// This is what we're testing here.
+	categories, err := collectSystemItems(s.repo, 7)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(reclaimableNames(categories, "Instances"), IsNil)
+}
+
+func (s *systemSuite) TestSystemPrune(c *C) {
+	m := []struct {
+		comment   string
+		opts      PruneOptions
+		confirm   bool
+		removed   []string
+		preserved []string
+	}{
+		{
+			"dry run",
+			PruneOptions{DryRun: true, Images: true, Packages: true},
+			false,
+			[]string{},
+			[]string{"repository/demo/unused/unused.qemu", "packages/pkg-b.mpm", "repository/demo/gone/gone.qemu.cache"},
+		},
+		{
+			"default",
+			PruneOptions{},
+			false,
+			[]string{"repository/demo/gone/gone.qemu.cache"},
+			[]string{"repository/demo/unused/unused.qemu", "packages/pkg-b.mpm"},
+		},
+		{
+			"images only",
+			PruneOptions{Images: true, Force: true},
+			false,
+			[]string{"repository/demo/unused/unused.qemu"},
+			[]string{
+				"repository/demo/used/used.qemu", "repository/demo/vbox/vbox.vbox",
+				"repository/demo/locked/locked.qemu", "repository/mike/osv-loader/osv-loader.qemu",
+				"packages/pkg-b.mpm", "repository/demo/gone/gone.qemu.cache",
+			},
+		},
+		{
+			"packages and caches",
+			PruneOptions{Packages: true, Caches: true},
+			true,
+			[]string{"packages/pkg-b.mpm", "packages/pkg-b.yaml", "repository/demo/gone/gone.qemu.cache"},
+			[]string{
+				"packages/pkg-a.mpm", "packages/osv.bootstrap.mpm", "packages/pkg-c.mpm",
+				"packages/pkg-d.mpm", "repository/demo/unused/unused.qemu",
+			},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		s.SetUpTest(c)
+		confirmPrune = func(string) bool { return args.confirm }
+
+		// This is what we're testing here.
+		err := SystemPrune(s.repo, args.opts)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		for _, path := range args.removed {
+			_, err := os.Stat(filepath.Join(s.repo.Path, path))
+			c.Check(os.IsNotExist(err), Equals, true, Commentf("%s was not removed", path))
+		}
+		for _, path := range args.preserved {
+			_, err := os.Stat(filepath.Join(s.repo.Path, path))
+			c.Check(err, IsNil, Commentf("%s was removed", path))
+		}
+	}
+}
+
+func (s *systemSuite) TestSystemPruneNotConfirmed(c *C) {
+	confirmPrune = func(string) bool { return false }
+
+	// This is what we're testing here.
+	err := SystemPrune(s.repo, PruneOptions{Images: true})
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "images and packages were not removed, use --force .*")
+	_, err = os.Stat(s.repo.ImagePath("qemu", "demo/unused"))
+	c.Check(err, IsNil)
+}
+
+func (s *systemSuite) TestSystemPruneInvalidLock(c *C) {
+	PrepareFiles(s.repo.Path, map[string]string{
+		"/locks/broken.yaml": "images: [",
+	})
+
+	// This is what we're testing here.
+	err := SystemPrune(s.repo, PruneOptions{Images: true, Force: true})
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "failed to parse lock file .*broken.yaml: .*")
+	_, err = os.Stat(s.repo.ImagePath("qemu", "demo/unused"))
+	c.Check(err, IsNil)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"github.com/mikelangelo-project/capstan/runtime"
+)
+
+// TemplateData is what templates in meta/templates are rendered with.
+type TemplateData struct {
+	// ConfigSet is name of the config set that the unikernel boots with.
+	ConfigSet string
+	// Env contains environment variables of the config set overridden
+	// by the ones given with --env and --env-file.
+	Env map[string]string
+	// Package is meta/package.yaml of the package.
+	Package core.Package
+	// Dependencies are names of all packages the package requires.
+	Dependencies []string
+}
+
+// templateFuncs are functions available in templates in addition to the
+// ones provided by text/template.
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"default": func(def, value interface{}) interface{} {
+		if value == nil || fmt.Sprint(value) == "" {
+			return def
+		}
+		return value
+	},
+}
+
+func newTemplateData(pkg core.Package, requiredPackages []core.Package, cmdConf *runtime.CmdConfig, bootOpts *BootOptions) (TemplateData, error) {
+	res := TemplateData{
+		Package: pkg,
+		Env:     make(map[string]string),
+	}
+	for _, req := range requiredPackages {
+		res.Dependencies = append(res.Dependencies, req.Name)
+	}
+
+	if cmdConf != nil {
+		res.ConfigSet = bootOpts.configSetName(cmdConf)
+		if conf := cmdConf.ConfigSets[res.ConfigSet]; conf != nil {
+			for k, v := range conf.GetEnv() {
+				res.Env[k] = v
+			}
+		}
+	}
+
+	env, err := bootOpts.Env()
+	if err != nil {
+		return res, err
+	}
+	for k, v := range env {
+		res.Env[k] = v
+	}
+
+	return res, nil
+}
+
+// renderTemplates renders every file in templatesDir with text/template and
+// writes the result to the same relative path within targetDir. All files
+// are rendered and all errors are reported at once.
+func renderTemplates(templatesDir, targetDir string, data TemplateData) error {
+	if _, err := os.Stat(templatesDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	var problems []string
+	err := filepath.Walk(templatesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(templatesDir, path)
+		if err := renderTemplate(path, filepath.Join(targetDir, relPath), info.Mode(), data); err != nil {
+			problems = append(problems, fmt.Sprintf("  meta/templates/%s: %s", filepath.ToSlash(relPath), err))
+		} else {
+			fmt.Printf("Rendered template %s\n", filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("failed to render templates:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func renderTemplate(path, target string, mode os.FileMode, data TemplateData) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "template: "))
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "template: "))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0775); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, buf.Bytes(), mode)
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/image"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// volumeNamePattern restricts names of volumes to what can be used in file
+// names.
+var volumeNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// mkfsCommand formats volumes with ext filesystem that OSv can mount.
+var mkfsCommand = "mkfs.ext4"
+
+// volumePath returns path of the named volume.
+func volumePath(name string) string {
+	return filepath.Join(util.VolumesPath(), name+".img")
+}
+
+// CreateVolume creates named volume of given size, e.g. 10G, formatted with
+// ext filesystem.
+func CreateVolume(name, size string) error {
+	if !volumeNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid volume name '%s', use letters, digits, '.', '_' and '-'", name)
+	}
+	sizeMB, err := util.ParseMemSize(size)
+	if err != nil {
+		return err
+	}
+	sz := sizeMB * 1024 * 1024
+	path := volumePath(name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("volume %s already exists", name)
+	}
+	if err := os.MkdirAll(util.VolumesPath(), 0775); err != nil {
+		return err
+	}
+
+	// Volume is a sparse raw image, so it only takes as much space on the
+	// host as the guest writes to it.
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(sz)
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if out, err := exec.Command(mkfsCommand, "-q", "-F", path).CombinedOutput(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to create filesystem of volume %s with %s: %s %s",
+			name, mkfsCommand, err, strings.TrimSpace(string(out)))
+	}
+	fmt.Printf("Created volume %s (%s)\n", name, util.FormatSize(sz))
+	return nil
+}
+
+// volumeUsers returns names of instances that have the volume attached.
+func volumeUsers(path string) ([]string, error) {
+	instances, err := ListInstances("")
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, i := range instances {
+		for _, v := range i.Volumes {
+			if strings.HasPrefix(v, path+":") {
+				res = append(res, i.Name)
+			}
+		}
+	}
+	return res, nil
+}
+
+// ListVolumes prints named volumes together with instances that use them.
+func ListVolumes(out io.Writer) error {
+	files, err := ioutil.ReadDir(util.VolumesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fmt.Fprintf(out, "%-30s %-10s %-20s %s\n", "Name", "Size", "Created", "Instances")
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".img" {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), ".img")
+		users, err := volumeUsers(volumePath(name))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%-30s %-10s %-20s %s\n", name, util.FormatSize(f.Size()),
+			f.ModTime().Format("2006-01-02 15:04:05"), strings.Join(users, ","))
+	}
+	return nil
+}
+
+// DeleteVolume deletes named volume and all data on it. Volumes that are
+// attached to instances cannot be deleted.
+func DeleteVolume(name string) error {
+	path := volumePath(name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	users, err := volumeUsers(path)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("volume %s is used by instance %s, delete the instance first", name, strings.Join(users, ", "))
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted volume %s\n", name)
+	return nil
+}
+
+// ResolveVolumes returns volumes that are given as name[:size][:mount_point]
+// or path[:mount_point]. Named volumes are kept in the volume store and are
+// created when size is given and they do not exist yet. Paths, e.g.
+// ./data.img, are disk images on the host. Volumes are mounted to
+// /volumes/<name> unless mount point is given.
+func ResolveVolumes(specs []string) ([]hypervisor.Volume, error) {
+	res := make([]hypervisor.Volume, 0, len(specs))
+	mounted := make(map[string]string)
+	for _, spec := range specs {
+		v, err := resolveVolume(spec)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := mounted[v.MountPoint]; ok {
+			return nil, fmt.Errorf("volumes %s and %s are both mounted to %s", other, spec, v.MountPoint)
+		}
+		mounted[v.MountPoint] = spec
+		res = append(res, *v)
+	}
+	return res, nil
+}
+
+func resolveVolume(spec string) (*hypervisor.Volume, error) {
+	parts := strings.Split(spec, ":")
+	source, size, mountPoint := parts[0], "", ""
+	for _, part := range parts[1:] {
+		switch {
+		case strings.HasPrefix(part, "/") && mountPoint == "":
+			mountPoint = part
+		case size == "" && mountPoint == "":
+			size = part
+		default:
+			return nil, fmt.Errorf("invalid volume '%s': expected name[:size][:mount_point] or path[:mount_point]", spec)
+		}
+	}
+
+	var path, name string
+	if strings.ContainsRune(source, '/') || strings.ContainsRune(source, filepath.Separator) {
+		// Disk image on the host.
+		if size != "" {
+			return nil, fmt.Errorf("invalid volume '%s': size can only be given for named volumes", spec)
+		}
+		var err error
+		if path, err = filepath.Abs(source); err != nil {
+			return nil, err
+		}
+		if f, err := os.Stat(path); err != nil || !f.Mode().IsRegular() {
+			return nil, fmt.Errorf("invalid volume '%s': %s is not a disk image", spec, source)
+		}
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	} else {
+		if !volumeNamePattern.MatchString(source) {
+			return nil, fmt.Errorf("invalid volume '%s': use letters, digits, '.', '_' and '-' in volume name", spec)
+		}
+		name, path = source, volumePath(source)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if size == "" {
+				return nil, fmt.Errorf("volume %s not found, create it with 'capstan volume create' or give its size e.g. %s:1G", source, source)
+			}
+			if err := CreateVolume(source, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if mountPoint == "" {
+		mountPoint = "/volumes/" + name
+	}
+
+	v := &hypervisor.Volume{Path: path, MountPoint: mountPoint}
+	format, err := image.Probe(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case image.RAW:
+		v.Format = "raw"
+	case image.QCOW2:
+		v.Format = "qcow2"
+	default:
+		return nil, fmt.Errorf("invalid volume '%s': only raw and qcow2 disk images can be attached", spec)
+	}
+	v.Filesystem = volumeFilesystem(path, v.Format)
+	return v, nil
+}
+
+// volumeFilesystem returns filesystem of the disk image as OSv mounts it.
+// Raw images with ext superblock are mounted as ext, all other as ZFS which
+// OSv images use.
+func volumeFilesystem(path, format string) string {
+	if format != "raw" {
+		return "zfs"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "zfs"
+	}
+	defer f.Close()
+
+	// Magic number of ext superblock is at offset 56 of the superblock that
+	// starts 1024 bytes into the disk.
+	var magic uint16
+	if _, err := f.Seek(1024+56, io.SeekStart); err != nil {
+		return "zfs"
+	}
+	if err := binary.Read(f, binary.LittleEndian, &magic); err != nil || magic != 0xef53 {
+		return "zfs"
+	}
+	return "ext"
+}
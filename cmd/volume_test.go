@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/hypervisor/fake"
+	"github.com/mikelangelo-project/capstan/runtime"
+	"github.com/mikelangelo-project/capstan/util"
+
+	. "gopkg.in/check.v1"
+)
+
+type volumeSuite struct {
+	instancesSuite
+}
+
+var _ = Suite(&volumeSuite{})
+
+func (s *volumeSuite) SetUpTest(c *C) {
+	if _, err := exec.LookPath(mkfsCommand); err != nil {
+		c.Skip(mkfsCommand + " is needed to create volumes")
+	}
+
+	// Volumes are stored in the home directory as well.
+	s.instancesSuite.SetUpTest(c)
+}
+
+func (s *volumeSuite) TestCreateListDeleteVolume(c *C) {
+	// This is what we're testing here.
+	err := CreateVolume("pgdata", "16M")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	path := filepath.Join(util.VolumesPath(), "pgdata.img")
+	c.Check(volumeFilesystem(path, "raw"), Equals, "ext")
+	c.Check(CreateVolume("pgdata", "16M"), ErrorMatches, "volume pgdata already exists")
+
+	var out bytes.Buffer
+	c.Check(ListVolumes(&out), IsNil)
+	c.Check(out.String(), Matches, "Name +Size +Created +Instances\npgdata +16.0MB +[0-9-]+ [0-9:]+ +\n")
+
+	// This is what we're testing here.
+	err = DeleteVolume("pgdata")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	_, err = os.Stat(path)
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(DeleteVolume("pgdata"), ErrorMatches, "volume pgdata not found")
+}
+
+func (s *volumeSuite) TestResolveVolumes(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "data.img"), make([]byte, 4096), 0644), IsNil)
+	c.Assert(CreateVolume("cache", "16M"), IsNil)
+
+	// This is what we're testing here.
+	volumes, err := ResolveVolumes([]string{
+		"pgdata:16M:/var/lib/postgresql",
+		"cache",
+		filepath.Join(dir, "data.img") + ":/data",
+	})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(volumes, DeepEquals, []hypervisor.Volume{
+		{Path: volumePath("pgdata"), Format: "raw", Filesystem: "ext", MountPoint: "/var/lib/postgresql"},
+		{Path: volumePath("cache"), Format: "raw", Filesystem: "ext", MountPoint: "/volumes/cache"},
+		{Path: filepath.Join(dir, "data.img"), Format: "raw", Filesystem: "zfs", MountPoint: "/data"},
+	})
+}
+
+func (s *volumeSuite) TestResolveVolumesFails(c *C) {
+	m := []struct {
+		comment     string
+		volumes     []string
+		expectedErr string
+	}{
+		{
+			"missing volume", []string{"pgdata"},
+			"volume pgdata not found, create it with 'capstan volume create' or give its size e.g. pgdata:1G",
+		},
+		{
+			"missing file", []string{"./missing.img"},
+			"invalid volume './missing.img': ./missing.img is not a disk image",
+		},
+		{
+			"size of file", []string{"./missing.img:1G"},
+			"invalid volume './missing.img:1G': size can only be given for named volumes",
+		},
+		{
+			"too many parts", []string{"pgdata:1G:/data:/other"},
+			"invalid volume 'pgdata:1G:/data:/other': expected .*",
+		},
+		{
+			"invalid size", []string{"pgdata:lots"},
+			"lots: unrecognized memory size",
+		},
+		{
+			"same mount point", []string{"a:16M:/data", "b:16M:/data"},
+			"volumes a:16M:/data and b:16M:/data are both mounted to /data",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		_, err := ResolveVolumes(args.volumes)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+	}
+}
+
+func (s *volumeSuite) TestRunWithVolumes(c *C) {
+	image := filepath.Join(c.MkDir(), "demo.qcow2")
+	writeOverlay(c, image, "")
+	config := &runtime.RunConfig{
+		InstanceName: "db",
+		ImageName:    image,
+		Hypervisor:   fake.Name,
+		Memory:       "512M",
+		Cpus:         2,
+		Networking:   "nat",
+		Networks:     []hypervisor.Network{{Mode: "tap", Bridge: "tap0"}},
+		Volumes:      []string{"pgdata:16M:/var/lib/postgresql"},
+	}
+
+	// This is what we're testing here.
+	err := RunInstance(s.repo, config)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Assert(s.driver.Launched, HasLen, 1)
+	c.Check(s.driver.Launched[0].Networks, DeepEquals, config.Networks)
+	c.Check(s.driver.Launched[0].Volumes, DeepEquals, []hypervisor.Volume{
+		{Path: volumePath("pgdata"), Format: "raw", Filesystem: "ext", MountPoint: "/var/lib/postgresql"},
+	})
+	r, err := LoadInstanceRecord(fake.Name, "db")
+	c.Assert(err, IsNil)
+	c.Check(r.Volumes, DeepEquals, []string{volumePath("pgdata") + ":/var/lib/postgresql"})
+
+	c.Check(DeleteVolume("pgdata"), ErrorMatches, "volume pgdata is used by instance db, delete the instance first")
+	c.Assert(Delete("db"), IsNil)
+	c.Check(DeleteVolume("pgdata"), IsNil)
+}
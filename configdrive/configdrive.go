@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package configdrive generates contextualization disks in NoCloud format
+// that are read by cloud-init module of OSv when the unikernel boots.
+package configdrive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// VolumeLabel is label of the disk that NoCloud data source looks for.
+	VolumeLabel = "cidata"
+
+	UserDataFile      = "user-data"
+	MetaDataFile      = "meta-data"
+	NetworkConfigFile = "network-config"
+)
+
+// ConfigDrive is content of the contextualization disk of an instance.
+type ConfigDrive struct {
+	// InstanceID and Hostname are passed in meta-data.
+	InstanceID string
+	Hostname   string
+	// MAC is address of the network interface that is configured with
+	// DHCP in network-config. Network config is omitted when empty.
+	MAC string
+
+	// ConfigSet is name of the config set that the unikernel boots with.
+	ConfigSet string
+	// Env contains environment variables set before the application starts.
+	Env map[string]string
+	// Files maps guest paths to host files whose content is written there.
+	Files map[string]string
+}
+
+// ParseFiles parses file specifications of form local_path:guest_path.
+func ParseFiles(specs []string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i <= 0 || i == len(spec)-1 {
+			return nil, fmt.Errorf("invalid file '%s', expected local_path:guest_path", spec)
+		}
+		guestPath := spec[i+1:]
+		if !strings.HasPrefix(guestPath, "/") {
+			return nil, fmt.Errorf("invalid file '%s', guest path must be absolute", spec)
+		}
+		res[guestPath] = spec[:i]
+	}
+	return res, nil
+}
+
+// UserData returns user-data in cloud-config format. Files are written first,
+// then environment variables are set and finally the config set is started
+// through REST API of OSv.
+func (d *ConfigDrive) UserData() ([]byte, error) {
+	type restCall struct {
+		PUT     string `yaml:"PUT"`
+		Val     string `yaml:"val,omitempty"`
+		Command string `yaml:"command,omitempty"`
+	}
+	content := struct {
+		Files map[string]string `yaml:"files,omitempty"`
+		Run   []restCall        `yaml:"run,omitempty"`
+	}{}
+
+	if len(d.Files) > 0 {
+		content.Files = make(map[string]string)
+		for guestPath, localPath := range d.Files {
+			data, err := ioutil.ReadFile(localPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file for config drive: %s", err)
+			}
+			content.Files[guestPath] = string(data)
+		}
+	}
+
+	for _, k := range sortedKeys(d.Env) {
+		content.Run = append(content.Run, restCall{PUT: "/env/" + k, Val: d.Env[k]})
+	}
+	if d.ConfigSet != "" {
+		content.Run = append(content.Run, restCall{PUT: "/app/", Command: "runscript " + util.QuoteArg("/run/"+d.ConfigSet)})
+	}
+
+	data, err := yaml.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), data...), nil
+}
+
+// MetaData returns meta-data identifying the instance.
+func (d *ConfigDrive) MetaData() ([]byte, error) {
+	content := struct {
+		InstanceID string `yaml:"instance-id"`
+		Hostname   string `yaml:"local-hostname,omitempty"`
+	}{d.InstanceID, d.Hostname}
+	return yaml.Marshal(content)
+}
+
+// NetworkConfig returns network-config in version 1 format or nil when
+// there is nothing to configure.
+func (d *ConfigDrive) NetworkConfig() ([]byte, error) {
+	if d.MAC == "" {
+		return nil, nil
+	}
+
+	type subnet struct {
+		Type string `yaml:"type"`
+	}
+	type iface struct {
+		Type       string   `yaml:"type"`
+		Name       string   `yaml:"name"`
+		MacAddress string   `yaml:"mac_address"`
+		Subnets    []subnet `yaml:"subnets"`
+	}
+	content := struct {
+		Version int     `yaml:"version"`
+		Config  []iface `yaml:"config"`
+	}{1, []iface{{"physical", "eth0", d.MAC, []subnet{{"dhcp"}}}}}
+	return yaml.Marshal(content)
+}
+
+// WriteFiles writes files of the config drive into given directory.
+func (d *ConfigDrive) WriteFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content func() ([]byte, error)
+	}{
+		{UserDataFile, d.UserData},
+		{MetaDataFile, d.MetaData},
+		{NetworkConfigFile, d.NetworkConfig},
+	}
+	for _, f := range files {
+		data, err := f.content()
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create builds ISO 9660 image of the config drive labelled cidata at given
+// path. One of genisoimage, mkisofs and xorrisofs (hdiutil on macOS) is used.
+func (d *ConfigDrive) Create(path string) error {
+	dir, err := ioutil.TempDir("", "capstan-cidata")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := d.WriteFiles(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+	os.Remove(path)
+
+	cmd, err := isoCommand(dir, path)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to create config drive %s: %s %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func isoCommand(dir, path string) (*exec.Cmd, error) {
+	for _, tool := range []string{"genisoimage", "mkisofs", "xorrisofs"} {
+		if toolPath, err := exec.LookPath(tool); err == nil {
+			return exec.Command(toolPath, "-output", path, "-volid", VolumeLabel, "-joliet", "-rock", "-quiet", dir), nil
+		}
+	}
+	if runtime.GOOS == "darwin" {
+		if toolPath, err := exec.LookPath("hdiutil"); err == nil {
+			return exec.Command(toolPath, "makehybrid", "-iso", "-joliet", "-default-volume-name", VolumeLabel, "-o", path, dir), nil
+		}
+	}
+	return nil, fmt.Errorf("No tool to create config drive found. Please install genisoimage, mkisofs or xorriso.")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package configdrive
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type suite struct{}
+
+var _ = Suite(&suite{})
+
+func (*suite) TestParseFiles(c *C) {
+	m := []struct {
+		comment     string
+		specs       []string
+		expected    map[string]string
+		expectedErr string
+	}{
+		{
+			"simple",
+			[]string{"./app.conf:/etc/app.conf", "/tmp/key.pem:/keys/key.pem"},
+			map[string]string{"/etc/app.conf": "./app.conf", "/keys/key.pem": "/tmp/key.pem"},
+			"",
+		},
+		{
+			"colon in local path",
+			[]string{"C:/app.conf:/etc/app.conf"},
+			map[string]string{"/etc/app.conf": "C:/app.conf"},
+			"",
+		},
+		{
+			"missing guest path",
+			[]string{"./app.conf"},
+			nil,
+			"invalid file './app.conf', expected local_path:guest_path",
+		},
+		{
+			"relative guest path",
+			[]string{"./app.conf:etc/app.conf"},
+			nil,
+			"invalid file './app.conf:etc/app.conf', guest path must be absolute",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		files, err := ParseFiles(args.specs)
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Check(err, ErrorMatches, args.expectedErr)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(files, DeepEquals, args.expected)
+		}
+	}
+}
+
+func (*suite) TestUserData(c *C) {
+	tmp := c.MkDir()
+	ioutil.WriteFile(filepath.Join(tmp, "app.conf"), []byte("port=8000\n"), 0644)
+
+	d := ConfigDrive{
+		ConfigSet: "worker",
+		Env:       map[string]string{"PORT": "8000", "DEBUG": "true"},
+		Files:     map[string]string{"/etc/app.conf": filepath.Join(tmp, "app.conf")},
+	}
+
+	// This is what we're testing here.
+	data, err := d.UserData()
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `#cloud-config
+files:
+  /etc/app.conf: |
+    port=8000
+run:
+- PUT: /env/DEBUG
+  val: "true"
+- PUT: /env/PORT
+  val: "8000"
+- PUT: /app/
+  command: runscript /run/worker
+`)
+}
+
+func (*suite) TestUserDataQuotesConfigSet(c *C) {
+	d := ConfigDrive{ConfigSet: "my worker"}
+
+	// This is what we're testing here.
+	data, err := d.UserData()
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `#cloud-config
+run:
+- PUT: /app/
+  command: runscript "/run/my worker"
+`)
+}
+
+func (*suite) TestUserDataEmpty(c *C) {
+	d := ConfigDrive{}
+
+	// This is what we're testing here.
+	data, err := d.UserData()
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "#cloud-config\n{}\n")
+}
+
+func (*suite) TestUserDataMissingFile(c *C) {
+	d := ConfigDrive{Files: map[string]string{"/etc/app.conf": filepath.Join(c.MkDir(), "missing")}}
+
+	// This is what we're testing here.
+	_, err := d.UserData()
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "failed to read file for config drive: .*no such file or directory")
+}
+
+func (*suite) TestWriteFiles(c *C) {
+	m := []struct {
+		comment  string
+		mac      string
+		expected map[string]string
+	}{
+		{
+			"without network config",
+			"",
+			map[string]string{
+				UserDataFile: "#cloud-config\n{}\n",
+				MetaDataFile: "instance-id: demo\nlocal-hostname: demo\n",
+			},
+		},
+		{
+			"with network config",
+			"52:54:00:12:34:56",
+			map[string]string{
+				UserDataFile: "#cloud-config\n{}\n",
+				MetaDataFile: "instance-id: demo\nlocal-hostname: demo\n",
+				NetworkConfigFile: `version: 1
+config:
+- type: physical
+  name: eth0
+  mac_address: "52:54:00:12:34:56"
+  subnets:
+  - type: dhcp
+`,
+			},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		tmp := c.MkDir()
+		d := ConfigDrive{InstanceID: "demo", Hostname: "demo", MAC: args.mac}
+
+		// This is what we're testing here.
+		err := d.WriteFiles(tmp)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		infos, _ := ioutil.ReadDir(tmp)
+		c.Check(infos, HasLen, len(args.expected))
+		for name, content := range args.expected {
+			data, err := ioutil.ReadFile(filepath.Join(tmp, name))
+			c.Check(err, IsNil)
+			c.Check(string(data), Equals, content)
+		}
+	}
+}
+
+func (*suite) TestCreate(c *C) {
+	if _, err := isoCommand(c.MkDir(), "disk.iso"); err != nil {
+		c.Skip(err.Error())
+	}
+	path := filepath.Join(c.MkDir(), "instance", "cidata.iso")
+	d := ConfigDrive{InstanceID: "demo", Env: map[string]string{"PORT": "8000"}}
+
+	// This is what we're testing here.
+	err := d.Create(path)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	out, err := exec.Command("file", path).Output()
+	if err == nil {
+		c.Check(string(out), Matches, "(?s).*ISO 9660.*'cidata'.*")
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package hypervisor defines Driver that each supported hypervisor implements
+// and a registry that drivers add themselves to when their package is imported.
+package hypervisor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/image"
+	"github.com/mikelangelo-project/capstan/nat"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+// ConfigDriveFile is name of the contextualization disk in instance directory.
+const ConfigDriveFile = "cidata.iso"
+
+// RunOptions apply to a single run of an instance.
+type RunOptions struct {
+	// Cmd is command line that is set before the instance boots, if any.
+	Cmd string
+	// ConfigDrive is path of NoCloud contextualization disk, if any.
+	ConfigDrive string
+	// Stdin and Stdout replace the terminal as console of the instance when
+	// set, e.g. when it runs in background.
+	Stdin  io.Reader `yaml:"-"`
+	Stdout io.Writer `yaml:"-"`
+}
+
+// Config describes a new instance.
+type Config struct {
+	RunOptions `yaml:",inline"`
+
+	Name string
+	// Image is path of the image that the instance is created from. For
+	// GCE it is either a local tarball or a gs:// location.
+	Image        string
+	Memory       int64
+	Cpus         int
+	Networking   string
+	Bridge       string
+	NatRules     []nat.Rule
+	MAC          string
+	DisableKvm   bool
+	Persist      bool
+	GCEUploadDir string
+	// Networks are network devices of the instance in addition to the one
+	// given by Networking, Bridge and MAC.
+	Networks []Network
+	// Volumes are disks attached to the instance in addition to its image.
+	Volumes []Volume
+	// Mounts are host directories shared with the instance.
+	Mounts []Mount
+}
+
+// Network is a network device of the instance.
+type Network struct {
+	// Mode is networking of the device: nat, bridge, tap or vhost.
+	Mode string
+	// Bridge is bridge or tap device that the device is attached to.
+	Bridge string
+	// MAC is generated when empty.
+	MAC string
+}
+
+// Volume is a disk that is attached to the instance and mounted in the
+// guest.
+type Volume struct {
+	// Path is path of the disk image on the host.
+	Path string
+	// Format is image format of the disk, raw or qcow2.
+	Format string
+	// Filesystem is type of filesystem on the disk as OSv mounts it, e.g.
+	// ext or zfs.
+	Filesystem string
+	// MountPoint is directory that the filesystem is mounted to in the
+	// guest.
+	MountPoint string
+}
+
+// Mount shares a host directory with the instance.
+type Mount struct {
+	// Source is absolute path of the directory on the host.
+	Source string
+	// Target is directory that Source is mounted to in the guest.
+	Target string
+}
+
+// Capabilities tell which optional features a driver supports.
+type Capabilities struct {
+	// Detach tells whether instances can run in background, i.e. with
+	// console other than the terminal.
+	Detach bool
+	// ConfigDrive tells whether contextualization disk can be attached.
+	ConfigDrive bool
+	// Remote tells that instances do not run on this host and have no
+	// console attached to the terminal.
+	Remote bool
+	// Networks tells whether instances can have more than one network
+	// device.
+	Networks bool
+	// Volumes tells whether volumes can be attached to instances.
+	Volumes bool
+	// Mounts tells whether host directories can be shared with instances.
+	Mounts bool
+	// Formats are image formats that can be run, nil meaning all.
+	Formats []image.ImageFormat
+}
+
+// Driver creates and manages instances of a single hypervisor. Instances are
+// identified by name and keep their files in InstanceDir.
+type Driver interface {
+	// Name returns name of the hypervisor e.g. qemu.
+	Name() string
+
+	// Capabilities returns optional features of the driver.
+	Capabilities() Capabilities
+
+	// Launch creates instance and starts it. Returned command, if not nil,
+	// runs until the instance stops.
+	Launch(c *Config) (*exec.Cmd, error)
+
+	// Start starts existing instance.
+	Start(name string, opts *RunOptions) (*exec.Cmd, error)
+
+	// Stop stops the instance.
+	Stop(name string) error
+
+	// Delete removes the instance and all its files.
+	Delete(name string) error
+
+	// Status returns Running, Stopped or a status specific to the
+	// hypervisor e.g. Paused.
+	Status(name string) (string, error)
+}
+
+// Stats are resource usage counters of a running instance that are only
+// known to the hypervisor.
+type Stats struct {
+	BlockReadBytes  int64
+	BlockWriteBytes int64
+}
+
+// StatsReporter is implemented by drivers that report resource usage of
+// running instances.
+type StatsReporter interface {
+	Stats(name string) (*Stats, error)
+}
+
+// Snapshot is saved state of an instance.
+type Snapshot struct {
+	Name string
+	// MemorySize is size of saved memory of the instance, zero for
+	// snapshots of disk only.
+	MemorySize int64
+	Created    time.Time
+}
+
+// Snapshotter is implemented by drivers that can save state of instances
+// and return to it later.
+type Snapshotter interface {
+	CreateSnapshot(name, snapshot string) error
+	Snapshots(name string) ([]Snapshot, error)
+	RestoreSnapshot(name, snapshot string) error
+	DeleteSnapshot(name, snapshot string) error
+}
+
+// DiskExporter is implemented by drivers that can write disk of a stopped
+// instance, including everything it is based on, into a standalone image.
+type DiskExporter interface {
+	ExportDisk(name, path string) error
+}
+
+var drivers = make(map[string]Driver)
+
+// Register makes driver available by its name. Driver that was registered
+// under the same name before is replaced.
+func Register(d Driver) {
+	drivers[d.Name()] = d
+}
+
+// Get returns driver of the hypervisor.
+func Get(name string) (Driver, error) {
+	if d, ok := drivers[name]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("%s: is not a supported hypervisor", name)
+}
+
+// Names returns names of all registered hypervisors.
+func Names() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// InstanceDir returns directory of the instance.
+func InstanceDir(platform, name string) string {
+	return filepath.Join(util.InstancesPath(), platform, name)
+}
+
+// ParseNetworks parses network devices of form mode[:device], e.g. nat or
+// bridge:virbr0.
+func ParseNetworks(specs []string) ([]Network, error) {
+	res := make([]Network, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		n := Network{Mode: parts[0]}
+		if len(parts) == 2 {
+			n.Bridge = parts[1]
+		}
+		switch n.Mode {
+		case "nat":
+			if n.Bridge != "" {
+				return nil, fmt.Errorf("invalid network '%s': nat networking has no device", spec)
+			}
+		case "bridge", "vhost":
+		case "tap":
+			if n.Bridge == "" {
+				return nil, fmt.Errorf("invalid network '%s': tap device must be provided e.g. tap:tap0", spec)
+			}
+		default:
+			return nil, fmt.Errorf("invalid network '%s': networking must be nat, bridge, tap or vhost", spec)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// ParseMounts parses host directories to share of form host_dir:guest_dir,
+// e.g. ./src:/app. Host directories are made absolute.
+func ParseMounts(specs []string) ([]Mount, error) {
+	res := make([]Mount, 0, len(specs))
+	targets := make(map[string]bool)
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 2 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+			return nil, fmt.Errorf("invalid mount '%s': expected host_dir:guest_dir e.g. ./src:/app", spec)
+		}
+		source, err := filepath.Abs(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if f, err := os.Stat(source); err != nil || !f.IsDir() {
+			return nil, fmt.Errorf("invalid mount '%s': %s is not a directory", spec, parts[0])
+		}
+		target := path.Clean(parts[1])
+		if targets[target] {
+			return nil, fmt.Errorf("invalid mount '%s': %s is mounted more than once", spec, target)
+		}
+		targets[target] = true
+		res = append(res, Mount{Source: source, Target: target})
+	}
+	return res, nil
+}
+
+// SupportsFormat tells whether driver with given capabilities can run images
+// of the format.
+func (c Capabilities) SupportsFormat(format image.ImageFormat) bool {
+	if c.Formats == nil {
+		return true
+	}
+	for _, f := range c.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
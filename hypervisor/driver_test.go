@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package hypervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mikelangelo-project/capstan/image"
+)
+
+type testDriver struct {
+	name string
+}
+
+func (d *testDriver) Name() string                                        { return d.name }
+func (d *testDriver) Capabilities() Capabilities                          { return Capabilities{} }
+func (d *testDriver) Launch(c *Config) (*exec.Cmd, error)                 { return nil, nil }
+func (d *testDriver) Start(name string, o *RunOptions) (*exec.Cmd, error) { return nil, nil }
+func (d *testDriver) Stop(name string) error                              { return nil }
+func (d *testDriver) Delete(name string) error                            { return nil }
+func (d *testDriver) Status(name string) (string, error)                  { return "Stopped", nil }
+
+func TestRegistry(t *testing.T) {
+	first := &testDriver{"test-b"}
+	second := &testDriver{"test-b"}
+	Register(&testDriver{"test-a"})
+	Register(first)
+	Register(second)
+
+	if d, err := Get("test-b"); err != nil || d != second {
+		t.Errorf("Get(\"test-b\") => %v, %v, want the last registered driver", d, err)
+	}
+	if _, err := Get("test-c"); err == nil || err.Error() != "test-c: is not a supported hypervisor" {
+		t.Errorf("Get(\"test-c\") => error %v, want not supported", err)
+	}
+	if names := Names(); !reflect.DeepEqual(names, []string{"test-a", "test-b"}) {
+		t.Errorf("Names() => %q, want [test-a test-b]", names)
+	}
+}
+
+func TestSupportsFormat(t *testing.T) {
+	all := Capabilities{}
+	vmdk := Capabilities{Formats: []image.ImageFormat{image.VMDK}}
+
+	if !all.SupportsFormat(image.QCOW2) {
+		t.Errorf("driver without formats should support all of them")
+	}
+	if !vmdk.SupportsFormat(image.VMDK) || vmdk.SupportsFormat(image.QCOW2) {
+		t.Errorf("driver should only support listed formats")
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"nat", "bridge", "bridge:br1", "tap:tap0"})
+	if err != nil {
+		t.Fatalf("ParseNetworks() => error %q", err)
+	}
+	want := []Network{{Mode: "nat"}, {Mode: "bridge"}, {Mode: "bridge", Bridge: "br1"}, {Mode: "tap", Bridge: "tap0"}}
+	if !reflect.DeepEqual(networks, want) {
+		t.Errorf("ParseNetworks() => %v, want %v", networks, want)
+	}
+
+	for _, spec := range []string{"nat:eth0", "tap", "host"} {
+		if _, err := ParseNetworks([]string{spec}); err == nil {
+			t.Errorf("ParseNetworks([%q]) => no error, want invalid network", spec)
+		}
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounts, err := ParseMounts([]string{dir + ":/app/", dir + ":/static"})
+	if err != nil {
+		t.Fatalf("ParseMounts() => error %q", err)
+	}
+	want := []Mount{{Source: dir, Target: "/app"}, {Source: dir, Target: "/static"}}
+	if !reflect.DeepEqual(mounts, want) {
+		t.Errorf("ParseMounts() => %v, want %v", mounts, want)
+	}
+
+	for _, specs := range [][]string{
+		{dir},
+		{dir + ":app"},
+		{dir + ":/app:ro"},
+		{filepath.Join(dir, "missing") + ":/app"},
+		{dir + ":/app", dir + ":/app/"},
+	} {
+		if _, err := ParseMounts(specs); err == nil {
+			t.Errorf("ParseMounts(%q) => no error, want invalid mount", specs)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package fake provides hypervisor driver that does not run anything. It
+// records what it was asked to do and is meant to be used in tests.
+package fake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+)
+
+// Name is name of the fake hypervisor.
+const Name = "fake"
+
+// Driver pretends to run instances. Launched instances get a directory with
+// osv.config so that they are found like instances of other hypervisors.
+type Driver struct {
+	Caps hypervisor.Capabilities
+	// Err, when set, is returned by all operations.
+	Err error
+	// Command, when set, is run with console of the instance in place of
+	// the hypervisor.
+	Command []string
+
+	Launched []hypervisor.Config
+	Started  map[string]hypervisor.RunOptions
+	Stopped  []string
+	Deleted  []string
+	Running  map[string]bool
+	// InstanceStats are reported by Stats for running instances.
+	InstanceStats map[string]hypervisor.Stats
+	// InstanceSnapshots are snapshots of instances, Restored are names of
+	// snapshots that instances were restored to.
+	InstanceSnapshots map[string][]hypervisor.Snapshot
+	Restored          map[string]string
+	// Exported are paths that disks of instances were exported to.
+	Exported map[string]string
+}
+
+// New returns driver that supports all optional features.
+func New() *Driver {
+	return &Driver{
+		Caps:              hypervisor.Capabilities{Detach: true, ConfigDrive: true, Networks: true, Volumes: true, Mounts: true},
+		Started:           make(map[string]hypervisor.RunOptions),
+		Running:           make(map[string]bool),
+		InstanceStats:     make(map[string]hypervisor.Stats),
+		InstanceSnapshots: make(map[string][]hypervisor.Snapshot),
+		Restored:          make(map[string]string),
+		Exported:          make(map[string]string),
+	}
+}
+
+// Register registers new fake driver and returns it.
+func Register() *Driver {
+	d := New()
+	hypervisor.Register(d)
+	return d
+}
+
+func (d *Driver) Name() string {
+	return Name
+}
+
+func (d *Driver) Capabilities() hypervisor.Capabilities {
+	return d.Caps
+}
+
+func (d *Driver) Launch(c *hypervisor.Config) (*exec.Cmd, error) {
+	if d.Err != nil {
+		return nil, d.Err
+	}
+
+	dir := hypervisor.InstanceDir(Name, c.Name)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "osv.config"), []byte("image: "+c.Image+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	d.Launched = append(d.Launched, *c)
+	d.Running[c.Name] = true
+	return d.run(&c.RunOptions)
+}
+
+func (d *Driver) Start(name string, opts *hypervisor.RunOptions) (*exec.Cmd, error) {
+	if d.Err != nil {
+		return nil, d.Err
+	}
+	d.Started[name] = *opts
+	d.Running[name] = true
+	return d.run(opts)
+}
+
+func (d *Driver) Stop(name string) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	d.Stopped = append(d.Stopped, name)
+	d.Running[name] = false
+	return nil
+}
+
+func (d *Driver) Delete(name string) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	d.Deleted = append(d.Deleted, name)
+	delete(d.Running, name)
+	return os.RemoveAll(hypervisor.InstanceDir(Name, name))
+}
+
+func (d *Driver) Status(name string) (string, error) {
+	if d.Running[name] {
+		return "Running", nil
+	}
+	return "Stopped", nil
+}
+
+func (d *Driver) Stats(name string) (*hypervisor.Stats, error) {
+	if !d.Running[name] {
+		return nil, fmt.Errorf("instance %s is not running", name)
+	}
+	stats := d.InstanceStats[name]
+	return &stats, nil
+}
+
+func (d *Driver) CreateSnapshot(name, snapshot string) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	s := hypervisor.Snapshot{Name: snapshot, Created: time.Now()}
+	if d.Running[name] {
+		s.MemorySize = 1024
+	}
+	d.InstanceSnapshots[name] = append(d.InstanceSnapshots[name], s)
+	return nil
+}
+
+func (d *Driver) Snapshots(name string) ([]hypervisor.Snapshot, error) {
+	if d.Err != nil {
+		return nil, d.Err
+	}
+	return d.InstanceSnapshots[name], nil
+}
+
+func (d *Driver) RestoreSnapshot(name, snapshot string) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	for _, s := range d.InstanceSnapshots[name] {
+		if s.Name == snapshot {
+			d.Restored[name] = snapshot
+			return nil
+		}
+	}
+	return fmt.Errorf("snapshot %s does not exist", snapshot)
+}
+
+func (d *Driver) DeleteSnapshot(name, snapshot string) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	snapshots := d.InstanceSnapshots[name]
+	for i, s := range snapshots {
+		if s.Name == snapshot {
+			d.InstanceSnapshots[name] = append(snapshots[:i], snapshots[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("snapshot %s does not exist", snapshot)
+}
+
+// ExportDisk copies the image that the instance was launched with.
+func (d *Driver) ExportDisk(name, path string) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	for _, c := range d.Launched {
+		if c.Name != name {
+			continue
+		}
+		data, err := ioutil.ReadFile(c.Image)
+		if err != nil {
+			return err
+		}
+		d.Exported[name] = path
+		return ioutil.WriteFile(path, data, 0644)
+	}
+	return fmt.Errorf("instance %s has no disk", name)
+}
+
+func (d *Driver) run(opts *hypervisor.RunOptions) (*exec.Cmd, error) {
+	if len(d.Command) == 0 {
+		return nil, nil
+	}
+
+	cmd := exec.Command(d.Command[0], d.Command[1:]...)
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package gce
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/image"
+)
+
+func init() {
+	hypervisor.Register(&Driver{})
+}
+
+// Driver runs instances on Google Compute Engine.
+type Driver struct{}
+
+func (d *Driver) Name() string {
+	return "gce"
+}
+
+func (d *Driver) Capabilities() hypervisor.Capabilities {
+	return hypervisor.Capabilities{Remote: true, Formats: []image.ImageFormat{image.GCE_TARBALL, image.GCE_GS}}
+}
+
+func (d *Driver) Launch(c *hypervisor.Config) (*exec.Cmd, error) {
+	dir := hypervisor.InstanceDir(d.Name(), c.Name)
+	config := &VMConfig{
+		Name:        c.Name,
+		Image:       c.Name,
+		Network:     "default",
+		MachineType: "n1-standard-1",
+		Zone:        "us-central1-a",
+		ConfigFile:  filepath.Join(dir, "osv.config"),
+		InstanceDir: dir,
+	}
+	if format, _ := image.Probe(c.Image); format == image.GCE_TARBALL {
+		config.CloudStoragePath = strings.TrimSuffix(c.GCEUploadDir, "/") + "/" + c.Name + ".tar.gz"
+		config.Tarball = c.Image
+	} else {
+		config.CloudStoragePath = c.Image
+		config.Tarball = ""
+	}
+	return LaunchVM(config)
+}
+
+func (d *Driver) Start(name string, opts *hypervisor.RunOptions) (*exec.Cmd, error) {
+	c, err := LoadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return LaunchVM(c)
+}
+
+func (d *Driver) Stop(name string) error {
+	return StopVM(name)
+}
+
+func (d *Driver) Delete(name string) error {
+	return DeleteVM(name)
+}
+
+func (d *Driver) Status(name string) (string, error) {
+	return GetVMStatus(name, hypervisor.InstanceDir(d.Name(), name))
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qemu
+
+import (
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+func init() {
+	hypervisor.Register(&Driver{})
+}
+
+// Driver runs instances with QEMU.
+type Driver struct{}
+
+func (d *Driver) Name() string {
+	return "qemu"
+}
+
+func (d *Driver) Capabilities() hypervisor.Capabilities {
+	return hypervisor.Capabilities{Detach: true, ConfigDrive: true, Networks: true, Volumes: true, Mounts: true}
+}
+
+func (d *Driver) Launch(c *hypervisor.Config) (*exec.Cmd, error) {
+	dir := hypervisor.InstanceDir(d.Name(), c.Name)
+	bridge := c.Bridge
+	if bridge == "" {
+		bridge = "virbr0"
+	}
+	networks := make([]hypervisor.Network, 0, len(c.Networks))
+	for _, n := range c.Networks {
+		if n.Bridge == "" && n.Mode == "bridge" {
+			n.Bridge = "virbr0"
+		}
+		networks = append(networks, n)
+	}
+	cmdLine := c.Cmd
+	if cmdLine == "" && (len(c.Volumes) > 0 || len(c.Mounts) > 0) {
+		// Mount options of volumes and host directories are put in front
+		// of the command line that the image boots with.
+		var err error
+		if cmdLine, err = util.GetCmdLine(c.Image); err != nil {
+			return nil, err
+		}
+	}
+	config := &VMConfig{
+		Name:        c.Name,
+		Image:       c.Image,
+		Verbose:     true,
+		Memory:      c.Memory,
+		Cpus:        c.Cpus,
+		Networking:  c.Networking,
+		Bridge:      bridge,
+		NatRules:    c.NatRules,
+		BackingFile: true,
+		InstanceDir: dir,
+		Monitor:     filepath.Join(dir, "osv.monitor"),
+		ConfigFile:  filepath.Join(dir, "osv.config"),
+		MAC:         c.MAC,
+		Cmd:         cmdLine,
+		DisableKvm:  c.DisableKvm,
+		Persist:     c.Persist,
+		ConfigDrive: c.ConfigDrive,
+		Networks:    networks,
+		Volumes:     c.Volumes,
+		Mounts:      c.Mounts,
+	}
+	return launch(config, &c.RunOptions)
+}
+
+func (d *Driver) Start(name string, opts *hypervisor.RunOptions) (*exec.Cmd, error) {
+	c, err := LoadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	// Also pass the command line to the instance (note that this is not stored in the config)
+	c.Cmd = opts.Cmd
+	if opts.ConfigDrive != "" {
+		c.ConfigDrive = opts.ConfigDrive
+	}
+	return launch(c, opts)
+}
+
+func (d *Driver) Stop(name string) error {
+	return StopVM(name)
+}
+
+func (d *Driver) Delete(name string) error {
+	return DeleteVM(name)
+}
+
+func (d *Driver) Status(name string) (string, error) {
+	return GetVMStatus(name, hypervisor.InstanceDir(d.Name(), name))
+}
+
+func (d *Driver) Stats(name string) (*hypervisor.Stats, error) {
+	return GetVMStats(hypervisor.InstanceDir(d.Name(), name))
+}
+
+func (d *Driver) ExportDisk(name, path string) error {
+	return ExportVMDisk(hypervisor.InstanceDir(d.Name(), name), path)
+}
+
+// launch starts the instance either attached to the terminal or with the
+// console given in options.
+func launch(c *VMConfig, opts *hypervisor.RunOptions) (*exec.Cmd, error) {
+	if opts.Stdout == nil {
+		return LaunchVM(c)
+	}
+
+	cmd, err := VMCommand(c)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stdout
+	if err := startVM(c, cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
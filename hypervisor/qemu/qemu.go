@@ -9,8 +9,9 @@
 package qemu
 
 import (
-	"bufio"
 	"fmt"
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu/qmp"
 	"github.com/mikelangelo-project/capstan/nat"
 	"github.com/mikelangelo-project/capstan/util"
 	"gopkg.in/yaml.v1"
@@ -22,6 +23,8 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type VMConfig struct {
@@ -41,6 +44,15 @@ type VMConfig struct {
 	Cmd         string
 	DisableKvm  bool
 	Persist     bool
+	// ConfigDrive is path of NoCloud contextualization disk, if any.
+	ConfigDrive string
+	// Networks are network devices in addition to the one given by
+	// Networking, Bridge and MAC.
+	Networks []hypervisor.Network
+	// Volumes are disks attached after the image and the config drive.
+	Volumes []hypervisor.Volume
+	// Mounts are host directories shared with virtiofs.
+	Mounts []hypervisor.Mount
 }
 
 type Version struct {
@@ -56,8 +68,12 @@ func DeleteVM(name string) error {
 		Monitor:     filepath.Join(dir, "osv.monitor"),
 		Image:       filepath.Join(dir, "disk.qcow2"),
 		ConfigFile:  filepath.Join(dir, "osv.config"),
+		ConfigDrive: filepath.Join(dir, hypervisor.ConfigDriveFile),
 	}
-	cmd := exec.Command("rm", "-f", c.Image, " ", c.Monitor, " ", c.ConfigFile)
+	// Sockets of virtiofsd are left behind when the instance shares host
+	// directories.
+	sockets, _ := filepath.Glob(filepath.Join(dir, "virtiofs*.sock"))
+	cmd := exec.Command("rm", append([]string{"-f", c.Image, " ", c.Monitor, " ", c.ConfigFile, " ", c.ConfigDrive}, sockets...)...)
 	_, err := cmd.Output()
 	if err != nil {
 		fmt.Printf("rm failed: %s, %s", c.Image, c.Monitor)
@@ -74,59 +90,204 @@ func DeleteVM(name string) error {
 	return nil
 }
 
+const (
+	// monitorTimeout is how long QEMU has to respond on its monitor.
+	monitorTimeout = 2 * time.Second
+	// fileServerTimeout is how long virtiofsd has to start listening.
+	fileServerTimeout = 5 * time.Second
+)
+
+// powerdownTimeout is how long the guest has to shut down after ACPI
+// powerdown before QEMU is told to quit.
+var powerdownTimeout = 10 * time.Second
+
 func StopVM(name string) error {
 	dir := filepath.Join(util.ConfigDir(), "instances/qemu", name)
 	c := &VMConfig{
 		Monitor: filepath.Join(dir, "osv.monitor"),
 	}
-	conn, err := net.Dial("unix", c.Monitor)
+	return stopVM(c.Monitor, powerdownTimeout)
+}
+
+// stopVM asks the guest to power down and tells QEMU to quit if the guest
+// does not shut down in time.
+func stopVM(monitor string, timeout time.Duration) error {
+	conn, err := net.Dial("unix", monitor)
 	if err != nil {
 		// The instance is stopped already
 		return nil
 	}
+	client, err := qmp.New(conn, monitorTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to QEMU monitor %s: %s", monitor, err)
+	}
+	defer client.Close()
 
-	writer := bufio.NewWriter(conn)
-
-	cmd := `{ "execute": "qmp_capabilities"}`
-	writer.WriteString(cmd)
-
-	cmd = `{ "execute": "system_powerdown" }`
-	writer.WriteString(cmd)
-
-	cmd = `{ "execute": "quit" }`
-	writer.WriteString(cmd)
-
-	writer.Flush()
+	status, stopWatching := watchStatus(client)
+	defer stopWatching()
+	if err := client.SystemPowerdown(); err != nil {
+		return err
+	}
 
-	return nil
+	deadline := time.After(timeout)
+	for {
+		select {
+		case s := <-status:
+			if s == "Stopped" {
+				return nil
+			}
+		case <-deadline:
+			return client.Quit()
+		}
+	}
 }
 
 func GetVMStatus(name, dir string) (string, error) {
 	c := &VMConfig{
 		Monitor: filepath.Join(dir, "osv.monitor"),
 	}
-	_, err := net.Dial("unix", c.Monitor)
+	conn, err := net.Dial("unix", c.Monitor)
 	if err != nil {
 		return "Stopped", nil
 	}
+	client, err := qmp.New(conn, monitorTimeout)
+	if err != nil {
+		// Monitor serves one client at a time, QEMU is running though.
+		return "Running", nil
+	}
+	defer client.Close()
 
-	return "Running", nil
+	status, err := client.QueryStatus()
+	if err == qmp.ErrClosed {
+		return "Stopped", nil
+	} else if err != nil {
+		return "", err
+	}
+	return runStatus(status.Status), nil
+}
+
+// GetVMStats returns block I/O counters of running instance. Instances have
+// no balloon device, memory usage is known from the QEMU process only.
+func GetVMStats(dir string) (*hypervisor.Stats, error) {
+	client, err := qmp.Dial(filepath.Join(dir, "osv.monitor"), monitorTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	stats := &hypervisor.Stats{}
+	blocks, err := client.QueryBlockstats()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		stats.BlockReadBytes += b.Stats.RdBytes
+		stats.BlockWriteBytes += b.Stats.WrBytes
+	}
+	return stats, nil
+}
+
+// ExportVMDisk writes disk of the instance in given directory together with
+// its backing image into a standalone qcow2 image. Internal snapshots of the
+// disk are not exported.
+func ExportVMDisk(dir, path string) error {
+	disk := filepath.Join(dir, "disk.qcow2")
+	if _, err := os.Stat(disk); err != nil {
+		return fmt.Errorf("instance in %s has no disk that could be exported", dir)
+	}
+	// Convert into a temporary file so that a failed conversion does not
+	// leave a partial image behind.
+	tmp := path + ".tmp"
+	out, err := exec.Command("qemu-img", "convert", "-O", "qcow2", disk, tmp).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("qemu-img convert failed: %s", strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, path)
+}
+
+// runStatus returns status of the instance given QEMU run state.
+func runStatus(state string) string {
+	switch state {
+	case "running":
+		return "Running"
+	case "shutdown":
+		return "Stopped"
+	case "guest-panicked", "internal-error", "io-error", "watchdog":
+		return "Crashed"
+	case "suspended":
+		return "Suspended"
+	default:
+		return "Paused"
+	}
+}
+
+// watchStatus returns channel that receives status of the instance each
+// time QEMU reports that it changed. Stopped is sent also when QEMU exits.
+// Returned function stops watching.
+func watchStatus(client *qmp.Client) (<-chan string, func()) {
+	events := client.Subscribe(qmp.EventShutdown, qmp.EventStop, qmp.EventResume,
+		qmp.EventSuspend, qmp.EventWakeup, qmp.EventGuestPanicked)
+	status := make(chan string)
+	quit := make(chan struct{})
+	send := func(s string) bool {
+		select {
+		case status <- s:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+	go func() {
+		for e := range events {
+			s := "Stopped"
+			switch e.Name {
+			case qmp.EventStop:
+				s = "Paused"
+			case qmp.EventResume, qmp.EventWakeup:
+				s = "Running"
+			case qmp.EventSuspend:
+				s = "Suspended"
+			case qmp.EventGuestPanicked:
+				s = "Crashed"
+			}
+			if !send(s) {
+				return
+			}
+		}
+		send("Stopped")
+	}()
+	return status, func() {
+		close(quit)
+		client.Unsubscribe(events)
+	}
 }
 
 func LoadConfig(name string) (*VMConfig, error) {
 	dir := filepath.Join(util.ConfigDir(), "instances/qemu", name)
 	file := filepath.Join(dir, "osv.config")
+	c, err := readConfig(file)
+	if _, ok := err.(*os.PathError); ok {
+		fmt.Printf("Failed to open: %s\n", file)
+	}
+	return c, err
+}
+
+// readConfig reads the config that instance was launched with.
+func readConfig(file string) (*VMConfig, error) {
 	c := VMConfig{}
 
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Printf("Failed to open: %s\n", file)
 		return nil, err
 	}
 	err = yaml.Unmarshal(data, &c)
 	if err != nil {
 		return nil, err
 	}
+	if err := nat.Validate(c.NatRules); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
 
 	return &c, nil
 }
@@ -168,8 +329,10 @@ func VMCommand(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 	}
 
 	if c.Cmd != "" {
-		fmt.Printf("Setting cmdline: %s\n", c.Cmd)
-		util.SetCmdLine(c.Image, c.Cmd)
+		// Volumes are mounted by options in front of the command.
+		cmdLine := c.vmMountOptions() + c.Cmd
+		fmt.Printf("Setting cmdline: %s\n", cmdLine)
+		util.SetCmdLine(c.Image, cmdLine)
 	}
 
 	if c.Persist {
@@ -194,6 +357,22 @@ func VMCommand(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
+// startVM starts the command of the VM together with virtiofsd for shared
+// host directories, which are killed if QEMU fails to start.
+func startVM(c *VMConfig, cmd *exec.Cmd) error {
+	servers, err := c.startFileServers()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		for _, server := range servers {
+			server.Process.Kill()
+		}
+		return err
+	}
+	return nil
+}
+
 func LaunchVM(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 	cmd, err := VMCommand(c, extra...)
 	if err != nil {
@@ -204,7 +383,7 @@ func LaunchVM(c *VMConfig, extra ...string) (*exec.Cmd, error) {
 		cmd.Stderr = os.Stderr
 	}
 	cmd.Stdin = os.Stdin
-	if err := cmd.Start(); err != nil {
+	if err := startVM(c, cmd); err != nil {
 		return nil, err
 	}
 	return cmd, nil
@@ -254,8 +433,9 @@ func ParseVersion(text string) (*Version, error) {
 	}, nil
 }
 
-func (c *VMConfig) vmDriveCache() string {
-	if util.IsDirectIOSupported(c.Image) {
+// vmDriveCache returns cache mode of the drive backed by given file.
+func vmDriveCache(path string) string {
+	if util.IsDirectIOSupported(path) {
 		return "none"
 	}
 	return "unsafe"
@@ -267,7 +447,16 @@ func (c *VMConfig) vmArguments(version *Version) ([]string, error) {
 	args = append(args, "-m", strconv.FormatInt(c.Memory, 10))
 	args = append(args, "-smp", strconv.Itoa(c.Cpus))
 	args = append(args, "-device", "virtio-blk-pci,id=blk0,bootindex=0,drive=hd0")
-	args = append(args, "-drive", "file="+c.Image+",if=none,id=hd0,aio=native,cache="+c.vmDriveCache())
+	args = append(args, "-drive", "file="+c.Image+",if=none,id=hd0,aio=native,cache="+vmDriveCache(c.Image))
+	if c.ConfigDrive != "" {
+		args = append(args, "-device", "virtio-blk-pci,id=blk1,drive=cidata")
+		args = append(args, "-drive", "file="+c.ConfigDrive+",if=none,id=cidata,format=raw,readonly=on")
+	}
+	for i, v := range c.Volumes {
+		args = append(args, "-device", fmt.Sprintf("virtio-blk-pci,id=blk%d,drive=vd%d", c.vmVolumeIndex(i), i))
+		args = append(args, "-drive", fmt.Sprintf("file=%s,if=none,id=vd%d,format=%s,aio=native,cache=%s", v.Path, i, v.Format, vmDriveCache(v.Path)))
+	}
+	args = append(args, c.vmMounts()...)
 	if version.Major >= 1 && version.Minor >= 3 {
 		args = append(args, "-device", "virtio-rng-pci")
 	}
@@ -287,17 +476,40 @@ func (c *VMConfig) vmArguments(version *Version) ([]string, error) {
 }
 
 func (c *VMConfig) vmMAC() (net.HardwareAddr, error) {
-	if c.MAC != "" {
-		return net.ParseMAC(c.MAC)
+	return vmMAC(c.MAC)
+}
+
+func vmMAC(mac string) (net.HardwareAddr, error) {
+	if mac != "" {
+		return net.ParseMAC(mac)
 	}
 	return util.GenerateMAC()
 }
 
+// vmNetworking returns arguments of all network devices, the one given by
+// Networking first. Ports are only forwarded by the first nat device.
 func (c *VMConfig) vmNetworking() ([]string, error) {
+	networks := append([]hypervisor.Network{{Mode: c.Networking, Bridge: c.Bridge, MAC: c.MAC}}, c.Networks...)
 	args := make([]string, 0)
-	switch c.Networking {
+	natRules := c.NatRules
+	for i, n := range networks {
+		nic, err := vmNIC(i, n, natRules)
+		if err != nil {
+			return nil, err
+		}
+		if n.Mode == "nat" {
+			natRules = nil
+		}
+		args = append(args, nic...)
+	}
+	return args, nil
+}
+
+// vmNIC returns arguments of i-th network device of the instance.
+func vmNIC(i int, n hypervisor.Network, natRules []nat.Rule) ([]string, error) {
+	switch n.Mode {
 	case "bridge":
-		mac, err := c.vmMAC()
+		mac, err := vmMAC(n.MAC)
 		if err != nil {
 			return nil, err
 		}
@@ -307,32 +519,139 @@ func (c *VMConfig) vmNetworking() ([]string, error) {
 			return nil, err
 		}
 
-		args = append(args, "-netdev", fmt.Sprintf("bridge,id=hn0,br=%s,helper=%s", c.Bridge, bridgeHelper), "-device", fmt.Sprintf("virtio-net-pci,netdev=hn0,id=nic1,mac=%s", mac.String()))
-		return args, nil
+		return []string{"-netdev", fmt.Sprintf("bridge,id=hn%d,br=%s,helper=%s", i, n.Bridge, bridgeHelper), "-device", fmt.Sprintf("virtio-net-pci,netdev=hn%d,id=nic%d,mac=%s", i, i+1, mac.String())}, nil
 	case "nat":
-		args = append(args, "-netdev", "user,id=un0,net=192.168.122.0/24,host=192.168.122.1", "-device", "virtio-net-pci,netdev=un0")
-		for _, portForward := range c.NatRules {
-			redirect := fmt.Sprintf("tcp:%s::%s", portForward.HostPort, portForward.GuestPort)
-			args = append(args, "-redir", redirect)
+		netdev := fmt.Sprintf("user,id=un%d,net=192.168.122.0/24,host=192.168.122.1", i)
+		for _, rule := range natRules {
+			for _, f := range rule.Forwards() {
+				netdev += fmt.Sprintf(",hostfwd=%s:%s:%d-:%d", rule.Protocol, rule.BindIP, f.HostPort, f.GuestPort)
+			}
 		}
-		return args, nil
+		return []string{"-netdev", netdev, "-device", fmt.Sprintf("virtio-net-pci,netdev=un%d", i)}, nil
 	case "tap":
-		mac, err := c.vmMAC()
+		mac, err := vmMAC(n.MAC)
 		if err != nil {
 			return nil, err
 		}
-		args = append(args, "-netdev", fmt.Sprintf("tap,id=hn0,ifname=%s,script=no,downscript=no", c.Bridge), "-device", fmt.Sprintf("virtio-net-pci,netdev=hn0,id=nic1,mac=%s", mac.String()))
-		return args, nil
+		return []string{"-netdev", fmt.Sprintf("tap,id=hn%d,ifname=%s,script=no,downscript=no", i, n.Bridge), "-device", fmt.Sprintf("virtio-net-pci,netdev=hn%d,id=nic%d,mac=%s", i, i+1, mac.String())}, nil
 	case "vhost":
-		mac, err := c.vmMAC()
+		mac, err := vmMAC(n.MAC)
 		if err != nil {
 			return nil, err
 		}
-		args = append(args, "-net", fmt.Sprintf("nic,model=virtio,macaddr=%s,netdev=nic-0", mac.String()), "-netdev", "tap,id=nic-0,vhost=on")
-		return args, nil
+		return []string{"-net", fmt.Sprintf("nic,model=virtio,macaddr=%s,netdev=nic-%d", mac.String(), i), "-netdev", fmt.Sprintf("tap,id=nic-%d,vhost=on", i)}, nil
+	}
+
+	return nil, fmt.Errorf("%s: networking not supported", n.Mode)
+}
+
+// vmVolumeIndex returns index of the block device of i-th volume. OSv names
+// virtio block devices in order they are attached, after the image and the
+// config drive, e.g. /dev/vblk1.
+func (c *VMConfig) vmVolumeIndex(i int) int {
+	if c.ConfigDrive != "" {
+		return i + 2
+	}
+	return i + 1
+}
+
+// vmMountOptions returns OSv options that mount volumes and host
+// directories of the instance, empty when it has none.
+func (c *VMConfig) vmMountOptions() string {
+	opts := ""
+	for i, v := range c.Volumes {
+		opts += fmt.Sprintf("--mount-fs=%s,/dev/vblk%d,%s ", v.Filesystem, c.vmVolumeIndex(i), v.MountPoint)
 	}
+	for i, m := range c.Mounts {
+		opts += fmt.Sprintf("--mount-fs=virtiofs,/dev/virtiofs%d,%s ", i, m.Target)
+	}
+	return opts
+}
 
-	return nil, fmt.Errorf("%s: networking not supported", c.Networking)
+// vmFileServerSocket returns socket of virtiofsd that shares i-th host
+// directory.
+func (c *VMConfig) vmFileServerSocket(i int) string {
+	return filepath.Join(c.InstanceDir, fmt.Sprintf("virtiofs%d.sock", i))
+}
+
+// vmMounts returns arguments that share host directories with the guest.
+// virtiofs needs guest memory that virtiofsd can access.
+func (c *VMConfig) vmMounts() []string {
+	if len(c.Mounts) == 0 {
+		return nil
+	}
+	args := []string{
+		"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", c.Memory),
+		"-numa", "node,memdev=mem",
+	}
+	for i := range c.Mounts {
+		args = append(args, "-chardev", fmt.Sprintf("socket,id=vfs%d,path=%s", i, c.vmFileServerSocket(i)))
+		args = append(args, "-device", fmt.Sprintf("vhost-user-fs-pci,queue-size=1024,chardev=vfs%d,tag=fs%d", i, i))
+	}
+	return args
+}
+
+// startFileServers starts virtiofsd for each shared host directory and
+// waits until it listens. virtiofsd exits when QEMU disconnects from it and
+// is terminated together with the process that started it in case QEMU never
+// connects. All servers are killed if one of them fails to start.
+func (c *VMConfig) startFileServers() ([]*exec.Cmd, error) {
+	if len(c.Mounts) == 0 {
+		return nil, nil
+	}
+	path, err := virtiofsdExecutable()
+	if err != nil {
+		return nil, err
+	}
+	help, _ := exec.Command(path, "--help").CombinedOutput()
+
+	var servers []*exec.Cmd
+	fail := func(err error) ([]*exec.Cmd, error) {
+		for _, server := range servers {
+			server.Process.Kill()
+		}
+		return nil, err
+	}
+	for i, m := range c.Mounts {
+		socket := c.vmFileServerSocket(i)
+		os.Remove(socket)
+		cmd := exec.Command(path, virtiofsdArgs(string(help), socket, m.Source)...)
+		util.BindToParent(cmd)
+		if err := cmd.Start(); err != nil {
+			return fail(fmt.Errorf("failed to start virtiofsd for %s: %s", m.Source, err))
+		}
+		go cmd.Wait()
+		servers = append(servers, cmd)
+		if err := waitForSocket(socket, fileServerTimeout); err != nil {
+			return fail(fmt.Errorf("virtiofsd for %s did not start: %s", m.Source, err))
+		}
+	}
+	return servers, nil
+}
+
+// virtiofsdArgs returns arguments of virtiofsd that shares dir on socket.
+// The Rust virtiofsd is told apart from the legacy C one that came with QEMU
+// by options listed in its help.
+func virtiofsdArgs(help, socket, dir string) []string {
+	if strings.Contains(help, "--shared-dir") {
+		return []string{"--socket-path=" + socket, "--shared-dir=" + dir, "--sandbox=none", "--cache=auto"}
+	}
+	return []string{"--socket-path=" + socket, "-o", "source=" + dir, "-o", "cache=auto"}
+}
+
+// waitForSocket waits until the socket file exists. Connecting to it would
+// take the only connection that virtiofsd accepts.
+func waitForSocket(socket string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was not created in %s", socket, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
 func qemuExecutable() (string, error) {
@@ -353,6 +672,24 @@ func qemuExecutable() (string, error) {
 	return "", fmt.Errorf("No QEMU installation found. Use the CAPSTAN_QEMU_PATH environment variable to specify its path.")
 }
 
+func virtiofsdExecutable() (string, error) {
+	paths := []string{
+		"/usr/libexec/virtiofsd",
+		"/usr/lib/qemu/virtiofsd",
+		"/usr/bin/virtiofsd",
+	}
+	path := os.Getenv("CAPSTAN_VIRTIOFSD_PATH")
+	if len(path) > 0 {
+		paths = append([]string{path}, paths...)
+	}
+	for _, path = range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("No virtiofsd found, it is needed to mount host directories. Use the CAPSTAN_VIRTIOFSD_PATH environment variable to specify its path.")
+}
+
 func qemuBridgeHelper() (string, error) {
 	paths := []string{
 		"/usr/libexec",
@@ -8,7 +8,20 @@
 package qemu
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu/qmp"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu/qmp/qmptest"
+	"github.com/mikelangelo-project/capstan/nat"
 )
 
 var parsingtests = []struct {
@@ -30,3 +43,413 @@ func TestVersionParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigDriveArguments(t *testing.T) {
+	c := &VMConfig{
+		Image:       "disk.qcow2",
+		Memory:      512,
+		Cpus:        1,
+		Networking:  "nat",
+		Monitor:     "osv.monitor",
+		DisableKvm:  true,
+		ConfigDrive: "/instances/demo/cidata.iso",
+	}
+	args, err := c.vmArguments(&Version{Major: 2, Minor: 5})
+	if err != nil {
+		t.Fatalf("vmArguments() => error %q", err)
+	}
+
+	drive := "file=/instances/demo/cidata.iso,if=none,id=cidata,format=raw,readonly=on"
+	for i, arg := range args {
+		if arg == drive && args[i-1] == "-drive" {
+			return
+		}
+	}
+	t.Errorf("vmArguments() => %q, want -drive %s", args, drive)
+}
+
+func TestNATArguments(t *testing.T) {
+	c := &VMConfig{
+		Networking: "nat",
+		NatRules: []nat.Rule{
+			{HostPort: nat.Port(8000), GuestPort: nat.Port(80), Protocol: nat.TCP},
+			{BindIP: "127.0.0.1", HostPort: nat.PortRange{First: 5000, Last: 5001}, GuestPort: nat.PortRange{First: 6000, Last: 6001}, Protocol: nat.TCP},
+			{HostPort: nat.Port(5353), GuestPort: nat.Port(53), Protocol: nat.UDP},
+		},
+	}
+	args, err := c.vmNetworking()
+	if err != nil {
+		t.Fatalf("vmNetworking() => error %q", err)
+	}
+
+	want := []string{
+		"-netdev", "user,id=un0,net=192.168.122.0/24,host=192.168.122.1" +
+			",hostfwd=tcp::8000-:80" +
+			",hostfwd=tcp:127.0.0.1:5000-:6000,hostfwd=tcp:127.0.0.1:5001-:6001" +
+			",hostfwd=udp::5353-:53",
+		"-device", "virtio-net-pci,netdev=un0",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("vmNetworking() => %q, want %q", args, want)
+	}
+}
+
+func TestVolumeArguments(t *testing.T) {
+	c := &VMConfig{
+		Image:       "disk.qcow2",
+		Memory:      512,
+		Cpus:        1,
+		Networking:  "nat",
+		Monitor:     "osv.monitor",
+		DisableKvm:  true,
+		ConfigDrive: "/instances/demo/cidata.iso",
+		Volumes: []hypervisor.Volume{
+			{Path: "/volumes/pgdata.img", Format: "raw", Filesystem: "ext", MountPoint: "/var/lib/postgresql"},
+			{Path: "/data/logs.qcow2", Format: "qcow2", Filesystem: "zfs", MountPoint: "/logs"},
+		},
+	}
+	args, err := c.vmArguments(&Version{Major: 2, Minor: 5})
+	if err != nil {
+		t.Fatalf("vmArguments() => error %q", err)
+	}
+
+	devices := []string{}
+	for i, arg := range args {
+		if arg == "-device" && strings.HasPrefix(args[i+1], "virtio-blk-pci") {
+			devices = append(devices, args[i+1])
+		}
+	}
+	want := []string{
+		"virtio-blk-pci,id=blk0,bootindex=0,drive=hd0",
+		"virtio-blk-pci,id=blk1,drive=cidata",
+		"virtio-blk-pci,id=blk2,drive=vd0",
+		"virtio-blk-pci,id=blk3,drive=vd1",
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("vmArguments() => block devices %q, want %q", devices, want)
+	}
+
+	mounts := "--mount-fs=ext,/dev/vblk2,/var/lib/postgresql --mount-fs=zfs,/dev/vblk3,/logs "
+	if opts := c.vmMountOptions(); opts != mounts {
+		t.Errorf("vmMountOptions() => %q, want %q", opts, mounts)
+	}
+}
+
+func TestMountArguments(t *testing.T) {
+	c := &VMConfig{
+		Image:       "disk.qcow2",
+		Memory:      512,
+		Cpus:        1,
+		Networking:  "nat",
+		InstanceDir: "/instances/demo",
+		Monitor:     "osv.monitor",
+		DisableKvm:  true,
+		Volumes: []hypervisor.Volume{
+			{Path: "/volumes/pgdata.img", Format: "raw", Filesystem: "ext", MountPoint: "/data"},
+		},
+		Mounts: []hypervisor.Mount{{Source: "/home/demo/src", Target: "/app"}},
+	}
+	args, err := c.vmArguments(&Version{Major: 2, Minor: 5})
+	if err != nil {
+		t.Fatalf("vmArguments() => error %q", err)
+	}
+
+	want := []string{
+		"-object", "memory-backend-memfd,id=mem,size=512M,share=on",
+		"-numa", "node,memdev=mem",
+		"-chardev", "socket,id=vfs0,path=/instances/demo/virtiofs0.sock",
+		"-device", "vhost-user-fs-pci,queue-size=1024,chardev=vfs0,tag=fs0",
+	}
+	found := false
+	for i := range args {
+		if i+len(want) <= len(args) && reflect.DeepEqual(args[i:i+len(want)], want) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("vmArguments() => %q, want %q", args, want)
+	}
+
+	mounts := "--mount-fs=ext,/dev/vblk1,/data --mount-fs=virtiofs,/dev/virtiofs0,/app "
+	if opts := c.vmMountOptions(); opts != mounts {
+		t.Errorf("vmMountOptions() => %q, want %q", opts, mounts)
+	}
+}
+
+func TestNetworksArguments(t *testing.T) {
+	c := &VMConfig{
+		Networking: "nat",
+		NatRules:   []nat.Rule{{HostPort: nat.Port(8000), GuestPort: nat.Port(80), Protocol: nat.TCP}},
+		Networks: []hypervisor.Network{
+			{Mode: "tap", Bridge: "tap0", MAC: "52:54:00:12:34:56"},
+			{Mode: "nat"},
+		},
+	}
+	args, err := c.vmNetworking()
+	if err != nil {
+		t.Fatalf("vmNetworking() => error %q", err)
+	}
+
+	want := []string{
+		"-netdev", "user,id=un0,net=192.168.122.0/24,host=192.168.122.1,hostfwd=tcp::8000-:80",
+		"-device", "virtio-net-pci,netdev=un0",
+		"-netdev", "tap,id=hn1,ifname=tap0,script=no,downscript=no",
+		"-device", "virtio-net-pci,netdev=hn1,id=nic2,mac=52:54:00:12:34:56",
+		"-netdev", "user,id=un2,net=192.168.122.0/24,host=192.168.122.1",
+		"-device", "virtio-net-pci,netdev=un2",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("vmNetworking() => %q, want %q", args, want)
+	}
+}
+
+func startMonitor(t *testing.T, ignorePowerdown bool) (*qmptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := qmptest.NewUnstartedServer(filepath.Join(dir, "osv.monitor"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s.IgnorePowerdown = ignorePowerdown
+	s.Start()
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStopVM(t *testing.T) {
+	for _, ignorePowerdown := range []bool{false, true} {
+		s, cleanup := startMonitor(t, ignorePowerdown)
+
+		if err := stopVM(s.Path, 100*time.Millisecond); err != nil {
+			t.Errorf("stopVM() => error %q", err)
+		}
+
+		expected := []string{"qmp_capabilities", "system_powerdown"}
+		if ignorePowerdown {
+			expected = append(expected, "quit")
+		}
+		if commands := s.Commands(); !reflect.DeepEqual(commands, expected) {
+			t.Errorf("stopVM() with IgnorePowerdown=%v => commands %q, want %q", ignorePowerdown, commands, expected)
+		}
+		select {
+		case <-s.Done():
+		default:
+			t.Errorf("stopVM() with IgnorePowerdown=%v did not stop QEMU", ignorePowerdown)
+		}
+		cleanup()
+	}
+}
+
+func TestStopStoppedVM(t *testing.T) {
+	if err := stopVM(filepath.Join(os.TempDir(), "no-such-dir", "osv.monitor"), time.Second); err != nil {
+		t.Errorf("stopVM() => error %q", err)
+	}
+}
+
+func TestGetVMStatus(t *testing.T) {
+	s, cleanup := startMonitor(t, false)
+	defer cleanup()
+	dir := filepath.Dir(s.Path)
+
+	var statustests = []struct {
+		state string
+		out   string
+	}{
+		{"running", "Running"},
+		{"paused", "Paused"},
+		{"guest-panicked", "Crashed"},
+	}
+	for _, tt := range statustests {
+		s.SetStatus(tt.state)
+		if status, err := GetVMStatus("demo", dir); err != nil || status != tt.out {
+			t.Errorf("GetVMStatus() in state %s => %q, %v, want %q", tt.state, status, err, tt.out)
+		}
+	}
+
+	// Monitor serves one client at a time.
+	client, err := qmp.Dial(s.Path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := GetVMStatus("demo", dir); err != nil || status != "Running" {
+		t.Errorf("GetVMStatus() while monitor is in use => %q, %v, want Running", status, err)
+	}
+
+	client.Quit()
+	if status, err := GetVMStatus("demo", dir); err != nil || status != "Stopped" {
+		t.Errorf("GetVMStatus() after quit => %q, %v, want Stopped", status, err)
+	}
+}
+
+func TestGetVMStats(t *testing.T) {
+	s, cleanup := startMonitor(t, false)
+	defer cleanup()
+	s.Handle("query-blockstats", func(args json.RawMessage) (interface{}, error) {
+		return []qmp.BlockStats{
+			{QDev: "blk0", Stats: qmp.BlockDeviceStats{RdBytes: 1000, WrBytes: 200}},
+			{QDev: "blk1", Stats: qmp.BlockDeviceStats{RdBytes: 24}},
+		}, nil
+	})
+
+	stats, err := GetVMStats(filepath.Dir(s.Path))
+
+	expected := hypervisor.Stats{BlockReadBytes: 1024, BlockWriteBytes: 200}
+	if err != nil || *stats != expected {
+		t.Errorf("GetVMStats() => %+v, %v, want %+v", stats, err, expected)
+	}
+}
+
+func TestSnapshotRunningVM(t *testing.T) {
+	s, cleanup := startMonitor(t, false)
+	defer cleanup()
+	dir := filepath.Dir(s.Path)
+	if err := ioutil.WriteFile(filepath.Join(dir, "disk.qcow2"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var commands []string
+	s.Handle("human-monitor-command", func(args json.RawMessage) (interface{}, error) {
+		var a struct {
+			CommandLine string `json:"command-line"`
+		}
+		json.Unmarshal(args, &a)
+		commands = append(commands, a.CommandLine)
+		if a.CommandLine == "loadvm missing" {
+			return "Error: Snapshot 'missing' does not exist\r\n", nil
+		}
+		return "", nil
+	})
+	s.Handle("query-block", func(args json.RawMessage) (interface{}, error) {
+		return []qmp.BlockInfo{
+			{Device: "hd0", Inserted: &qmp.BlockDeviceInfo{Image: qmp.ImageInfo{Snapshots: []qmp.SnapshotInfo{
+				{ID: "1", Name: "first", VMStateSize: 1024, DateSec: 1496311200},
+			}}}},
+			{Device: "cidata", Inserted: &qmp.BlockDeviceInfo{}},
+		}, nil
+	})
+
+	if err := vmSnapshot(dir, "savevm", "-c", "first"); err != nil {
+		t.Errorf("vmSnapshot(savevm) => error %q", err)
+	}
+	if err := vmSnapshot(dir, "loadvm", "-a", "missing"); err == nil || err.Error() != "loadvm failed: Error: Snapshot 'missing' does not exist" {
+		t.Errorf("vmSnapshot(loadvm) => error %v, want that snapshot does not exist", err)
+	}
+	if expected := []string{"savevm first", "loadvm missing"}; !reflect.DeepEqual(commands, expected) {
+		t.Errorf("vmSnapshot() => commands %q, want %q", commands, expected)
+	}
+
+	snapshots, err := vmSnapshots(dir)
+	expected := []hypervisor.Snapshot{{Name: "first", MemorySize: 1024, Created: time.Unix(1496311200, 0)}}
+	if err != nil || !reflect.DeepEqual(snapshots, expected) {
+		t.Errorf("vmSnapshots() => %+v, %v, want %+v", snapshots, err, expected)
+	}
+}
+
+var snapshotdevicetests = []struct {
+	volumes []hypervisor.Volume
+	mounts  []hypervisor.Mount
+	err     string
+}{
+	{
+		volumes: []hypervisor.Volume{{Path: "/volumes/data.img", Format: "raw"}},
+		err:     "volume /volumes/data.img is a raw disk image that does not support snapshots, stop the instance to snapshot its disk only",
+	},
+	{
+		mounts: []hypervisor.Mount{{Source: "/srv/www", Target: "/www"}},
+		err:    "host directory /srv/www is mounted to the instance, which prevents saving its state, stop the instance to snapshot its disk only",
+	},
+	{
+		volumes: []hypervisor.Volume{{Path: "/volumes/data.qcow2", Format: "qcow2"}},
+	},
+}
+
+func TestSnapshotRunningVMWithDevices(t *testing.T) {
+	s, cleanup := startMonitor(t, false)
+	defer cleanup()
+	dir := filepath.Dir(s.Path)
+	if err := ioutil.WriteFile(filepath.Join(dir, "disk.qcow2"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Handle("human-monitor-command", func(args json.RawMessage) (interface{}, error) {
+		return "", nil
+	})
+
+	for _, tt := range snapshotdevicetests {
+		c := &VMConfig{ConfigFile: filepath.Join(dir, "osv.config"), Volumes: tt.volumes, Mounts: tt.mounts}
+		if err := StoreConfig(c); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, command := range []string{"savevm", "loadvm"} {
+			err := vmSnapshot(dir, command, "", "first")
+			if tt.err == "" && err != nil {
+				t.Errorf("vmSnapshot(%s) with volumes %+v, mounts %+v => error %q", command, tt.volumes, tt.mounts, err)
+			} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("vmSnapshot(%s) with volumes %+v, mounts %+v => error %v, want %q", command, tt.volumes, tt.mounts, err, tt.err)
+			}
+		}
+		if err := vmSnapshot(dir, "delvm", "", "first"); err != nil {
+			t.Errorf("vmSnapshot(delvm) with volumes %+v, mounts %+v => error %q", tt.volumes, tt.mounts, err)
+		}
+	}
+}
+
+func TestSnapshotStoppedVM(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img is not installed")
+	}
+	dir, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk := filepath.Join(dir, "disk.qcow2")
+	if out, err := exec.Command("qemu-img", "create", "-f", "qcow2", disk, "1M").CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img create => %s", out)
+	}
+
+	if err := vmSnapshot(dir, "savevm", "-c", "first"); err != nil {
+		t.Errorf("vmSnapshot(create) => error %q", err)
+	}
+	if snapshots, err := vmSnapshots(dir); err != nil || len(snapshots) != 1 || snapshots[0].Name != "first" || snapshots[0].MemorySize != 0 {
+		t.Errorf("vmSnapshots() => %+v, %v, want disk only snapshot first", snapshots, err)
+	}
+	if err := vmSnapshot(dir, "loadvm", "-a", "first"); err != nil {
+		t.Errorf("vmSnapshot(apply) => error %q", err)
+	}
+	if err := vmSnapshot(dir, "delvm", "-d", "first"); err != nil {
+		t.Errorf("vmSnapshot(delete) => error %q", err)
+	}
+	if snapshots, err := vmSnapshots(dir); err != nil || len(snapshots) != 0 {
+		t.Errorf("vmSnapshots() after delete => %+v, %v, want none", snapshots, err)
+	}
+}
+
+func TestVirtiofsdArguments(t *testing.T) {
+	var virtiofsdtests = []struct {
+		name string
+		help string
+		want []string
+	}{
+		{
+			"rust",
+			"Usage: virtiofsd [OPTIONS]\n      --shared-dir <shared-dir>  Shared directory path\n",
+			[]string{"--socket-path=/instances/demo/virtiofs0.sock", "--shared-dir=/home/demo/src", "--sandbox=none", "--cache=auto"},
+		},
+		{
+			"legacy",
+			"usage: virtiofsd [options]\n    -o source=PATH             shared directory tree\n",
+			[]string{"--socket-path=/instances/demo/virtiofs0.sock", "-o", "source=/home/demo/src", "-o", "cache=auto"},
+		},
+	}
+	for _, test := range virtiofsdtests {
+		if args := virtiofsdArgs(test.help, "/instances/demo/virtiofs0.sock", "/home/demo/src"); !reflect.DeepEqual(args, test.want) {
+			t.Errorf("%s: virtiofsdArgs() => %q, want %q", test.name, args, test.want)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package qmp implements client of QEMU Machine Protocol, the JSON protocol
+// that QEMU speaks on its control monitor socket.
+//
+// Client reads the greeting and negotiates capabilities when it connects.
+// Commands may be executed concurrently, each response is matched with its
+// command by id. Asynchronous events are passed to subscribers.
+package qmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Events emitted by QEMU that Capstan is interested in.
+const (
+	EventShutdown      = "SHUTDOWN"
+	EventPowerdown     = "POWERDOWN"
+	EventStop          = "STOP"
+	EventResume        = "RESUME"
+	EventSuspend       = "SUSPEND"
+	EventWakeup        = "WAKEUP"
+	EventGuestPanicked = "GUEST_PANICKED"
+)
+
+// ErrClosed is returned by commands once connection to QEMU is closed, e.g.
+// because QEMU exited.
+var ErrClosed = errors.New("qmp: connection closed")
+
+// Version is version of QEMU as reported in the greeting.
+type Version struct {
+	Major   int    `json:"major"`
+	Minor   int    `json:"minor"`
+	Micro   int    `json:"micro"`
+	Package string `json:"-"`
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d%s", v.Major, v.Minor, v.Micro, v.Package)
+}
+
+// Greeting is the first message that QEMU sends to a new client.
+type Greeting struct {
+	Version struct {
+		QEMU    Version `json:"qemu"`
+		Package string  `json:"package"`
+	} `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Error is returned when QEMU fails to execute a command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+// Event is an asynchronous notification from QEMU.
+type Event struct {
+	Name      string
+	Data      json.RawMessage
+	Timestamp time.Time
+}
+
+// Command is request sent to QEMU. Id is set by the client.
+type Command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        uint64      `json:"id"`
+}
+
+// message is any message that QEMU sends: greeting, response or event.
+type message struct {
+	QMP       *Greeting       `json:"QMP"`
+	Return    json.RawMessage `json:"return"`
+	Error     *Error          `json:"error"`
+	ID        *uint64         `json:"id"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp *struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Client is connection to QMP monitor of a QEMU instance.
+type Client struct {
+	Version      Version
+	Capabilities []string
+
+	conn net.Conn
+	dec  *json.Decoder
+
+	// wmu serializes writing of commands.
+	wmu sync.Mutex
+	enc *json.Encoder
+
+	mu          sync.Mutex
+	lastID      uint64
+	pending     map[uint64]chan *message
+	subscribers map[chan Event][]string
+	err         error
+	done        chan struct{}
+}
+
+// Dial connects to QMP monitor listening on unix socket at given path. See
+// New for the meaning of timeout.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn, timeout)
+}
+
+// New reads greeting from the connection and negotiates capabilities. When
+// timeout is not zero, negotiation fails if it does not complete in time,
+// which happens when another client is already connected to the monitor.
+// The connection is closed when negotiation fails.
+func New(conn net.Conn, timeout time.Duration) (*Client, error) {
+	c := &Client{
+		conn:        conn,
+		dec:         json.NewDecoder(conn),
+		enc:         json.NewEncoder(conn),
+		pending:     make(map[uint64]chan *message),
+		subscribers: make(map[chan Event][]string),
+		done:        make(chan struct{}),
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var greeting message
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: failed to read greeting: %s", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: expected greeting, got another message")
+	}
+	c.Version = greeting.QMP.Version.QEMU
+	c.Version.Package = greeting.QMP.Version.Package
+	c.Capabilities = greeting.QMP.Capabilities
+
+	go c.read()
+
+	if err := c.Execute("qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("qmp: capabilities negotiation failed: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// Execute sends command with given arguments to QEMU and waits for the
+// response. Arguments are omitted when nil. When result is not nil, the
+// returned value is decoded into it.
+func (c *Client) Execute(command string, arguments, result interface{}) error {
+	ch := make(chan *message, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.lastID++
+	id := c.lastID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	err := c.enc.Encode(&Command{Execute: command, Arguments: arguments, ID: id})
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return err
+	}
+
+	var resp *message
+	select {
+	case resp = <-ch:
+	case <-c.done:
+		// Response might have been received just before the connection
+		// was closed.
+		select {
+		case resp = <-ch:
+		default:
+			return c.err
+		}
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && len(resp.Return) > 0 {
+		return json.Unmarshal(resp.Return, result)
+	}
+	return nil
+}
+
+// Subscribe returns channel that receives events with given names or all
+// events when no name is given. Events are dropped when the subscriber does
+// not keep up. The channel is closed when connection is closed.
+func (c *Client) Subscribe(names ...string) <-chan Event {
+	ch := make(chan Event, 32)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		close(ch)
+		return ch
+	}
+	c.subscribers[ch] = names
+	return ch
+}
+
+// Unsubscribe stops sending events to the channel returned by Subscribe and
+// closes it.
+func (c *Client) Unsubscribe(events <-chan Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ch := range c.subscribers {
+		if ch == events {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Done returns channel that is closed when connection is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes connection to QEMU.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// read dispatches messages until the connection is closed.
+func (c *Client) read() {
+	for {
+		var msg message
+		if err := c.dec.Decode(&msg); err != nil {
+			c.shutdown()
+			return
+		}
+
+		if msg.Event != "" {
+			c.publish(&msg)
+		} else if msg.ID != nil {
+			c.mu.Lock()
+			ch := c.pending[*msg.ID]
+			delete(c.pending, *msg.ID)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- &msg
+			}
+		}
+	}
+}
+
+func (c *Client) publish(msg *message) {
+	event := Event{Name: msg.Event, Data: msg.Data}
+	if msg.Timestamp != nil {
+		event.Timestamp = time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ch, names := range c.subscribers {
+		if !matches(names, event.Name) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func matches(names []string, name string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = ErrClosed
+	for ch := range c.subscribers {
+		close(ch)
+	}
+	c.subscribers = nil
+	close(c.done)
+}
+
+// Status is the run state of the instance.
+type Status struct {
+	Running    bool   `json:"running"`
+	Singlestep bool   `json:"singlestep"`
+	Status     string `json:"status"`
+}
+
+// QueryStatus returns run state of the instance e.g. running or paused.
+func (c *Client) QueryStatus() (*Status, error) {
+	status := &Status{}
+	if err := c.Execute("query-status", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// SystemPowerdown asks the guest to shut down with ACPI power button. It
+// returns once the request is sent, the guest may ignore it.
+func (c *Client) SystemPowerdown() error {
+	return c.Execute("system_powerdown", nil, nil)
+}
+
+// Quit terminates QEMU immediately.
+func (c *Client) Quit() error {
+	err := c.Execute("quit", nil, nil)
+	if err == ErrClosed {
+		// QEMU may exit before it responds.
+		return nil
+	}
+	return err
+}
+
+// BlockStats are I/O counters of a block device.
+type BlockStats struct {
+	Device string           `json:"device"`
+	QDev   string           `json:"qdev"`
+	Stats  BlockDeviceStats `json:"stats"`
+}
+
+// BlockDeviceStats are counters of bytes and operations since QEMU started.
+type BlockDeviceStats struct {
+	RdBytes      int64 `json:"rd_bytes"`
+	WrBytes      int64 `json:"wr_bytes"`
+	RdOperations int64 `json:"rd_operations"`
+	WrOperations int64 `json:"wr_operations"`
+}
+
+// QueryBlockstats returns I/O counters of all block devices.
+func (c *Client) QueryBlockstats() ([]BlockStats, error) {
+	stats := []BlockStats{}
+	if err := c.Execute("query-blockstats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// HumanMonitorCommand executes command of the human monitor e.g. savevm,
+// for which there is no QMP equivalent, and returns its output.
+func (c *Client) HumanMonitorCommand(commandLine string) (string, error) {
+	var out string
+	args := map[string]string{"command-line": commandLine}
+	if err := c.Execute("human-monitor-command", args, &out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// BlockInfo describes a block device.
+type BlockInfo struct {
+	Device   string           `json:"device"`
+	QDev     string           `json:"qdev"`
+	Inserted *BlockDeviceInfo `json:"inserted"`
+}
+
+// BlockDeviceInfo describes medium that is inserted in a block device.
+type BlockDeviceInfo struct {
+	File  string    `json:"file"`
+	Image ImageInfo `json:"image"`
+}
+
+// ImageInfo describes disk image. It has the same form in 'qemu-img info
+// --output=json'.
+type ImageInfo struct {
+	Filename  string         `json:"filename"`
+	Format    string         `json:"format"`
+	Snapshots []SnapshotInfo `json:"snapshots"`
+}
+
+// SnapshotInfo describes internal snapshot of a disk image.
+type SnapshotInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm-state-size"`
+	DateSec     int64  `json:"date-sec"`
+	DateNsec    int64  `json:"date-nsec"`
+	VMClockSec  int64  `json:"vm-clock-sec"`
+	VMClockNsec int64  `json:"vm-clock-nsec"`
+}
+
+// QueryBlock returns all block devices.
+func (c *Client) QueryBlock() ([]BlockInfo, error) {
+	info := []BlockInfo{}
+	if err := c.Execute("query-block", nil, &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qmp_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu/qmp"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu/qmp/qmptest"
+)
+
+func startServer(t *testing.T, configure ...func(s *qmptest.Server)) (*qmptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := qmptest.NewUnstartedServer(filepath.Join(dir, "osv.monitor"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	for _, f := range configure {
+		f(s)
+	}
+	s.Start()
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func dial(t *testing.T, s *qmptest.Server) *qmp.Client {
+	c, err := qmp.Dial(s.Path, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() => error %q", err)
+	}
+	return c
+}
+
+func TestNegotiation(t *testing.T) {
+	s, cleanup := startServer(t, func(s *qmptest.Server) {
+		s.Version = qmp.Version{Major: 2, Minor: 5, Micro: 1}
+	})
+	defer cleanup()
+
+	c := dial(t, s)
+	defer c.Close()
+
+	if c.Version.String() != "2.5.1" {
+		t.Errorf("Version => %s, want 2.5.1", c.Version)
+	}
+	if commands := s.Commands(); !reflect.DeepEqual(commands, []string{"qmp_capabilities"}) {
+		t.Errorf("Commands() => %q, want only qmp_capabilities", commands)
+	}
+}
+
+func TestQueryStatus(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+	s.SetStatus("paused")
+
+	c := dial(t, s)
+	defer c.Close()
+
+	status, err := c.QueryStatus()
+	if err != nil {
+		t.Fatalf("QueryStatus() => error %q", err)
+	}
+	if *status != (qmp.Status{Running: false, Status: "paused"}) {
+		t.Errorf("QueryStatus() => %+v, want paused", status)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+
+	c := dial(t, s)
+	defer c.Close()
+
+	err := c.Execute("query-nothing", nil, nil)
+	qmpErr, ok := err.(*qmp.Error)
+	if !ok || qmpErr.Class != "CommandNotFound" {
+		t.Errorf("Execute() => error %q, want CommandNotFound", err)
+	}
+}
+
+func TestResponsesAreCorrelated(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+	s.Handle("echo", func(args json.RawMessage) (interface{}, error) {
+		return args, nil
+	})
+
+	c := dial(t, s)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var result struct{ N int }
+			if err := c.Execute("echo", map[string]int{"n": n}, &result); err != nil {
+				t.Errorf("Execute(echo %d) => error %q", n, err)
+			} else if result.N != n {
+				t.Errorf("Execute(echo %d) => %d", n, result.N)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEvents(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+
+	c := dial(t, s)
+	defer c.Close()
+	stops := c.Subscribe(qmp.EventStop)
+	all := c.Subscribe()
+
+	if err := c.Execute("stop", nil, nil); err != nil {
+		t.Fatalf("Execute(stop) => error %q", err)
+	}
+	s.Emit(qmp.EventResume, nil)
+
+	if e := <-stops; e.Name != qmp.EventStop || e.Timestamp.IsZero() {
+		t.Errorf("Subscribe(STOP) => %+v, want STOP event", e)
+	}
+	if e := <-all; e.Name != qmp.EventStop {
+		t.Errorf("Subscribe() => %+v, want STOP event", e)
+	}
+	if e := <-all; e.Name != qmp.EventResume {
+		t.Errorf("Subscribe() => %+v, want RESUME event", e)
+	}
+
+	c.Unsubscribe(all)
+	if _, ok := <-all; ok {
+		t.Errorf("Unsubscribe() did not close the channel")
+	}
+}
+
+func TestQuit(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+
+	c := dial(t, s)
+	defer c.Close()
+	events := c.Subscribe(qmp.EventShutdown)
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() => error %q", err)
+	}
+
+	if e := <-events; e.Name != qmp.EventShutdown {
+		t.Errorf("Subscribe(SHUTDOWN) => %+v, want SHUTDOWN event", e)
+	}
+	if _, ok := <-events; ok {
+		t.Errorf("events channel is not closed after QEMU exited")
+	}
+	<-c.Done()
+	if _, err := c.QueryStatus(); err != qmp.ErrClosed {
+		t.Errorf("QueryStatus() after quit => error %q, want %q", err, qmp.ErrClosed)
+	}
+}
+
+func TestMonitorInUse(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+
+	c := dial(t, s)
+	defer c.Close()
+
+	// QEMU monitor serves one client at a time.
+	if _, err := qmp.Dial(s.Path, 100*time.Millisecond); err == nil {
+		t.Errorf("Dial() while monitor is in use => no error")
+	}
+}
+
+func TestResourceQueries(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+	s.Handle("query-blockstats", func(args json.RawMessage) (interface{}, error) {
+		return json.RawMessage(`[{"device": "", "qdev": "blk0", "stats": {"rd_bytes": 512, "wr_bytes": 1024, "rd_operations": 1, "wr_operations": 2}}]`), nil
+	})
+
+	c := dial(t, s)
+	defer c.Close()
+
+	blocks, err := c.QueryBlockstats()
+	expected := []qmp.BlockStats{
+		{QDev: "blk0", Stats: qmp.BlockDeviceStats{RdBytes: 512, WrBytes: 1024, RdOperations: 1, WrOperations: 2}},
+	}
+	if err != nil || !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("QueryBlockstats() => %+v, %v, want %+v", blocks, err, expected)
+	}
+}
+
+func TestHumanMonitorCommand(t *testing.T) {
+	s, cleanup := startServer(t)
+	defer cleanup()
+	s.Handle("human-monitor-command", func(args json.RawMessage) (interface{}, error) {
+		var a struct {
+			CommandLine string `json:"command-line"`
+		}
+		json.Unmarshal(args, &a)
+		return "executed " + a.CommandLine, nil
+	})
+
+	c := dial(t, s)
+	defer c.Close()
+
+	out, err := c.HumanMonitorCommand("savevm first")
+	if err != nil || out != "executed savevm first" {
+		t.Errorf("HumanMonitorCommand() => %q, %v, want 'executed savevm first'", out, err)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package qmptest provides QMP server that pretends to be QEMU monitor. It
+// is meant to be used in tests.
+package qmptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu/qmp"
+)
+
+// Handler returns result of a command given its arguments. When returned
+// error is *qmp.Error it is passed to the client as is.
+type Handler func(args json.RawMessage) (interface{}, error)
+
+// Server listens on unix socket like QEMU monitor does. It serves one client
+// at a time, other clients wait until the current one disconnects. Commands
+// query-status, stop, cont, system_powerdown and quit are
+// handled like QEMU would, others can be added with Handle.
+type Server struct {
+	Path    string
+	Version qmp.Version
+	// IgnorePowerdown makes the guest ignore system_powerdown like a guest
+	// without ACPI support does.
+	IgnorePowerdown bool
+
+	listener net.Listener
+	done     chan struct{}
+	served   chan struct{}
+
+	mu       sync.Mutex
+	status   string
+	handlers map[string]Handler
+	commands []string
+	conn     net.Conn
+	enc      *json.Encoder
+	exiting  bool
+}
+
+// NewServer starts server listening on unix socket at path.
+func NewServer(path string) (*Server, error) {
+	s, err := NewUnstartedServer(path)
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+	return s, nil
+}
+
+// NewUnstartedServer returns server listening on unix socket at path that
+// does not serve clients until it is started. Its fields can be changed
+// until then.
+func NewUnstartedServer(path string) (*Server, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Path:     path,
+		Version:  qmp.Version{Major: 2, Minor: 8, Micro: 0},
+		listener: listener,
+		done:     make(chan struct{}),
+		served:   make(chan struct{}),
+		status:   "running",
+		handlers: make(map[string]Handler),
+	}
+	s.handlers["query-status"] = s.queryStatus
+	s.handlers["stop"] = s.stop
+	s.handlers["cont"] = s.cont
+	s.handlers["system_powerdown"] = s.systemPowerdown
+	s.handlers["quit"] = s.quit
+	return s, nil
+}
+
+// Start starts serving clients.
+func (s *Server) Start() {
+	go s.serve()
+}
+
+// Handle sets handler of the command.
+func (s *Server) Handle(command string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[command] = h
+}
+
+// Commands returns commands that were executed so far, in order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// SetStatus sets run state reported by query-status.
+func (s *Server) SetStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Emit sends event to the connected client, if any.
+func (s *Server) Emit(event string, data interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.emit(event, data)
+}
+
+// Exit makes the server behave as if the guest shut down and QEMU exited.
+func (s *Server) Exit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emit(qmp.EventShutdown, map[string]interface{}{"guest": true})
+	s.exit()
+}
+
+// Done returns channel that is closed when QEMU exits.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.exit()
+	s.mu.Unlock()
+	<-s.served
+}
+
+func (s *Server) serve() {
+	defer close(s.served)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.enc = json.NewEncoder(conn)
+	greeting := map[string]interface{}{
+		"QMP": map[string]interface{}{
+			"version": map[string]interface{}{
+				"qemu":    s.Version,
+				"package": s.Version.Package,
+			},
+			"capabilities": []string{},
+		},
+	}
+	err := s.enc.Encode(greeting)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	negotiated := false
+	dec := json.NewDecoder(conn)
+	for {
+		var cmd struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+			ID        json.RawMessage `json:"id"`
+		}
+		if err := dec.Decode(&cmd); err != nil {
+			break
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd.Execute)
+		h := s.handlers[cmd.Execute]
+		s.mu.Unlock()
+
+		var result interface{}
+		switch {
+		case cmd.Execute == "qmp_capabilities":
+			negotiated = true
+			err = nil
+		case !negotiated:
+			err = &qmp.Error{Class: "CommandNotFound", Desc: "Expecting capabilities negotiation with 'qmp_capabilities'"}
+		case h == nil:
+			err = &qmp.Error{Class: "CommandNotFound", Desc: fmt.Sprintf("The command %s has not been found", cmd.Execute)}
+		default:
+			result, err = h(cmd.Arguments)
+		}
+
+		resp := map[string]interface{}{}
+		if cmd.ID != nil {
+			resp["id"] = cmd.ID
+		}
+		if qmpErr, ok := err.(*qmp.Error); ok {
+			resp["error"] = qmpErr
+		} else if err != nil {
+			resp["error"] = &qmp.Error{Class: "GenericError", Desc: err.Error()}
+		} else if result != nil {
+			resp["return"] = result
+		} else {
+			resp["return"] = struct{}{}
+		}
+
+		s.mu.Lock()
+		s.enc.Encode(resp)
+		exiting := s.exiting
+		if exiting {
+			s.emit(qmp.EventShutdown, map[string]interface{}{"guest": true})
+			s.exit()
+		}
+		s.mu.Unlock()
+		if exiting {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	s.conn = nil
+	s.enc = nil
+	s.mu.Unlock()
+}
+
+func (s *Server) emit(event string, data interface{}) error {
+	if s.enc == nil {
+		return fmt.Errorf("qmptest: no client is connected")
+	}
+	now := time.Now()
+	return s.enc.Encode(map[string]interface{}{
+		"event": event,
+		"data":  data,
+		"timestamp": map[string]int64{
+			"seconds":      now.Unix(),
+			"microseconds": int64(now.Nanosecond() / 1000),
+		},
+	})
+}
+
+// exit closes the listener and the connection, must be called with mu held.
+func (s *Server) exit() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	close(s.done)
+	s.listener.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	os.Remove(s.Path)
+}
+
+func (s *Server) queryStatus(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &qmp.Status{Running: s.status == "running", Status: s.status}, nil
+}
+
+func (s *Server) stop(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = "paused"
+	return nil, s.emit(qmp.EventStop, nil)
+}
+
+func (s *Server) cont(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = "running"
+	return nil, s.emit(qmp.EventResume, nil)
+}
+
+func (s *Server) systemPowerdown(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.emit(qmp.EventPowerdown, nil); err != nil {
+		return nil, err
+	}
+	if !s.IgnorePowerdown {
+		s.exiting = true
+	}
+	return nil, nil
+}
+
+func (s *Server) quit(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exiting = true
+	return nil, nil
+}
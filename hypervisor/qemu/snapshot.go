@@ -0,0 +1,172 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/hypervisor/qemu/qmp"
+)
+
+// Snapshots of stopped instances are internal qcow2 snapshots of the disk
+// of the instance taken with qemu-img. Snapshots of running instances are
+// taken over QMP and include memory of the instance as well. QEMU can only
+// take them when all writable disks support snapshots, so running instances
+// with raw volumes or mounted host directories must be stopped first.
+
+// bootDrive is id of the drive that the instance boots from.
+const bootDrive = "hd0"
+
+func (d *Driver) CreateSnapshot(name, snapshot string) error {
+	return vmSnapshot(hypervisor.InstanceDir(d.Name(), name), "savevm", "-c", snapshot)
+}
+
+func (d *Driver) RestoreSnapshot(name, snapshot string) error {
+	return vmSnapshot(hypervisor.InstanceDir(d.Name(), name), "loadvm", "-a", snapshot)
+}
+
+func (d *Driver) DeleteSnapshot(name, snapshot string) error {
+	return vmSnapshot(hypervisor.InstanceDir(d.Name(), name), "delvm", "-d", snapshot)
+}
+
+func (d *Driver) Snapshots(name string) ([]hypervisor.Snapshot, error) {
+	return vmSnapshots(hypervisor.InstanceDir(d.Name(), name))
+}
+
+// vmSnapshot runs human monitor command when the instance in given directory
+// is running or qemu-img snapshot with given option when it is stopped.
+func vmSnapshot(dir, command, option, snapshot string) error {
+	disk := filepath.Join(dir, "disk.qcow2")
+	if _, err := os.Stat(disk); err != nil {
+		return fmt.Errorf("instance in %s has no disk that could be snapshotted", dir)
+	}
+
+	client, err := dialRunningVM(dir)
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		out, err := exec.Command("qemu-img", "snapshot", option, snapshot, disk).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("qemu-img snapshot %s failed: %s", option, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	defer client.Close()
+
+	if command != "delvm" {
+		if err := checkRunningVMSnapshot(dir); err != nil {
+			return err
+		}
+	}
+
+	// Human monitor commands report errors in their output only.
+	out, err := client.HumanMonitorCommand(command + " " + snapshot)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%s failed: %s", command, out)
+	}
+	return nil
+}
+
+// vmSnapshots returns snapshots of the disk of instance in given directory.
+func vmSnapshots(dir string) ([]hypervisor.Snapshot, error) {
+	disk := filepath.Join(dir, "disk.qcow2")
+	if _, err := os.Stat(disk); err != nil {
+		return nil, fmt.Errorf("instance in %s has no disk that could be snapshotted", dir)
+	}
+
+	client, err := dialRunningVM(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []qmp.SnapshotInfo
+	if client == nil {
+		out, err := exec.Command("qemu-img", "info", "--output=json", disk).Output()
+		if err != nil {
+			return nil, fmt.Errorf("qemu-img info failed: %s", err)
+		}
+		info := qmp.ImageInfo{}
+		if err := json.Unmarshal(out, &info); err != nil {
+			return nil, err
+		}
+		snapshots = info.Snapshots
+	} else {
+		defer client.Close()
+		blocks, err := client.QueryBlock()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blocks {
+			if b.Device == bootDrive && b.Inserted != nil {
+				snapshots = b.Inserted.Image.Snapshots
+			}
+		}
+	}
+
+	res := []hypervisor.Snapshot{}
+	for _, s := range snapshots {
+		res = append(res, hypervisor.Snapshot{
+			Name:       s.Name,
+			MemorySize: s.VMStateSize,
+			Created:    time.Unix(s.DateSec, s.DateNsec),
+		})
+	}
+	return res, nil
+}
+
+// checkRunningVMSnapshot returns an error when QEMU can not save or load
+// state of the running instance in given directory. All writable disks must
+// support snapshots, which raw volumes do not, and host directories shared
+// with vhost-user-fs prevent QEMU from saving state of the devices.
+func checkRunningVMSnapshot(dir string) error {
+	c, err := readConfig(filepath.Join(dir, "osv.config"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, v := range c.Volumes {
+		if v.Format != "qcow2" {
+			return fmt.Errorf("volume %s is a %s disk image that does not support snapshots, "+
+				"stop the instance to snapshot its disk only", v.Path, v.Format)
+		}
+	}
+	if len(c.Mounts) > 0 {
+		return fmt.Errorf("host directory %s is mounted to the instance, which prevents saving its state, "+
+			"stop the instance to snapshot its disk only", c.Mounts[0].Source)
+	}
+	return nil
+}
+
+// dialRunningVM connects to monitor of the instance in given directory. Nil
+// client is returned when the instance is not running.
+func dialRunningVM(dir string) (*qmp.Client, error) {
+	status, err := GetVMStatus("", dir)
+	if err != nil {
+		return nil, err
+	}
+	if status == "Stopped" {
+		return nil, nil
+	}
+	client, err := qmp.Dial(filepath.Join(dir, "osv.monitor"), monitorTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QEMU monitor: %s", err)
+	}
+	return client, nil
+}
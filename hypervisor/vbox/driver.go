@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package vbox
+
+import (
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/image"
+)
+
+func init() {
+	hypervisor.Register(&Driver{})
+}
+
+// Driver runs instances with VirtualBox.
+type Driver struct{}
+
+func (d *Driver) Name() string {
+	return "vbox"
+}
+
+func (d *Driver) Capabilities() hypervisor.Capabilities {
+	return hypervisor.Capabilities{Formats: []image.ImageFormat{image.VDI, image.VMDK}}
+}
+
+func (d *Driver) Launch(c *hypervisor.Config) (*exec.Cmd, error) {
+	dir := hypervisor.InstanceDir(d.Name(), c.Name)
+	bridge := c.Bridge
+	if bridge == "" {
+		bridge = "vboxnet0"
+	}
+	return LaunchVM(&VMConfig{
+		Name:       c.Name,
+		Dir:        filepath.Dir(dir),
+		Image:      c.Image,
+		Memory:     c.Memory,
+		Cpus:       c.Cpus,
+		Networking: c.Networking,
+		Bridge:     bridge,
+		NatRules:   c.NatRules,
+		ConfigFile: filepath.Join(dir, "osv.config"),
+		MAC:        c.MAC,
+	})
+}
+
+func (d *Driver) Start(name string, opts *hypervisor.RunOptions) (*exec.Cmd, error) {
+	c, err := LoadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return LaunchVM(c)
+}
+
+func (d *Driver) Stop(name string) error {
+	return StopVM(name)
+}
+
+func (d *Driver) Delete(name string) error {
+	return DeleteVM(name)
+}
+
+func (d *Driver) Status(name string) (string, error) {
+	return GetVMStatus(name, hypervisor.InstanceDir(d.Name(), name))
+}
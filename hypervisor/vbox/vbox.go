@@ -173,8 +173,7 @@ func vmSetupNAT(c *VMConfig) error {
 	if err != nil {
 		return err
 	}
-	for _, rule := range c.NatRules {
-		natRule := fmt.Sprintf("guest%s,tcp,,%s,,%s", rule.GuestPort, rule.HostPort, rule.GuestPort)
+	for _, natRule := range natRules(c.NatRules) {
 		err := VBoxManage("modifyvm", c.Name, "--natpf1", natRule)
 		if err != nil {
 			return err
@@ -183,6 +182,19 @@ func vmSetupNAT(c *VMConfig) error {
 	return nil
 }
 
+// natRules returns port forwarding rules in form that --natpf option takes,
+// i.e. name,protocol,host_ip,host_port,guest_ip,guest_port.
+func natRules(rules []nat.Rule) []string {
+	var res []string
+	for _, rule := range rules {
+		for _, f := range rule.Forwards() {
+			// Rules are named after host port, which must be unique.
+			res = append(res, fmt.Sprintf("%s%d,%s,%s,%d,,%d", rule.Protocol, f.HostPort, rule.Protocol, rule.BindIP, f.HostPort, f.GuestPort))
+		}
+	}
+	return res
+}
+
 func DeleteVM(name string) error {
 	dir := filepath.Join(util.ConfigDir(), "instances/vbox", name)
 	c := &VMConfig{
@@ -246,6 +258,9 @@ func LoadConfig(name string) (*VMConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := nat.Validate(c.NatRules); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
 
 	return &c, nil
 }
@@ -0,0 +1,33 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package vbox
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mikelangelo-project/capstan/nat"
+)
+
+func TestNATRules(t *testing.T) {
+	rules := []nat.Rule{
+		{HostPort: nat.Port(8000), GuestPort: nat.Port(80), Protocol: nat.TCP},
+		{BindIP: "127.0.0.1", HostPort: nat.PortRange{First: 5000, Last: 5001}, GuestPort: nat.PortRange{First: 6000, Last: 6001}, Protocol: nat.TCP},
+		{HostPort: nat.Port(5353), GuestPort: nat.Port(53), Protocol: nat.UDP},
+	}
+
+	want := []string{
+		"tcp8000,tcp,,8000,,80",
+		"tcp5000,tcp,127.0.0.1,5000,,6000",
+		"tcp5001,tcp,127.0.0.1,5001,,6001",
+		"udp5353,udp,,5353,,53",
+	}
+	if got := natRules(rules); !reflect.DeepEqual(got, want) {
+		t.Errorf("natRules() => %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package vmw
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mikelangelo-project/capstan/hypervisor"
+	"github.com/mikelangelo-project/capstan/image"
+)
+
+func init() {
+	hypervisor.Register(&Driver{})
+}
+
+// Driver runs instances with VMware.
+type Driver struct{}
+
+func (d *Driver) Name() string {
+	return "vmw"
+}
+
+func (d *Driver) Capabilities() hypervisor.Capabilities {
+	return hypervisor.Capabilities{Formats: []image.ImageFormat{image.VMDK}}
+}
+
+func (d *Driver) Launch(c *hypervisor.Config) (*exec.Cmd, error) {
+	if len(c.NatRules) > 0 {
+		// VMware forwards ports of its NAT network in nat.conf of vmnet8,
+		// which is shared by all virtual machines of the host and needs
+		// address of the guest.
+		fmt.Printf("WARNING: %s: port forwarding rules are not applied, forward ports of the VMware NAT network (vmnet8) instead\n", d.Name())
+	}
+	dir := hypervisor.InstanceDir(d.Name(), c.Name)
+	return LaunchVM(&VMConfig{
+		Name:         c.Name,
+		Dir:          dir,
+		Image:        filepath.Join(dir, "osv.vmdk"),
+		Memory:       c.Memory,
+		Cpus:         c.Cpus,
+		NatRules:     c.NatRules,
+		VMXFile:      filepath.Join(dir, "osv.vmx"),
+		InstanceDir:  dir,
+		OriginalVMDK: c.Image,
+		ConfigFile:   filepath.Join(dir, "osv.config"),
+	})
+}
+
+func (d *Driver) Start(name string, opts *hypervisor.RunOptions) (*exec.Cmd, error) {
+	c, err := LoadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return LaunchVM(c)
+}
+
+func (d *Driver) Stop(name string) error {
+	return StopVM(name)
+}
+
+func (d *Driver) Delete(name string) error {
+	return DeleteVM(name)
+}
+
+func (d *Driver) Status(name string) (string, error) {
+	return GetVMStatus(name, hypervisor.InstanceDir(d.Name(), name))
+}
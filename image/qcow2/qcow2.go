@@ -9,6 +9,7 @@ package qcow2
 
 import (
 	"encoding/binary"
+	"fmt"
 	"os"
 )
 
@@ -48,3 +49,24 @@ func readHeader(f *os.File) (*Header, error) {
 	}
 	return &header, nil
 }
+
+// BackingFile returns the backing file name stored in the image header or
+// an empty string if the image has no backing file.
+func BackingFile(f *os.File) (string, error) {
+	header, err := readHeader(f)
+	if err != nil {
+		return "", err
+	}
+	if header.Magic != QCOW2_MAGIC {
+		return "", fmt.Errorf("%s: not a QCOW2 image", f.Name())
+	}
+	if header.BackingFileOffset == 0 || header.BackingFileSize == 0 {
+		return "", nil
+	}
+
+	name := make([]byte, header.BackingFileSize)
+	if _, err := f.ReadAt(name, int64(header.BackingFileOffset)); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
@@ -8,19 +8,252 @@
 package nat
 
 import (
+	"fmt"
+	"net"
+	"strconv"
 	"strings"
 )
 
+// Protocols that ports can be forwarded for.
+const (
+	TCP = "tcp"
+	UDP = "udp"
+)
+
+// Rule forwards a range of host ports to the same number of guest ports.
 type Rule struct {
-	HostPort  string
-	GuestPort string
+	// BindIP is IPv4 address of the host that host ports are bound to, all
+	// addresses when empty.
+	BindIP    string
+	HostPort  PortRange
+	GuestPort PortRange
+	Protocol  string
+}
+
+// PortRange is range of ports from First to Last inclusive.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// Port returns range of a single port.
+func Port(port int) PortRange {
+	return PortRange{First: port, Last: port}
+}
+
+// Forward is a single forwarded port.
+type Forward struct {
+	HostPort  int
+	GuestPort int
 }
 
-func Parse(rules []string) []Rule {
-	fwds := make([]Rule, 0, 0)
+// Parse parses rules of form [bind_ip:]host[-last]:guest[-last][/tcp|udp]
+// e.g. 8000:80, 127.0.0.1:5000-5010:5000-5010 or 5353:53/udp.
+func Parse(rules []string) ([]Rule, error) {
+	res := make([]Rule, 0, len(rules))
 	for _, rule := range rules {
-		ports := strings.Split(rule, ":")
-		fwds = append(fwds, Rule{HostPort: ports[0], GuestPort: ports[1]})
+		r, err := ParseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// ParseRule parses a single rule, see Parse.
+func ParseRule(rule string) (Rule, error) {
+	r := Rule{Protocol: TCP}
+	invalid := func(reason string) (Rule, error) {
+		return Rule{}, fmt.Errorf("invalid port forwarding rule '%s': %s", rule, reason)
+	}
+
+	ports := rule
+	if i := strings.LastIndex(rule, "/"); i >= 0 {
+		ports, r.Protocol = rule[:i], rule[i+1:]
+		if r.Protocol != TCP && r.Protocol != UDP {
+			return invalid("protocol must be tcp or udp")
+		}
+	}
+
+	parts := strings.Split(ports, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		r.BindIP, parts = parts[0], parts[1:]
+		if ip := net.ParseIP(r.BindIP); ip == nil || ip.To4() == nil {
+			return invalid("bind address must be an IPv4 address")
+		}
+	default:
+		return invalid("expected [bind_ip:]host_port:guest_port[/tcp|udp]")
+	}
+
+	var err error
+	if r.HostPort, err = parsePortRange(parts[0]); err != nil {
+		return invalid("host " + err.Error())
+	}
+	if r.GuestPort, err = parsePortRange(parts[1]); err != nil {
+		return invalid("guest " + err.Error())
+	}
+	if r.HostPort.Len() != r.GuestPort.Len() {
+		return invalid("host and guest port ranges must be of the same size")
+	}
+	return r, nil
+}
+
+// parsePortRange parses either a single port or range of form first-last.
+func parsePortRange(s string) (PortRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	var res PortRange
+	var err error
+	if res.First, err = parsePort(bounds[0]); err != nil {
+		return res, err
+	}
+	res.Last = res.First
+	if len(bounds) == 2 {
+		if res.Last, err = parsePort(bounds[1]); err != nil {
+			return res, err
+		}
+		if res.Last < res.First {
+			return res, fmt.Errorf("port range %s is empty", s)
+		}
+	}
+	return res, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port '%s' must be a number between 1 and 65535", s)
+	}
+	return port, nil
+}
+
+// Len returns number of ports in the range.
+func (p PortRange) Len() int {
+	return p.Last - p.First + 1
+}
+
+func (p PortRange) String() string {
+	if p.First == p.Last {
+		return strconv.Itoa(p.First)
+	}
+	return fmt.Sprintf("%d-%d", p.First, p.Last)
+}
+
+// Forwards returns all ports that the rule forwards.
+func (r Rule) Forwards() []Forward {
+	res := make([]Forward, 0, r.HostPort.Len())
+	for i := 0; i < r.HostPort.Len(); i++ {
+		res = append(res, Forward{HostPort: r.HostPort.First + i, GuestPort: r.GuestPort.First + i})
+	}
+	return res
+}
+
+// HostPortFor returns host port that the guest port is forwarded from.
+func (r Rule) HostPortFor(guestPort int) (int, bool) {
+	if guestPort < r.GuestPort.First || guestPort > r.GuestPort.Last {
+		return 0, false
+	}
+	return r.HostPort.First + guestPort - r.GuestPort.First, true
+}
+
+// String returns the rule as it is given on command line e.g. 8000:80. The
+// default tcp protocol is omitted.
+func (r Rule) String() string {
+	res := r.HostPort.String() + ":" + r.GuestPort.String()
+	if r.BindIP != "" {
+		res = r.BindIP + ":" + res
+	}
+	if r.Protocol != "" && r.Protocol != TCP {
+		res += "/" + r.Protocol
+	}
+	return res
+}
+
+// Validate returns error for the first rule that does not forward a valid
+// range of ports, e.g. one that could not be read from configuration.
+func Validate(rules []Rule) error {
+	for _, r := range rules {
+		if err := r.HostPort.validate(); err != nil {
+			return fmt.Errorf("invalid port forwarding rule '%s': host %s", r, err)
+		}
+		if err := r.GuestPort.validate(); err != nil {
+			return fmt.Errorf("invalid port forwarding rule '%s': guest %s", r, err)
+		}
+		if r.HostPort.Len() != r.GuestPort.Len() {
+			return fmt.Errorf("invalid port forwarding rule '%s': host and guest port ranges must be of the same size", r)
+		}
+		if r.Protocol != TCP && r.Protocol != UDP {
+			return fmt.Errorf("invalid port forwarding rule '%s': protocol must be tcp or udp", r)
+		}
+	}
+	return nil
+}
+
+func (p PortRange) validate() error {
+	if p.First < 1 || p.Last > 65535 || p.Last < p.First {
+		return fmt.Errorf("port range %s must be within 1 and 65535", p)
+	}
+	return nil
+}
+
+// SetYAML reads the rule from configuration of instances, which is stored
+// with yaml.v1. Earlier versions of Capstan stored ports as strings without
+// protocol, e.g. hostport: "8000", such rules forward tcp ports. Since
+// yaml.v1 silently drops values that are refused, invalid rules are read as
+// empty ones instead, so that Validate reports them.
+func (r *Rule) SetYAML(tag string, value interface{}) bool {
+	*r = Rule{}
+	fields, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return true
+	}
+
+	res := Rule{Protocol: TCP}
+	for key, v := range fields {
+		switch key {
+		case "bindip":
+			res.BindIP, ok = v.(string)
+		case "hostport":
+			ok = res.HostPort.SetYAML(tag, v)
+		case "guestport":
+			ok = res.GuestPort.SetYAML(tag, v)
+		case "protocol":
+			res.Protocol, ok = v.(string)
+		}
+		if !ok {
+			return true
+		}
+	}
+	*r = res
+	return true
+}
+
+// SetYAML reads the range either as mapping of first and last port or as
+// a single port, see Rule.SetYAML.
+func (p *PortRange) SetYAML(tag string, value interface{}) bool {
+	switch v := value.(type) {
+	case int:
+		*p = Port(v)
+	case string:
+		port, err := parsePortRange(v)
+		if err != nil {
+			return false
+		}
+		*p = port
+	case map[interface{}]interface{}:
+		first, ok := v["first"].(int)
+		if !ok {
+			return false
+		}
+		last, ok := v["last"].(int)
+		if !ok {
+			return false
+		}
+		*p = PortRange{First: first, Last: last}
+	default:
+		return false
 	}
-	return fwds
+	return true
 }
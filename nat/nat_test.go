@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package nat
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type natSuite struct{}
+
+var _ = Suite(&natSuite{})
+
+func (*natSuite) TestParseRule(c *C) {
+	m := []struct {
+		comment  string
+		rule     string
+		expected Rule
+	}{
+		{"ports", "8000:80", Rule{HostPort: Port(8000), GuestPort: Port(80), Protocol: TCP}},
+		{"tcp", "8000:80/tcp", Rule{HostPort: Port(8000), GuestPort: Port(80), Protocol: TCP}},
+		{"udp", "5353:53/udp", Rule{HostPort: Port(5353), GuestPort: Port(53), Protocol: UDP}},
+		{"bind address", "127.0.0.1:8000:80", Rule{BindIP: "127.0.0.1", HostPort: Port(8000), GuestPort: Port(80), Protocol: TCP}},
+		{
+			"ranges", "0.0.0.0:5000-5010:6000-6010/udp",
+			Rule{BindIP: "0.0.0.0", HostPort: PortRange{5000, 5010}, GuestPort: PortRange{6000, 6010}, Protocol: UDP},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		rule, err := ParseRule(args.rule)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(rule, DeepEquals, args.expected)
+		c.Check(rule.String(), Equals, strings.TrimSuffix(args.rule, "/tcp"))
+	}
+}
+
+func (*natSuite) TestParseRuleFails(c *C) {
+	m := []struct {
+		comment     string
+		rule        string
+		expectedErr string
+	}{
+		{"single port", "8000", "expected \\[bind_ip:\\]host_port:guest_port\\[/tcp\\|udp\\]"},
+		{"too many parts", "1:2:3:4", "expected \\[bind_ip:\\]host_port:guest_port\\[/tcp\\|udp\\]"},
+		{"empty", ":80", "host port '' must be a number between 1 and 65535"},
+		{"not a number", "http:80", "host port 'http' must be a number between 1 and 65535"},
+		{"out of range", "8000:70000", "guest port '70000' must be a number between 1 and 65535"},
+		{"zero", "0:80", "host port '0' must be a number between 1 and 65535"},
+		{"protocol", "8000:80/sctp", "protocol must be tcp or udp"},
+		{"bind hostname", "localhost:8000:80", "bind address must be an IPv4 address"},
+		{"bind IPv6", "::1:8000:80", "expected .*"},
+		{"empty range", "8010-8000:80-90", "host port range 8010-8000 is empty"},
+		{"range sizes", "8000-8010:80", "host and guest port ranges must be of the same size"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		_, err := ParseRule(args.rule)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, "invalid port forwarding rule '"+regexp.QuoteMeta(args.rule)+"': "+args.expectedErr)
+	}
+}
+
+func (*natSuite) TestParse(c *C) {
+	// This is what we're testing here.
+	rules, err := Parse([]string{"8000:80", "5000-5001:6000-6001/udp"})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(rules, HasLen, 2)
+	c.Check(rules[1].Forwards(), DeepEquals, []Forward{{5000, 6000}, {5001, 6001}})
+	port, ok := rules[1].HostPortFor(6001)
+	c.Check(port, Equals, 5001)
+	c.Check(ok, Equals, true)
+	_, ok = rules[0].HostPortFor(81)
+	c.Check(ok, Equals, false)
+
+	_, err = Parse([]string{"8000:80", "8000"})
+	c.Check(err, ErrorMatches, "invalid port forwarding rule '8000': .*")
+}
+
+func (*natSuite) TestReadFromConfig(c *C) {
+	m := []struct {
+		comment     string
+		config      string
+		expected    []Rule
+		expectedErr string
+	}{
+		{
+			"written by this version",
+			FixIndent(`
+				natrules:
+				- bindip: 127.0.0.1
+				  hostport:
+				    first: 5000
+				    last: 5001
+				  guestport:
+				    first: 6000
+				    last: 6001
+				  protocol: udp
+			`),
+			[]Rule{{BindIP: "127.0.0.1", HostPort: PortRange{5000, 5001}, GuestPort: PortRange{6000, 6001}, Protocol: UDP}}, "",
+		},
+		{
+			"written by earlier versions",
+			FixIndent(`
+				natrules:
+				- hostport: "8000"
+				  guestport: "80"
+			`),
+			[]Rule{{HostPort: Port(8000), GuestPort: Port(80), Protocol: TCP}}, "",
+		},
+		{
+			"invalid port",
+			FixIndent(`
+				natrules:
+				- hostport: "http"
+				  guestport: "80"
+			`),
+			nil, "invalid port forwarding rule '0:0': host port range 0 must be within 1 and 65535",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+		config := struct{ NatRules []Rule }{}
+
+		// This is what we're testing here.
+		c.Assert(yaml.Unmarshal([]byte(args.config), &config), IsNil)
+		err := Validate(config.NatRules)
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Check(err, ErrorMatches, args.expectedErr)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(config.NatRules, DeepEquals, args.expected)
+		}
+	}
+}
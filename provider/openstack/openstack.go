@@ -67,15 +67,15 @@ func PushImage(clientGlance *gophercloud.ServiceClient, imageName string, imageF
 }
 
 // LaunchInstances launches <count> instances. Return first error that occurs or nil on success.
-func LaunchInstances(clientNova *gophercloud.ServiceClient, name string, imageName string, flavorName string, count int, verbose bool) error {
+func LaunchInstances(clientNova *gophercloud.ServiceClient, name string, imageName string, flavorName string, count int, userData []byte, verbose bool) error {
 	var err error
 	if count <= 1 {
 		// Take name as it is.
-		err = launchServer(clientNova, name, flavorName, imageName, verbose)
+		err = launchServer(clientNova, name, flavorName, imageName, userData, verbose)
 	} else {
 		// Append index after the name of each instance.
 		for i := 0; i < count; i++ {
-			currErr := launchServer(clientNova, fmt.Sprintf("%s-%d", name, (i+1)), flavorName, imageName, verbose)
+			currErr := launchServer(clientNova, fmt.Sprintf("%s-%d", name, (i+1)), flavorName, imageName, userData, verbose)
 			if err == nil {
 				err = currErr
 			}
@@ -125,13 +125,20 @@ func listFlavors(clientNova *gophercloud.ServiceClient, minDiskGB int, minMemory
 }
 
 // launchServer launches single server of given image.
-func launchServer(clientNova *gophercloud.ServiceClient, name string, flavorName string, imageName string, verbose bool) error {
-	resp := servers.Create(clientNova, servers.CreateOpts{
+func launchServer(clientNova *gophercloud.ServiceClient, name string, flavorName string, imageName string, userData []byte, verbose bool) error {
+	opts := servers.CreateOpts{
 		Name:          name,
 		FlavorName:    flavorName,
 		ImageName:     imageName,
 		ServiceClient: clientNova, // need to pass this to perform name-to-ID lookup
-	})
+	}
+	// User-data is read by cloud-init from config drive.
+	if userData != nil {
+		configDrive := true
+		opts.UserData = userData
+		opts.ConfigDrive = &configDrive
+	}
+	resp := servers.Create(clientNova, opts)
 	if verbose {
 		instance, err := resp.Extract()
 		if err != nil {
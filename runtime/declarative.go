@@ -0,0 +1,469 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mikelangelo-project/capstan/util"
+	"gopkg.in/yaml.v2"
+)
+
+// Types of fields that declarative runtime can consist of.
+const (
+	FieldString = "string"
+	FieldList   = "list"
+	FieldInt    = "int"
+	FieldBool   = "bool"
+)
+
+// RuntimeDefinition describes a runtime that is defined in a yaml file rather
+// than implemented in Capstan itself. Definitions are read from
+// $CAPSTAN_ROOT/runtimes/*.yaml and from meta/runtimes/*.yaml of packages.
+type RuntimeDefinition struct {
+	Name         string   `yaml:"name"`
+	Description  string   `yaml:"description"`
+	Dependencies []string `yaml:"dependencies"`
+
+	// Base is a config set in form of <package>:<config_set> that is used to
+	// boot the unikernel. Fields are passed to it as environment variables.
+	Base string `yaml:"base"`
+	// BootCmd is used instead of Base for runtimes that do not inherit from
+	// another package. Environment variables are prepended to it.
+	BootCmd string `yaml:"bootcmd"`
+
+	Fields []FieldDefinition `yaml:"fields"`
+
+	// Env maps names of environment variables to names of fields.
+	Env map[string]string `yaml:"env"`
+
+	// Source is the file that the definition was loaded from.
+	Source string `yaml:"-"`
+}
+
+// FieldDefinition describes a single field that can be used in config set
+// of meta/run.yaml.
+type FieldDefinition struct {
+	Name        string      `yaml:"name"`
+	Type        string      `yaml:"type"`
+	Required    bool        `yaml:"required"`
+	Description string      `yaml:"description"`
+	Example     string      `yaml:"example"`
+	Default     interface{} `yaml:"default"`
+}
+
+var (
+	definitionsMutex sync.Mutex
+	definitions      = make(map[RuntimeType]*RuntimeDefinition)
+	// userClashes holds errors of user-defined runtimes that clash with
+	// runtimes of the same name that were loaded before them.
+	userClashes     = make(map[RuntimeType]error)
+	userDefinitions sync.Once
+
+	runtimeNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+	envNameRegexp     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// UserRuntimesPath returns the directory containing user-defined runtimes.
+func UserRuntimesPath() string {
+	root := os.Getenv("CAPSTAN_ROOT")
+	if root == "" {
+		root = util.ConfigDir()
+	}
+	return filepath.Join(root, "runtimes")
+}
+
+// runtimeClashError is returned when two different definitions of the
+// runtime with the same name are loaded.
+type runtimeClashError struct {
+	name     RuntimeType
+	existing string
+	source   string
+}
+
+func (e *runtimeClashError) Error() string {
+	return fmt.Sprintf("runtime '%s' is defined both in %s and %s, rename one of them", e.name, e.existing, e.source)
+}
+
+// LoadRuntimeDefinitions registers all runtime definitions (*.yaml files)
+// from the given directory. Missing directory is not an error. Runtime that is
+// already registered with a different definition is an error.
+func LoadRuntimeDefinitions(dir string) error {
+	return loadRuntimeDefinitions(dir, func(err error) error { return err })
+}
+
+// loadRuntimeDefinitions loads definitions from the directory and passes
+// errors of individual files to handle. Loading stops at the first error
+// that handle returns.
+func loadRuntimeDefinitions(dir string, handle func(err error) error) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".yaml" {
+			continue
+		}
+
+		path := filepath.Join(dir, f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = LoadRuntimeDefinitionData(data, path)
+		}
+		if err != nil {
+			if err := handle(err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadRuntimeDefinitionData parses and registers a single runtime definition.
+// Source is only used in error messages.
+func LoadRuntimeDefinitionData(data []byte, source string) error {
+	def := RuntimeDefinition{}
+	if err := yaml.UnmarshalStrict(data, &def); err != nil {
+		return fmt.Errorf("failed to parse runtime definition %s: %s", source, err)
+	}
+	def.Source = source
+
+	if err := def.Validate(); err != nil {
+		return fmt.Errorf("invalid runtime definition %s: %s", source, err)
+	}
+
+	return RegisterRuntime(&def)
+}
+
+// RegisterRuntime makes the runtime available to PickRuntime. Registering
+// the same definition again is allowed, a different definition of a runtime
+// with the same name is not.
+func RegisterRuntime(def *RuntimeDefinition) error {
+	if isBuiltinRuntime(RuntimeType(def.Name)) {
+		return fmt.Errorf("runtime '%s' is built into Capstan and cannot be redefined", def.Name)
+	}
+
+	definitionsMutex.Lock()
+	defer definitionsMutex.Unlock()
+	if existing, ok := definitions[RuntimeType(def.Name)]; ok && existing.Source != def.Source {
+		a, b := *existing, *def
+		a.Source, b.Source = "", ""
+		if !reflect.DeepEqual(a, b) {
+			return &runtimeClashError{name: RuntimeType(def.Name), existing: existing.Source, source: def.Source}
+		}
+	}
+	definitions[RuntimeType(def.Name)] = def
+
+	return nil
+}
+
+// DeclaredRuntimes returns names of all runtimes that were loaded from
+// runtime definitions, sorted alphabetically.
+func DeclaredRuntimes() []RuntimeType {
+	loadUserRuntimes()
+
+	definitionsMutex.Lock()
+	defer definitionsMutex.Unlock()
+
+	var res []RuntimeType
+	for name := range definitions {
+		res = append(res, name)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// declaredRuntime returns runtime definition with given name or nil. Error is
+// returned if the user-defined runtime clashes with the one of a package.
+func declaredRuntime(name RuntimeType) (*RuntimeDefinition, error) {
+	loadUserRuntimes()
+
+	definitionsMutex.Lock()
+	defer definitionsMutex.Unlock()
+	if err, ok := userClashes[name]; ok {
+		return nil, err
+	}
+	return definitions[name], nil
+}
+
+// loadUserRuntimes loads user-defined runtimes once per Capstan invocation.
+// Broken definition is reported, but does not prevent other runtimes from
+// being used. Runtime that clashes with an already loaded one cannot be used.
+func loadUserRuntimes() {
+	userDefinitions.Do(func() {
+		err := loadRuntimeDefinitions(UserRuntimesPath(), func(err error) error {
+			if clash, ok := err.(*runtimeClashError); ok {
+				definitionsMutex.Lock()
+				userClashes[clash.name] = clash
+				definitionsMutex.Unlock()
+			}
+			fmt.Printf("WARN: %s\n", err)
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("WARN: %s\n", err)
+		}
+	})
+}
+
+func isBuiltinRuntime(name RuntimeType) bool {
+	switch name {
+	case Native, NodeJS, Java, Python, Python3:
+		return true
+	}
+	return false
+}
+
+// Validate checks that runtime definition is complete and consistent.
+func (d *RuntimeDefinition) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("'name' must be provided")
+	}
+	if !runtimeNameRegexp.MatchString(d.Name) {
+		return fmt.Errorf("'name' must consist of lowercase letters, digits, '.', '_' and '-'")
+	}
+	if d.Base == "" && d.BootCmd == "" {
+		return fmt.Errorf("either 'base' or 'bootcmd' must be provided")
+	}
+	if d.Base != "" && d.BootCmd != "" {
+		return fmt.Errorf("'base' and 'bootcmd' are mutually exclusive")
+	}
+	if d.Base != "" && !strings.Contains(d.Base, ":") {
+		return fmt.Errorf("'base' must be in format <pkg_name>:<config_set>")
+	}
+
+	fields := make(map[string]bool)
+	for _, f := range d.Fields {
+		if f.Name == "" {
+			return fmt.Errorf("field name must be provided")
+		}
+		if f.Name == "env" || f.Name == "base" || f.Name == "merge" || f.Name == "healthcheck" {
+			return fmt.Errorf("field name '%s' is reserved", f.Name)
+		}
+		if fields[f.Name] {
+			return fmt.Errorf("field '%s' is defined more than once", f.Name)
+		}
+		fields[f.Name] = true
+
+		switch f.Type {
+		case FieldString, FieldList, FieldInt, FieldBool:
+		default:
+			return fmt.Errorf("field '%s' has unknown type '%s', use one of: %s, %s, %s, %s",
+				f.Name, f.Type, FieldString, FieldList, FieldInt, FieldBool)
+		}
+		if f.Default != nil {
+			if err := f.check(f.Default); err != nil {
+				return fmt.Errorf("default value of %s", err)
+			}
+		}
+	}
+
+	for envName, fieldName := range d.Env {
+		if !envNameRegexp.MatchString(envName) {
+			return fmt.Errorf("'%s' is not a valid environment variable name", envName)
+		}
+		if !fields[fieldName] {
+			return fmt.Errorf("environment variable '%s' refers to unknown field '%s'", envName, fieldName)
+		}
+	}
+
+	return nil
+}
+
+// check verifies that the value matches type of the field.
+func (f FieldDefinition) check(value interface{}) error {
+	ok := false
+	switch f.Type {
+	case FieldString:
+		switch value.(type) {
+		case string, int, float64, bool:
+			ok = true
+		}
+	case FieldInt:
+		_, ok = value.(int)
+	case FieldBool:
+		_, ok = value.(bool)
+	case FieldMap:
+		var items map[interface{}]interface{}
+		if items, ok = value.(map[interface{}]interface{}); ok {
+			for _, item := range items {
+				switch item.(type) {
+				case map[interface{}]interface{}, []interface{}:
+					ok = false
+				}
+			}
+		}
+	case fieldMapList:
+		var items []interface{}
+		if items, ok = value.([]interface{}); ok {
+			for _, item := range items {
+				if _, isMap := item.(map[interface{}]interface{}); !isMap {
+					ok = false
+				}
+			}
+		}
+	case FieldList:
+		var items []interface{}
+		if items, ok = value.([]interface{}); ok {
+			for _, item := range items {
+				switch item.(type) {
+				case map[interface{}]interface{}, []interface{}:
+					ok = false
+				}
+			}
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("field '%s' must be of type %s", f.Name, f.Type)
+	}
+	return nil
+}
+
+// format converts value of the field into environment variable value.
+func (f FieldDefinition) format(value interface{}) string {
+	if items, ok := value.([]interface{}); ok {
+		s := make([]string, len(items))
+		for i, item := range items {
+			s[i] = fmt.Sprint(item)
+		}
+		return util.QuoteArgs(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// declarativeRuntime implements Runtime interface based on RuntimeDefinition.
+type declarativeRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Values        map[string]interface{} `yaml:"-"`
+
+	def *RuntimeDefinition
+}
+
+// UnmarshalYAML stores common fields into CommonRuntime and all other
+// fields into Values so that they can be validated against definition.
+func (conf *declarativeRuntime) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&conf.CommonRuntime); err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+	delete(values, "env")
+	delete(values, "base")
+	delete(values, "merge")
+	delete(values, "healthcheck")
+	conf.Values = values
+
+	return nil
+}
+
+//
+// Interface implementation
+//
+
+func (conf declarativeRuntime) GetRuntimeName() string {
+	return conf.def.Name
+}
+func (conf declarativeRuntime) GetRuntimeDescription() string {
+	return conf.def.Description
+}
+func (conf declarativeRuntime) GetDependencies() []string {
+	if conf.def.Dependencies == nil {
+		return []string{}
+	}
+	return conf.def.Dependencies
+}
+func (conf declarativeRuntime) Validate() error {
+	inherit := conf.Base != ""
+
+	known := make(map[string]bool)
+	for _, f := range conf.def.Fields {
+		known[f.Name] = true
+
+		value, exists := conf.Values[f.Name]
+		if !exists || value == nil {
+			if f.Required && !inherit {
+				return fmt.Errorf("'%s' must be provided", f.Name)
+			}
+			continue
+		}
+		if err := f.check(value); err != nil {
+			return err
+		}
+	}
+
+	for name := range conf.Values {
+		if !known[name] {
+			return fmt.Errorf("unknown field '%s' for runtime '%s'", name, conf.def.Name)
+		}
+	}
+
+	return conf.CommonRuntime.Validate(inherit)
+}
+func (conf declarativeRuntime) GetBootCmd(cmdConfs map[string]*CmdConfig) (string, error) {
+	env := make(map[string]string)
+	for envName, fieldName := range conf.def.Env {
+		for _, f := range conf.def.Fields {
+			if f.Name != fieldName {
+				continue
+			}
+			if value, exists := conf.Values[f.Name]; exists && value != nil {
+				env[envName] = f.format(value)
+			} else if f.Default != nil {
+				env[envName] = f.format(f.Default)
+			}
+		}
+	}
+
+	// Base given in the config set takes precedence over the one of the
+	// runtime definition.
+	if conf.Base == "" {
+		conf.Base = conf.def.Base
+	}
+	conf.setDefaultEnv(env)
+	return conf.CommonRuntime.BuildBootCmd(conf.def.BootCmd, cmdConfs)
+}
+func (conf declarativeRuntime) GetYamlTemplate() string {
+	res := ""
+	for _, f := range conf.def.Fields {
+		if f.Required {
+			res += "\n# REQUIRED\n"
+		} else {
+			res += "\n# OPTIONAL\n"
+		}
+		if f.Description != "" {
+			for _, line := range strings.Split(strings.TrimSpace(f.Description), "\n") {
+				res += fmt.Sprintf("# %s\n", line)
+			}
+		}
+		if f.Example != "" {
+			res += fmt.Sprintf("# Example value: %s\n", f.Example)
+		}
+		if f.Type == FieldList {
+			res += fmt.Sprintf("%s:\n   - <list>\n", f.Name)
+		} else {
+			res += fmt.Sprintf("%s: <%s>\n", f.Name, f.Type)
+		}
+	}
+	return res + conf.CommonRuntime.GetYamlTemplate()
+}
@@ -0,0 +1,412 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"os"
+	"sync"
+
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+type declarativeSuite struct {
+}
+
+var _ = Suite(&declarativeSuite{})
+
+const rubyDefinition = `
+name: ruby
+description: Run Ruby application
+dependencies:
+  - ruby-2.4
+base: ruby-2.4:ruby
+fields:
+  - name: main
+    type: string
+    required: true
+    description: Filepath of the Ruby script.
+    example: /app.rb
+  - name: ruby_args
+    type: list
+    default: ["-W0"]
+  - name: threads
+    type: int
+env:
+  MAIN: main
+  RUBY_ARGS: ruby_args
+  THREADS: threads
+`
+
+func (*declarativeSuite) SetUpTest(c *C) {
+	definitions = make(map[RuntimeType]*RuntimeDefinition)
+	c.Assert(LoadRuntimeDefinitionData([]byte(FixIndent(rubyDefinition)), "ruby.yaml"), IsNil)
+}
+
+func (*declarativeSuite) TestPickRuntime(c *C) {
+	// This is what we're testing here.
+	rt, err := PickRuntime("ruby")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(rt.GetRuntimeName(), Equals, "ruby")
+	c.Check(rt.GetRuntimeDescription(), Equals, "Run Ruby application")
+	c.Check(rt.GetDependencies(), DeepEquals, []string{"ruby-2.4"})
+	c.Check(DeclaredRuntimes(), DeepEquals, []RuntimeType{"ruby"})
+}
+
+func (*declarativeSuite) TestInvalidDefinition(c *C) {
+	m := []struct {
+		comment    string
+		definition string
+		err        string
+	}{
+		{
+			"missing name",
+			`
+			base: pkg:cfg
+			`,
+			".*'name' must be provided",
+		},
+		{
+			"builtin runtime",
+			`
+			name: node
+			base: pkg:cfg
+			`,
+			"runtime 'node' is built into Capstan and cannot be redefined",
+		},
+		{
+			"missing base",
+			`
+			name: ruby
+			`,
+			".*either 'base' or 'bootcmd' must be provided",
+		},
+		{
+			"unknown type",
+			`
+			name: ruby
+			base: pkg:cfg
+			fields:
+			  - name: main
+			    type: path
+			`,
+			".*field 'main' has unknown type 'path'.*",
+		},
+		{
+			"invalid default",
+			`
+			name: ruby
+			base: pkg:cfg
+			fields:
+			  - name: threads
+			    type: int
+			    default: many
+			`,
+			".*default value of field 'threads' must be of type int",
+		},
+		{
+			"env of unknown field",
+			`
+			name: ruby
+			base: pkg:cfg
+			env:
+			  MAIN: main
+			`,
+			".*environment variable 'MAIN' refers to unknown field 'main'",
+		},
+		{
+			"unknown key",
+			`
+			name: ruby
+			base: pkg:cfg
+			dependency: ruby-2.4
+			`,
+			"(?s)failed to parse runtime definition test.yaml:.*field dependency not found.*",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := LoadRuntimeDefinitionData([]byte(FixIndent(args.definition)), "test.yaml")
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.err)
+	}
+}
+
+func (*declarativeSuite) TestValidate(c *C) {
+	m := []struct {
+		comment     string
+		runYamlText string
+		err         string
+	}{
+		{
+			"valid",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    main: /app.rb
+			    threads: 4
+			`,
+			"",
+		},
+		{
+			"missing required field",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    threads: 4
+			`,
+			"'main' must be provided",
+		},
+		{
+			"wrong type",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    main: /app.rb
+			    threads: four
+			`,
+			"field 'threads' must be of type int",
+		},
+		{
+			"unknown field",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    main: /app.rb
+			    mian: /app.rb
+			`,
+			"unknown field 'mian' for runtime 'ruby'",
+		},
+		{
+			"inherit",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    base: other:default
+			`,
+			"",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		cmdConfig, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		c.Assert(err, IsNil)
+		testRuntime, _ := cmdConfig.selectConfigSetByName("default")
+
+		// This is what we're testing here.
+		err = testRuntime.Validate()
+
+		// Expectations.
+		if args.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, args.err)
+		}
+	}
+}
+
+func (*declarativeSuite) TestGetBootCmd(c *C) {
+	// Simulate ruby-2.4's meta/run.yaml being parsed.
+	cmdConfs := map[string]*CmdConfig{
+		"ruby-2.4": &CmdConfig{
+			RuntimeType:      Native,
+			ConfigSetDefault: "ruby",
+			ConfigSets: map[string]Runtime{
+				"ruby": nativeRuntime{
+					BootCmd: "/ruby.so",
+					CommonRuntime: CommonRuntime{
+						Env: map[string]string{
+							"RUBY_ARGS": "-W0",
+							"MAIN":      "-",
+						},
+					},
+				},
+				"debug": nativeRuntime{
+					BootCmd: "/ruby.so --debug",
+				},
+			},
+		},
+	}
+
+	m := []struct {
+		comment      string
+		runYamlText  string
+		expectedBoot string
+		expectedEnv  []string
+	}{
+		{
+			"defaults",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    main: /app.rb
+			`,
+			"/ruby.so", []string{
+				"--env=RUBY_ARGS?=-W0",
+				"--env=MAIN?=/app.rb",
+			},
+		},
+		{
+			"all fields",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    main: /app.rb
+			    ruby_args:
+			      - -w
+			      - -d
+			    threads: 4
+			`,
+			"/ruby.so", []string{
+				`"--env=RUBY_ARGS?=-w -d"`,
+				"--env=MAIN?=/app.rb",
+				"--env=THREADS?=4",
+			},
+		},
+		{
+			"env",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    main: /app.rb
+			    env:
+			      PORT: 8000
+			`,
+			"/ruby.so", []string{
+				"--env=RUBY_ARGS?=-W0",
+				"--env=MAIN?=/app.rb",
+				"--env=PORT?=8000",
+			},
+		},
+		{
+			"base of config set",
+			`
+			runtime: ruby
+			config_set:
+			  default:
+			    main: /app.rb
+			    base: ruby-2.4:debug
+			`,
+			"/ruby.so --debug", []string{
+				"--env=RUBY_ARGS?=-W0",
+				"--env=MAIN?=/app.rb",
+			},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		cmdConfig, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		c.Assert(err, IsNil)
+		testRuntime, _ := cmdConfig.selectConfigSetByName("default")
+
+		// This is what we're testing here.
+		boot, err := testRuntime.GetBootCmd(cmdConfs)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(boot, BootCmdEquals, args.expectedBoot, args.expectedEnv)
+	}
+}
+
+func (*declarativeSuite) TestGetBootCmdWithoutBase(c *C) {
+	// Prepare
+	definition := `
+		name: hello
+		bootcmd: /hello.so $GREETING
+		fields:
+		  - name: greeting
+		    type: string
+		    default: world
+		env:
+		  GREETING: greeting
+	`
+	c.Assert(LoadRuntimeDefinitionData([]byte(FixIndent(definition)), "hello.yaml"), IsNil)
+	rt, err := PickRuntime("hello")
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	boot, err := rt.GetBootCmd(nil)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(boot, BootCmdEquals, "/hello.so $GREETING", []string{"--env=GREETING?=world"})
+}
+
+func (*declarativeSuite) TestRuntimeNameClash(c *C) {
+	// Prepare
+	definition := `
+		name: ruby
+		bootcmd: /other-ruby.so
+	`
+
+	// This is what we're testing here.
+	err := LoadRuntimeDefinitionData([]byte(FixIndent(definition)), "other.yaml")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "runtime 'ruby' is defined both in ruby.yaml and other.yaml, rename one of them")
+	c.Check(LoadRuntimeDefinitionData([]byte(FixIndent(rubyDefinition)), "pkg:/meta/runtimes/ruby.yaml"), IsNil)
+}
+
+func (*declarativeSuite) TestUserRuntimeClash(c *C) {
+	// Prepare
+	root := c.MkDir()
+	PrepareFiles(root, map[string]string{
+		"runtimes/ruby.yaml":  "name: ruby\nbootcmd: /other-ruby.so\n",
+		"runtimes/hello.yaml": "name: hello\nbootcmd: /hello.so\n",
+	})
+	oldRoot := os.Getenv("CAPSTAN_ROOT")
+	defer os.Setenv("CAPSTAN_ROOT", oldRoot)
+	os.Setenv("CAPSTAN_ROOT", root)
+	reset := func() {
+		userDefinitions = sync.Once{}
+		userClashes = make(map[RuntimeType]error)
+	}
+	reset()
+	defer reset()
+
+	// This is what we're testing here.
+	_, err := PickRuntime("ruby")
+
+	// Expectations.
+	c.Check(err, ErrorMatches, "runtime 'ruby' is defined both in ruby.yaml and .*/runtimes/ruby.yaml, rename one of them")
+	_, err = PickRuntime("hello")
+	c.Check(err, IsNil)
+}
+
+func (*declarativeSuite) TestGetYamlTemplate(c *C) {
+	// Prepare
+	testRuntime, _ := PickRuntime("ruby")
+
+	// This is what we're testing here.
+	template := testRuntime.GetYamlTemplate()
+
+	// Expectations.
+	c.Check(template, MatchesMultiline, "# REQUIRED\n# Filepath of the Ruby script.\n# Example value: /app.rb\nmain: <string>")
+	c.Check(template, MatchesMultiline, "ruby_args:\n   - <list>")
+	c.Check(template, MatchesMultiline, "threads: <int>")
+	c.Check(template, MatchesMultiline, "env:")
+	c.Check(yaml.Unmarshal([]byte(template), &map[string]interface{}{}), IsNil)
+}
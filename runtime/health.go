@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kinds of health checks.
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckLog  = "log"
+)
+
+const (
+	// DefaultHealthCheckInterval is time between two attempts when not set.
+	DefaultHealthCheckInterval = time.Second
+	// DefaultHealthCheckTimeout is time after which instance that has not
+	// passed the check is considered unhealthy when not set.
+	DefaultHealthCheckTimeout = time.Minute
+)
+
+// HealthCheck tells how to verify that the application in a running
+// instance is healthy. Exactly one of TCP, HTTP and Log must be set.
+type HealthCheck struct {
+	// TCP is guest port that must accept connections.
+	TCP int `yaml:"tcp,omitempty"`
+	// HTTP is path that GET request is sent to on guest Port. Response
+	// must have the expected Status (200 by default).
+	HTTP   string `yaml:"http,omitempty"`
+	Port   int    `yaml:"port,omitempty"`
+	Status int    `yaml:"status,omitempty"`
+	// Log is regular expression that a line of console output must match.
+	Log string `yaml:"log,omitempty"`
+
+	Interval string `yaml:"interval,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty"`
+}
+
+// Kind returns which kind of the check this is.
+func (h *HealthCheck) Kind() string {
+	switch {
+	case h.TCP != 0:
+		return HealthCheckTCP
+	case h.HTTP != "":
+		return HealthCheckHTTP
+	case h.Log != "":
+		return HealthCheckLog
+	}
+	return ""
+}
+
+// GuestPort returns port that the check connects to, 0 for log checks.
+func (h *HealthCheck) GuestPort() int {
+	switch h.Kind() {
+	case HealthCheckTCP:
+		return h.TCP
+	case HealthCheckHTTP:
+		return h.Port
+	}
+	return 0
+}
+
+// ExpectedStatus returns HTTP status that the check expects.
+func (h *HealthCheck) ExpectedStatus() int {
+	if h.Status == 0 {
+		return 200
+	}
+	return h.Status
+}
+
+// IntervalDuration returns time between two attempts.
+func (h *HealthCheck) IntervalDuration() time.Duration {
+	if d, err := time.ParseDuration(h.Interval); err == nil {
+		return d
+	}
+	return DefaultHealthCheckInterval
+}
+
+// TimeoutDuration returns time that the check may take to pass.
+func (h *HealthCheck) TimeoutDuration() time.Duration {
+	if d, err := time.ParseDuration(h.Timeout); err == nil {
+		return d
+	}
+	return DefaultHealthCheckTimeout
+}
+
+// String describes the check for the user.
+func (h *HealthCheck) String() string {
+	switch h.Kind() {
+	case HealthCheckTCP:
+		return fmt.Sprintf("tcp port %d", h.TCP)
+	case HealthCheckHTTP:
+		return fmt.Sprintf("http GET %s on port %d", h.HTTP, h.Port)
+	case HealthCheckLog:
+		return fmt.Sprintf("log line matching '%s'", h.Log)
+	}
+	return "none"
+}
+
+// Validate checks that the health check is complete.
+func (h *HealthCheck) Validate() error {
+	var kinds []string
+	if h.TCP != 0 {
+		kinds = append(kinds, HealthCheckTCP)
+	}
+	if h.HTTP != "" {
+		kinds = append(kinds, HealthCheckHTTP)
+	}
+	if h.Log != "" {
+		kinds = append(kinds, HealthCheckLog)
+	}
+	if len(kinds) != 1 {
+		return fmt.Errorf("exactly one of 'tcp', 'http' and 'log' must be provided in 'healthcheck'")
+	}
+
+	if h.TCP < 0 || h.TCP > 65535 {
+		return fmt.Errorf("'tcp' of 'healthcheck' must be a port number")
+	}
+	if h.HTTP != "" {
+		if !strings.HasPrefix(h.HTTP, "/") {
+			return fmt.Errorf("'http' of 'healthcheck' must be a path starting with '/'")
+		}
+		if h.Port <= 0 || h.Port > 65535 {
+			return fmt.Errorf("'port' of 'healthcheck' must be provided for http check")
+		}
+	}
+	if h.Log != "" {
+		if _, err := regexp.Compile(h.Log); err != nil {
+			return fmt.Errorf("'log' of 'healthcheck' is not a valid regular expression: %s", err)
+		}
+	}
+	for name, value := range map[string]string{"interval": h.Interval, "timeout": h.Timeout} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("'%s' of 'healthcheck' must be a duration e.g. 30s", name)
+		}
+	}
+
+	return nil
+}
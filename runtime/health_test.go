@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"time"
+
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+type healthSuite struct {
+}
+
+var _ = Suite(&healthSuite{})
+
+func (*healthSuite) TestParseHealthCheck(c *C) {
+	// Prepare
+	runYamlText := `
+		runtime: native
+		config_set:
+		  default:
+		    bootcmd: /web.so
+		    healthcheck:
+		      http: /health
+		      port: 8000
+		      status: 204
+		      timeout: 2m
+	`
+
+	// This is what we're testing here.
+	cmdConf, err := ParsePackageRunManifestData([]byte(FixIndent(runYamlText)))
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	rt := cmdConf.ConfigSets["default"]
+	c.Assert(rt.Validate(), IsNil)
+	h := rt.GetHealthCheck()
+	c.Assert(h, NotNil)
+	c.Check(h.Kind(), Equals, HealthCheckHTTP)
+	c.Check(h.GuestPort(), Equals, 8000)
+	c.Check(h.ExpectedStatus(), Equals, 204)
+	c.Check(h.IntervalDuration(), Equals, time.Second)
+	c.Check(h.TimeoutDuration(), Equals, 2*time.Minute)
+}
+
+func (*healthSuite) TestValidateHealthCheck(c *C) {
+	m := []struct {
+		comment     string
+		check       HealthCheck
+		expectedErr string
+	}{
+		{"tcp", HealthCheck{TCP: 8000}, ""},
+		{"http", HealthCheck{HTTP: "/", Port: 80, Interval: "500ms"}, ""},
+		{"log", HealthCheck{Log: `listening on \d+`}, ""},
+		{"none", HealthCheck{}, "exactly one of 'tcp', 'http' and 'log' must be provided in 'healthcheck'"},
+		{"two kinds", HealthCheck{TCP: 8000, Log: "started"}, "exactly one of 'tcp', 'http' and 'log' must be provided in 'healthcheck'"},
+		{"invalid port", HealthCheck{TCP: 80000}, "'tcp' of 'healthcheck' must be a port number"},
+		{"http without port", HealthCheck{HTTP: "/"}, "'port' of 'healthcheck' must be provided for http check"},
+		{"http relative path", HealthCheck{HTTP: "health", Port: 80}, "'http' of 'healthcheck' must be a path starting with '/'"},
+		{"invalid regexp", HealthCheck{Log: "(started"}, "'log' of 'healthcheck' is not a valid regular expression: .*"},
+		{"invalid timeout", HealthCheck{TCP: 80, Timeout: "60"}, "'timeout' of 'healthcheck' must be a duration e.g. 30s"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := args.check.Validate()
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Check(err, ErrorMatches, args.expectedErr)
+		} else {
+			c.Check(err, IsNil)
+		}
+	}
+}
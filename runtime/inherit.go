@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Modes of merging list fields of config set with the ones of its base.
+const (
+	MergeReplace = "replace"
+	MergeAppend  = "append"
+	MergePrepend = "prepend"
+)
+
+// resolveInheritance replaces config sets that inherit from a config set of
+// the same runtime with the result of merging them with their base. Fields
+// of the config set override the ones of its base, 'env' maps are merged and
+// lists are merged as requested by 'merge'. Bases are resolved recursively
+// and cycles are reported. Config sets inheriting from another runtime can
+// only override environment variables, see CommonRuntime.inheritBootCmd.
+func (c *AllCmdConfigs) resolveInheritance() error {
+	resolved := make(map[string]map[string]interface{})
+	for _, pkgName := range c.order {
+		cmdConf := c.cmdConfigs[pkgName]
+		if cmdConf == nil {
+			continue
+		}
+
+		for _, confName := range sortedKeysOfMap(cmdConf.ConfigSets) {
+			merged, err := c.resolveConfigSet(pkgName, confName, nil, resolved)
+			if err != nil {
+				return fmt.Errorf("Failed to inherit configuration set '%s': %s", confName, err)
+			}
+			if merged == nil {
+				continue
+			}
+
+			theRuntime, err := PickRuntime(cmdConf.RuntimeType)
+			if err != nil {
+				return err
+			}
+			subdata, _ := yaml.Marshal(merged)
+			if err := yaml.Unmarshal(subdata, theRuntime); err != nil {
+				return fmt.Errorf("Failed to inherit configuration set '%s': %s", confName, err)
+			}
+			cmdConf.ConfigSets[confName] = theRuntime
+		}
+	}
+
+	return nil
+}
+
+// resolveConfigSet returns config set merged with its base or nil when it
+// cannot be merged. Chain contains config sets that are being resolved.
+func (c *AllCmdConfigs) resolveConfigSet(pkgName, confName string, chain []string, resolved map[string]map[string]interface{}) (map[string]interface{}, error) {
+	ref := pkgName + ":" + confName
+	for _, r := range chain {
+		if r == ref {
+			return nil, fmt.Errorf("inheritance cycle: %s", strings.Join(append(chain, ref), " -> "))
+		}
+	}
+	if merged, exists := resolved[ref]; exists {
+		return merged, nil
+	}
+
+	cmdConf := c.cmdConfigs[pkgName]
+	raw := cmdConf.raw[confName]
+	base, _ := raw["base"].(string)
+	if _, isProcesses := raw[Processes]; base == "" || isProcesses {
+		return nil, nil
+	}
+
+	// Missing or malformed base is reported when boot command is built.
+	parts := strings.SplitN(base, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	baseConf := c.cmdConfigs[parts[0]]
+	if baseConf == nil || baseConf.raw[parts[1]] == nil {
+		return nil, nil
+	}
+
+	baseRaw, err := c.resolveConfigSet(parts[0], parts[1], append(chain, ref), resolved)
+	if err != nil {
+		return nil, err
+	}
+	if baseRaw == nil {
+		baseRaw = baseConf.raw[parts[1]]
+	}
+
+	if _, isProcesses := baseRaw[Processes]; isProcesses || baseConf.RuntimeType != cmdConf.RuntimeType {
+		for key := range raw {
+			if key != "env" && key != "base" {
+				return nil, fmt.Errorf("'%s' cannot be overridden, base '%s' is not of runtime '%s'",
+					key, base, cmdConf.RuntimeType)
+			}
+		}
+		return nil, nil
+	}
+
+	merged, err := mergeConfigSets(baseRaw, raw)
+	if err != nil {
+		return nil, err
+	}
+	resolved[ref] = merged
+	return merged, nil
+}
+
+// mergeConfigSets returns config set with fields of child set over the ones
+// of base.
+func mergeConfigSets(base, child map[string]interface{}) (map[string]interface{}, error) {
+	modes := make(map[string]string)
+	if merge, ok := child["merge"].(map[interface{}]interface{}); ok {
+		for field, mode := range merge {
+			modes[fmt.Sprint(field)] = fmt.Sprint(mode)
+		}
+	}
+
+	res := make(map[string]interface{})
+	for key, value := range base {
+		if key != "merge" {
+			res[key] = value
+		}
+	}
+	delete(res, "base")
+	if base["base"] != nil {
+		res["base"] = base["base"]
+	}
+
+	for key, value := range child {
+		switch key {
+		case "base", "merge":
+			continue
+		case "env":
+			env := make(map[interface{}]interface{})
+			if baseEnv, ok := res["env"].(map[interface{}]interface{}); ok {
+				for k, v := range baseEnv {
+					env[k] = v
+				}
+			}
+			if childEnv, ok := value.(map[interface{}]interface{}); ok {
+				for k, v := range childEnv {
+					env[k] = v
+				}
+			}
+			res["env"] = env
+			continue
+		}
+
+		mode, exists := modes[key]
+		if !exists || mode == MergeReplace {
+			res[key] = value
+			continue
+		}
+
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("merge mode '%s' of '%s' only applies to lists", mode, key)
+		}
+		baseItems, _ := res[key].([]interface{})
+		switch mode {
+		case MergeAppend:
+			res[key] = append(append([]interface{}{}, baseItems...), items...)
+		case MergePrepend:
+			res[key] = append(append([]interface{}{}, items...), baseItems...)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+type inheritSuite struct {
+}
+
+var _ = Suite(&inheritSuite{})
+
+const baseJavaRunYaml = `
+runtime: java
+config_set:
+  default:
+    main: main.Hello
+    classpath:
+      - /
+    jvm_args:
+      - -Dfoo=bar
+    args:
+      - first
+    env:
+      PORT: 8000
+      HOST: localhost
+`
+
+func (*inheritSuite) TestResolveInheritance(c *C) {
+	m := []struct {
+		comment     string
+		runYamlText string
+		expected    javaRuntime
+	}{
+		{
+			"override scalar",
+			`
+			runtime: java
+			config_set:
+			  child:
+			    base: app.base:default
+			    main: main.Other
+			`,
+			javaRuntime{
+				CommonRuntime: CommonRuntime{Env: map[string]string{"PORT": "8000", "HOST": "localhost"}},
+				Main:          "main.Other",
+				Classpath:     []string{"/"},
+				JvmArgs:       []string{"-Dfoo=bar"},
+				Args:          []string{"first"},
+			},
+		},
+		{
+			"replace list and merge env",
+			`
+			runtime: java
+			config_set:
+			  child:
+			    base: app.base:default
+			    jvm_args:
+			      - -Xss2m
+			    env:
+			      PORT: 9000
+			`,
+			javaRuntime{
+				CommonRuntime: CommonRuntime{Env: map[string]string{"PORT": "9000", "HOST": "localhost"}},
+				Main:          "main.Hello",
+				Classpath:     []string{"/"},
+				JvmArgs:       []string{"-Xss2m"},
+				Args:          []string{"first"},
+			},
+		},
+		{
+			"append and prepend lists",
+			`
+			runtime: java
+			config_set:
+			  child:
+			    base: app.base:default
+			    jvm_args:
+			      - -Xss2m
+			    args:
+			      - zeroth
+			    merge:
+			      jvm_args: append
+			      args: prepend
+			`,
+			javaRuntime{
+				CommonRuntime: CommonRuntime{Env: map[string]string{"PORT": "8000", "HOST": "localhost"}},
+				Main:          "main.Hello",
+				Classpath:     []string{"/"},
+				JvmArgs:       []string{"-Dfoo=bar", "-Xss2m"},
+				Args:          []string{"zeroth", "first"},
+			},
+		},
+		{
+			"multi-level chain",
+			`
+			runtime: java
+			config_set:
+			  middle:
+			    base: app.base:default
+			    jvm_args:
+			      - -Xss2m
+			    merge:
+			      jvm_args: append
+			  child:
+			    base: app:middle
+			    jvm_args:
+			      - -Xss4m
+			    merge:
+			      jvm_args: append
+			`,
+			javaRuntime{
+				CommonRuntime: CommonRuntime{Env: map[string]string{"PORT": "8000", "HOST": "localhost"}},
+				Main:          "main.Hello",
+				Classpath:     []string{"/"},
+				JvmArgs:       []string{"-Dfoo=bar", "-Xss2m", "-Xss4m"},
+				Args:          []string{"first"},
+			},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		baseConf, err := ParsePackageRunManifestData([]byte(baseJavaRunYaml))
+		c.Assert(err, IsNil)
+		cmdConf, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		c.Assert(err, IsNil)
+		all := AllCmdConfigs{}
+		all.Add("app.base", baseConf)
+		all.Add("app", cmdConf)
+
+		// This is what we're testing here.
+		err = all.resolveInheritance()
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(cmdConf.ConfigSets["child"], DeepEquals, &args.expected)
+		c.Check(cmdConf.ConfigSets["child"].Validate(), IsNil)
+	}
+}
+
+func (*inheritSuite) TestResolveInheritanceInvalid(c *C) {
+	m := []struct {
+		comment     string
+		runYamlText string
+		expectedErr string
+	}{
+		{
+			"cycle",
+			`
+			runtime: java
+			config_set:
+			  first:
+			    base: app:second
+			  second:
+			    base: app:third
+			  third:
+			    base: app:first
+			`,
+			"Failed to inherit configuration set 'first': inheritance cycle: app:first -> app:second -> app:third -> app:first",
+		},
+		{
+			"self reference",
+			`
+			runtime: native
+			config_set:
+			  first:
+			    base: app:first
+			`,
+			"Failed to inherit configuration set 'first': inheritance cycle: app:first -> app:first",
+		},
+		{
+			"override field of other runtime",
+			`
+			runtime: native
+			config_set:
+			  first:
+			    base: app.base:default
+			    bootcmd: /app.so
+			`,
+			"Failed to inherit configuration set 'first': 'bootcmd' cannot be overridden, base 'app.base:default' is not of runtime 'native'",
+		},
+		{
+			"merge scalar",
+			`
+			runtime: java
+			config_set:
+			  first:
+			    base: app.base:default
+			    main: main.Other
+			    merge:
+			      main: append
+			`,
+			"Failed to inherit configuration set 'first': merge mode 'append' of 'main' only applies to lists",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		baseConf, err := ParsePackageRunManifestData([]byte(baseJavaRunYaml))
+		c.Assert(err, IsNil)
+		cmdConf, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		c.Assert(err, IsNil)
+		all := AllCmdConfigs{}
+		all.Add("app.base", baseConf)
+		all.Add("app", cmdConf)
+
+		// This is what we're testing here.
+		err = all.resolveInheritance()
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+	}
+}
+
+func (*inheritSuite) TestValidateMerge(c *C) {
+	conf := nativeRuntime{CommonRuntime: CommonRuntime{
+		Base:  "app:default",
+		Merge: map[string]string{"args": "insert"},
+	}}
+	c.Check(conf.Validate(), ErrorMatches, "unknown merge mode 'insert' of 'args', use one of: replace, append, prepend")
+
+	conf = nativeRuntime{BootCmd: "/app.so", CommonRuntime: CommonRuntime{
+		Merge: map[string]string{"args": "append"},
+	}}
+	c.Check(conf.Validate(), ErrorMatches, "'merge' can only be used together with 'base'")
+}
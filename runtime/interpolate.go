@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// interpolationRegexp matches $${...} (escaped), ${VAR} and ${VAR:-default}.
+var interpolationRegexp = regexp.MustCompile(`\$?\$\{([^}:]*)(:-([^}]*))?\}`)
+
+// Interpolate replaces ${VAR} and ${VAR:-default} in values of meta/run.yaml
+// with values of variables. Default value is used when variable is not set
+// or is empty. Use $${VAR} to get literal ${VAR}. Other occurrences of '$'
+// are left intact since OSv expands $VAR in boot commands itself.
+//
+// Variables are only substituted into string values after the content is
+// parsed, so a value of a variable can never change the structure of the
+// file. Content without variables is returned unchanged.
+func Interpolate(data []byte, vars map[string]string) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse meta/run.yaml: %s", err)
+	}
+
+	in := interpolator{vars: vars}
+	res := in.value(doc, "")
+
+	if len(in.errors) > 0 {
+		return nil, fmt.Errorf("failed to interpolate meta/run.yaml:\n  %s\n"+
+			"Set variables in environment, with --env or with --env-file, provide default with "+
+			"${VAR:-default} or use $${VAR} to keep ${VAR} as it is",
+			strings.Join(in.errors, "\n  "))
+	}
+	if !in.changed {
+		return data, nil
+	}
+
+	return yaml.Marshal(res)
+}
+
+type interpolator struct {
+	vars    map[string]string
+	errors  []string
+	changed bool
+}
+
+// value interpolates all string values within v. Path is used in errors.
+func (in *interpolator) value(v interface{}, path string) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			key := fmt.Sprint(v[i].Key)
+			if path != "" {
+				key = path + "." + key
+			}
+			v[i].Value = in.value(v[i].Value, key)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = in.value(v[i], fmt.Sprintf("%s[%d]", path, i))
+		}
+		return v
+	case string:
+		return in.scalar(v, path)
+	}
+	return v
+}
+
+// scalar interpolates a single string value. Value that becomes a number or
+// a boolean is returned as such, e.g. for 'threads: ${THREADS}'.
+func (in *interpolator) scalar(s, path string) interface{} {
+	if !interpolationRegexp.MatchString(s) {
+		return s
+	}
+
+	res := interpolationRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+
+		m := interpolationRegexp.FindStringSubmatch(match)
+		name := m[1]
+		if !envNameRegexp.MatchString(name) {
+			in.errors = append(in.errors, fmt.Sprintf("%s: invalid variable name '%s'", path, name))
+			return match
+		}
+
+		if value := in.vars[name]; value != "" {
+			return value
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if value, exists := in.vars[name]; exists {
+			return value
+		}
+
+		in.errors = append(in.errors, fmt.Sprintf("%s: variable '%s' is not defined", path, name))
+		return match
+	})
+	in.changed = true
+
+	var typed interface{}
+	if err := yaml.Unmarshal([]byte(res), &typed); err == nil {
+		switch typed.(type) {
+		case int, int64, uint64, float64, bool:
+			return typed
+		}
+	}
+	return res
+}
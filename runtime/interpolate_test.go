@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+type interpolateSuite struct {
+}
+
+var _ = Suite(&interpolateSuite{})
+
+func (*interpolateSuite) TestInterpolate(c *C) {
+	vars := map[string]string{
+		"PORT":     "8000",
+		"PROFILE":  "prod",
+		"EMPTY":    "",
+		"INJECTED": "localhost\nbootcmd: /evil.so",
+	}
+
+	m := []struct {
+		comment  string
+		text     string
+		expected string
+		err      string
+	}{
+		{
+			"no variables",
+			"main: /server.js",
+			"main: /server.js",
+			"",
+		},
+		{
+			"variable",
+			"PORT: ${PORT}",
+			"PORT: 8000",
+			"",
+		},
+		{
+			"variables in one line",
+			"bootcmd: /app.so --port ${PORT} --profile=${PROFILE}",
+			"bootcmd: /app.so --port 8000 --profile=prod",
+			"",
+		},
+		{
+			"default not used",
+			"config_set_default: ${PROFILE:-dev}",
+			"config_set_default: prod",
+			"",
+		},
+		{
+			"default used",
+			"HOST: ${HOST:-localhost}",
+			"HOST: localhost",
+			"",
+		},
+		{
+			"default used for empty variable",
+			"HOST: ${EMPTY:-localhost}",
+			"HOST: localhost",
+			"",
+		},
+		{
+			"empty default",
+			"HOST: ${HOST:-}",
+			"HOST: ''",
+			"",
+		},
+		{
+			"empty variable",
+			"HOST: ${EMPTY}",
+			"HOST: ''",
+			"",
+		},
+		{
+			"escaped",
+			"bootcmd: echo $${PORT} $PORT",
+			"bootcmd: echo ${PORT} $PORT",
+			"",
+		},
+		{
+			"number",
+			"threads: ${PORT}",
+			"threads: 8000",
+			"",
+		},
+		{
+			"list",
+			"args: [--port, '${PORT}']",
+			"args: [--port, 8000]",
+			"",
+		},
+		{
+			"value is not parsed",
+			"HOST: ${INJECTED}",
+			"HOST: \"localhost\\nbootcmd: /evil.so\"",
+			"",
+		},
+		{
+			"undefined variable",
+			"main: /server.js\nconfig:\n  HOST: ${HOST}\n  USER: ${USER_NAME}",
+			"",
+			"(?s)failed to interpolate meta/run.yaml:\n  config.HOST: variable 'HOST' is not defined\n  config.USER: variable 'USER_NAME' is not defined\n.*",
+		},
+		{
+			"invalid name",
+			"HOST: ${MY HOST}",
+			"",
+			"(?s).*HOST: invalid variable name 'MY HOST'.*",
+		},
+		{
+			"invalid yaml",
+			"HOST: [",
+			"",
+			"failed to parse meta/run.yaml: .*",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		res, err := Interpolate([]byte(args.text), vars)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+		} else {
+			c.Assert(err, IsNil)
+			var obtained, expected interface{}
+			c.Assert(yaml.Unmarshal(res, &obtained), IsNil)
+			c.Assert(yaml.Unmarshal([]byte(args.expected), &expected), IsNil)
+			c.Check(obtained, DeepEquals, expected)
+		}
+	}
+}
+
+func (*interpolateSuite) TestInterpolateUnchanged(c *C) {
+	text := "# comment\nmain: /server.js\n"
+
+	// This is what we're testing here.
+	res, err := Interpolate([]byte(text), nil)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(string(res), Equals, text)
+}
+
+func (*interpolateSuite) TestInterpolateRunYaml(c *C) {
+	// Prepare
+	runYamlText := FixIndent(`
+		runtime: node
+		config_set:
+		  default:
+		    main: ${MAIN:-/server.js}
+		    env:
+		      PORT: ${PORT}
+	`)
+
+	// This is what we're testing here.
+	data, err := Interpolate([]byte(runYamlText), map[string]string{"PORT": "9000"})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	cmdConfig, err := ParsePackageRunManifestData(data)
+	c.Assert(err, IsNil)
+	rt, _ := cmdConfig.selectConfigSetByName("default")
+	c.Check(rt.(*nodeJsRuntime).Main, Equals, "/server.js")
+	c.Check(rt.GetEnv(), DeepEquals, map[string]string{"PORT": "9000"})
+}
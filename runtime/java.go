@@ -10,15 +10,18 @@ package runtime
 import (
 	"fmt"
 	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
 )
 
 type javaRuntime struct {
 	CommonRuntime `yaml:"-,inline"`
+	Version       string   `yaml:"version"`
 	Xms           string   `yaml:"xms"`
 	Xmx           string   `yaml:"xmx"`
-	Classpath     []string `yaml:"classpath"`
+	Classpath     []string `yaml:"classpath" required:"true"`
 	JvmArgs       []string `yaml:"jvm_args"`
-	Main          string   `yaml:"main"`
+	Main          string   `yaml:"main" required:"true"`
 	Args          []string `yaml:"args"`
 }
 
@@ -33,11 +36,15 @@ func (conf javaRuntime) GetRuntimeDescription() string {
 	return "Run Java application"
 }
 func (conf javaRuntime) GetDependencies() []string {
-	return []string{"openjdk8-zulu-compact1"}
+	return []string{javaVersions.pkg(conf.Version)}
 }
 func (conf javaRuntime) Validate() error {
 	inherit := conf.Base != ""
 
+	if err := javaVersions.validate(conf.Version); err != nil {
+		return err
+	}
+
 	if !inherit {
 		if conf.Main == "" {
 			return fmt.Errorf("'main' must be provided")
@@ -51,14 +58,14 @@ func (conf javaRuntime) Validate() error {
 	return conf.CommonRuntime.Validate(inherit)
 }
 func (conf javaRuntime) GetBootCmd(cmdConfs map[string]*CmdConfig) (string, error) {
-	conf.Base = "openjdk8-zulu-compact1:java"
+	conf.Base = javaVersions.base(conf.Version)
 	conf.setDefaultEnv(map[string]string{
 		"XMS":       conf.Xms,
 		"XMX":       conf.Xmx,
 		"CLASSPATH": strings.Join(conf.Classpath, ":"),
 		"JVM_ARGS":  conf.concatJvmArgs(),
 		"MAIN":      conf.Main,
-		"ARGS":      strings.Join(conf.Args, " "),
+		"ARGS":      util.QuoteArgs(conf.Args),
 	})
 	return conf.CommonRuntime.BuildBootCmd("", cmdConfs)
 }
@@ -77,6 +84,12 @@ main: <name>
 classpath:
    - <list>
 
+# OPTIONAL
+# Version of Java, i.e. package openjdk<version> is used to run the application.
+# Run 'capstan runtime preview' to list available versions.
+# Default value: ` + javaVersions.defaultVersion + `
+version: <version>
+
 # OPTIONAL
 # Initial and maximum JVM memory size.
 # Example value: xms: 512m
@@ -101,12 +114,22 @@ args:
 ` + conf.CommonRuntime.GetYamlTemplate()
 }
 
+func (conf javaRuntime) GetVersion() string {
+	return javaVersions.version(conf.Version)
+}
+func (conf javaRuntime) VersionPackage(version string) string {
+	return javaVersions.pkg(version)
+}
+func (conf javaRuntime) PackageVersion(pkgName string) string {
+	return javaVersions.packageVersion(pkgName)
+}
+
 //
 // Utility
 //
 
 func (conf javaRuntime) concatJvmArgs() string {
-	res := strings.Join(conf.JvmArgs, " ")
+	res := util.QuoteArgs(conf.JvmArgs)
 
 	// This is a workaround since runscript is currently unable to
 	// handle empty environment variable as a parameter. So we set
@@ -130,7 +130,7 @@ func (*javaSuite) TestGetBootCmd(c *C) {
 				"--env=XMS?=512m",
 				"--env=XMX?=512m",
 				"--env=CLASSPATH?=/src",
-				"--env=JVM_ARGS?=-Darg1=val1 -Darg2=val2",
+				`"--env=JVM_ARGS?=-Darg1=val1 -Darg2=val2"`,
 				"--env=MAIN?=demo.Main",
 				"--env=ARGS?=",
 			},
@@ -154,7 +154,7 @@ func (*javaSuite) TestGetBootCmd(c *C) {
 				"--env=CLASSPATH?=/src",
 				"--env=JVM_ARGS?=-Dx=y",
 				"--env=MAIN?=demo.Main",
-				"--env=ARGS?=localhost 8000",
+				`"--env=ARGS?=localhost 8000"`,
 			},
 		},
 	}
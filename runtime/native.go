@@ -11,7 +11,7 @@ import "fmt"
 
 type nativeRuntime struct {
 	CommonRuntime `yaml:"-,inline"`
-	BootCmd       string `yaml:"bootcmd"`
+	BootCmd       string `yaml:"bootcmd" required:"true"`
 }
 
 //
@@ -9,13 +9,15 @@ package runtime
 
 import (
 	"fmt"
-	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
 )
 
 type nodeJsRuntime struct {
 	CommonRuntime `yaml:"-,inline"`
+	Version       string   `yaml:"version"`
 	NodeArgs      []string `yaml:"node_args"`
-	Main          string   `yaml:"main"`
+	Main          string   `yaml:"main" required:"true"`
 	Args          []string `yaml:"args"`
 }
 
@@ -27,14 +29,18 @@ func (conf nodeJsRuntime) GetRuntimeName() string {
 	return string(NodeJS)
 }
 func (conf nodeJsRuntime) GetRuntimeDescription() string {
-	return "Run JavaScript NodeJS 4.4.5 application"
+	return "Run JavaScript NodeJS application"
 }
 func (conf nodeJsRuntime) GetDependencies() []string {
-	return []string{"node-4.4.5"}
+	return []string{nodeVersions.pkg(conf.Version)}
 }
 func (conf nodeJsRuntime) Validate() error {
 	inherit := conf.Base != ""
 
+	if err := nodeVersions.validate(conf.Version); err != nil {
+		return err
+	}
+
 	if !inherit {
 		if conf.Main == "" {
 			return fmt.Errorf("'main' must be provided")
@@ -44,11 +50,11 @@ func (conf nodeJsRuntime) Validate() error {
 	return conf.CommonRuntime.Validate(inherit)
 }
 func (conf nodeJsRuntime) GetBootCmd(cmdConfs map[string]*CmdConfig) (string, error) {
-	conf.Base = "node-4.4.5:node"
+	conf.Base = nodeVersions.base(conf.Version)
 	conf.setDefaultEnv(map[string]string{
 		"NODE_ARGS": conf.concatNodeArgs(),
 		"MAIN":      conf.Main,
-		"ARGS":      strings.Join(conf.Args, " "),
+		"ARGS":      util.QuoteArgs(conf.Args),
 	})
 	return conf.CommonRuntime.BuildBootCmd("", cmdConfs)
 }
@@ -60,6 +66,12 @@ func (conf nodeJsRuntime) GetYamlTemplate() string {
 # Example value: /server.js
 main: <filepath>
 
+# OPTIONAL
+# Version of Node.js, i.e. package node-<version> is used to run the application.
+# Run 'capstan runtime preview' to list available versions.
+# Default value: ` + nodeVersions.defaultVersion + `
+version: <version>
+
 # OPTIONAL
 # A list of Node.js args.
 # Example value: node_args:
@@ -77,12 +89,22 @@ args:
 ` + conf.CommonRuntime.GetYamlTemplate()
 }
 
+func (conf nodeJsRuntime) GetVersion() string {
+	return nodeVersions.version(conf.Version)
+}
+func (conf nodeJsRuntime) VersionPackage(version string) string {
+	return nodeVersions.pkg(version)
+}
+func (conf nodeJsRuntime) PackageVersion(pkgName string) string {
+	return nodeVersions.packageVersion(pkgName)
+}
+
 //
 // Utility
 //
 
 func (conf nodeJsRuntime) concatNodeArgs() string {
-	res := strings.Join(conf.NodeArgs, " ")
+	res := util.QuoteArgs(conf.NodeArgs)
 
 	// This is a workaround since runscript is currently unable to
 	// handle empty environment variable as a parameter. So we set
@@ -19,8 +19,15 @@ type nodeSuite struct {
 var _ = Suite(&nodeSuite{})
 
 func (*nodeSuite) TestGetBootCmd(c *C) {
-	// Simulate node-4.4.5's meta/run.yaml being parsed.
+	// Simulate node-4.4.5's and node-6.11.0's meta/run.yaml being parsed.
 	cmdConfs := map[string]*CmdConfig{
+		"node-6.11.0": &CmdConfig{
+			RuntimeType:      Native,
+			ConfigSetDefault: "node",
+			ConfigSets: map[string]Runtime{
+				"node": nativeRuntime{BootCmd: "/node6.so"},
+			},
+		},
 		"node-4.4.5": &CmdConfig{
 			RuntimeType:      Native,
 			ConfigSetDefault: "node",
@@ -89,7 +96,39 @@ func (*nodeSuite) TestGetBootCmd(c *C) {
 			"/node.so", []string{
 				"--env=NODE_ARGS?=--no-deprecation",
 				"--env=MAIN?=/server.js",
-				"--env=ARGS?=localhost 8000",
+				`"--env=ARGS?=localhost 8000"`,
+			},
+		},
+		{
+			"args with special characters",
+			`
+			runtime: node
+			config_set:
+			  default:
+			    main: /server.js
+			    args:
+			        - hello world
+			        - say "hi"
+			        - a;b&c
+			`,
+			"/node.so", []string{
+				"--env=NODE_ARGS?=--no-deprecation",
+				"--env=MAIN?=/server.js",
+				`"--env=ARGS?=\"hello world\" \"say \\\"hi\\\"\" \"a;b&c\""`,
+			},
+		},
+		{
+			"version",
+			`
+			runtime: node
+			config_set:
+			  default:
+			    version: 6.11.0
+			    main: /server.js
+			`,
+			"/node6.so", []string{
+				"--env=NODE_ARGS?=--no-deprecation",
+				"--env=MAIN?=/server.js",
 			},
 		},
 	}
@@ -124,6 +163,17 @@ func (*nodeSuite) TestValidate(c *C) {
 			`,
 			"'main' must be provided",
 		},
+		{
+			"invalid version",
+			`
+			runtime: node
+			config_set:
+			  default:
+			    main: /server.js
+			    version: ../4.4.5
+			`,
+			"invalid version '../4.4.5'",
+		},
 	}
 	for i, args := range m {
 		c.Logf("CASE #%d: %s", i, args.comment)
@@ -144,6 +194,27 @@ func (*nodeSuite) TestValidate(c *C) {
 	}
 }
 
+func (*nodeSuite) TestVersions(c *C) {
+	// Prepare
+	cmdConfig, err := ParsePackageRunManifestData([]byte(FixIndent(`
+		runtime: node
+		config_set:
+		  default:
+		    main: /server.js
+		  new:
+		    main: /server.js
+		    version: 6.11.0
+	`)))
+	c.Assert(err, IsNil)
+	packages := []string{"osv.bootstrap", "node-6.11.0", "node-4.4.5", "node-6.11.0", "nodejs-extras"}
+
+	// Expectations.
+	c.Check(cmdConfig.Dependencies(), DeepEquals, []string{"node-4.4.5", "node-6.11.0"})
+	c.Check(RuntimeVersions(&nodeJsRuntime{}, packages), DeepEquals, []string{"4.4.5", "6.11.0"})
+	c.Check(RuntimeVersions(&javaRuntime{}, packages), DeepEquals, []string{})
+	c.Check(RuntimeVersions(&nativeRuntime{}, packages), IsNil)
+}
+
 func (*nodeSuite) TestGetYamlTemplateIsComplete(c *C) {
 	// Prepare
 	testRuntime := nodeJsRuntime{}
@@ -153,6 +224,7 @@ func (*nodeSuite) TestGetYamlTemplateIsComplete(c *C) {
 
 	// Expectations.
 	c.Check(template, MatchesMultiline, "node_args:")
+	c.Check(template, MatchesMultiline, "version:")
 	c.Check(template, MatchesMultiline, "main:")
 	c.Check(template, MatchesMultiline, "args:")
 	c.Check(template, MatchesMultiline, "env:")
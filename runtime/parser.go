@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -32,6 +33,10 @@ type CmdConfig struct {
 	// ConfigSets is a map of available <config-name>:<runtime> pairs.
 	// The map is built based on meta/run.yaml.
 	ConfigSets map[string]Runtime
+
+	// raw contains config sets as they were read from meta/run.yaml. It is
+	// used to merge config sets with their base.
+	raw map[string]map[string]interface{}
 }
 
 // AllCmdConfigs is a result that parsing meta/run.yamls of all required
@@ -100,6 +105,7 @@ func ParsePackageRunManifestData(cmdConfigData []byte) (*CmdConfig, error) {
 	}
 
 	res.ConfigSets = make(map[string]Runtime)
+	res.raw = internal.ConfigSet
 
 	// We are marshalling the `map[interface{}]interface{}` data here (containing single
 	// configuration set parameters) so that we will be able to unmarshal it in the next
@@ -116,8 +122,12 @@ func ParsePackageRunManifestData(cmdConfigData []byte) (*CmdConfig, error) {
 	// interface.
 	for k := range internal.ConfigSet {
 		// Prepare empty runtime struct that will be used for unmarshalling.
-		theRuntime, err := PickRuntime(internal.Runtime)
-		if err != nil {
+		// Config sets listing processes are not bound to package's runtime.
+		var theRuntime Runtime
+		var err error
+		if _, isProcesses := internal.ConfigSet[k][Processes]; isProcesses {
+			theRuntime = &processesRuntime{own: &res}
+		} else if theRuntime, err = PickRuntime(internal.Runtime); err != nil {
 			return nil, err
 		}
 
@@ -164,6 +174,36 @@ func (r *CmdConfig) selectConfigSetByName(name string) (Runtime, error) {
 	return r.ConfigSets[name], nil
 }
 
+// Dependencies returns packages required by any of the config sets. Unlike
+// dependencies of a blank runtime, these reflect values set in meta/run.yaml,
+// e.g. selected interpreter.
+func (r *CmdConfig) Dependencies() []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, confName := range sortedKeysOfMap(r.ConfigSets) {
+		for _, dep := range r.ConfigSets[confName].GetDependencies() {
+			if !seen[dep] {
+				seen[dep] = true
+				res = append(res, dep)
+			}
+		}
+	}
+	return res
+}
+
+// PrepareContent lets config sets that implement ContentPreparer add their
+// content to the package being collected into targetDir.
+func (r *CmdConfig) PrepareContent(packageDir, targetDir string) error {
+	for _, confName := range sortedKeysOfMap(r.ConfigSets) {
+		if preparer, ok := r.ConfigSets[confName].(ContentPreparer); ok {
+			if err := preparer.PrepareContent(packageDir, targetDir); err != nil {
+				return fmt.Errorf("Failed to prepare content for configuration set '%s': %s", confName, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (c *AllCmdConfigs) Add(pkgName string, cmdConfig *CmdConfig) {
 	if c.cmdConfigs == nil {
 		c.cmdConfigs = make(map[string]*CmdConfig, 15)
@@ -181,6 +221,11 @@ func (c *AllCmdConfigs) Persist(mpmDir string) error {
 		}
 	}
 
+	// Apply fields that config sets override in their base.
+	if err := c.resolveInheritance(); err != nil {
+		return err
+	}
+
 	// Persist runscript scripts for all config_sets of all packages.
 	for _, pkgName := range c.order {
 		cmdConf := c.cmdConfigs[pkgName]
@@ -194,6 +239,11 @@ func (c *AllCmdConfigs) Persist(mpmDir string) error {
 			if err := currConf.Validate(); err != nil {
 				return fmt.Errorf("Validation failed for configuration set '%s': %s", confName, err)
 			}
+			if validator, ok := currConf.(ContentValidator); ok {
+				if err := validator.ValidateContent(mpmDir); err != nil {
+					return fmt.Errorf("Validation failed for configuration set '%s': %s", confName, err)
+				}
+			}
 
 			// Calculate boot command.
 			bootCmd, err := currConf.GetBootCmd(c.cmdConfigs)
@@ -212,6 +262,13 @@ func (c *AllCmdConfigs) Persist(mpmDir string) error {
 	return nil
 }
 
+// sortedKeysOfMap returns keys of the map in alphabetical order.
+func sortedKeysOfMap(myMap map[string]Runtime) []string {
+	keys := keysOfMap(myMap)
+	sort.Strings(keys)
+	return keys
+}
+
 // keysOfMap does nothing but returns a list of all the keys in a map.
 func keysOfMap(myMap map[string]Runtime) []string {
 	keys := make([]string, len(myMap))
@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Processes is the name of config set kind that combines several config
+// sets into a single boot command.
+const Processes = "processes"
+
+// Process is a single entry of the 'processes' config set.
+type Process struct {
+	// ConfigSet refers to config set that is run, either to the one of
+	// the same package (<config_set>) or of a required one (<pkg_name>:<config_set>).
+	ConfigSet string `yaml:"config_set"`
+	// Background process is started and the next one follows immediately
+	// instead of waiting for it to finish.
+	Background bool `yaml:"background"`
+}
+
+// processesRuntime is a config set that runs several config sets, possibly
+// of different runtimes and packages, in given order. It is used instead of
+// package's runtime for config sets containing 'processes' key.
+type processesRuntime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Processes     []Process `yaml:"processes" required:"true"`
+
+	// own is configuration of the package the config set belongs to.
+	own *CmdConfig
+}
+
+//
+// Interface implementation
+//
+
+func (conf processesRuntime) GetRuntimeName() string {
+	return Processes
+}
+func (conf processesRuntime) GetRuntimeDescription() string {
+	return "Run several config sets in one unikernel"
+}
+func (conf processesRuntime) GetDependencies() []string {
+	return []string{}
+}
+func (conf processesRuntime) Validate() error {
+	if conf.Base != "" {
+		return fmt.Errorf("'base' cannot be used together with 'processes'")
+	}
+	if len(conf.Processes) == 0 {
+		return fmt.Errorf("'processes' must contain at least one process")
+	}
+	for i, p := range conf.Processes {
+		if p.ConfigSet == "" {
+			return fmt.Errorf("'config_set' must be provided for process #%d", i+1)
+		}
+		if parts := strings.Split(p.ConfigSet, ":"); len(parts) > 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+			return fmt.Errorf("'config_set' of process #%d must be in format [<pkg_name>:]<config_set>", i+1)
+		}
+	}
+	// Nothing would keep the unikernel running after the last process is
+	// started, so it has to run in foreground.
+	if conf.Processes[len(conf.Processes)-1].Background {
+		return fmt.Errorf("last process #%d cannot run in background", len(conf.Processes))
+	}
+
+	return conf.CommonRuntime.Validate(false)
+}
+
+// GetBootCmd joins boot commands of all processes. Foreground processes are
+// followed by ';' so that OSv waits for them to finish before the next one is
+// started, while background processes are followed by '&'. OSv waits for all
+// processes before it shuts down.
+//
+// All processes share the environment of the unikernel, so processes that
+// set the same variable to different values, e.g. MAIN of two Node.js config
+// sets, are an error. Variables set by the config set of processes itself are
+// shared on purpose and are not checked.
+func (conf processesRuntime) GetBootCmd(cmdConfs map[string]*CmdConfig) (string, error) {
+	var cmds []string
+	setBy := make(map[string]int)
+	values := make(map[string]string)
+	for i, p := range conf.Processes {
+		rt, err := conf.resolve(p.ConfigSet, cmdConfs)
+		if err != nil {
+			return "", fmt.Errorf("process #%d: %s", i+1, err)
+		}
+
+		cmd, err := rt.GetBootCmd(cmdConfs)
+		if err != nil {
+			return "", fmt.Errorf("process #%d: %s", i+1, err)
+		}
+
+		env := leadingEnv(cmd)
+		keys := make([]string, 0, len(env))
+		for key := range env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := env[key]
+			if _, shared := conf.Env[key]; shared {
+				continue
+			}
+			if other, exists := setBy[key]; exists && values[key] != value {
+				return "", fmt.Errorf("process #%d sets environment variable %s to '%s' while process #%d sets it to '%s', "+
+					"but all processes share the same environment", i+1, key, value, other+1, values[key])
+			}
+			setBy[key], values[key] = i, value
+		}
+
+		if i < len(conf.Processes)-1 {
+			if p.Background {
+				cmd += " &"
+			} else {
+				cmd += ";"
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	return conf.CommonRuntime.BuildBootCmd(strings.Join(cmds, " "), cmdConfs)
+}
+func (conf processesRuntime) GetYamlTemplate() string {
+	return `
+# REQUIRED
+# Config sets to run, in given order. Refer to config set of this package
+# by its name and to config set of a required package with <pkg_name>:<config_set>.
+# Next process is started when the previous one finishes unless it is
+# started in background.
+# Example value: processes:
+#                   - config_set: osv.httpserver:httpserver
+#                     background: true
+#                   - config_set: myconfig1
+processes:
+   - config_set: <config_set>
+     background: <bool>
+` + conf.CommonRuntime.GetYamlTemplate()
+}
+
+//
+// Utility
+//
+
+// leadingEnv returns environment variables that are set with --env arguments
+// at the beginning of the boot command. Variables that are set softly with
+// '?=' keep the first value, as OSv does.
+func leadingEnv(cmd string) map[string]string {
+	env := make(map[string]string)
+	for {
+		arg, rest := nextArg(strings.TrimLeft(cmd, " \t"))
+		if !strings.HasPrefix(arg, "--env=") {
+			return env
+		}
+		cmd = rest
+
+		parts := strings.SplitN(strings.TrimPrefix(arg, "--env="), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := parts[0]
+		if strings.HasSuffix(key, "?") {
+			key = strings.TrimSuffix(key, "?")
+			if _, exists := env[key]; exists {
+				continue
+			}
+		}
+		env[key] = parts[1]
+	}
+}
+
+// nextArg splits the first argument off the command and removes quotes the
+// way OSv command line parser does, i.e. the reverse of util.QuoteArg.
+func nextArg(cmd string) (arg, rest string) {
+	var b bytes.Buffer
+	quoted := false
+	for i := 0; i < len(cmd); i++ {
+		switch ch := cmd[i]; {
+		case quoted && ch == '\\' && i+1 < len(cmd):
+			i++
+			b.WriteByte(cmd[i])
+		case ch == '"':
+			quoted = !quoted
+		case !quoted && (ch == ' ' || ch == '\t'):
+			return b.String(), cmd[i:]
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String(), ""
+}
+
+// resolve returns config set referenced by the process.
+func (conf processesRuntime) resolve(ref string, cmdConfs map[string]*CmdConfig) (Runtime, error) {
+	cmdConf := conf.own
+	configSet := ref
+	if parts := strings.SplitN(ref, ":", 2); len(parts) == 2 {
+		cmdConf = cmdConfs[parts[0]]
+		configSet = parts[1]
+		if cmdConf == nil {
+			return nil, fmt.Errorf("package '%s' is not included or has no meta/run.yaml", parts[0])
+		}
+	}
+	if cmdConf == nil || cmdConf.ConfigSets[configSet] == nil {
+		return nil, fmt.Errorf("config set '%s' does not exist", ref)
+	}
+
+	rt := cmdConf.ConfigSets[configSet]
+	if _, ok := rt.(*processesRuntime); ok {
+		return nil, fmt.Errorf("config set '%s' is a set of processes itself and cannot be nested", ref)
+	}
+	return rt, nil
+}
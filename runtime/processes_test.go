@@ -0,0 +1,347 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+type processesSuite struct {
+}
+
+var _ = Suite(&processesSuite{})
+
+func (*processesSuite) TestGetBootCmd(c *C) {
+	// Simulate meta/run.yaml of a required package being parsed.
+	cmdConfs := map[string]*CmdConfig{
+		"osv.httpserver": {
+			RuntimeType: Native,
+			ConfigSets: map[string]Runtime{
+				"httpserver": nativeRuntime{BootCmd: "/libhttpserver.so"},
+			},
+		},
+	}
+
+	m := []struct {
+		comment      string
+		runYamlText  string
+		expectedBoot string
+	}{
+		{
+			"single process",
+			`
+			runtime: native
+			config_set:
+			  app:
+			    bootcmd: /app.so
+			  all:
+			    processes:
+			      - config_set: app
+			`,
+			"/app.so",
+		},
+		{
+			"foreground processes",
+			`
+			runtime: native
+			config_set:
+			  migrate:
+			    bootcmd: /migrate.so
+			  app:
+			    bootcmd: /app.so
+			  all:
+			    processes:
+			      - config_set: migrate
+			      - config_set: app
+			`,
+			"/migrate.so; /app.so",
+		},
+		{
+			"background process of required package",
+			`
+			runtime: native
+			config_set:
+			  app:
+			    bootcmd: /app.so --port 8000
+			  all:
+			    processes:
+			      - config_set: osv.httpserver:httpserver
+			        background: true
+			      - config_set: app
+			`,
+			"/libhttpserver.so & /app.so --port 8000",
+		},
+		{
+			"environment variables",
+			`
+			runtime: native
+			config_set:
+			  app:
+			    bootcmd: /app.so
+			  all:
+			    processes:
+			      - config_set: app
+			    env:
+			      PORT: 8000
+			`,
+			"--env=PORT?=8000 /app.so",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		cmdConf, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		c.Assert(err, IsNil)
+		rt := cmdConf.ConfigSets["all"]
+		c.Assert(rt.Validate(), IsNil)
+
+		// This is what we're testing here.
+		boot, err := rt.GetBootCmd(cmdConfs)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(boot, Equals, args.expectedBoot)
+		c.Check(rt.GetDependencies(), DeepEquals, []string{})
+	}
+}
+
+func (*processesSuite) TestGetBootCmdInvalid(c *C) {
+	m := []struct {
+		comment     string
+		runYamlText string
+		expectedErr string
+	}{
+		{
+			"missing config set",
+			`
+			runtime: native
+			config_set:
+			  all:
+			    processes:
+			      - config_set: app
+			`,
+			"process #1: config set 'app' does not exist",
+		},
+		{
+			"missing package",
+			`
+			runtime: native
+			config_set:
+			  all:
+			    processes:
+			      - config_set: osv.httpserver:httpserver
+			`,
+			"process #1: package 'osv.httpserver' is not included or has no meta/run.yaml",
+		},
+		{
+			"nested processes",
+			`
+			runtime: native
+			config_set:
+			  app:
+			    bootcmd: /app.so
+			  first:
+			    processes:
+			      - config_set: app
+			  all:
+			    processes:
+			      - config_set: app
+			      - config_set: first
+			`,
+			"process #2: config set 'first' is a set of processes itself and cannot be nested",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		cmdConf, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		c.Assert(err, IsNil)
+
+		// This is what we're testing here.
+		_, err = cmdConf.ConfigSets["all"].GetBootCmd(nil)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+	}
+}
+
+func (*processesSuite) TestGetBootCmdRuntimes(c *C) {
+	// Simulate meta/run.yaml of interpreter and application packages being parsed.
+	interpreter := func(bootCmd string, env map[string]string) *CmdConfig {
+		return &CmdConfig{
+			RuntimeType: Native,
+			ConfigSets: map[string]Runtime{
+				"node":   nativeRuntime{BootCmd: bootCmd, CommonRuntime: CommonRuntime{Env: env}},
+				"java":   nativeRuntime{BootCmd: bootCmd, CommonRuntime: CommonRuntime{Env: env}},
+				"python": nativeRuntime{BootCmd: bootCmd, CommonRuntime: CommonRuntime{Env: env}},
+			},
+		}
+	}
+	cmdConfs := map[string]*CmdConfig{
+		"node-4.4.5":             interpreter("/node.so $MAIN $ARGS", map[string]string{"MAIN": "-", "ARGS": ""}),
+		"python-2.7":             interpreter("/python.so $MAIN $ARGS", map[string]string{"MAIN": "-", "ARGS": ""}),
+		"openjdk8-zulu-compact1": interpreter("/java.so $MAIN $ARGS", map[string]string{"MAIN": "-", "ARGS": ""}),
+		"api": {
+			RuntimeType: NodeJS,
+			ConfigSets: map[string]Runtime{
+				"api":   &nodeJsRuntime{Main: "/api.js"},
+				"admin": &nodeJsRuntime{Main: "/admin.js", Args: []string{"--port", "8001"}},
+				"same":  &nodeJsRuntime{Main: "/api.js"},
+			},
+		},
+		"worker": {
+			RuntimeType: Python,
+			ConfigSets: map[string]Runtime{
+				"worker": &pythonRuntime{Main: "/worker.py"},
+			},
+		},
+		"jobs": {
+			RuntimeType: Java,
+			ConfigSets: map[string]Runtime{
+				"import": &javaRuntime{Main: "main.Import"},
+				"export": &javaRuntime{Main: "main.Export"},
+			},
+		},
+		"httpserver": {
+			RuntimeType: Native,
+			ConfigSets: map[string]Runtime{
+				"httpserver": nativeRuntime{BootCmd: "/libhttpserver.so"},
+			},
+		},
+	}
+
+	m := []struct {
+		comment      string
+		processes    []Process
+		env          map[string]string
+		expectedBoot string
+		expectedEnv  []string
+		expectedErr  string
+	}{
+		{
+			"node and native",
+			[]Process{{ConfigSet: "httpserver:httpserver", Background: true}, {ConfigSet: "api:api"}},
+			nil,
+			"/libhttpserver.so & /node.so $MAIN $ARGS",
+			[]string{"--env=NODE_ARGS?=--no-deprecation", "--env=MAIN?=/api.js", "--env=ARGS?="},
+			"",
+		},
+		{
+			"node and node with same values",
+			[]Process{{ConfigSet: "api:api", Background: true}, {ConfigSet: "api:same"}},
+			nil,
+			"/node.so $MAIN $ARGS & /node.so $MAIN $ARGS",
+			[]string{
+				"--env=NODE_ARGS?=--no-deprecation", "--env=MAIN?=/api.js", "--env=ARGS?=",
+				"--env=NODE_ARGS?=--no-deprecation", "--env=MAIN?=/api.js", "--env=ARGS?=",
+			},
+			"",
+		},
+		{
+			"node and node",
+			[]Process{{ConfigSet: "api:api", Background: true}, {ConfigSet: "api:admin"}},
+			nil,
+			"", nil,
+			"process #2 sets environment variable ARGS to '--port 8001' while process #1 sets it to '', .*",
+		},
+		{
+			"node and python",
+			[]Process{{ConfigSet: "api:api", Background: true}, {ConfigSet: "worker:worker"}},
+			nil,
+			"", nil,
+			"process #2 sets environment variable MAIN to '/worker.py' while process #1 sets it to '/api.js', " +
+				"but all processes share the same environment",
+		},
+		{
+			"java and java",
+			[]Process{{ConfigSet: "jobs:import"}, {ConfigSet: "jobs:export"}},
+			nil,
+			"", nil,
+			"process #2 sets environment variable MAIN to 'main.Export' while process #1 sets it to 'main.Import', .*",
+		},
+		{
+			"shared variable",
+			[]Process{{ConfigSet: "api:api", Background: true}, {ConfigSet: "worker:worker"}},
+			map[string]string{"MAIN": "/main"},
+			"/node.so $MAIN $ARGS & /python.so $MAIN $ARGS",
+			[]string{
+				"--env=MAIN?=/main",
+				"--env=NODE_ARGS?=--no-deprecation", "--env=MAIN?=/api.js", "--env=ARGS?=",
+				"--env=PYTHON_ARGS?=-O", "--env=MAIN?=/worker.py", "--env=ARGS?=",
+			},
+			"",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		rt := processesRuntime{Processes: args.processes, CommonRuntime: CommonRuntime{Env: args.env}}
+		c.Assert(rt.Validate(), IsNil)
+
+		// This is what we're testing here.
+		boot, err := rt.GetBootCmd(cmdConfs)
+
+		// Expectations.
+		if args.expectedErr != "" {
+			c.Check(err, ErrorMatches, args.expectedErr)
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(boot, BootCmdEquals, args.expectedBoot, args.expectedEnv)
+		}
+	}
+}
+
+func (*processesSuite) TestValidate(c *C) {
+	m := []struct {
+		comment     string
+		conf        processesRuntime
+		expectedErr string
+	}{
+		{
+			"no processes",
+			processesRuntime{},
+			"'processes' must contain at least one process",
+		},
+		{
+			"missing config set",
+			processesRuntime{Processes: []Process{{ConfigSet: "app"}, {Background: true}}},
+			"'config_set' must be provided for process #2",
+		},
+		{
+			"malformed config set",
+			processesRuntime{Processes: []Process{{ConfigSet: "osv.httpserver:"}}},
+			"'config_set' of process #1 must be in format \\[<pkg_name>:\\]<config_set>",
+		},
+		{
+			"background last process",
+			processesRuntime{Processes: []Process{{ConfigSet: "app", Background: true}, {ConfigSet: "worker", Background: true}}},
+			"last process #2 cannot run in background",
+		},
+		{
+			"base",
+			processesRuntime{
+				CommonRuntime: CommonRuntime{Base: "osv.httpserver:httpserver"},
+				Processes:     []Process{{ConfigSet: "app"}},
+			},
+			"'base' cannot be used together with 'processes'",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := args.conf.Validate()
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/nat"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultProjectFile is file that describes the project when no other file
+// is given.
+const DefaultProjectFile = "capstan-project.yaml"
+
+// projectNamePattern restricts names of projects and their instances to what
+// can be used in names of instance directories.
+var projectNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Project describes several instances that make up an application, e.g. API,
+// worker and cache services, and order in which they are started.
+type Project struct {
+	// Name prefixes names of all instances of the project. Base name of
+	// directory of the project file is used when not set.
+	Name      string                      `yaml:"name,omitempty"`
+	Instances map[string]*ProjectInstance `yaml:"instances"`
+
+	// Dir is directory that relative paths in the project are relative to.
+	Dir string `yaml:"-"`
+}
+
+// ProjectInstance describes a single instance of the project. Exactly one of
+// Image and Package must be set.
+type ProjectInstance struct {
+	// Image is name of image in the local or remote repository.
+	Image string `yaml:"image,omitempty"`
+	// Package is directory of package that is composed into image named
+	// after the instance before it is run.
+	Package string `yaml:"package,omitempty"`
+
+	// Run is command line to boot with, Boot is name of config set to boot
+	// with. Config set default of the package is used when neither is set.
+	Run     string            `yaml:"run,omitempty"`
+	Boot    string            `yaml:"boot,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	EnvFile []string          `yaml:"env_file,omitempty"`
+
+	Memory     string   `yaml:"memory,omitempty"`
+	Cpus       int      `yaml:"cpus,omitempty"`
+	Networking string   `yaml:"networking,omitempty"`
+	Bridge     string   `yaml:"bridge,omitempty"`
+	Ports      []string `yaml:"ports,omitempty"`
+
+	// DependsOn are instances that must be running, and healthy when they
+	// have a health check, before this instance is started.
+	DependsOn []string `yaml:"depends_on,omitempty"`
+	// HealthCheck replaces health check of config set of the package.
+	HealthCheck *HealthCheck `yaml:"healthcheck,omitempty"`
+}
+
+// ParseProjectFile reads and validates the project file.
+func ParseProjectFile(path string) (*Project, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	return ParseProject(data, dir)
+}
+
+// ParseProject parses and validates project with relative paths relative to
+// given directory.
+func ParseProject(data []byte, dir string) (*Project, error) {
+	p := &Project{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse project file: %s", err)
+	}
+	p.Dir = dir
+	if p.Name == "" {
+		p.Name = filepath.Base(dir)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks that the project can be run.
+func (p *Project) Validate() error {
+	if !projectNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("invalid project name '%s', use letters, digits, '.', '_' and '-'", p.Name)
+	}
+	if len(p.Instances) == 0 {
+		return fmt.Errorf("project %s has no instances", p.Name)
+	}
+	for _, name := range p.InstanceNames() {
+		i := p.Instances[name]
+		if !projectNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid instance name '%s', use letters, digits, '.', '_' and '-'", name)
+		}
+		if i == nil || (i.Image == "") == (i.Package == "") {
+			return fmt.Errorf("instance %s: exactly one of 'image' and 'package' must be provided", name)
+		}
+		for _, dep := range i.DependsOn {
+			if dep == name {
+				return fmt.Errorf("instance %s: cannot depend on itself", name)
+			}
+			if p.Instances[dep] == nil {
+				return fmt.Errorf("instance %s: depends on unknown instance %s", name, dep)
+			}
+		}
+		if _, err := nat.Parse(i.Ports); err != nil {
+			return fmt.Errorf("instance %s: %s", name, err)
+		}
+		if i.HealthCheck != nil {
+			if err := i.HealthCheck.Validate(); err != nil {
+				return fmt.Errorf("instance %s: %s", name, err)
+			}
+		}
+	}
+	if _, err := p.StartOrder(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// InstanceNames returns sorted names of instances as given in the project.
+func (p *Project) InstanceNames() []string {
+	names := []string{}
+	for name := range p.Instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// InstanceName returns name of the instance that the project runs for given
+// project instance.
+func (p *Project) InstanceName(name string) string {
+	return p.Name + "-" + name
+}
+
+// Path resolves path relative to directory of the project.
+func (p *Project) Path(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(p.Dir, path)
+}
+
+// StartOrder returns names of instances in order in which they must be
+// started so that every instance is started after instances it depends on.
+// Instances that do not depend on each other are ordered by name.
+func (p *Project) StartOrder() ([]string, error) {
+	order := []string{}
+	started := make(map[string]bool)
+	for len(order) < len(p.Instances) {
+		progress := false
+		for _, name := range p.InstanceNames() {
+			if started[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range p.Instances[name].DependsOn {
+				ready = ready && started[dep]
+			}
+			if ready {
+				order = append(order, name)
+				started[name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			var blocked []string
+			for _, name := range p.InstanceNames() {
+				if !started[name] {
+					blocked = append(blocked, name)
+				}
+			}
+			return nil, fmt.Errorf("instances %s depend on each other", strings.Join(blocked, ", "))
+		}
+	}
+	return order, nil
+}
+
+// HasDependents returns true if any other instance depends on the instance.
+func (p *Project) HasDependents(name string) bool {
+	for _, i := range p.Instances {
+		for _, dep := range i.DependsOn {
+			if dep == name {
+				return true
+			}
+		}
+	}
+	return false
+}
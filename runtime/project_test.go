@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+type projectSuite struct {
+}
+
+var _ = Suite(&projectSuite{})
+
+func (*projectSuite) TestParseProject(c *C) {
+	// Prepare
+	projectText := `
+		instances:
+		  api:
+		    package: ./api
+		    boot: production
+		    env:
+		      PORT: 8000
+		    ports: ["8000:8000"]
+		    depends_on: [cache, worker]
+		  worker:
+		    image: shop/worker:v2
+		    memory: 256M
+		    depends_on: [cache]
+		  cache:
+		    image: mike/redis
+		    healthcheck:
+		      tcp: 6379
+	`
+
+	// This is what we're testing here.
+	p, err := ParseProject([]byte(FixIndent(projectText)), "/projects/shop")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(p.Name, Equals, "shop")
+	c.Check(p.InstanceName("api"), Equals, "shop-api")
+	c.Check(p.Path(p.Instances["api"].Package), Equals, "/projects/shop/api")
+	c.Check(p.Instances["api"].Env, DeepEquals, map[string]string{"PORT": "8000"})
+	c.Check(p.Instances["cache"].HealthCheck, DeepEquals, &HealthCheck{TCP: 6379})
+	order, err := p.StartOrder()
+	c.Assert(err, IsNil)
+	c.Check(order, DeepEquals, []string{"cache", "worker", "api"})
+	c.Check(p.HasDependents("cache"), Equals, true)
+	c.Check(p.HasDependents("api"), Equals, false)
+}
+
+func (*projectSuite) TestParseProjectFails(c *C) {
+	m := []struct {
+		comment     string
+		project     string
+		expectedErr string
+	}{
+		{
+			"no instances", "name: shop\n",
+			"project shop has no instances",
+		},
+		{
+			"unknown field", "instances:\n  api:\n    image: api\n    volumes: [data]\n",
+			"(?s)failed to parse project file: .*field volumes not found.*",
+		},
+		{
+			"invalid name", "name: my shop\ninstances:\n  api:\n    image: api\n",
+			"invalid project name 'my shop', .*",
+		},
+		{
+			"image and package", "instances:\n  api:\n    image: api\n    package: ./api\n",
+			"instance api: exactly one of 'image' and 'package' must be provided",
+		},
+		{
+			"unknown dependency", "instances:\n  api:\n    image: api\n    depends_on: [db]\n",
+			"instance api: depends on unknown instance db",
+		},
+		{
+			"cycle", "instances:\n  a:\n    image: a\n    depends_on: [b]\n  b:\n    image: b\n    depends_on: [a]\n  c:\n    image: c\n",
+			"instances a, b depend on each other",
+		},
+		{
+			"ports", "instances:\n  api:\n    image: api\n    ports: [\"8000\"]\n",
+			"instance api: invalid port forwarding rule '8000': .*",
+		},
+		{
+			"health check", "instances:\n  api:\n    image: api\n    healthcheck:\n      http: /health\n",
+			"instance api: 'port' of 'healthcheck' must be provided for http check",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		_, err := ParseProject([]byte(args.project), "/projects/shop")
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+	}
+}
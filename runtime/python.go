@@ -7,7 +7,7 @@
 
 package runtime
 
-import "strings"
+import "github.com/mikelangelo-project/capstan/util"
 
 type pythonRuntime struct {
 	CommonRuntime `yaml:"-,inline"`
@@ -38,7 +38,7 @@ func (conf pythonRuntime) GetBootCmd(cmdConfs map[string]*CmdConfig) (string, er
 	conf.setDefaultEnv(map[string]string{
 		"PYTHON_ARGS": conf.concatPythonArgs(),
 		"MAIN":        conf.Main,
-		"ARGS":        strings.Join(conf.Args, " "),
+		"ARGS":        util.QuoteArgs(conf.Args),
 	})
 	return conf.CommonRuntime.BuildBootCmd("", cmdConfs)
 }
@@ -72,7 +72,7 @@ args:
 //
 
 func (conf pythonRuntime) concatPythonArgs() string {
-	res := strings.Join(conf.PythonArgs, " ")
+	res := util.QuoteArgs(conf.PythonArgs)
 
 	// This is a workaround since runscript is currently unable to
 	// handle empty environment variable as a parameter. So we set
@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikelangelo-project/capstan/util"
+)
+
+const (
+	// DefaultPython3Interpreter is the package used when interpreter is not set.
+	DefaultPython3Interpreter = "python-3.6"
+	// Python3SitePackages is where wheels from requirements.txt are vendored to.
+	Python3SitePackages = "/usr/lib/python3/site-packages"
+	// DefaultPython3Requirements is requirements file used when not set.
+	DefaultPython3Requirements = "/requirements.txt"
+)
+
+// Python3Interpreters lists packages that provide Python 3 interpreter.
+var Python3Interpreters = []string{
+	"python-3.5",
+	"python-3.6",
+	"python-3.7",
+}
+
+type python3Runtime struct {
+	CommonRuntime `yaml:"-,inline"`
+	Interpreter   string   `yaml:"interpreter"`
+	PythonArgs    []string `yaml:"python_args"`
+	Main          string   `yaml:"main" required:"true"`
+	Args          []string `yaml:"args"`
+	Requirements  string   `yaml:"requirements"`
+}
+
+// Wheelhouse returns directory that wheels are vendored from.
+func Wheelhouse() string {
+	if wheelhouse := os.Getenv("CAPSTAN_WHEELHOUSE"); wheelhouse != "" {
+		return wheelhouse
+	}
+	root := os.Getenv("CAPSTAN_ROOT")
+	if root == "" {
+		root = util.ConfigDir()
+	}
+	return filepath.Join(root, "wheelhouse")
+}
+
+//
+// Interface implementation
+//
+
+func (conf python3Runtime) GetRuntimeName() string {
+	return string(Python3)
+}
+func (conf python3Runtime) GetRuntimeDescription() string {
+	return "Run Python 3 application"
+}
+func (conf python3Runtime) GetDependencies() []string {
+	return []string{conf.interpreter()}
+}
+func (conf python3Runtime) Validate() error {
+	inherit := conf.Base != ""
+
+	if !inherit && conf.Main == "" {
+		return fmt.Errorf("'main' must be provided")
+	}
+
+	if conf.Interpreter != "" && !isPython3Interpreter(conf.Interpreter) {
+		return fmt.Errorf("unknown interpreter '%s', use one of: %s",
+			conf.Interpreter, strings.Join(Python3Interpreters, ", "))
+	}
+
+	return conf.CommonRuntime.Validate(inherit)
+}
+func (conf python3Runtime) GetBootCmd(cmdConfs map[string]*CmdConfig) (string, error) {
+	conf.Base = fmt.Sprintf("%s:python", conf.interpreter())
+	conf.setDefaultEnv(map[string]string{
+		"PYTHON_ARGS": conf.concatPythonArgs(),
+		"MAIN":        conf.Main,
+		"ARGS":        util.QuoteArgs(conf.Args),
+		"PYTHONPATH":  Python3SitePackages,
+	})
+	return conf.CommonRuntime.BuildBootCmd("", cmdConfs)
+}
+func (conf python3Runtime) GetYamlTemplate() string {
+	return fmt.Sprintf(`
+# REQUIRED
+# Filepath of the Python script.
+# Note that package root will correspond to filesystem root (/) in OSv image.
+# Example value: /hello-world.py
+main: <filepath>
+
+# OPTIONAL
+# Package providing the Python 3 interpreter, one of: %s.
+# Default value: %s
+interpreter: <package>
+
+# OPTIONAL
+# Filepath of requirements.txt within the package. Wheels of listed packages
+# are vendored from the wheelhouse (%s) into %s.
+# Default value: %s
+requirements: <filepath>
+
+# OPTIONAL
+# A list of Python args.
+# Example value: python_args:
+#                   - -O
+python_args:
+   - <list>
+
+# OPTIONAL
+# A list of command line args used by the application.
+# Example value: args:
+#                   - argument1
+#                   - argument2
+args:
+   - <list>
+`, strings.Join(Python3Interpreters, ", "), DefaultPython3Interpreter, Wheelhouse(),
+		Python3SitePackages, DefaultPython3Requirements) + conf.CommonRuntime.GetYamlTemplate()
+}
+
+// PrepareContent vendors wheels listed in requirements file of the package
+// into site-packages of the collected content.
+func (conf python3Runtime) PrepareContent(packageDir, targetDir string) error {
+	requirements := conf.Requirements
+	if requirements == "" {
+		requirements = DefaultPython3Requirements
+	}
+
+	requirementsFile := filepath.Join(packageDir, requirements)
+	if _, err := os.Stat(requirementsFile); os.IsNotExist(err) {
+		// Requirements file is optional unless explicitly set.
+		if conf.Requirements == "" {
+			return nil
+		}
+		return fmt.Errorf("requirements file '%s' does not exist", conf.Requirements)
+	}
+
+	vendored, err := VendorRequirements(requirementsFile, conf.pythonVersion(), Wheelhouse(), filepath.Join(targetDir, Python3SitePackages))
+	if err != nil {
+		return fmt.Errorf("failed to vendor requirements from %s: %s", requirements, err)
+	}
+	for _, wheel := range vendored {
+		fmt.Printf("Vendored %s\n", wheel)
+	}
+
+	return nil
+}
+
+// ValidateContent checks that main script is part of the collected content.
+func (conf python3Runtime) ValidateContent(root string) error {
+	if conf.Main == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(root, conf.Main)); os.IsNotExist(err) {
+		return fmt.Errorf("main script '%s' does not exist in the package", conf.Main)
+	}
+	return nil
+}
+
+//
+// Utility
+//
+
+func (conf python3Runtime) interpreter() string {
+	if conf.Interpreter == "" {
+		return DefaultPython3Interpreter
+	}
+	return conf.Interpreter
+}
+
+// pythonVersion returns version of the interpreter package e.g. "3.6".
+func (conf python3Runtime) pythonVersion() string {
+	return strings.TrimPrefix(conf.interpreter(), "python-")
+}
+
+func isPython3Interpreter(name string) bool {
+	for _, interpreter := range Python3Interpreters {
+		if interpreter == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf python3Runtime) concatPythonArgs() string {
+	res := util.QuoteArgs(conf.PythonArgs)
+
+	// Workaround for runscript being unable to handle empty environment
+	// variable as a parameter, see pythonRuntime.
+	if res == "" {
+		return "-O"
+	}
+	return res
+}
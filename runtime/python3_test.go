@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+	yaml "gopkg.in/yaml.v1"
+)
+
+type python3Suite struct {
+}
+
+var _ = Suite(&python3Suite{})
+
+func (*python3Suite) TestGetBootCmd(c *C) {
+	// Simulate meta/run.yaml of interpreter packages being parsed.
+	interpreterCmdConf := func(bootCmd string) *CmdConfig {
+		return &CmdConfig{
+			RuntimeType:      Native,
+			ConfigSetDefault: "python",
+			ConfigSets: map[string]Runtime{
+				"python": nativeRuntime{
+					BootCmd: bootCmd,
+					CommonRuntime: CommonRuntime{
+						Env: map[string]string{
+							"PYTHON_ARGS": "-O",
+							"MAIN":        "-",
+							"ARGS":        "",
+						},
+					},
+				},
+			},
+		}
+	}
+	cmdConfs := map[string]*CmdConfig{
+		"python-3.6": interpreterCmdConf("/python3.6.so"),
+		"python-3.7": interpreterCmdConf("/python3.7.so"),
+	}
+
+	m := []struct {
+		comment      string
+		runYamlText  string
+		expectedBoot string
+		expectedEnv  []string
+		expectedDeps []string
+	}{
+		{
+			"default interpreter",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    main: /script.py
+			`,
+			"/python3.6.so", []string{
+				"--env=PYTHON_ARGS?=-O",
+				"--env=MAIN?=/script.py",
+				"--env=ARGS?=",
+				"--env=PYTHONPATH?=/usr/lib/python3/site-packages",
+			},
+			[]string{"python-3.6"},
+		},
+		{
+			"selected interpreter",
+			`
+			runtime: python3
+			config_set:
+			  default:
+			    interpreter: python-3.7
+			    main: /script.py
+			    python_args:
+			        - -u
+			    args:
+			        - localhost
+			        - 8000
+			`,
+			"/python3.7.so", []string{
+				"--env=PYTHON_ARGS?=-u",
+				"--env=MAIN?=/script.py",
+				`"--env=ARGS?=localhost 8000"`,
+				"--env=PYTHONPATH?=/usr/lib/python3/site-packages",
+			},
+			[]string{"python-3.7"},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		cmdConfig, err := ParsePackageRunManifestData([]byte(FixIndent(args.runYamlText)))
+		c.Assert(err, IsNil)
+		testRuntime, _ := cmdConfig.selectConfigSetByName("default")
+
+		// This is what we're testing here.
+		boot, err := testRuntime.GetBootCmd(cmdConfs)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(boot, BootCmdEquals, args.expectedBoot, args.expectedEnv)
+		c.Check(cmdConfig.Dependencies(), DeepEquals, args.expectedDeps)
+	}
+}
+
+func (*python3Suite) TestValidate(c *C) {
+	m := []struct {
+		comment string
+		conf    python3Runtime
+		err     string
+	}{
+		{
+			"valid",
+			python3Runtime{Main: "/script.py", Interpreter: "python-3.5"},
+			"",
+		},
+		{
+			"missing main",
+			python3Runtime{},
+			"'main' must be provided",
+		},
+		{
+			"unknown interpreter",
+			python3Runtime{Main: "/script.py", Interpreter: "python-2.7"},
+			"unknown interpreter 'python-2.7', use one of: python-3.5, python-3.6, python-3.7",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		err := args.conf.Validate()
+
+		// Expectations.
+		if args.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, args.err)
+		}
+	}
+}
+
+func (*python3Suite) TestValidateContent(c *C) {
+	// Prepare
+	tmp := c.MkDir()
+	PrepareFiles(tmp, map[string]string{"/script.py": DefaultText})
+
+	// Expectations.
+	c.Check(python3Runtime{Main: "/script.py"}.ValidateContent(tmp), IsNil)
+	c.Check(python3Runtime{Main: "/other.py"}.ValidateContent(tmp), ErrorMatches,
+		"main script '/other.py' does not exist in the package")
+}
+
+func (*python3Suite) TestGetYamlTemplateIsValidYaml(c *C) {
+	// Prepare
+	testRuntime := python3Runtime{}
+	template := testRuntime.GetYamlTemplate()
+
+	// This is what we're testing here.
+	err := yaml.Unmarshal([]byte(template), &python3Runtime{})
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(template, MatchesMultiline, "interpreter:")
+	c.Check(template, MatchesMultiline, "requirements:")
+}
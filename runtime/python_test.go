@@ -89,7 +89,7 @@ func (*pythonSuite) TestGetBootCmd(c *C) {
 			"/python.so", []string{
 				"--env=PYTHON_ARGS?=-O",
 				"--env=MAIN?=/script.py",
-				"--env=ARGS?=localhost 8000",
+				`"--env=ARGS?=localhost 8000"`,
 			},
 		},
 	}
@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/mikelangelo-project/capstan/configdrive"
+	"github.com/mikelangelo-project/capstan/hypervisor"
 	"github.com/mikelangelo-project/capstan/nat"
 	"github.com/mikelangelo-project/capstan/util"
 )
@@ -18,16 +20,18 @@ import (
 type RuntimeType string
 
 const (
-	Native RuntimeType = "native"
-	NodeJS RuntimeType = "node"
-	Java   RuntimeType = "java"
-	Python RuntimeType = "python"
+	Native  RuntimeType = "native"
+	NodeJS  RuntimeType = "node"
+	Java    RuntimeType = "java"
+	Python  RuntimeType = "python"
+	Python3 RuntimeType = "python3"
 )
 
 var SupportedRuntimes []RuntimeType = []RuntimeType{
 	Native,
 	NodeJS,
 	Java,
+	Python3,
 }
 
 type RunConfig struct {
@@ -44,6 +48,18 @@ type RunConfig struct {
 	MAC          string
 	Cmd          string
 	Persist      bool
+	Detach       bool
+	WaitHealthy  bool
+	HealthCheck  *HealthCheck
+	ConfigDrive  *configdrive.ConfigDrive
+	// Networks are network devices in addition to the one given by
+	// Networking, Bridge and MAC.
+	Networks []hypervisor.Network
+	// Volumes are volumes to attach as given on command line, e.g.
+	// pgdata:10G:/var/lib/postgresql.
+	Volumes []string
+	// Mounts are host directories shared with the instance.
+	Mounts []hypervisor.Mount
 }
 
 // Runtime interface must be extended for every new runtime.
@@ -81,6 +97,23 @@ type Runtime interface {
 	// ForceEnv updates runtime's environment with given values.
 	// List of updated keys is returned
 	ForceEnv(env map[string]string) []string
+
+	// GetHealthCheck returns health check of the config set or nil.
+	GetHealthCheck() *HealthCheck
+}
+
+// ContentPreparer is implemented by runtimes that need to add content to the
+// package when it is being collected, e.g. vendor libraries.
+type ContentPreparer interface {
+	// PrepareContent is given the package directory and the directory
+	// where package content is being collected into.
+	PrepareContent(packageDir, targetDir string) error
+}
+
+// ContentValidator is implemented by runtimes that can verify that files
+// referred to by the config set are part of the collected content.
+type ContentValidator interface {
+	ValidateContent(root string) error
 }
 
 // CommonRuntime fields are those common to all runtimes.
@@ -89,12 +122,21 @@ type Runtime interface {
 type CommonRuntime struct {
 	Env  map[string]string `yaml:"env"`
 	Base string            `yaml:"base"`
+	// Merge maps names of list fields to the mode of merging them with
+	// the ones of base: replace (default), append or prepend.
+	Merge map[string]string `yaml:"merge"`
+	// Healthcheck tells how to verify that the application is healthy.
+	Healthcheck *HealthCheck `yaml:"healthcheck"`
 }
 
 func (r CommonRuntime) GetEnv() map[string]string {
 	return r.Env
 }
 
+func (r CommonRuntime) GetHealthCheck() *HealthCheck {
+	return r.Healthcheck
+}
+
 // ForceEnv updates runtime's own environment with given values.
 // Only existing keys are updated and then a list of those is returned.
 // Purpose of this function is to be able to modify environment (that was
@@ -142,15 +184,54 @@ env:
    <key>: <value>
 
 # OPTIONAL
-# Configuration to contextualize.
+# Configuration to contextualize. Fields set here override the ones of
+# the base configuration if it is of the same runtime.
 base: "<package-name>:<config_set>"
+
+# OPTIONAL
+# How lists are merged with the ones of base configuration, one of:
+# replace (default), append, prepend.
+# Example value:  merge:
+#                    jvm_args: append
+merge:
+   <field>: <mode>
+
+# OPTIONAL
+# Health check of the application, used by 'capstan run --wait-healthy' and
+# 'capstan instances'. Set one of: tcp (guest port that must accept
+# connections), http (path of GET request on guest port that must return
+# status, 200 by default) or log (regular expression matching console line).
+# Example value:  healthcheck:
+#                    http: /health
+#                    port: 8000
+#                    interval: 1s
+#                    timeout: 60s
+healthcheck:
+   <key>: <value>
 `
 }
 
 func (r CommonRuntime) Validate(inherit bool) error {
-	for k, v := range r.Env {
-		if strings.Contains(k, " ") || strings.Contains(v, " ") {
-			return fmt.Errorf("spaces not allowed in env key/value: '%s':'%s'", k, v)
+	for k := range r.Env {
+		if err := util.ValidateEnvKey(k); err != nil {
+			return fmt.Errorf("invalid environment variable '%s': %s", k, err)
+		}
+	}
+
+	for field, mode := range r.Merge {
+		switch mode {
+		case MergeReplace, MergeAppend, MergePrepend:
+		default:
+			return fmt.Errorf("unknown merge mode '%s' of '%s', use one of: %s, %s, %s",
+				mode, field, MergeReplace, MergeAppend, MergePrepend)
+		}
+	}
+	if len(r.Merge) > 0 && r.Base == "" {
+		return fmt.Errorf("'merge' can only be used together with 'base'")
+	}
+	if r.Healthcheck != nil {
+		if err := r.Healthcheck.Validate(); err != nil {
+			return err
 		}
 	}
 
@@ -215,7 +296,8 @@ func (r CommonRuntime) inheritBootCmd(cmdConfs map[string]*CmdConfig) (string, e
 	return bootCmd, nil
 }
 
-// PickRuntime maps runtime name into runtime struct.
+// PickRuntime maps runtime name into runtime struct. Built-in runtimes take
+// precedence over the ones loaded from runtime definitions.
 func PickRuntime(runtimeName RuntimeType) (Runtime, error) {
 	switch runtimeName {
 	case Native:
@@ -226,14 +308,26 @@ func PickRuntime(runtimeName RuntimeType) (Runtime, error) {
 		return &javaRuntime{}, nil
 	case Python:
 		return &pythonRuntime{}, nil
+	case Python3:
+		return &python3Runtime{}, nil
+	}
+
+	// Runtimes defined in yaml files.
+	def, err := declaredRuntime(runtimeName)
+	if err != nil {
+		return nil, err
+	}
+	if def != nil {
+		return &declarativeRuntime{def: def}, nil
 	}
 
 	return nil, fmt.Errorf("Unknown runtime: '%s'\n", runtimeName)
 }
 
 // PrependEnvsPrefix prepends all key-values of env map to the boot cmd give.
-// It prepends each pair in a form of "--env={KEY}={VALUE}".
-// Also performs check that neither key nor value contains space.
+// It prepends each pair in a form of "--env={KEY}={VALUE}", quoted when
+// value contains characters that OSv would otherwise interpret.
+// Also performs check that key is valid.
 // Argument `soft` means that operator '?=' is used that only sets env
 // variable if it's not set yet.
 func PrependEnvsPrefix(cmd string, env map[string]string, soft bool) (string, error) {
@@ -244,7 +338,10 @@ func PrependEnvsPrefix(cmd string, env map[string]string, soft bool) (string, er
 
 	s := ""
 	for k, v := range env {
-		s += fmt.Sprintf("--env=%s%s%s ", k, operator, v)
+		if err := util.ValidateEnvKey(k); err != nil {
+			return "", fmt.Errorf("invalid environment variable '%s': %s", k, err)
+		}
+		s += util.QuoteArg(fmt.Sprintf("--env=%s%s%s", k, operator, v)) + " "
 	}
 	return fmt.Sprintf("%s%s", s, cmd), nil
 }
@@ -256,5 +353,5 @@ func BootCmdForScript(bootName string) string {
 		return ""
 	}
 
-	return fmt.Sprintf("runscript /run/%s", bootName)
+	return fmt.Sprintf("runscript %s", util.QuoteArg("/run/"+bootName))
 }
@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldMap is type of fields that contain a map of scalar values e.g. env.
+// It is only used by built-in runtimes.
+const FieldMap = "map"
+
+// fieldMapList is type of fields that contain a list of maps e.g. processes.
+const fieldMapList = "list of maps"
+
+// RuntimeSchema returns fields that config set of the given runtime can
+// contain. For built-in runtimes fields are derived from the runtime struct:
+// fields with `required:"true"` tag are required unless config set inherits
+// from another one using 'base'.
+func RuntimeSchema(rt Runtime) []FieldDefinition {
+	if declarative, ok := rt.(*declarativeRuntime); ok {
+		fields := append([]FieldDefinition{}, declarative.def.Fields...)
+		return append(fields, commonSchema()...)
+	}
+	return structSchema(reflect.TypeOf(rt))
+}
+
+func commonSchema() []FieldDefinition {
+	return structSchema(reflect.TypeOf(CommonRuntime{}))
+}
+
+func structSchema(t reflect.Type) []FieldDefinition {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var res []FieldDefinition
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			res = append(res, structSchema(f.Type)...)
+			continue
+		}
+		if tag[0] == "" || tag[0] == "-" {
+			continue
+		}
+
+		field := FieldDefinition{
+			Name:     tag[0],
+			Required: f.Tag.Get("required") == "true",
+		}
+		switch f.Type.Kind() {
+		case reflect.Ptr, reflect.Struct:
+			field.Type = FieldMap
+		case reflect.Slice:
+			field.Type = FieldList
+			if f.Type.Elem().Kind() == reflect.Struct {
+				field.Type = fieldMapList
+			}
+		case reflect.Map:
+			field.Type = FieldMap
+		case reflect.Int:
+			field.Type = FieldInt
+		case reflect.Bool:
+			field.Type = FieldBool
+		default:
+			field.Type = FieldString
+		}
+		res = append(res, field)
+	}
+	return res
+}
+
+// RunManifestJSONSchema returns JSON Schema (draft-07) of meta/run.yaml for
+// given runtimes. Editors can use it to validate and complete meta/run.yaml.
+func RunManifestJSONSchema(runtimes []Runtime) map[string]interface{} {
+	var variants []interface{}
+	for _, rt := range runtimes {
+		variants = append(variants, runtimeJSONSchema(rt))
+	}
+
+	res := map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   "Capstan meta/run.yaml",
+	}
+	if len(variants) == 1 {
+		for k, v := range variants[0].(map[string]interface{}) {
+			res[k] = v
+		}
+	} else {
+		res["oneOf"] = variants
+	}
+	return res
+}
+
+func runtimeJSONSchema(rt Runtime) map[string]interface{} {
+	return map[string]interface{}{
+		"description": rt.GetRuntimeDescription(),
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"runtime": map[string]interface{}{"enum": []string{rt.GetRuntimeName()}},
+			"config_set": map[string]interface{}{
+				"type":          "object",
+				"minProperties": 1,
+				"additionalProperties": map[string]interface{}{
+					"oneOf": []interface{}{
+						configSetJSONSchema(rt),
+						configSetJSONSchema(&processesRuntime{}),
+					},
+				},
+			},
+			"config_set_default": map[string]interface{}{"type": "string"},
+		},
+		"required":             []string{"runtime", "config_set"},
+		"additionalProperties": false,
+	}
+}
+
+func configSetJSONSchema(rt Runtime) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for _, f := range RuntimeSchema(rt) {
+		property := jsonSchemaType(f.Type)
+		if f.Description != "" {
+			property["description"] = strings.TrimSpace(f.Description)
+		}
+		if f.Default != nil {
+			property["default"] = f.Default
+		}
+		properties[f.Name] = property
+		if f.Required {
+			required = append(required, f.Name)
+		}
+	}
+
+	configSet := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		// Required fields may be omitted when config set inherits from base.
+		configSet["anyOf"] = []interface{}{
+			map[string]interface{}{"required": []string{"base"}},
+			map[string]interface{}{"required": required},
+		}
+	}
+	return configSet
+}
+
+func jsonSchemaType(fieldType string) map[string]interface{} {
+	scalar := []string{"string", "number", "boolean"}
+	switch fieldType {
+	case FieldList:
+		return map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": scalar}}
+	case FieldMap:
+		return map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": scalar}}
+	case fieldMapList:
+		return map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}
+	case FieldInt:
+		return map[string]interface{}{"type": "integer"}
+	case FieldBool:
+		return map[string]interface{}{"type": "boolean"}
+	}
+	return map[string]interface{}{"type": scalar}
+}
+
+// describeType returns human readable name of the field type.
+func describeType(fieldType string) string {
+	switch fieldType {
+	case FieldList:
+		return "a list"
+	case FieldMap:
+		return "a map"
+	case fieldMapList:
+		return "a list of maps"
+	case FieldInt:
+		return "an integer"
+	case FieldBool:
+		return "a boolean"
+	}
+	return fmt.Sprintf("a %s", fieldType)
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationError is a problem found in meta/run.yaml together with its
+// position. Line and column start with 1, zero means unknown position.
+type ValidationError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// BaseLookup returns parsed meta/run.yaml of the package with given name.
+// It is used to verify 'base' references and should return nil CmdConfig
+// if package exists, but has no meta/run.yaml.
+type BaseLookup func(pkgName string) (*CmdConfig, error)
+
+var yamlErrorLineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// ValidateRunManifestData checks meta/run.yaml content against schema of its
+// runtime and returns all problems sorted by position. Unknown keys, wrong
+// types, missing required fields, malformed 'base' references and missing
+// target of config_set_default are reported. References of 'base' are only
+// resolved if lookup is given.
+func ValidateRunManifestData(data []byte, lookup BaseLookup) []ValidationError {
+	return ValidateInterpolatedRunManifest(data, data, lookup)
+}
+
+// ValidateInterpolatedRunManifest validates data, which is meta/run.yaml
+// after Interpolate, see ValidateRunManifestData. Positions of problems are
+// taken from source, the content as it is written in the file, since
+// interpolated content is formatted anew.
+func ValidateInterpolatedRunManifest(source, data []byte, lookup BaseLookup) []ValidationError {
+	manifest := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		res := ValidationError{Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+		if m := yamlErrorLineRegexp.FindStringSubmatch(err.Error()); m != nil {
+			res.Line, _ = strconv.Atoi(m[1])
+			res.Column = 1
+		}
+		return []ValidationError{res}
+	}
+
+	v := manifestValidator{positions: yamlKeyPositions(source), lookup: lookup}
+	v.validate(manifest)
+
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		if v.errors[i].Line != v.errors[j].Line {
+			return v.errors[i].Line < v.errors[j].Line
+		}
+		return v.errors[i].Column < v.errors[j].Column
+	})
+	return v.errors
+}
+
+type manifestValidator struct {
+	positions map[string]yamlPosition
+	lookup    BaseLookup
+	errors    []ValidationError
+
+	// configSets of the manifest, used to resolve references of processes.
+	configSets map[interface{}]interface{}
+}
+
+func (v *manifestValidator) addError(path []string, format string, args ...interface{}) {
+	pos := v.positions[strings.Join(path, pathSeparator)]
+	v.errors = append(v.errors, ValidationError{
+		Line:    pos.line,
+		Column:  pos.column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *manifestValidator) validate(manifest map[interface{}]interface{}) {
+	for key := range manifest {
+		switch key {
+		case "runtime", "config_set", "config_set_default":
+		default:
+			v.addError([]string{fmt.Sprint(key)}, "unknown key '%v', expected one of: runtime, config_set, config_set_default", key)
+		}
+	}
+
+	// Runtime.
+	var rt Runtime
+	if name, ok := manifest["runtime"]; !ok {
+		v.addError(nil, "'runtime' must be provided")
+	} else if nameStr, ok := name.(string); !ok {
+		v.addError([]string{"runtime"}, "'runtime' must be a string")
+	} else if picked, err := PickRuntime(RuntimeType(nameStr)); err != nil {
+		v.addError([]string{"runtime"}, "unknown runtime '%s'", nameStr)
+	} else {
+		rt = picked
+	}
+
+	// Config sets.
+	configSets, ok := manifest["config_set"].(map[interface{}]interface{})
+	if _, exists := manifest["config_set"]; !exists {
+		v.addError(nil, "'config_set' must be provided")
+	} else if !ok {
+		v.addError([]string{"config_set"}, "'config_set' must be a map of named configuration sets")
+	} else if len(configSets) == 0 {
+		v.addError([]string{"config_set"}, "at least one config set must be provided")
+	}
+
+	v.configSets = configSets
+
+	var names []string
+	for name := range configSets {
+		names = append(names, fmt.Sprint(name))
+	}
+	sort.Strings(names)
+
+	if rt != nil {
+		for _, name := range names {
+			v.validateConfigSet(rt, name, configSets[name])
+		}
+	}
+
+	// Default config set.
+	if def, exists := manifest["config_set_default"]; exists && def != nil {
+		defStr, ok := def.(string)
+		if !ok {
+			v.addError([]string{"config_set_default"}, "'config_set_default' must be a string")
+		} else if _, exists := configSets[defStr]; !exists && configSets != nil {
+			v.addError([]string{"config_set_default"}, "config_set_default '%s' does not exist, available config sets: %s",
+				defStr, strings.Join(names, ", "))
+		}
+	}
+}
+
+func (v *manifestValidator) validateConfigSet(rt Runtime, name string, value interface{}) {
+	path := []string{"config_set", name}
+	errorsBefore := len(v.errors)
+
+	if value == nil {
+		value = map[interface{}]interface{}{}
+	}
+	configSet, ok := value.(map[interface{}]interface{})
+	if !ok {
+		v.addError(path, "config set '%s' must be a map", name)
+		return
+	}
+	if _, isProcesses := configSet[Processes]; isProcesses {
+		rt = &processesRuntime{}
+	}
+
+	schema := make(map[string]FieldDefinition)
+	var known []string
+	for _, f := range RuntimeSchema(rt) {
+		schema[f.Name] = f
+		known = append(known, f.Name)
+	}
+
+	for key, fieldValue := range configSet {
+		keyStr := fmt.Sprint(key)
+		f, exists := schema[keyStr]
+		if !exists {
+			v.addError(append(path, keyStr), "unknown key '%s' for runtime '%s', expected one of: %s",
+				keyStr, rt.GetRuntimeName(), strings.Join(known, ", "))
+			continue
+		}
+		if fieldValue != nil && f.check(fieldValue) != nil {
+			v.addError(append(path, keyStr), "'%s' must be %s", keyStr, describeType(f.Type))
+		}
+	}
+
+	base, inherit := configSet["base"]
+	if !inherit {
+		for _, f := range RuntimeSchema(rt) {
+			if value, exists := configSet[f.Name]; f.Required && (!exists || value == nil) {
+				v.addError(path, "'%s' must be provided in config set '%s'", f.Name, name)
+			}
+		}
+	} else if baseStr, ok := base.(string); ok {
+		v.validateBase(append(path, "base"), baseStr)
+	}
+
+	// Runtime-specific checks only make sense when the structure is valid.
+	if len(v.errors) > errorsBefore {
+		return
+	}
+	subdata, _ := yaml.Marshal(configSet)
+	var conf Runtime = &processesRuntime{}
+	if rt.GetRuntimeName() != Processes {
+		conf, _ = PickRuntime(RuntimeType(rt.GetRuntimeName()))
+	}
+	if err := yaml.Unmarshal(subdata, conf); err != nil {
+		v.addError(path, "%s", strings.TrimPrefix(err.Error(), "yaml: "))
+	} else if err := conf.Validate(); err != nil {
+		v.addError(path, "%s", err)
+	} else if processes, ok := conf.(*processesRuntime); ok {
+		v.validateProcesses(append(path, Processes), processes)
+	}
+}
+
+// validateProcesses checks that config sets referenced by processes exist.
+func (v *manifestValidator) validateProcesses(path []string, conf *processesRuntime) {
+	for i, p := range conf.Processes {
+		parts := strings.SplitN(p.ConfigSet, ":", 2)
+		if len(parts) == 1 {
+			if configSet, exists := v.configSets[p.ConfigSet]; !exists {
+				v.addError(path, "process #%d: config set '%s' does not exist", i+1, p.ConfigSet)
+			} else if configSet, ok := configSet.(map[interface{}]interface{}); ok && configSet[Processes] != nil {
+				v.addError(path, "process #%d: config set '%s' is a set of processes itself and cannot be nested", i+1, p.ConfigSet)
+			}
+			continue
+		}
+		if v.lookup == nil {
+			continue
+		}
+
+		cmdConf, err := v.lookup(parts[0])
+		if err != nil {
+			v.addError(path, "process #%d: %s", i+1, err)
+		} else if cmdConf == nil || cmdConf.ConfigSets[parts[1]] == nil {
+			v.addError(path, "process #%d: config set '%s' does not exist", i+1, p.ConfigSet)
+		}
+	}
+}
+
+func (v *manifestValidator) validateBase(path []string, base string) {
+	parts := strings.SplitN(base, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		v.addError(path, "'base' must be in format <pkg_name>:<config_set>")
+		return
+	}
+	if v.lookup == nil {
+		return
+	}
+
+	pkgName, configSetName := parts[0], parts[1]
+	cmdConf, err := v.lookup(pkgName)
+	if err != nil {
+		v.addError(path, "cannot resolve base '%s': %s", base, err)
+	} else if cmdConf == nil {
+		v.addError(path, "cannot resolve base '%s': package '%s' has no config sets", base, pkgName)
+	} else if cmdConf.ConfigSets[configSetName] == nil {
+		v.addError(path, "cannot resolve base '%s': package '%s' has no config set '%s', available config sets: %s",
+			base, pkgName, configSetName, strings.Join(sortedKeysOfMap(cmdConf.ConfigSets), ", "))
+	}
+}
+
+//
+// Positions
+//
+
+const pathSeparator = "\x00"
+
+type yamlPosition struct {
+	line   int
+	column int
+}
+
+var yamlKeyRegexp = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"][^:#]*?)\s*:(\s+(.*))?$`)
+
+// yamlKeyPositions returns positions of keys of block mappings in yaml
+// document. Keys are identified by their path joined with pathSeparator,
+// empty path refers to the beginning of the document. Flow collections and
+// sequences are not descended into, which is enough for meta/run.yaml.
+func yamlKeyPositions(data []byte) map[string]yamlPosition {
+	type level struct {
+		indent int
+		key    string
+	}
+
+	res := map[string]yamlPosition{"": {line: 1, column: 1}}
+	var stack []level
+	blockIndent := -1
+
+	for i, line := range strings.Split(string(data), "\n") {
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		content = strings.TrimRight(content, " \t\r")
+
+		// Skip content of block scalars.
+		if blockIndent >= 0 {
+			if content == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+
+		if content == "" || strings.HasPrefix(content, "#") || strings.HasPrefix(content, "-") {
+			continue
+		}
+		m := yamlKeyRegexp.FindStringSubmatch(content)
+		if m == nil {
+			continue
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		key := strings.Trim(m[1], `"'`)
+
+		path := make([]string, 0, len(stack)+1)
+		for _, l := range stack {
+			path = append(path, l.key)
+		}
+		path = append(path, key)
+		res[strings.Join(path, pathSeparator)] = yamlPosition{line: i + 1, column: indent + 1}
+
+		stack = append(stack, level{indent: indent, key: key})
+		if value := m[3]; strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockIndent = indent
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+type validateSuite struct {
+}
+
+var _ = Suite(&validateSuite{})
+
+func (*validateSuite) TestValidateRunManifestData(c *C) {
+	lookup := func(pkgName string) (*CmdConfig, error) {
+		if pkgName != "node-4.4.5" {
+			return nil, fmt.Errorf("package '%s' is not in the local repository", pkgName)
+		}
+		return &CmdConfig{
+			RuntimeType: Native,
+			ConfigSets:  map[string]Runtime{"node": nativeRuntime{BootCmd: "/node.so"}},
+		}, nil
+	}
+
+	m := []struct {
+		comment     string
+		runYamlText string
+		expected    []string
+	}{
+		{
+			"valid",
+			`
+			runtime: node
+			config_set:
+			  default:
+			    main: /server.js
+			    args:
+			      - 8000
+			    env:
+			      PORT: 8000
+			  inherited:
+			    base: node-4.4.5:node
+			config_set_default: default
+			`,
+			nil,
+		},
+		{
+			"unknown keys",
+			`
+			runtime: node
+			config_sets:
+			  default:
+			    main: /server.js
+			config_set:
+			  default:
+			    main: /server.js
+			    mian: /server.js
+			`,
+			[]string{
+				"line 2, column 1: unknown key 'config_sets', expected one of: runtime, config_set, config_set_default",
+				"line 8, column 5: unknown key 'mian' for runtime 'node', expected one of: env, base, merge, healthcheck, version, node_args, main, args",
+			},
+		},
+		{
+			"wrong types",
+			`
+			runtime: java
+			config_set:
+			  default:
+			    main: main.Hello
+			    classpath: /
+			    env:
+			      - PORT=8000
+			`,
+			[]string{
+				"line 5, column 5: 'classpath' must be a list",
+				"line 6, column 5: 'env' must be a map",
+			},
+		},
+		{
+			"missing required fields",
+			`
+			runtime: java
+			config_set:
+			  default:
+			    xmx: 512m
+			`,
+			[]string{
+				"line 3, column 3: 'classpath' must be provided in config set 'default'",
+				"line 3, column 3: 'main' must be provided in config set 'default'",
+			},
+		},
+		{
+			"bad base references",
+			`
+			runtime: native
+			config_set:
+			  malformed:
+			    base: node-4.4.5
+			  unknown-package:
+			    base: node-6.0.0:node
+			  unknown-config-set:
+			    base: node-4.4.5:npm
+			`,
+			[]string{
+				"line 4, column 5: 'base' must be in format <pkg_name>:<config_set>",
+				"line 6, column 5: cannot resolve base 'node-6.0.0:node': package 'node-6.0.0' is not in the local repository",
+				"line 8, column 5: cannot resolve base 'node-4.4.5:npm': package 'node-4.4.5' has no config set 'npm', available config sets: node",
+			},
+		},
+		{
+			"missing config_set_default target",
+			`
+			runtime: native
+			config_set:
+			  dev:
+			    bootcmd: /app.so --dev
+			  prod:
+			    bootcmd: /app.so
+			config_set_default: staging
+			`,
+			[]string{
+				"line 7, column 1: config_set_default 'staging' does not exist, available config sets: dev, prod",
+			},
+		},
+		{
+			"processes",
+			`
+			runtime: native
+			config_set:
+			  app:
+			    bootcmd: /app.so
+			  all:
+			    processes:
+			      - config_set: node-4.4.5:node
+			        background: true
+			      - config_set: app
+			  broken:
+			    processes:
+			      - config_set: node-4.4.5:npm
+			      - config_set: ap
+			      - config_set: all
+			    bootcmd: /app.so
+			  typo:
+			    processes: app
+			`,
+			[]string{
+				"line 15, column 5: unknown key 'bootcmd' for runtime 'processes', expected one of: env, base, merge, healthcheck, processes",
+				"line 17, column 5: 'processes' must be a list of maps",
+			},
+		},
+		{
+			"processes references",
+			`
+			runtime: native
+			config_set:
+			  all:
+			    processes:
+			      - config_set: node-4.4.5:npm
+			      - config_set: ap
+			      - config_set: nested
+			  nested:
+			    processes:
+			      - config_set: all
+			`,
+			[]string{
+				"line 4, column 5: process #1: config set 'node-4.4.5:npm' does not exist",
+				"line 4, column 5: process #2: config set 'ap' does not exist",
+				"line 4, column 5: process #3: config set 'nested' is a set of processes itself and cannot be nested",
+				"line 9, column 5: process #1: config set 'all' is a set of processes itself and cannot be nested",
+			},
+		},
+		{
+			"runtime-specific validation",
+			`
+			runtime: node
+			config_set:
+			  default:
+			    main: /server.js
+			    version: ../4.4.5
+			`,
+			[]string{
+				"line 3, column 3: invalid version '../4.4.5'",
+			},
+		},
+		{
+			"unknown runtime",
+			`
+			runtime: cobol
+			config_set:
+			  default:
+			    main: /app.cbl
+			`,
+			[]string{
+				"line 1, column 1: unknown runtime 'cobol'",
+			},
+		},
+		{
+			"missing runtime and config sets",
+			`
+			config_set_default: default
+			`,
+			[]string{
+				"line 1, column 1: 'runtime' must be provided",
+				"line 1, column 1: 'config_set' must be provided",
+			},
+		},
+		{
+			"invalid yaml",
+			`
+			runtime: native
+			config_set:
+			  default:
+			    bootcmd: [/app.so
+			`,
+			[]string{
+				"line 4, column 1: line 4: did not find expected ',' or ']'",
+			},
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		problems := ValidateRunManifestData([]byte(FixIndent(args.runYamlText)), lookup)
+
+		// Expectations.
+		var messages []string
+		for _, problem := range problems {
+			messages = append(messages, problem.Error())
+		}
+		c.Check(messages, DeepEquals, args.expected)
+	}
+}
+
+func (*validateSuite) TestValidateInterpolatedRunManifest(c *C) {
+	// Prepare
+	source := []byte(FixIndent(`
+		# Application that is configured with variables.
+		runtime: native
+
+		config_set:
+		  default:
+		    bootcmd: >
+		      /app.so
+		      --port=${PORT}
+		    env:
+		      MODE: ${MODE:-production}
+
+		    bootcdm: /app.so
+	`))
+	data, err := Interpolate(source, map[string]string{"PORT": "8000"})
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	problems := ValidateInterpolatedRunManifest(source, data, nil)
+
+	// Expectations.
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	c.Check(messages, DeepEquals, []string{
+		"line 12, column 5: unknown key 'bootcdm' for runtime 'native', expected one of: env, base, merge, healthcheck, bootcmd",
+	})
+}
+
+func (*validateSuite) TestYamlKeyPositions(c *C) {
+	// Prepare
+	text := FixIndent(`
+		# Comment
+		runtime: native
+		config_set:
+		  "first":
+		    bootcmd: |
+		      not: a key
+		    env:
+		      PORT: 8000
+		  second:
+		    bootcmd: /app.so
+	`)
+
+	// This is what we're testing here.
+	positions := yamlKeyPositions([]byte(text))
+
+	// Expectations.
+	c.Check(positions["runtime"], Equals, yamlPosition{line: 2, column: 1})
+	c.Check(positions["config_set\x00first"], Equals, yamlPosition{line: 4, column: 3})
+	c.Check(positions["config_set\x00first\x00env\x00PORT"], Equals, yamlPosition{line: 8, column: 7})
+	c.Check(positions["config_set\x00second\x00bootcmd"], Equals, yamlPosition{line: 10, column: 5})
+	_, exists := positions["config_set\x00first\x00bootcmd\x00not"]
+	c.Check(exists, Equals, false)
+}
+
+func (*validateSuite) TestRunManifestJSONSchema(c *C) {
+	// This is what we're testing here.
+	schema := RunManifestJSONSchema([]Runtime{&javaRuntime{}})
+
+	// Expectations.
+	data, err := json.Marshal(schema)
+	c.Assert(err, IsNil)
+	c.Check(string(data), MatchesMultiline, `"runtime":\{"enum":\["java"\]\}`)
+	c.Check(string(data), MatchesMultiline, `"classpath":\{"items":\{"type":\["string","number","boolean"\]\},"type":"array"\}`)
+	c.Check(string(data), MatchesMultiline, `\{"required":\["classpath","main"\]\}`)
+	c.Check(schema["$schema"], Equals, "http://json-schema.org/draft-07/schema#")
+
+	// Multiple runtimes.
+	schema = RunManifestJSONSchema([]Runtime{&javaRuntime{}, &nativeRuntime{}})
+	c.Check(schema["oneOf"], HasLen, 2)
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// VersionedRuntime is implemented by runtimes whose interpreter is provided
+// by a package that is selected with 'version' field of the config set.
+type VersionedRuntime interface {
+	// GetVersion returns version selected in config set or the default one.
+	GetVersion() string
+
+	// VersionPackage returns name of the package that provides given version.
+	VersionPackage(version string) string
+
+	// PackageVersion returns version that given package provides or empty
+	// string if the package is not one of the runtime packages.
+	PackageVersion(pkgName string) string
+}
+
+var versionRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// versionScheme maps runtime versions to packages named <prefix><version>
+// that provide config set with the given name.
+type versionScheme struct {
+	prefix         string
+	defaultVersion string
+	configSet      string
+}
+
+var (
+	nodeVersions = versionScheme{prefix: "node-", defaultVersion: "4.4.5", configSet: "node"}
+	javaVersions = versionScheme{prefix: "openjdk", defaultVersion: "8-zulu-compact1", configSet: "java"}
+)
+
+func (s versionScheme) version(version string) string {
+	if version == "" {
+		return s.defaultVersion
+	}
+	return version
+}
+
+func (s versionScheme) pkg(version string) string {
+	return s.prefix + s.version(version)
+}
+
+func (s versionScheme) base(version string) string {
+	return fmt.Sprintf("%s:%s", s.pkg(version), s.configSet)
+}
+
+func (s versionScheme) packageVersion(pkgName string) string {
+	if !strings.HasPrefix(pkgName, s.prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(pkgName, s.prefix)
+}
+
+func (s versionScheme) validate(version string) error {
+	if version != "" && !versionRegexp.MatchString(version) {
+		return fmt.Errorf("invalid version '%s'", version)
+	}
+	return nil
+}
+
+// RuntimeVersions returns sorted versions of the runtime that are provided
+// by given packages. Nil is returned if runtime is not versioned.
+func RuntimeVersions(rt Runtime, pkgNames []string) []string {
+	versioned, ok := rt.(VersionedRuntime)
+	if !ok {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	res := []string{}
+	for _, pkgName := range pkgNames {
+		if version := versioned.PackageVersion(pkgName); version != "" && !seen[version] {
+			seen[version] = true
+			res = append(res, version)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Requirement is a single line of requirements.txt.
+type Requirement struct {
+	Name string
+	// Specifiers are version constraints e.g. ">=1.0" and "<2.0".
+	Specifiers []string
+}
+
+// Wheel is a Python wheel file (PEP 427) found in the wheelhouse.
+type Wheel struct {
+	Path     string
+	Name     string
+	Version  string
+	Python   string
+	Abi      string
+	Platform string
+}
+
+var (
+	requirementRegexp = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)\s*(\[[^\]]*\])?\s*(.*)$`)
+	specifierRegexp   = regexp.MustCompile(`^(===|==|!=|~=|>=|<=|>|<)\s*([A-Za-z0-9.*+!_-]+)$`)
+	nameNormalizer    = regexp.MustCompile(`[-_.]+`)
+)
+
+// ParseRequirements parses requirements.txt content read from the file with
+// the given name, which is only used in errors. Only requirements given by
+// name and optional version specifiers are supported since wheels are taken
+// from a local directory.
+func ParseRequirements(name string, r io.Reader) ([]Requirement, error) {
+	var res []Requirement
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+
+		// Strip comments and environment markers.
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "-") {
+			return nil, fmt.Errorf("%s:%d: options are not supported: '%s'", name, lineNo, line)
+		}
+
+		m := requirementRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: invalid requirement '%s'", name, lineNo, line)
+		}
+
+		req := Requirement{Name: m[1]}
+		if spec := strings.TrimSpace(m[3]); spec != "" {
+			for _, s := range strings.Split(spec, ",") {
+				s = strings.Replace(s, " ", "", -1)
+				if !specifierRegexp.MatchString(s) {
+					return nil, fmt.Errorf("%s:%d: invalid version specifier '%s'", name, lineNo, s)
+				}
+				req.Specifiers = append(req.Specifiers, s)
+			}
+		}
+		res = append(res, req)
+	}
+
+	return res, scanner.Err()
+}
+
+// ListWheels returns all wheels from the wheelhouse directory.
+func ListWheels(wheelhouse string) ([]Wheel, error) {
+	files, err := ioutil.ReadDir(wheelhouse)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Wheel
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".whl" {
+			continue
+		}
+
+		// {distribution}-{version}(-{build tag})?-{python tag}-{abi tag}-{platform tag}.whl
+		parts := strings.Split(strings.TrimSuffix(f.Name(), ".whl"), "-")
+		if len(parts) != 5 && len(parts) != 6 {
+			continue
+		}
+		n := len(parts)
+		res = append(res, Wheel{
+			Path:     filepath.Join(wheelhouse, f.Name()),
+			Name:     parts[0],
+			Version:  parts[1],
+			Python:   parts[n-3],
+			Abi:      parts[n-2],
+			Platform: parts[n-1],
+		})
+	}
+	return res, nil
+}
+
+// FindWheel returns the wheel with the highest version that satisfies the
+// requirement and can be used with the given Python version (e.g. "3.6") on
+// OSv.
+func FindWheel(req Requirement, wheels []Wheel, python string) (*Wheel, error) {
+	var best *Wheel
+	for i, w := range wheels {
+		if normalizePythonName(w.Name) != normalizePythonName(req.Name) {
+			continue
+		}
+		if !w.compatible(python) || !req.satisfiedBy(w.Version) {
+			continue
+		}
+		if best == nil || compareVersions(w.Version, best.Version) > 0 {
+			best = &wheels[i]
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no matching wheel found for requirement '%s%s'", req.Name, strings.Join(req.Specifiers, ","))
+	}
+	return best, nil
+}
+
+// VendorRequirements extracts wheels for all requirements from the given
+// requirements.txt into target directory. Only wheels that can be used with
+// the given Python version are considered. Names of vendored wheels are
+// returned.
+func VendorRequirements(requirementsFile, python, wheelhouse, target string) ([]string, error) {
+	f, err := os.Open(requirementsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	requirements, err := ParseRequirements(requirementsFile, f)
+	if err != nil {
+		return nil, err
+	}
+	if len(requirements) == 0 {
+		return nil, nil
+	}
+
+	wheels, err := ListWheels(wheelhouse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wheelhouse: %s", err)
+	}
+
+	var vendored []string
+	for _, req := range requirements {
+		w, err := FindWheel(req, wheels, python)
+		if err != nil {
+			return nil, err
+		}
+		if err := extractWheel(w.Path, target); err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %s", filepath.Base(w.Path), err)
+		}
+		vendored = append(vendored, filepath.Base(w.Path))
+	}
+
+	return vendored, nil
+}
+
+// compatible returns true for wheels that are built for the given Python
+// version and either pure Python or built for 64-bit Linux. Pure Python
+// wheels may target any earlier minor version (py3, py35 for 3.6), while
+// wheels with extension modules must be built for exactly this CPython.
+func (w Wheel) compatible(python string) bool {
+	version := strings.Replace(python, ".", "", -1)
+
+	pythonOk := false
+	for _, tag := range strings.Split(w.Python, ".") {
+		if tag == "py3" || tag == "cp"+version || (strings.HasPrefix(tag, "py3") && compareVersions(tag[2:], version) <= 0) {
+			pythonOk = true
+		}
+	}
+
+	abi := false
+	for _, tag := range strings.Split(w.Abi, ".") {
+		if tag == "none" || tag == "abi3" || tag == "cp"+version+"m" {
+			abi = true
+		}
+	}
+
+	platform := false
+	for _, tag := range strings.Split(w.Platform, ".") {
+		if tag == "any" || strings.HasSuffix(tag, "linux_x86_64") || strings.HasSuffix(tag, "linux1_x86_64") {
+			platform = true
+		}
+	}
+
+	return pythonOk && abi && platform
+}
+
+func (req Requirement) satisfiedBy(version string) bool {
+	for _, spec := range req.Specifiers {
+		m := specifierRegexp.FindStringSubmatch(spec)
+		op, v := m[1], m[2]
+
+		cmp := compareVersions(version, v)
+		ok := false
+		switch op {
+		case "==", "===":
+			if strings.HasSuffix(v, ".*") {
+				ok = strings.HasPrefix(version+".", strings.TrimSuffix(v, "*"))
+			} else {
+				ok = cmp == 0
+			}
+		case "!=":
+			ok = cmp != 0
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		case "~=":
+			// Compatible release: ~=1.4.5 means >=1.4.5, ==1.4.*
+			parts := strings.Split(v, ".")
+			prefix := strings.Join(parts[:len(parts)-1], ".") + "."
+			ok = cmp >= 0 && (len(parts) < 2 || strings.HasPrefix(version+".", prefix))
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersions compares dot separated versions part by part, numerically
+// where possible.
+func compareVersions(a, b string) int {
+	pa := strings.Split(a, ".")
+	pb := strings.Split(b, ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		x, y := "0", "0"
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil && nx != ny:
+			if nx < ny {
+				return -1
+			}
+			return 1
+		case (errx != nil || erry != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func normalizePythonName(name string) string {
+	return strings.ToLower(nameNormalizer.ReplaceAllString(name, "_"))
+}
+
+func extractWheel(path, target string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		dst := filepath.Join(target, f.Name)
+		if !strings.HasPrefix(dst, filepath.Clean(target)+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal file path '%s'", f.Name)
+		}
+
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(dst, 0775); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+			return err
+		}
+		if err := extractZipFile(f, dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(f *zip.File, dst string) error {
+	reader, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	_, err = io.Copy(writer, reader)
+	return err
+}
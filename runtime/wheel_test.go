@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package runtime
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/mikelangelo-project/capstan/testing"
+	. "gopkg.in/check.v1"
+)
+
+type wheelSuite struct {
+}
+
+var _ = Suite(&wheelSuite{})
+
+func (*wheelSuite) TestParseRequirements(c *C) {
+	// Prepare
+	requirements := FixIndent(`
+		# Comment
+		six
+		requests[security] >= 2.0, < 3.0  # inline comment
+		Flask==0.12.*
+		pywin32 >= 1.0 ; platform_system == "Windows"
+	`)
+
+	// This is what we're testing here.
+	res, err := ParseRequirements("requirements.txt", strings.NewReader(requirements))
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []Requirement{
+		{Name: "six"},
+		{Name: "requests", Specifiers: []string{">=2.0", "<3.0"}},
+		{Name: "Flask", Specifiers: []string{"==0.12.*"}},
+		{Name: "pywin32", Specifiers: []string{">=1.0"}},
+	})
+}
+
+func (*wheelSuite) TestParseRequirementsInvalid(c *C) {
+	m := []struct {
+		comment      string
+		requirements string
+		err          string
+	}{
+		{"option", "-r other.txt", "/app/requirements.txt:1: options are not supported: '-r other.txt'"},
+		{"url", "six\nhttps://example.org/six.whl", "/app/requirements.txt:2: invalid version specifier.*"},
+		{"specifier", "six =1.0", "/app/requirements.txt:1: invalid version specifier '=1.0'"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		_, err := ParseRequirements("/app/requirements.txt", strings.NewReader(args.requirements))
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.err)
+	}
+}
+
+func (*wheelSuite) TestFindWheel(c *C) {
+	// Prepare
+	wheels := []Wheel{
+		{Name: "six", Version: "1.9.0", Python: "py2.py3", Abi: "none", Platform: "any"},
+		{Name: "six", Version: "1.11.0", Python: "py2.py3", Abi: "none", Platform: "any"},
+		{Name: "six", Version: "1.12.0", Python: "py2", Abi: "none", Platform: "any"},
+		{Name: "Flask_Cors", Version: "3.0.2", Python: "py3", Abi: "none", Platform: "any"},
+		{Name: "numpy", Version: "1.14.0", Python: "cp36", Abi: "cp36m", Platform: "win_amd64"},
+		{Name: "numpy", Version: "1.13.3", Python: "cp36", Abi: "cp36m", Platform: "manylinux1_x86_64"},
+		{Name: "numpy", Version: "1.15.0", Python: "cp37", Abi: "cp37m", Platform: "manylinux1_x86_64"},
+		{Name: "ujson", Version: "1.35", Python: "cp35", Abi: "cp35m", Platform: "manylinux1_x86_64"},
+		{Name: "typing", Version: "3.6.4", Python: "py35", Abi: "none", Platform: "any"},
+		{Name: "typing", Version: "3.7.4", Python: "py37", Abi: "none", Platform: "any"},
+		{Name: "cryptography", Version: "2.2", Python: "cp36", Abi: "abi3", Platform: "manylinux1_x86_64"},
+	}
+
+	m := []struct {
+		comment         string
+		requirement     Requirement
+		expectedVersion string
+	}{
+		{"highest version", Requirement{Name: "six"}, "1.11.0"},
+		{"upper bound", Requirement{Name: "six", Specifiers: []string{"<1.10"}}, "1.9.0"},
+		{"exact", Requirement{Name: "six", Specifiers: []string{"==1.9.0"}}, "1.9.0"},
+		{"excluded", Requirement{Name: "six", Specifiers: []string{"!=1.11.0"}}, "1.9.0"},
+		{"compatible release", Requirement{Name: "six", Specifiers: []string{"~=1.9"}}, "1.11.0"},
+		{"wildcard", Requirement{Name: "six", Specifiers: []string{"==1.9.*"}}, "1.9.0"},
+		{"normalized name", Requirement{Name: "flask-cors"}, "3.0.2"},
+		{"linux platform", Requirement{Name: "numpy"}, "1.13.3"},
+		{"other interpreter", Requirement{Name: "ujson"}, ""},
+		{"earlier python tag", Requirement{Name: "typing"}, "3.6.4"},
+		{"stable abi", Requirement{Name: "cryptography"}, "2.2"},
+		{"no match", Requirement{Name: "six", Specifiers: []string{">2"}}, ""},
+		{"unknown", Requirement{Name: "requests"}, ""},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		w, err := FindWheel(args.requirement, wheels, "3.6")
+
+		// Expectations.
+		if args.expectedVersion == "" {
+			c.Check(err, ErrorMatches, "no matching wheel found for requirement.*")
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(w.Version, Equals, args.expectedVersion)
+		}
+	}
+}
+
+func (*wheelSuite) TestVendorRequirements(c *C) {
+	// Prepare
+	tmp := c.MkDir()
+	wheelhouse := filepath.Join(tmp, "wheelhouse")
+	target := filepath.Join(tmp, "site-packages")
+	os.MkdirAll(wheelhouse, 0775)
+	writeTestWheel(filepath.Join(wheelhouse, "six-1.11.0-py2.py3-none-any.whl"), map[string]string{
+		"six.py":                        DefaultText,
+		"six-1.11.0.dist-info/METADATA": DefaultText,
+	}, c)
+	writeTestWheel(filepath.Join(wheelhouse, "six-1.9.0-py2.py3-none-any.whl"), map[string]string{
+		"six.py": "old",
+	}, c)
+	ioutil.WriteFile(filepath.Join(tmp, "requirements.txt"), []byte("six\n"), 0600)
+
+	// This is what we're testing here.
+	vendored, err := VendorRequirements(filepath.Join(tmp, "requirements.txt"), "3.6", wheelhouse, target)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(vendored, DeepEquals, []string{"six-1.11.0-py2.py3-none-any.whl"})
+	c.Check(target, DirEquals, map[string]interface{}{"six.py": DefaultText})
+	c.Check(filepath.Join(target, "six-1.11.0.dist-info"), DirEquals, map[string]interface{}{"METADATA": DefaultText})
+}
+func writeTestWheel(path string, files map[string]string, c *C) {
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		c.Assert(err, IsNil)
+		fw.Write([]byte(content))
+	}
+	c.Assert(w.Close(), IsNil)
+}
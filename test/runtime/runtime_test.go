@@ -67,6 +67,30 @@ func (s *testingRuntimeSuite) TestPrependEnvsPrefix(c *C) {
 			"/node server.js", []string{"--env=PORT?=8000", "--env=ENDPOINT?=foo.com"},
 			"",
 		},
+		{
+			"value with space",
+			"/node server.js", map[string]string{"NAME": "my name"}, false,
+			"/node server.js", []string{`"--env=NAME=my name"`},
+			"",
+		},
+		{
+			"value with quotes and backslash",
+			"/node server.js", map[string]string{"GREETING": `say "hi" \o/`}, false,
+			"/node server.js", []string{`"--env=GREETING=say \"hi\" \\o/"`},
+			"",
+		},
+		{
+			"value with command separators",
+			"/node server.js", map[string]string{"CMD": "a;b&c"}, true,
+			"/node server.js", []string{`"--env=CMD?=a;b&c"`},
+			"",
+		},
+		{
+			"invalid key",
+			"/node server.js", map[string]string{"MY NAME": "name"}, false,
+			"", []string{},
+			"invalid environment variable 'MY NAME': key must not contain .*",
+		},
 	}
 	for i, args := range m {
 		c.Logf("CASE #%d: %s", i, args.comment)
@@ -82,3 +106,9 @@ func (s *testingRuntimeSuite) TestPrependEnvsPrefix(c *C) {
 		}
 	}
 }
+
+func (s *testingRuntimeSuite) TestBootCmdForScript(c *C) {
+	c.Check(runtime.BootCmdForScript(""), Equals, "")
+	c.Check(runtime.BootCmdForScript("default"), Equals, "runscript /run/default")
+	c.Check(runtime.BootCmdForScript("my config"), Equals, `runscript "/run/my config"`)
+}
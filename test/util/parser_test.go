@@ -8,6 +8,8 @@
 package util_test
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/mikelangelo-project/capstan/util"
@@ -46,19 +48,19 @@ func (s *testingParserSuite) TestParseEnvironmentList(c *C) {
 			"",
 		},
 		{
-			"invalid char (space) #1",
+			"value with space",
 			[]string{"NAME=my name"},
-			map[string]string{},
-			"failed to parse --env argument .*",
+			map[string]string{"NAME": "my name"},
+			"",
 		},
 		{
-			"invalid char (space) #2",
+			"invalid char (space) #1",
 			[]string{"MY NAME=name"},
 			map[string]string{},
 			"failed to parse --env argument .*",
 		},
 		{
-			"invalid char (space) #3",
+			"invalid char (space) #2",
 			[]string{"MY NAME=my name"},
 			map[string]string{},
 			"failed to parse --env argument .*",
@@ -77,10 +79,22 @@ func (s *testingParserSuite) TestParseEnvironmentList(c *C) {
 		},
 		{
 			"one parameter ok, other not",
-			[]string{"PORT=8000", "ENDPOINT=i am invalid"},
+			[]string{"PORT=8000", "END POINT=foo.com"},
 			map[string]string{},
 			"failed to parse --env argument .*",
 		},
+		{
+			"invalid char (semicolon)",
+			[]string{"NAME;=name"},
+			map[string]string{},
+			"failed to parse --env argument 'NAME;=name': key must not contain .*",
+		},
+		{
+			"empty key",
+			[]string{"=name"},
+			map[string]string{},
+			"failed to parse --env argument '=name': key must not be empty",
+		},
 		{
 			"same parameter two times",
 			[]string{"PORT=8000", "PORT=9999"},
@@ -114,3 +128,89 @@ func (s *testingParserSuite) TestParseEnvironmentList(c *C) {
 		}
 	}
 }
+
+func (s *testingParserSuite) TestQuoteArg(c *C) {
+	m := []struct {
+		comment  string
+		arg      string
+		expected string
+	}{
+		{"plain", "/server.js", "/server.js"},
+		{"empty", "", `""`},
+		{"space", "hello world", `"hello world"`},
+		{"tab", "a\tb", "\"a\tb\""},
+		{"double quotes", `say "hi"`, `"say \"hi\""`},
+		{"single quotes", "it's", `"it's"`},
+		{"backslash", `C:\dir`, `"C:\\dir"`},
+		{"semicolon", "a;b", `"a;b"`},
+		{"ampersand", "a&b", `"a&b"`},
+		{"equals and dollar", "--env=A=$B", "--env=A=$B"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		res := util.QuoteArg(args.arg)
+
+		// Expectations.
+		c.Check(res, Equals, args.expected)
+	}
+}
+
+func (s *testingParserSuite) TestQuoteArgs(c *C) {
+	c.Check(util.QuoteArgs(nil), Equals, "")
+	c.Check(util.QuoteArgs([]string{"localhost", "hello world", "a;b"}), Equals, `localhost "hello world" "a;b"`)
+	c.Check(util.QuoteArgs([]string{"a", "", "b"}), Equals, `a "" b`)
+}
+
+func (s *testingParserSuite) TestParseEnvFile(c *C) {
+	m := []struct {
+		comment     string
+		content     string
+		expectedRes map[string]string
+		err         string
+	}{
+		{
+			"comments and empty lines",
+			"# Comment\n\nPORT=8000\n  HOST = localhost  \n",
+			map[string]string{"PORT": "8000", "HOST": "localhost"},
+			"",
+		},
+		{
+			"export and quotes",
+			"export NAME=\"my name\"\nGREETING='hi'\nEMPTY=",
+			map[string]string{"NAME": "my name", "GREETING": "hi", "EMPTY": ""},
+			"",
+		},
+		{
+			"missing equals",
+			"PORT=8000\nHOST",
+			nil,
+			".*test.env:2: missing =",
+		},
+		{
+			"invalid key",
+			"MY HOST=localhost",
+			nil,
+			".*test.env:1: key must not contain .*",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare
+		path := filepath.Join(c.MkDir(), "test.env")
+		ioutil.WriteFile(path, []byte(args.content), 0600)
+
+		// This is what we're testing here.
+		res, err := util.ParseEnvFile(path)
+
+		// Expectations.
+		if args.err != "" {
+			c.Check(err, ErrorMatches, args.err)
+		} else {
+			c.Assert(err, IsNil)
+			c.Check(res, DeepEquals, args.expectedRes)
+		}
+	}
+}
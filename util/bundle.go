@@ -0,0 +1,350 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/core"
+	"gopkg.in/yaml.v2"
+)
+
+// Names of the files inside image bundle archive.
+const (
+	bundleManifestFile = "bundle.yaml"
+	bundleIndexFile    = "index.yaml"
+	bundlePackagesFile = "packages.yaml"
+	bundleCacheFile    = "cache.yaml"
+	bundleHealthFile   = "healthcheck.yaml"
+)
+
+// BundleManifest describes the content of the image bundle. It is stored
+// as the first file of the bundle archive.
+type BundleManifest struct {
+	FormatVersion string `yaml:"format_version"`
+	Name          string `yaml:"name"`
+	Hypervisor    string `yaml:"hypervisor"`
+	Disk          string `yaml:"disk"`
+	Checksum      string `yaml:"checksum"`
+	Exported      string `yaml:"exported"`
+}
+
+// ExportImage bundles the image from the local repository together with its
+// index.yaml, hash cache and package metadata into a single tar archive. The
+// archive is gzipped if compress is set.
+func (r *Repo) ExportImage(imageName, hypervisor, target string, compress bool) error {
+	imagePath := r.ImagePath(hypervisor, imageName)
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such image", imageName)
+	}
+
+	checksum, err := FileChecksum(imagePath)
+	if err != nil {
+		return err
+	}
+
+	manifest := BundleManifest{
+		FormatVersion: "1",
+		Name:          imageName,
+		Hypervisor:    hypervisor,
+		Disk:          filepath.Base(imagePath),
+		Checksum:      checksum,
+		Exported:      time.Now().Format(core.DATETIME_F),
+	}
+
+	fmt.Printf("Exporting %s into %s...\n", imageName, target)
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	// Partial archive must not be left behind as it would look like a
+	// valid bundle.
+	if err := r.writeImageBundle(f, compress, &manifest, imagePath); err != nil {
+		f.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// writeImageBundle writes the bundle archive of the image. Archive is only
+// complete when no error is returned.
+func (r *Repo) writeImageBundle(f io.Writer, compress bool, manifest *BundleManifest, imagePath string) error {
+	w := f
+	var gzWriter *gzip.Writer
+	if compress {
+		gzWriter = gzip.NewWriter(f)
+		w = gzWriter
+	}
+	tarball := tar.NewWriter(w)
+
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeBundleData(tarball, bundleManifestFile, data); err != nil {
+		return err
+	}
+
+	// Metadata files are optional since images that were imported manually
+	// or composed with older Capstan do not have them.
+	optional := map[string]string{
+		bundleIndexFile:    filepath.Join(filepath.Dir(imagePath), "index.yaml"),
+		bundlePackagesFile: r.ImagePackagesPath(manifest.Name),
+		bundleCacheFile:    r.ImageCachePath(manifest.Hypervisor, manifest.Name),
+		bundleHealthFile:   r.ImageHealthCheckPath(manifest.Name),
+	}
+	for _, name := range []string{bundleIndexFile, bundlePackagesFile, bundleCacheFile, bundleHealthFile} {
+		if _, err := os.Stat(optional[name]); os.IsNotExist(err) {
+			continue
+		}
+		if err := writeBundleFile(tarball, name, optional[name]); err != nil {
+			return err
+		}
+	}
+
+	// Image itself comes last as it is by far the largest file.
+	if err := writeBundleFile(tarball, manifest.Disk, imagePath); err != nil {
+		return err
+	}
+	if err := tarball.Close(); err != nil {
+		return err
+	}
+	if gzWriter != nil {
+		return gzWriter.Close()
+	}
+	return nil
+}
+
+// LoadImage unpacks the image bundle and registers the image in the local
+// repository. Image name stored in the bundle is used unless imageName is
+// given. Hypervisor of the bundle must be one of given hypervisors. Existing
+// image is only replaced if force is set.
+func (r *Repo) LoadImage(bundlePath, imageName string, hypervisors []string, force bool) (*BundleManifest, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tarReader, err := openTarReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract into temporary directory first so that a corrupted bundle does
+	// not leave the repository in an inconsistent state.
+	tmp, err := ioutil.TempDir("", "capstan-bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var manifest *BundleManifest
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Base(header.Name)
+		if name != header.Name || header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s: unexpected entry '%s' in image bundle", bundlePath, header.Name)
+		}
+
+		if name == bundleManifestFile {
+			data, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return nil, err
+			}
+			manifest = &BundleManifest{}
+			if err := yaml.Unmarshal(data, manifest); err != nil {
+				return nil, fmt.Errorf("%s: invalid bundle manifest: %s", bundlePath, err)
+			}
+			continue
+		}
+
+		if err := extractBundleFile(tarReader, filepath.Join(tmp, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%s: not an image bundle (missing %s)", bundlePath, bundleManifestFile)
+	}
+	// Manifest comes from the bundle and must not place files outside the
+	// repository.
+	if manifest.Disk != filepath.Base(manifest.Disk) || manifest.Disk == "." || manifest.Disk == ".." {
+		return nil, fmt.Errorf("%s: invalid disk '%s' in image bundle", bundlePath, manifest.Disk)
+	}
+	if !containsString(hypervisors, manifest.Hypervisor) {
+		return nil, fmt.Errorf("%s: unsupported hypervisor '%s' in image bundle", bundlePath, manifest.Hypervisor)
+	}
+
+	diskPath := filepath.Join(tmp, manifest.Disk)
+	if _, err := os.Stat(diskPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: image bundle does not contain disk '%s'", bundlePath, manifest.Disk)
+	}
+	if checksum, err := FileChecksum(diskPath); err != nil {
+		return nil, err
+	} else if checksum != manifest.Checksum {
+		return nil, fmt.Errorf("%s: checksum mismatch for disk '%s'", bundlePath, manifest.Disk)
+	}
+
+	if imageName == "" {
+		imageName = manifest.Name
+	}
+	if err := ValidateImageReference(imageName); err != nil {
+		return nil, err
+	}
+	manifest.Name = imageName
+
+	imagePath := r.ImagePath(manifest.Hypervisor, imageName)
+	if !isWithinDir(r.RepoPath(), imagePath) || !isWithinDir(r.RepoPath(), r.ImageCachePath(manifest.Hypervisor, imageName)) {
+		return nil, fmt.Errorf("%s: image would be stored outside of the repository", imageName)
+	}
+	if _, err := os.Stat(imagePath); err == nil && !force {
+		return nil, fmt.Errorf("%s: image already exists, use --force to replace it", imageName)
+	}
+
+	fmt.Printf("Loading %s into %s\n", imageName, imagePath)
+
+	dir := filepath.Dir(imagePath)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, fmt.Errorf("%s: mkdir failed", dir)
+	}
+
+	targets := map[string]string{
+		manifest.Disk:      imagePath,
+		bundleIndexFile:    filepath.Join(dir, "index.yaml"),
+		bundlePackagesFile: r.ImagePackagesPath(imageName),
+		bundleCacheFile:    r.ImageCachePath(manifest.Hypervisor, imageName),
+		bundleHealthFile:   r.ImageHealthCheckPath(imageName),
+	}
+	for name, target := range targets {
+		src := filepath.Join(tmp, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := CopyLocalFile(target, src); err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+// isWithinDir tells whether path is inside of directory dir.
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// openTarReader returns tar reader for either tar.gz or tar content.
+func openTarReader(reader io.ReadSeeker) (*tar.Reader, error) {
+	if gzReader, err := gzip.NewReader(reader); err == nil {
+		return tar.NewReader(gzReader), nil
+	} else if err == gzip.ErrHeader {
+		reader.Seek(0, io.SeekStart) // revert offset that gzReader has corrupted
+		return tar.NewReader(reader), nil
+	} else {
+		return nil, err
+	}
+}
+
+func writeBundleData(tarball *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tarball.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tarball.Write(data)
+	return err
+}
+
+func writeBundleFile(tarball *tar.Writer, name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err := tarball.WriteHeader(header); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tarball, file)
+	return err
+}
+
+func extractBundleFile(reader io.Reader, path string) error {
+	writer, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// FileChecksum returns hex encoded SHA256 digest of the file content.
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cachedChecksum is checksum of a file as it was when the checksum was
+// computed.
+type cachedChecksum struct {
+	Size     int64     `yaml:"size"`
+	ModTime  time.Time `yaml:"mod_time"`
+	Checksum string    `yaml:"checksum"`
+}
+
+// ChecksumCachePath returns the file that checksums of images are cached in.
+func ChecksumCachePath() string {
+	return filepath.Join(ConfigDir(), "checksums.yaml")
+}
+
+// CachedFileChecksum returns the same as FileChecksum, but only reads the
+// file when its size or modification time changed since the checksum was
+// last computed. Images are large and do not change between runs, so hashing
+// them every time would make starting an instance needlessly slow.
+func CachedFileChecksum(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	cache := loadChecksumCache()
+	if c, ok := cache[path]; ok && c.Size == info.Size() && c.ModTime.Equal(info.ModTime()) {
+		return c.Checksum, nil
+	}
+
+	checksum, err := FileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Failing to update the cache only means that the file is read again.
+	for p := range cache {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			delete(cache, p)
+		}
+	}
+	cache[path] = cachedChecksum{Size: info.Size(), ModTime: info.ModTime(), Checksum: checksum}
+	storeChecksumCache(cache)
+
+	return checksum, nil
+}
+
+func loadChecksumCache() map[string]cachedChecksum {
+	cache := make(map[string]cachedChecksum)
+	if data, err := ioutil.ReadFile(ChecksumCachePath()); err == nil {
+		if yaml.Unmarshal(data, &cache) != nil {
+			return make(map[string]cachedChecksum)
+		}
+	}
+	return cache
+}
+
+func storeChecksumCache(cache map[string]cachedChecksum) error {
+	data, err := yaml.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	path := ChecksumCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+
+	// Concurrent runs must never see a partially written cache.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "checksums")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mikelangelo-project/capstan/util"
+
+	. "gopkg.in/check.v1"
+)
+
+type checksumSuite struct {
+	home string
+}
+
+var _ = Suite(&checksumSuite{})
+
+func (s *checksumSuite) SetUpSuite(c *C) {
+	s.home = os.Getenv("HOME")
+}
+
+func (s *checksumSuite) TearDownSuite(c *C) {
+	os.Setenv("HOME", s.home)
+}
+
+func (s *checksumSuite) SetUpTest(c *C) {
+	os.Setenv("HOME", c.MkDir())
+}
+
+func (*checksumSuite) TestCachedFileChecksum(c *C) {
+	// Prepare
+	path := filepath.Join(c.MkDir(), "demo.qemu")
+	modTime := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	writeFile := func(content string, modTime time.Time) {
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		c.Assert(os.Chtimes(path, modTime, modTime), IsNil)
+	}
+	writeFile("first", modTime)
+	first, err := util.FileChecksum(path)
+	c.Assert(err, IsNil)
+
+	// This is what we're testing here.
+	checksum, err := util.CachedFileChecksum(path)
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	c.Check(checksum, Equals, first)
+	_, err = os.Stat(util.ChecksumCachePath())
+	c.Check(err, IsNil)
+
+	// File that looks unchanged is not read again.
+	writeFile("other", modTime)
+	checksum, err = util.CachedFileChecksum(path)
+	c.Assert(err, IsNil)
+	c.Check(checksum, Equals, first)
+
+	// Modified file is read again.
+	writeFile("other", modTime.Add(time.Second))
+	other, err := util.FileChecksum(path)
+	c.Assert(err, IsNil)
+	checksum, err = util.CachedFileChecksum(path)
+	c.Assert(err, IsNil)
+	c.Check(checksum, Equals, other)
+	c.Check(checksum, Not(Equals), first)
+}
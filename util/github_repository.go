@@ -24,14 +24,23 @@ func (r *Repo) PullImage(image string) error {
 	if err != nil {
 		return err
 	}
+	if _, tag := ParseImageReference(image); tag != DefaultTag {
+		return r.updateTaggedImage(image, tag)
+	}
 	return r.updateImage(image)
 }
 
 func (r *Repo) cloneImage(image string) error {
 	fmt.Printf("Pulling %s...\n", image)
 	workTree := r.workTree(image)
-	gitUrl := fmt.Sprintf("https://github.com/%s", image)
-	cmd := exec.Command("git", "clone", "--depth", "1", gitUrl, workTree)
+	name, tag := ParseImageReference(image)
+	gitUrl := fmt.Sprintf("https://github.com/%s", name)
+	args := []string{"clone", "--depth", "1"}
+	// Image tags are mapped to git branches or tags.
+	if tag != DefaultTag {
+		args = append(args, "--branch", tag)
+	}
+	cmd := exec.Command("git", append(args, gitUrl, workTree)...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Println(string(out))
@@ -59,10 +68,31 @@ func (r *Repo) updateImage(image string) error {
 	return nil
 }
 
+// updateTaggedImage refreshes the tagged version of the image from the git
+// branch or tag of the same name, since both can be moved on the remote.
+func (r *Repo) updateTaggedImage(image, tag string) error {
+	fmt.Printf("Updating %s...\n", image)
+	workTree := r.workTree(image)
+	gitDir := r.gitDir(image)
+	cmd := exec.Command("git", "--git-dir", gitDir, "--work-tree", workTree, "fetch", "--depth", "1", "origin", tag)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
+	cmd = exec.Command("git", "--git-dir", gitDir, "--work-tree", workTree, "reset", "--hard", "FETCH_HEAD")
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		return err
+	}
+	return nil
+}
+
 func (r *Repo) gitDir(image string) string {
 	return filepath.Join(r.workTree(image), ".git")
 }
 
 func (r *Repo) workTree(image string) string {
-	return filepath.Join(r.RepoPath(), image)
+	return r.ImageDir(image)
 }
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultTag is the tag of an image that is referenced without one. Such
+	// images are stored directly in the image directory for compatibility with
+	// repositories that were populated before tags were introduced.
+	DefaultTag = "latest"
+
+	// tagsDir is the name of the subdirectory of the image directory that
+	// contains all tagged versions of the image.
+	tagsDir = "tags"
+)
+
+var tagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// ParseImageReference splits image reference of form "name[:tag]" into image
+// name and tag. DefaultTag is returned if the reference has no tag.
+func ParseImageReference(ref string) (name, tag string) {
+	i := strings.LastIndex(ref, ":")
+	// Colon in front of the last slash is not a tag separator.
+	if i < 0 || i < strings.LastIndex(ref, "/") {
+		return ref, DefaultTag
+	}
+	if ref[i+1:] == "" {
+		return ref[:i], DefaultTag
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// ImageReference composes image reference from name and tag. DefaultTag is
+// omitted so that references to the latest version remain unchanged.
+func ImageReference(name, tag string) string {
+	if tag == "" || tag == DefaultTag {
+		return name
+	}
+	return fmt.Sprintf("%s:%s", name, tag)
+}
+
+// ValidateImageReference checks that both name and tag of the reference can
+// be used to store the image in the local repository.
+func ValidateImageReference(ref string) error {
+	name, tag := ParseImageReference(ref)
+	if name == "" {
+		return fmt.Errorf("%s: missing image name", ref)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || part == tagsDir {
+			return fmt.Errorf("%s: invalid image name", ref)
+		}
+	}
+	if !tagRegexp.MatchString(tag) {
+		return fmt.Errorf("%s: invalid tag '%s'", ref, tag)
+	}
+	return nil
+}
+
+// imageRelDir returns directory of the referenced image relative to the root
+// of the repository. The same layout is used for local and remote repositories.
+func imageRelDir(ref string) string {
+	name, tag := ParseImageReference(ref)
+	if tag == DefaultTag {
+		return name
+	}
+	return filepath.Join(name, tagsDir, tag)
+}
+
+// ImageDir returns directory holding all files of the referenced image.
+func (r *Repo) ImageDir(ref string) string {
+	return filepath.Join(r.RepoPath(), imageRelDir(ref))
+}
+
+// ImageTags returns sorted tags of all versions of the image with the given
+// name. DefaultTag is included only if the untagged version exists.
+func (r *Repo) ImageTags(name string) []string {
+	var tags []string
+	if hasImageFiles(r.ImageDir(name)) {
+		tags = append(tags, DefaultTag)
+	}
+
+	entries, _ := ioutil.ReadDir(filepath.Join(r.RepoPath(), name, tagsDir))
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != DefaultTag {
+			tags = append(tags, e.Name())
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// TagImage creates image dst as a copy of image src, including the images of
+// all hypervisors and all metadata. Existing dst is replaced.
+func (r *Repo) TagImage(src, dst string) error {
+	if err := ValidateImageReference(dst); err != nil {
+		return err
+	}
+
+	srcDir := r.ImageDir(src)
+	if !hasImageFiles(srcDir) {
+		return fmt.Errorf("%s: no such image", src)
+	}
+	dstDir := r.ImageDir(dst)
+	if srcDir == dstDir {
+		return nil
+	}
+
+	srcName, _ := ParseImageReference(src)
+	dstName, _ := ParseImageReference(dst)
+	srcBase := filepath.Base(srcName)
+	dstBase := filepath.Base(dstName)
+
+	if err := os.MkdirAll(dstDir, 0775); err != nil {
+		return fmt.Errorf("%s: mkdir failed", dstDir)
+	}
+
+	files, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		// Image files are named after the image, e.g. name.qemu and name.qemu.cache.
+		target := f.Name()
+		if strings.HasPrefix(target, srcBase+".") {
+			target = dstBase + strings.TrimPrefix(target, srcBase)
+		}
+
+		// Images are copied rather than linked since composing with --update
+		// modifies the image in place.
+		if err := CopyLocalFile(filepath.Join(dstDir, target), filepath.Join(srcDir, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Tagged %s as %s\n", src, dst)
+	return nil
+}
+
+// hasImageFiles returns true if the directory contains at least one regular file.
+func hasImageFiles(dir string) bool {
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if !f.IsDir() {
+			return true
+		}
+	}
+	return false
+}
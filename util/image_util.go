@@ -9,6 +9,7 @@
 package util
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
@@ -118,6 +119,33 @@ func SetCmdLine(imagePath string, cmdLine string) error {
 	return nil
 }
 
+// cmdLineMaxSize is how much of the image is read when looking for the end
+// of its command line.
+const cmdLineMaxSize = 4096
+
+// GetCmdLine returns command line that the image boots with.
+func GetCmdLine(imagePath string) (string, error) {
+	nbdFile, err := NewNbdFile(imagePath)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := nbdFile.Session.Read(512, cmdLineMaxSize)
+	if err != nil {
+		nbdFile.Close()
+		return "", err
+	}
+	if err := nbdFile.Close(); err != nil {
+		return "", err
+	}
+
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", fmt.Errorf("%s: command line is longer than %d bytes", imagePath, cmdLineMaxSize)
+	}
+	return string(data[:end]), nil
+}
+
 func chs(x uint64) (uint64, uint64, uint64) {
 	sectorsPerTrack := uint64(63)
 	heads := uint64(255)
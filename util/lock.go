@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2017 XLAB, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Lock lists images and packages that have to be kept in the local repository
+// even when no instance uses them, e.g. because a build pipeline needs them.
+type Lock struct {
+	Images   []string `yaml:"images,omitempty"`
+	Packages []string `yaml:"packages,omitempty"`
+}
+
+// LocksPath returns the directory of lock files. Each *.yaml file in it is
+// parsed as Lock.
+func (r *Repo) LocksPath() string {
+	return filepath.Join(r.Path, "locks")
+}
+
+// Locks returns references of all lock files merged into a single lock.
+// Lock files that cannot be parsed are reported as an error so that nothing
+// they were meant to protect is treated as unused.
+func (r *Repo) Locks() (*Lock, error) {
+	res := &Lock{}
+	files, err := ioutil.ReadDir(r.LocksPath())
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".yaml" {
+			continue
+		}
+		path := filepath.Join(r.LocksPath(), f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		lock := Lock{}
+		if err := yaml.Unmarshal(data, &lock); err != nil {
+			return nil, fmt.Errorf("failed to parse lock file %s: %s", path, err)
+		}
+		res.Images = append(res.Images, lock.Images...)
+		res.Packages = append(res.Packages, lock.Packages...)
+	}
+	return res, nil
+}
@@ -1,7 +1,10 @@
 package util
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -25,19 +28,128 @@ func ParseMemSize(memory string) (int64, error) {
 	return size, nil
 }
 
+// FormatSize returns human readable representation of the given number of bytes.
+func FormatSize(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(bytes)
+	i := 0
+	for ; size >= 1024 && i < len(units)-1; i++ {
+		size /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", size, units[i])
+}
+
 func ParseEnvironmentList(envList []string) (map[string]string, error) {
 	res := make(map[string]string)
 
 	for _, part := range envList {
 		if keyValue := strings.SplitN(part, "=", 2); len(keyValue) < 2 {
 			return nil, fmt.Errorf("failed to parse --env argument '%s': missing =", part)
-		} else if strings.Contains(keyValue[0], " ") {
-			return nil, fmt.Errorf("failed to parse --env argument '%s': key must not contain spaces", part)
-		} else if strings.Contains(keyValue[1], " ") {
-			return nil, fmt.Errorf("failed to parse --env argument '%s': value must not contain spaces", part)
+		} else if err := ValidateEnvKey(keyValue[0]); err != nil {
+			return nil, fmt.Errorf("failed to parse --env argument '%s': %s", part, err)
 		} else {
 			res[keyValue[0]] = keyValue[1]
 		}
 	}
 	return res, nil
 }
+
+// ParseEnvFile reads environment variables from a file containing one
+// KEY=VALUE pair per line. Empty lines and lines starting with '#' are
+// ignored, optional 'export ' prefix and quotes around value are removed.
+func ParseEnvFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing =", path, i+1)
+		}
+		key := strings.TrimSpace(keyValue[0])
+		if err := ValidateEnvKey(key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, i+1, err)
+		}
+
+		value := strings.TrimSpace(keyValue[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+// EnvironMap returns environment of the current process as a map.
+func EnvironMap() map[string]string {
+	res := make(map[string]string)
+	for _, keyValue := range os.Environ() {
+		if parts := strings.SplitN(keyValue, "=", 2); len(parts) == 2 {
+			res[parts[0]] = parts[1]
+		}
+	}
+	return res
+}
+
+// ValidateEnvKey checks that the name of environment variable can be passed
+// to OSv. Unlike values, names cannot be quoted.
+func ValidateEnvKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key must not be empty")
+	}
+	if strings.ContainsAny(key, osvSpecialChars) {
+		return fmt.Errorf("key must not contain spaces, quotes, '\\', ';' or '&'")
+	}
+	return nil
+}
+
+// osvSpecialChars are characters that OSv command line parser treats
+// specially when they are not quoted: whitespace separates arguments,
+// ';' and '&' separate commands.
+const osvSpecialChars = " \t\r\n\"'\\;&"
+
+// QuoteArg quotes a single argument so that OSv command line parser
+// (used both for the kernel command line and for runscript files) yields
+// it unchanged. Arguments without special characters are returned as they
+// are, others are enclosed in double quotes with '"' and '\' escaped. Empty
+// argument is returned as "" so that it is not lost.
+func QuoteArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	if !strings.ContainsAny(arg, osvSpecialChars) {
+		return arg
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for _, r := range arg {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// QuoteArgs quotes each argument and joins them with spaces.
+func QuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = QuoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -10,7 +10,6 @@ package util
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
@@ -29,17 +28,21 @@ import (
 
 const (
 	DefaultRepositoryUrl = "https://mikelangelo-capstan.s3.amazonaws.com/"
+	DefaultLoaderImage   = "mike/osv-loader"
 )
 
 type Repo struct {
 	URL        string
 	Path       string
 	DisableKvm bool
+	// LoaderImage is the image that application images are composed on.
+	LoaderImage string
 }
 
 type CapstanSettings struct {
-	RepoUrl    string `yaml:"repo_url"`
-	DisableKvm bool   `yaml:"disable_kvm"`
+	RepoUrl     string `yaml:"repo_url"`
+	DisableKvm  bool   `yaml:"disable_kvm"`
+	LoaderImage string `yaml:"loader_image"`
 }
 
 func NewRepo(url string) *Repo {
@@ -82,10 +85,15 @@ func NewRepo(url string) *Repo {
 		config.DisableKvm = envDisableKvm
 	}
 
+	if config.LoaderImage == "" {
+		config.LoaderImage = DefaultLoaderImage
+	}
+
 	return &Repo{
-		URL:        url,
-		Path:       root,
-		DisableKvm: config.DisableKvm,
+		URL:         url,
+		Path:        root,
+		DisableKvm:  config.DisableKvm,
+		LoaderImage: config.LoaderImage,
 	}
 }
 
@@ -95,6 +103,11 @@ type ImageInfo struct {
 	Created       string
 	Description   string
 	Build         string
+	// Instance, BaseImage and BaseDigest record where images that were
+	// committed from instances come from.
+	Instance   string `yaml:",omitempty"`
+	BaseImage  string `yaml:"base_image,omitempty"`
+	BaseDigest string `yaml:"base_digest,omitempty"`
 }
 
 func (r *Repo) PrintRepo() {
@@ -138,6 +151,10 @@ func (r *Repo) ImportImage(imageName string, file string, version string, create
 	if err != nil {
 		return err
 	}
+	// Tag doubles as the version of the image unless given explicitly.
+	if _, tag := ParseImageReference(imageName); version == "" && tag != DefaultTag {
+		version = tag
+	}
 	info := ImageInfo{
 		FormatVersion: "1",
 		Version:       version,
@@ -145,15 +162,16 @@ func (r *Repo) ImportImage(imageName string, file string, version string, create
 		Description:   description,
 		Build:         build,
 	}
+	return r.StoreImageInfo(imageName, &info)
+}
+
+// StoreImageInfo writes index.yaml of the image in the local repository.
+func (r *Repo) StoreImageInfo(image string, info *ImageInfo) error {
 	value, err := yaml.Marshal(info)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filepath.Join(dir, "index.yaml"), value, 0644)
-	if err != nil {
-		return err
-	}
-	return nil
+	return ioutil.WriteFile(filepath.Join(r.ImageDir(image), "index.yaml"), value, 0644)
 }
 
 func (r *Repo) ImageExists(hypervisor, image string) bool {
@@ -178,14 +196,46 @@ func (r *Repo) PackageExists(packageName string) bool {
 	return true
 }
 
+// RemoveImage removes the image from the local repository. Reference without
+// a tag removes all versions of the image while "name:tag" only removes the
+// given version.
 func (r *Repo) RemoveImage(image string) error {
-	path := filepath.Join(r.RepoPath(), image)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	name, tag := ParseImageReference(image)
+	if name == image {
+		path := filepath.Join(r.RepoPath(), image)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("%s: no such image\n", image))
+		}
+		fmt.Printf("Removing %s...\n", image)
+		err := os.RemoveAll(path)
+		return err
+	}
+
+	dir := r.ImageDir(image)
+	if !hasImageFiles(dir) {
 		return errors.New(fmt.Sprintf("%s: no such image\n", image))
 	}
 	fmt.Printf("Removing %s...\n", image)
-	err := os.RemoveAll(path)
-	return err
+	if tag == DefaultTag {
+		// Tagged versions and nested images share the directory with the
+		// latest version so only its files are removed.
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	// Do not leave an empty tags directory behind.
+	os.Remove(filepath.Dir(dir))
+	return nil
 }
 
 func (r *Repo) RepoPath() string {
@@ -197,11 +247,25 @@ func (r *Repo) PackagesPath() string {
 }
 
 func (r *Repo) ImagePath(hypervisor string, image string) string {
-	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s", filepath.Base(image), hypervisor))
+	name, _ := ParseImageReference(image)
+	return filepath.Join(r.ImageDir(image), fmt.Sprintf("%s.%s", filepath.Base(name), hypervisor))
 }
 
 func (r *Repo) ImageCachePath(hypervisor string, image string) string {
-	return filepath.Join(r.RepoPath(), image, fmt.Sprintf("%s.%s.cache", filepath.Base(image), hypervisor))
+	name, _ := ParseImageReference(image)
+	return filepath.Join(r.ImageDir(image), fmt.Sprintf("%s.%s.cache", filepath.Base(name), hypervisor))
+}
+
+// ImagePackagesPath returns path of the file that lists packages the image
+// was composed from.
+func (r *Repo) ImagePackagesPath(image string) string {
+	return filepath.Join(r.ImageDir(image), "packages.yaml")
+}
+
+// ImageHealthCheckPath returns path of the file with the health check of the
+// config set that the image boots with.
+func (r *Repo) ImageHealthCheckPath(image string) string {
+	return filepath.Join(r.ImageDir(image), "healthcheck.yaml")
 }
 
 func (r *Repo) PackagePath(packageName string) string {
@@ -214,30 +278,84 @@ func (r *Repo) PackageManifest(packageName string) string {
 
 func (r *Repo) ListImages() string {
 	res := fmt.Sprintln(FileInfoHeader())
+	for _, name := range r.imageNames() {
+		for _, tag := range r.ImageTags(name) {
+			res += fmt.Sprintln(r.imageFileInfo(ImageReference(name, tag)).String())
+		}
+	}
+	return res
+}
+
+// imageNames returns names of all images in the local repository that have
+// at least one version, either "name" or "namespace/name".
+func (r *Repo) imageNames() []string {
+	var names []string
 	namespaces, _ := ioutil.ReadDir(r.RepoPath())
 	for _, n := range namespaces {
+		if !n.IsDir() {
+			continue
+		}
+		// Images without namespace keep their files, or only the tags
+		// directory, directly in the top-level directory.
+		if len(r.ImageTags(n.Name())) > 0 {
+			names = append(names, n.Name())
+		}
 		images, _ := ioutil.ReadDir(filepath.Join(r.RepoPath(), n.Name()))
 		for _, i := range images {
-			namespace := ""
-			directory := n.Name()
-
-			if i.IsDir() {
-				namespace = n.Name()
-				directory = i.Name()
-			} else if !strings.HasSuffix(i.Name(), ".qemu") {
+			if !i.IsDir() || i.Name() == tagsDir {
 				continue
 			}
-			info, err := ParseIndexYaml(r.RepoPath(), namespace, directory)
-			if err != nil {
-				fmt.Println(err)
-				info = &FileInfo{Name: directory, Namespace: namespace}
+			name := n.Name() + "/" + i.Name()
+			if len(r.ImageTags(name)) > 0 {
+				names = append(names, name)
 			}
-			res += fmt.Sprintln(info.String())
 		}
 	}
+	return names
+}
+
+// ListImageVersions lists all tagged versions of the image with the given name.
+func (r *Repo) ListImageVersions(name string) string {
+	res := fmt.Sprintln(FileInfoHeader())
+	for _, tag := range r.ImageTags(name) {
+		res += fmt.Sprintln(r.imageFileInfo(ImageReference(name, tag)).String())
+	}
 	return res
 }
 
+// imageFileInfo returns information about the referenced image from its
+// index.yaml.
+func (r *Repo) imageFileInfo(image string) *FileInfo {
+	name, tag := ParseImageReference(image)
+	namespace, directory := filepath.Split(name)
+	namespace = strings.TrimSuffix(namespace, "/")
+
+	indexDir := directory
+	if tag != DefaultTag {
+		indexDir = filepath.Join(directory, tagsDir, tag)
+	}
+	info, err := ParseIndexYaml(r.RepoPath(), namespace, indexDir)
+	if err != nil {
+		fmt.Println(err)
+		info = &FileInfo{Namespace: namespace}
+	}
+	info.Name = ImageReference(directory, tag)
+	return info
+}
+
+// ListImageNames returns references of all images in the local repository.
+// Same naming is used as by ListImages i.e. either "name" or "namespace/name",
+// followed by ":tag" for tagged versions.
+func (r *Repo) ListImageNames() []string {
+	var names []string
+	for _, name := range r.imageNames() {
+		for _, tag := range r.ImageTags(name) {
+			names = append(names, ImageReference(name, tag))
+		}
+	}
+	return names
+}
+
 func (r *Repo) ListPackages() string {
 	res := fmt.Sprintln(FileInfoHeader())
 	packages, _ := ioutil.ReadDir(r.PackagesPath())
@@ -256,6 +374,18 @@ func (r *Repo) ListPackages() string {
 	return res
 }
 
+// ListPackageNames returns names of all packages in the local repository.
+func (r *Repo) ListPackageNames() []string {
+	var names []string
+	packages, _ := ioutil.ReadDir(r.PackagesPath())
+	for _, p := range packages {
+		if filepath.Ext(p.Name()) == ".yaml" {
+			names = append(names, strings.TrimSuffix(p.Name(), ".yaml"))
+		}
+	}
+	return names
+}
+
 func (r *Repo) DefaultImage() string {
 	if !core.IsTemplateFile("Capstanfile") {
 		return ""
@@ -274,7 +404,7 @@ func (r *Repo) InitializeImage(loaderImage string, imageName string, imageSize i
 	//
 	// capstan import mike/osv-loader /path/to/osv/build/release/loader.img
 	if loaderImage == "" {
-		loaderImage = "mike/osv-loader"
+		loaderImage = r.LoaderImage
 	}
 
 	// Get the actual path of the loader image.
@@ -332,6 +462,37 @@ func (r *Repo) InitializeImage(loaderImage string, imageName string, imageSize i
 	return r.ImportImage(imageName, imagePath, "", time.Now().Format(core.DATETIME_F), "", "")
 }
 
+// StoreImagePackages records metadata of all packages that were used to compose
+// the given image. It is stored next to the image itself.
+func (r *Repo) StoreImagePackages(image string, packages []core.Package) error {
+	// Packages that are required by several other packages are listed only once.
+	data, err := yaml.Marshal(mergeDependencies(nil, packages))
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(r.ImagePackagesPath(image), data, 0644)
+}
+
+// ImagePackages returns metadata of packages that were used to compose the given
+// image. Empty list is returned for images that were not composed from packages.
+func (r *Repo) ImagePackages(image string) ([]core.Package, error) {
+	var packages []core.Package
+
+	data, err := ioutil.ReadFile(r.ImagePackagesPath(image))
+	if os.IsNotExist(err) {
+		return packages, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &packages); err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
 func (r *Repo) ImportPackage(pkg core.Package, packagePath string) error {
 	fmt.Printf("Importing package %s...\n", packagePath)
 
@@ -397,14 +558,7 @@ func (r *Repo) GetPackageTarReader(pkgname string) (*tar.Reader, error) {
 	}
 
 	// Load package (tar.gz or tar supported).
-	if gzReader, err := gzip.NewReader(reader); err == nil {
-		return tar.NewReader(gzReader), nil
-	} else if err == gzip.ErrHeader {
-		reader.Seek(0, io.SeekStart) // revert offset that gzReader has corrupted
-		return tar.NewReader(reader), nil
-	} else {
-		return nil, err
-	}
+	return openTarReader(reader)
 }
 
 func (r *Repo) GetPackageDependencies(pkg core.Package, downloadMissing bool) ([]core.Package, error) {
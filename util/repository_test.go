@@ -9,7 +9,12 @@
 package util_test
 
 import (
+	"archive/tar"
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
 
 	"github.com/mikelangelo-project/capstan/cmd"
@@ -215,6 +220,282 @@ func (s *suite) TestImagesList(c *C) {
 	}
 }
 
+func (s *suite) TestExportLoadImage(c *C) {
+	m := []struct {
+		comment  string
+		compress bool
+		name     string
+		expected string
+	}{
+		{"plain tar", false, "", "mike/myimage"},
+		{"gzipped tar", true, "", "mike/myimage"},
+		{"renamed", false, "other", "other"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare.
+		ClearDirectory(s.repo.Path)
+		PrepareFiles(s.repo.Path, map[string]string{
+			"repository/mike/myimage/myimage.qemu":       "disk content",
+			"repository/mike/myimage/myimage.qemu.cache": "/file.txt: 1234",
+			"repository/mike/myimage/index.yaml":         "version: 9aba80a",
+			"repository/mike/myimage/packages.yaml":      "- name: app\n  title: App\n",
+		})
+		bundle := filepath.Join(c.MkDir(), "bundle.tar")
+
+		// This is what we're testing here.
+		err := s.repo.ExportImage("mike/myimage", "qemu", bundle, args.compress)
+		c.Assert(err, IsNil)
+		ClearDirectory(s.repo.Path)
+		manifest, err := s.repo.LoadImage(bundle, args.name, []string{"qemu"}, false)
+
+		// Expectations.
+		c.Assert(err, IsNil)
+		c.Check(manifest.Name, Equals, args.expected)
+		c.Check(filepath.Join(s.repo.RepoPath(), args.expected), DirEquals, map[string]interface{}{
+			filepath.Base(args.expected) + ".qemu":       "disk content",
+			filepath.Base(args.expected) + ".qemu.cache": "/file.txt: 1234",
+			"index.yaml":    "version: 9aba80a",
+			"packages.yaml": "- name: app\n  title: App\n",
+		})
+		packages, err := s.repo.ImagePackages(args.expected)
+		c.Assert(err, IsNil)
+		c.Check(packages, HasLen, 1)
+
+		// Loading once again must not override the image.
+		_, err = s.repo.LoadImage(bundle, args.name, []string{"qemu"}, false)
+		c.Check(err, ErrorMatches, ".*image already exists.*")
+	}
+}
+
+func (s *suite) TestLoadImageFails(c *C) {
+	m := []struct {
+		comment     string
+		manifest    string
+		name        string
+		expectedErr string
+	}{
+		{
+			"name outside repository", "name: ../../../x\nhypervisor: qemu\ndisk: x.qemu\n", "",
+			"../../../x: invalid image name",
+		},
+		{
+			"renamed outside repository", "name: x\nhypervisor: qemu\ndisk: x.qemu\n", "/tmp/x",
+			"/tmp/x: invalid image name",
+		},
+		{
+			"unknown hypervisor", "name: x\nhypervisor: ../qemu\ndisk: x.qemu\n", "",
+			".*: unsupported hypervisor '../qemu' in image bundle",
+		},
+		{
+			"disk outside bundle", "name: x\nhypervisor: qemu\ndisk: ../x.qemu\n", "",
+			".*: invalid disk '../x.qemu' in image bundle",
+		},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// Prepare.
+		ClearDirectory(s.repo.Path)
+		bundle := filepath.Join(c.MkDir(), "bundle.tar")
+		f, err := os.Create(bundle)
+		c.Assert(err, IsNil)
+		tarball := tar.NewWriter(f)
+		for _, file := range []struct{ name, content string }{
+			{"bundle.yaml", args.manifest + "checksum: " + fmt.Sprintf("%x", sha256.Sum256([]byte("disk"))) + "\n"},
+			{"x.qemu", "disk"},
+		} {
+			c.Assert(tarball.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content))}), IsNil)
+			_, err = tarball.Write([]byte(file.content))
+			c.Assert(err, IsNil)
+		}
+		c.Assert(tarball.Close(), IsNil)
+		c.Assert(f.Close(), IsNil)
+
+		// This is what we're testing here.
+		_, err = s.repo.LoadImage(bundle, args.name, []string{"qemu"}, false)
+
+		// Expectations.
+		c.Check(err, ErrorMatches, args.expectedErr)
+		_, err = os.Stat(s.repo.RepoPath())
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+}
+
+func (s *suite) TestExportImageFails(c *C) {
+	PrepareFiles(s.repo.Path, map[string]string{
+		"repository/mike/myimage/myimage.qemu": "disk content",
+	})
+	bundle := filepath.Join(c.MkDir(), "missing", "bundle.tar")
+
+	// This is what we're testing here.
+	err := s.repo.ExportImage("mike/myimage", "qemu", bundle, true)
+
+	// Expectations.
+	c.Check(err, NotNil)
+	_, err = os.Stat(bundle)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *suite) TestParseImageReference(c *C) {
+	m := []struct {
+		comment string
+		ref     string
+		name    string
+		tag     string
+		err     string
+	}{
+		{"no tag", "mike/myimage", "mike/myimage", "latest", ""},
+		{"tag", "mike/myimage:v1.0", "mike/myimage", "v1.0", ""},
+		{"explicit latest", "myimage:latest", "myimage", "latest", ""},
+		{"empty tag", "myimage:", "myimage", "latest", ""},
+		{"colon in namespace", "host:5000/myimage", "host:5000/myimage", "latest", ""},
+		{"invalid tag", "myimage:-v1", "myimage", "-v1", ".*invalid tag '-v1'"},
+		{"reserved name", "mike/tags:v1", "mike/tags", "v1", ".*invalid image name"},
+	}
+	for i, args := range m {
+		c.Logf("CASE #%d: %s", i, args.comment)
+
+		// This is what we're testing here.
+		name, tag := util.ParseImageReference(args.ref)
+		err := util.ValidateImageReference(args.ref)
+
+		// Expectations.
+		c.Check(name, Equals, args.name)
+		c.Check(tag, Equals, args.tag)
+		if args.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, args.err)
+		}
+	}
+}
+
+func (s *suite) TestTaggedImagePath(c *C) {
+	c.Check(s.repo.ImagePath("qemu", "mike/myimage:latest"), Equals,
+		filepath.Join(s.repo.Path, "repository", "mike", "myimage", "myimage.qemu"))
+	c.Check(s.repo.ImagePath("qemu", "mike/myimage:v1"), Equals,
+		filepath.Join(s.repo.Path, "repository", "mike", "myimage", "tags", "v1", "myimage.qemu"))
+	c.Check(s.repo.ImageCachePath("qemu", "myimage:v1"), Equals,
+		filepath.Join(s.repo.Path, "repository", "myimage", "tags", "v1", "myimage.qemu.cache"))
+}
+
+func (s *suite) TestTagImage(c *C) {
+	// Prepare.
+	PrepareFiles(s.repo.Path, map[string]string{
+		"repository/mike/myimage/myimage.qemu":       "disk content",
+		"repository/mike/myimage/myimage.qemu.cache": "/file.txt: 1234",
+		"repository/mike/myimage/index.yaml":         "version: 9aba80a",
+	})
+
+	// This is what we're testing here.
+	c.Assert(s.repo.TagImage("mike/myimage", "mike/myimage:v1"), IsNil)
+	c.Assert(s.repo.TagImage("mike/myimage:v1", "mike/other:v2"), IsNil)
+
+	// Expectations.
+	c.Check(s.repo.ImageDir("mike/myimage:v1"), DirEquals, map[string]interface{}{
+		"myimage.qemu":       "disk content",
+		"myimage.qemu.cache": "/file.txt: 1234",
+		"index.yaml":         "version: 9aba80a",
+	})
+	c.Check(s.repo.ImageDir("mike/other:v2"), DirEquals, map[string]interface{}{
+		"other.qemu":       "disk content",
+		"other.qemu.cache": "/file.txt: 1234",
+		"index.yaml":       "version: 9aba80a",
+	})
+	c.Check(s.repo.ImageTags("mike/myimage"), DeepEquals, []string{"latest", "v1"})
+	c.Check(s.repo.ImageTags("mike/other"), DeepEquals, []string{"v2"})
+	c.Check(s.repo.ListImageNames(), DeepEquals, []string{"mike/myimage", "mike/myimage:v1", "mike/other:v2"})
+	c.Check(s.repo.ListImages(), MatchesMultiline, FixIndent(`
+		Name {47}Description {40}Version {9}Created {14}Platform
+		mike/myimage {90}9aba80a
+		mike/myimage:v1 {87}9aba80a
+		mike/other:v2 {89}9aba80a
+	`))
+
+	c.Check(s.repo.TagImage("mike/missing", "mike/myimage:v3"), ErrorMatches, "mike/missing: no such image")
+}
+
+func (s *suite) TestListTaggedImages(c *C) {
+	// Prepare.
+	PrepareFiles(s.repo.Path, map[string]string{
+		"repository/myimage/tags/v1/myimage.qemu":          DefaultText,
+		"repository/myimage/tags/v2/myimage.qemu":          DefaultText,
+		"repository/mike/myimage/tags/v1/myimage.qemu":     DefaultText,
+		"repository/mike/vboximage/vboximage.vbox":         DefaultText,
+		"repository/mike/vboximage/tags/v1/vboximage.vbox": DefaultText,
+	})
+
+	// This is what we're testing here.
+	names := s.repo.ListImageNames()
+
+	// Expectations.
+	c.Check(names, DeepEquals, []string{
+		"mike/myimage:v1", "mike/vboximage", "mike/vboximage:v1", "myimage:v1", "myimage:v2",
+	})
+	c.Check(s.repo.ListImages(), MatchesMultiline, FixIndent(`
+		Name {47}Description {40}Version {9}Created {14}Platform
+		mike/myimage:v1
+		mike/vboximage
+		mike/vboximage:v1
+		myimage:v1
+		myimage:v2
+	`))
+}
+
+func (s *suite) TestPullTaggedImageRefreshes(c *C) {
+	if _, err := exec.LookPath("git"); err != nil {
+		c.Skip("git is needed to pull images")
+	}
+	remote := c.MkDir()
+	git := func(dir string, args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		c.Assert(err, IsNil, Commentf("%s", out))
+	}
+	commit := func(content string) {
+		PrepareFiles(remote, map[string]string{"myimage.qemu": content})
+		git(remote, "add", "-A")
+		git(remote, "commit", "-q", "-m", content)
+	}
+	git(remote, "init", "-q")
+	git(remote, "checkout", "-q", "-b", "v1")
+	commit("first")
+	git(s.repo.Path, "clone", "-q", "--depth", "1", "--branch", "v1", "file://"+remote, s.repo.ImageDir("mike/myimage:v1"))
+	commit("second")
+
+	// This is what we're testing here.
+	err := s.repo.PullImage("mike/myimage:v1")
+
+	// Expectations.
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(s.repo.ImagePath("qemu", "mike/myimage:v1"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "second")
+}
+
+func (s *suite) TestRemoveTaggedImage(c *C) {
+	// Prepare.
+	PrepareFiles(s.repo.Path, map[string]string{
+		"repository/mike/myimage/myimage.qemu":         "latest",
+		"repository/mike/myimage/tags/v1/myimage.qemu": "v1",
+		"repository/mike/myimage/tags/v2/myimage.qemu": "v2",
+	})
+
+	// This is what we're testing here.
+	c.Assert(s.repo.RemoveImage("mike/myimage:v1"), IsNil)
+	c.Assert(s.repo.RemoveImage("mike/myimage:latest"), IsNil)
+
+	// Expectations.
+	c.Check(s.repo.ImageTags("mike/myimage"), DeepEquals, []string{"v2"})
+	c.Check(s.repo.RemoveImage("mike/myimage:v1"), ErrorMatches, "mike/myimage:v1: no such image\n")
+
+	// Removing without a tag removes all versions.
+	c.Assert(s.repo.RemoveImage("mike/myimage"), IsNil)
+	c.Check(s.repo.ImageTags("mike/myimage"), IsNil)
+}
+
 //
 // Utility
 //
@@ -165,6 +165,21 @@ func ListPackagesRemote(repo_url string, search string) error {
 	return nil
 }
 
+// ListPackageNamesRemote returns names of all packages in the remote repository.
+func ListPackageNamesRemote(repo_url string) ([]string, error) {
+	q, err := QueryRemote(repo_url)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, content := range q.ContentsList {
+		if strings.HasPrefix(content.Key, "packages/") && strings.HasSuffix(content.Key, ".yaml") {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(content.Key, "packages/"), ".yaml"))
+		}
+	}
+	return names, nil
+}
+
 func (r *Repo) downloadFile(repo_url string, destPath string, name string) error {
 	compressed := strings.HasSuffix(name, ".gz")
 	output, err := os.Create(filepath.Join(destPath, strings.TrimSuffix(name, ".gz")))
@@ -203,19 +218,22 @@ func (r *Repo) downloadFile(repo_url string, destPath string, name string) error
 }
 
 func (r *Repo) DownloadImage(repo_url, hypervisor string, path string) error {
-	parts := strings.Split(path, "/")
+	name, _ := ParseImageReference(path)
+	parts := strings.Split(name, "/")
 	if len(parts) < 2 {
 		return fmt.Errorf("%s: wrong name format", path)
 	}
-	err := os.MkdirAll(filepath.Join(r.RepoPath(), path), os.ModePerm)
+	// Tagged versions are stored in the same layout remotely as locally.
+	dir := filepath.ToSlash(imageRelDir(path))
+	err := os.MkdirAll(filepath.Join(r.RepoPath(), dir), os.ModePerm)
 	if err != nil {
 		return err
 	}
-	err = r.downloadFile(repo_url, r.RepoPath(), fmt.Sprintf("%s/index.yaml", path))
+	err = r.downloadFile(repo_url, r.RepoPath(), fmt.Sprintf("%s/index.yaml", dir))
 	if err != nil {
 		return err
 	}
-	return r.downloadFile(repo_url, r.RepoPath(), fmt.Sprintf("%s/%s.%s.gz", path, parts[1], hypervisor))
+	return r.downloadFile(repo_url, r.RepoPath(), fmt.Sprintf("%s/%s.%s.gz", dir, parts[1], hypervisor))
 }
 
 func IsRemoteImage(repo_url, name string) (bool, error) {
@@ -223,8 +241,9 @@ func IsRemoteImage(repo_url, name string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	dir := filepath.ToSlash(imageRelDir(name))
 	for _, content := range q.ContentsList {
-		if strings.HasPrefix(content.Key, name+"/") {
+		if strings.HasPrefix(content.Key, dir+"/") {
 			return true, nil
 		}
 	}
@@ -24,6 +24,17 @@ func ConfigDir() string {
 	return filepath.Join(HomePath(), ".capstan")
 }
 
+// InstancesPath returns the root directory of instances for all hypervisors.
+func InstancesPath() string {
+	return filepath.Join(ConfigDir(), "instances")
+}
+
+// VolumesPath returns the directory of volumes that instances keep their
+// data on.
+func VolumesPath() string {
+	return filepath.Join(ConfigDir(), "volumes")
+}
+
 func HomePath() string {
 	if runtime.GOOS == "windows" {
 		return filepath.Join(os.Getenv("HOMEDRIVE"), os.Getenv("HOMEPATH"))
@@ -75,7 +86,7 @@ func CopyLocalFile(dst, src string) error {
 func SearchInstance(name string) (instanceName, instancePlatform string) {
 	instanceName = ""
 	instancePlatform = ""
-	rootDir := filepath.Join(ConfigDir(), "instances")
+	rootDir := InstancesPath()
 	platforms, _ := ioutil.ReadDir(rootDir)
 	for _, platform := range platforms {
 		if !platform.IsDir() {
@@ -120,8 +131,7 @@ func ConnectAndWait(network, path string) (net.Conn, error) {
 
 // RemoveOrphanedInstances removes directories of instances that were not persisted with --persist.
 func RemoveOrphanedInstances(verbose bool) error {
-	// TODO: Implement function InstancesPath()
-	qemuDir := filepath.Join(ConfigDir(), "instances", "qemu")
+	qemuDir := filepath.Join(InstancesPath(), "qemu")
 
 	// Do nothing when instances/qemu folder does not exist.
 	if _, err := os.Stat(qemuDir); os.IsNotExist(err) {
@@ -149,6 +159,21 @@ func RemoveOrphanedInstances(verbose bool) error {
 	return nil
 }
 
+// DirSize returns the total size of all regular files in the given directory.
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 func DeepCopyMap(original map[string]string) map[string]string {
 	res := make(map[string]string, 15)
 	for key, value := range original {
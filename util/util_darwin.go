@@ -7,6 +7,13 @@
 
 package util
 
+import "os/exec"
+
+// BindToParent does nothing, it is only needed for virtiofsd, which runs on
+// Linux only.
+func BindToParent(cmd *exec.Cmd) {
+}
+
 func IsDirectIOSupported(path string) bool {
 	return false
 }
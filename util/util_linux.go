@@ -9,9 +9,19 @@ package util
 
 import (
 	"os"
+	"os/exec"
 	"syscall"
 )
 
+// BindToParent makes the command receive SIGTERM when the process that
+// started it exits.
+func BindToParent(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGTERM
+}
+
 func IsDirectIOSupported(path string) bool {
 	f, err := os.OpenFile(path, syscall.O_DIRECT, 0)
 	defer f.Close()
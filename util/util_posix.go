@@ -11,8 +11,26 @@ package util
 
 import (
 	"net"
+	"os/exec"
+	"syscall"
 )
 
 func Connect(network, path string) (net.Conn, error) {
 	return net.Dial(network, path)
 }
+
+func Listen(network, path string) (net.Listener, error) {
+	return net.Listen(network, path)
+}
+
+// DetachProcess makes the command run in its own session so that it keeps
+// running after the terminal it was started from is closed.
+func DetachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// ProcessAlive tells whether process with given pid is running.
+func ProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
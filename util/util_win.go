@@ -12,12 +12,47 @@ package util
 import (
 	"gopkg.in/natefinch/npipe.v2"
 	"net"
+	"os/exec"
+	"syscall"
 )
 
 func Connect(network, path string) (net.Conn, error) {
 	return npipe.Dial(path)
 }
 
+func Listen(network, path string) (net.Listener, error) {
+	return npipe.Listen(path)
+}
+
+// DetachProcess makes the command run in its own process group so that it
+// keeps running after the console it was started from is closed.
+func DetachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// stillActive is exit code of processes that are still running.
+const stillActive = 259
+
+// ProcessAlive tells whether process with given pid is running.
+func ProcessAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// BindToParent does nothing, it is only needed for virtiofsd, which runs on
+// Linux only.
+func BindToParent(cmd *exec.Cmd) {
+}
+
 func IsDirectIOSupported(path string) bool {
 	return false
 }